@@ -39,6 +39,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -194,15 +196,22 @@ func SPointer(s string) *string {
 
 type ActiveStreamerServer struct {
 	activestreamer.UnimplementedActiveStreamerServer
-	Local    *rtmp.URLAddr
+	Local *rtmp.URLAddr
+
+	// Remotes are the proxy destinations, indexed on their ID
 	Remotes  map[string]*rtmp.URLAddr
 	Listener *rtmp.Listener
-	Server   *rtmp.Server
+
+	// Server is kept for the lifetime of the daemon, so that
+	// the proxy destinations survive an RTMP stop and start.
+	Server *rtmp.Server
+	mtx    sync.Mutex
 }
 
 func NewActiveStreamerServer() *ActiveStreamerServer {
 	return &ActiveStreamerServer{
 		Remotes: make(map[string]*rtmp.URLAddr),
+		Server:  rtmp.NewServer(),
 	}
 }
 
@@ -216,6 +225,9 @@ func (a *ActiveStreamerServer) StartRTMP(ctx context.Context, r *activestreamer.
 		}, fmt.Errorf("invalid RTPM addr: %v", err)
 	}
 
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
 	// Ensure no host has been started
 	if a.Local != nil {
 		return &activestreamer.Ack{
@@ -224,10 +236,65 @@ func (a *ActiveStreamerServer) StartRTMP(ctx context.Context, r *activestreamer.
 		}, fmt.Errorf("unable to start rtmp, already running")
 	}
 
+	policy, err := rtmp.ParseOverflowPolicy(r.GetOverflowPolicy())
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	publishAccess, err := rtmp.NewAccessList(r.AllowPublish, r.DenyPublish)
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	playAccess, err := rtmp.NewAccessList(r.AllowPlay, r.DenyPlay)
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	var slate *rtmp.Slate
+	if r.GetSlate() != "" {
+		slate, err = rtmp.LoadSlate(r.GetSlate())
+		if err != nil {
+			return &activestreamer.Ack{
+				Success: false,
+				Message: S(err.Error()),
+			}, err
+		}
+	}
+
 	// Start the server
 
-	rServer := rtmp.NewServer()
-	rListener, err := rtmp.Listen(addr.StreamURL())
+	rServer := a.Server
+	rServer.SetWriteQueueSize(int(r.BufferSize))
+	rServer.SetOverflowPolicy(policy)
+	rServer.SetAggregateAudio(r.AggregateAudio)
+	rServer.SetProxyGracePeriod(time.Millisecond * time.Duration(r.ProxyGracePeriod))
+	rServer.SetDVR(time.Millisecond*time.Duration(r.DvrRetention), int(r.DvrMaxSize))
+	rServer.SetSlate(slate)
+	if r.Auth {
+		rServer.SetRoomKeys(rtmp.RoomKeys)
+	} else {
+		rServer.SetRoomKeys(nil)
+	}
+	rServer.SetPlayAuthentication(r.AuthPlay)
+	rServer.SetLimits(limits(r))
+	rServer.SetPublishAccess(publishAccess)
+	rServer.SetPlayAccess(playAccess)
+	if r.GetSecret() != "" {
+		rServer.SetSecret([]byte(r.GetSecret()))
+	}
+	var rListener *rtmp.Listener
+	if addr.TLS() {
+		rListener, err = rtmp.ListenTLS(addr.StreamURL(), r.GetCertFile(), r.GetKeyFile())
+	} else {
+		rListener, err = rtmp.Listen(addr.StreamURL())
+	}
 	if err != nil {
 		return &activestreamer.Ack{
 			Success: false,
@@ -239,7 +306,6 @@ func (a *ActiveStreamerServer) StartRTMP(ctx context.Context, r *activestreamer.
 	//logger.Debug("Caching local RTMP server")
 	a.Local = addr
 	a.Listener = rListener
-	a.Server = rServer
 
 	// Run the server in a go routine
 	go func() {
@@ -256,6 +322,9 @@ func (a *ActiveStreamerServer) StartRTMP(ctx context.Context, r *activestreamer.
 }
 func (a *ActiveStreamerServer) StopRTMP(context.Context, *activestreamer.Null) (*activestreamer.Ack, error) {
 
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
 	// Ensure no host has been started
 	if a.Local == nil {
 		return &activestreamer.Ack{
@@ -264,7 +333,12 @@ func (a *ActiveStreamerServer) StopRTMP(context.Context, *activestreamer.Null) (
 		}, nil
 	}
 
-	err := a.Listener.Close()
+	// Close will disconnect the publisher, which stops every
+	// proxy destination. The destinations are kept, and will
+	// start again with the next publisher.
+	err := a.Server.Close()
+	a.Local = nil
+	a.Listener = nil
 	if err != nil {
 		return &activestreamer.Ack{
 			Success: false,
@@ -286,22 +360,312 @@ func (a *ActiveStreamerServer) ProxyRTMP(ctx context.Context, r *activestreamer.
 		}, fmt.Errorf("invalid RTPM addr: %v", err)
 	}
 
-	// Ensure no host has been started
-	if a.Local == nil {
+	client, err := newProxyClient(r)
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	d, err := rtmp.NewDestination(client, addr.StreamURL())
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	d.SetSource(r.GetStream())
+	err = a.Server.AddProxy(d)
+	if err != nil {
+		err = fmt.Errorf("add proxy: %v", err)
 		return &activestreamer.Ack{
 			Success: false,
-			Message: S("unable to start rtmp relay, local server not running"),
-		}, fmt.Errorf("unable to start rtmp relay, local server notrunning")
+			Message: S(err.Error()),
+		}, err
+	}
+	a.mtx.Lock()
+	a.Remotes[d.ID()] = d.URLAddr()
+	a.mtx.Unlock()
+
+	return &activestreamer.Ack{
+		Success: true,
+		Message: S("Success"),
+		Id:      S(d.ID()),
+	}, nil
+}
+
+// newProxyClient will configure a client for a single proxy destination.
+//
+// Each destination has its own write queue, so that
+// one slow destination will never block the others.
+func newProxyClient(r *activestreamer.RTMPHost) (*rtmp.Client, error) {
+	policy, err := rtmp.ParseOverflowPolicy(r.GetOverflowPolicy())
+	if err != nil {
+		return nil, err
 	}
+	client := rtmp.NewClient()
+	client.SetWriteQueueSize(int(r.BufferSize))
+	client.SetOverflowPolicy(policy)
+	client.SetAggregateAudio(r.AggregateAudio)
+	client.SetDelay(time.Millisecond * time.Duration(r.Delay))
+	return client, nil
+}
 
-	err = a.Server.Proxy(addr.StreamURL())
+func (a *ActiveStreamerServer) ListProxies(context.Context, *activestreamer.Null) (*activestreamer.ProxyList, error) {
+	list := &activestreamer.ProxyList{}
+	for _, d := range a.Server.Proxies() {
+		proxy := &activestreamer.Proxy{
+			Id:        d.ID(),
+			Addr:      d.URLAddr().SafeURL(),
+			Connected: d.Connected(),
+			Delay:     d.Delay().Milliseconds(),
+		}
+		if d.Source() != "" {
+			proxy.Stream = S(d.Source())
+		}
+		rtmp.M().Lock()
+		p := rtmp.P(d.ID())
+		proxy.BytesTX = int64(p.ProxyTotalBytesTX)
+		proxy.PacketsTX = int64(p.ProxyTotalPacketsTX)
+		proxy.PacketsDropped = int64(p.ProxyTotalPacketsDropped)
+		proxy.Reconnects = int64(p.ProxyReconnects)
+		proxy.Rtt = p.ProxyRTT.Milliseconds()
+		if p.ProxyLastError != "" {
+			proxy.LastError = S(p.ProxyLastError)
+		}
+		rtmp.M().Unlock()
+		list.Proxies = append(list.Proxies, proxy)
+	}
+	return list, nil
+}
+
+func (a *ActiveStreamerServer) RemoveProxy(ctx context.Context, r *activestreamer.ProxyID) (*activestreamer.Ack, error) {
+	err := a.Server.RemoveProxy(r.Id)
 	if err != nil {
 		return &activestreamer.Ack{
 			Success: false,
-			Message: S("unable to dial play client"),
-		}, fmt.Errorf("unable to dial play client")
+			Message: S(err.Error()),
+		}, err
 	}
+	a.mtx.Lock()
+	delete(a.Remotes, r.Id)
+	a.mtx.Unlock()
+	return &activestreamer.Ack{
+		Success: true,
+		Message: S("Success"),
+	}, nil
+}
 
+func (a *ActiveStreamerServer) ReplaceProxy(ctx context.Context, r *activestreamer.ProxyReplacement) (*activestreamer.Ack, error) {
+	addr, err := rtmp.NewURLAddr(r.GetHost().GetAddr())
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S("invalid RTMP addr"),
+		}, fmt.Errorf("invalid RTPM addr: %v", err)
+	}
+	client, err := newProxyClient(r.GetHost())
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	d, err := a.Server.ReplaceProxy(r.Id, client, addr.StreamURL())
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	a.mtx.Lock()
+	delete(a.Remotes, r.Id)
+	a.Remotes[d.ID()] = d.URLAddr()
+	a.mtx.Unlock()
+	return &activestreamer.Ack{
+		Success: true,
+		Message: S("Success"),
+		Id:      S(d.ID()),
+	}, nil
+}
+
+// DelayProxy will change the broadcast delay of a proxy destination
+// while it is publishing.
+func (a *ActiveStreamerServer) DelayProxy(ctx context.Context, r *activestreamer.ProxyDelay) (*activestreamer.Ack, error) {
+	if r.Delay < 0 {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S("invalid delay"),
+		}, fmt.Errorf("invalid delay %dms", r.Delay)
+	}
+	delay := time.Millisecond * time.Duration(r.Delay)
+	err := a.Server.SetProxyDelay(r.Id, delay)
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	logger.Info("Proxy %s delay: %v", r.Id, delay)
+	return &activestreamer.Ack{
+		Success: true,
+		Message: S("Success"),
+	}, nil
+}
+
+// limits will return the server limits for an RTMPHost,
+// using the defaults for every limit that is not set.
+func limits(r *activestreamer.RTMPHost) rtmp.Limits {
+	limits := rtmp.DefaultLimits()
+	if r.MaxConnections != nil {
+		limits.MaxConnections = int(r.GetMaxConnections())
+	}
+	if r.MaxConnectionsPerIP != nil {
+		limits.MaxConnectionsPerIP = int(r.GetMaxConnectionsPerIP())
+	}
+	if r.MaxHandshakes != nil {
+		limits.MaxHandshakes = int(r.GetMaxHandshakes())
+	}
+	if r.HandshakeTimeout != nil {
+		limits.HandshakeTimeout = time.Millisecond * time.Duration(r.GetHandshakeTimeout())
+	}
+	if r.IdleTimeout != nil {
+		limits.IdleTimeout = time.Millisecond * time.Duration(r.GetIdleTimeout())
+	}
+	if r.MaxPublishBitrate != nil {
+		limits.MaxPublishBitrate = r.GetMaxPublishBitrate()
+	}
+	return limits
+}
+
+// IssueKey will issue a new key for a stream. Any previous key
+// for the stream is revoked.
+func (a *ActiveStreamerServer) IssueKey(ctx context.Context, r *activestreamer.StreamKey) (*activestreamer.StreamKey, error) {
+	stream := strings.Trim(r.Stream, "/")
+	splt := strings.Split(stream, "/")
+	if len(splt) != 2 || splt[0] == "" || splt[1] == "" {
+		return nil, fmt.Errorf("invalid stream %q, expected app/stream", r.Stream)
+	}
+	key, err := rtmp.RoomKeys.SetKey(stream)
+	if err != nil {
+		return nil, fmt.Errorf("issue key: %v", err)
+	}
+	logger.Info("Issued key for stream: %s", stream)
+	return &activestreamer.StreamKey{
+		Stream: stream,
+		Key:    S(key),
+	}, nil
+}
+
+// RevokeKey will revoke the key for a stream, or the key itself.
+func (a *ActiveStreamerServer) RevokeKey(ctx context.Context, r *activestreamer.StreamKey) (*activestreamer.Ack, error) {
+	var revoked bool
+	if r.Key != nil {
+		revoked = rtmp.RoomKeys.DeleteKey(r.GetKey())
+	} else {
+		revoked = rtmp.RoomKeys.DeleteChannel(strings.Trim(r.Stream, "/"))
+	}
+	if !revoked {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S("unknown stream key"),
+		}, fmt.Errorf("unknown stream key")
+	}
+	logger.Info("Revoked key for stream: %s", r.Stream)
+	return &activestreamer.Ack{
+		Success: true,
+		Message: S("Success"),
+	}, nil
+}
+
+// SignKey will sign a stream name that can be used in place of an
+// issued key until it expires.
+func (a *ActiveStreamerServer) SignKey(ctx context.Context, r *activestreamer.StreamKey) (*activestreamer.StreamKey, error) {
+	stream := strings.Trim(r.Stream, "/")
+	splt := strings.Split(stream, "/")
+	if len(splt) != 2 || splt[0] == "" || splt[1] == "" {
+		return nil, fmt.Errorf("invalid stream %q, expected app/stream", r.Stream)
+	}
+	if r.Expires <= 0 {
+		return nil, fmt.Errorf("invalid expiry %ds", r.Expires)
+	}
+	expires := time.Now().Add(time.Second * time.Duration(r.Expires))
+	key, err := a.Server.Sign(splt[0], splt[1], expires)
+	if err != nil {
+		return nil, fmt.Errorf("sign key: %v", err)
+	}
+	logger.Info("Signed key for stream: %s until %s", stream, expires.Format(time.RFC3339))
+	return &activestreamer.StreamKey{
+		Stream:  stream,
+		Key:     S(key),
+		Expires: r.Expires,
+	}, nil
+}
+
+// ClipRTMP will save the last milliseconds of a stream from the DVR
+// as an FLV file.
+func (a *ActiveStreamerServer) ClipRTMP(ctx context.Context, r *activestreamer.Clip) (*activestreamer.Ack, error) {
+	if r.Path == "" {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S("empty clip path"),
+		}, fmt.Errorf("empty clip path")
+	}
+	f, err := os.Create(r.Path)
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, fmt.Errorf("create clip: %v", err)
+	}
+	stream := strings.Trim(r.GetStream(), "/")
+	err = a.Server.Clip(stream, time.Millisecond*time.Duration(r.Last), f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(r.Path)
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, fmt.Errorf("clip: %v", err)
+	}
+	logger.Info("Saved clip of stream %s to %s", stream, r.Path)
+	return &activestreamer.Ack{
+		Success: true,
+		Message: S("Success"),
+	}, nil
+}
+
+func (a *ActiveStreamerServer) ListInputs(ctx context.Context, r *activestreamer.InputSelection) (*activestreamer.InputList, error) {
+	inputs, err := a.Server.Inputs(strings.Trim(r.GetStream(), "/"))
+	if err != nil {
+		return nil, err
+	}
+	list := &activestreamer.InputList{}
+	for _, in := range inputs {
+		list.Inputs = append(list.Inputs, &activestreamer.Input{
+			Name:     in.Name,
+			Priority: int64(in.Priority),
+			Addr:     in.Addr,
+			Active:   in.Active,
+			Healthy:  in.Healthy,
+			Forced:   in.Forced,
+		})
+	}
+	return list, nil
+}
+
+func (a *ActiveStreamerServer) UseInput(ctx context.Context, r *activestreamer.InputSelection) (*activestreamer.Ack, error) {
+	stream := strings.Trim(r.GetStream(), "/")
+	err := a.Server.UseInput(stream, r.GetName())
+	if err != nil {
+		return &activestreamer.Ack{
+			Success: false,
+			Message: S(err.Error()),
+		}, err
+	}
+	logger.Info("Stream %s input: %s", stream, r.GetName())
 	return &activestreamer.Ack{
 		Success: true,
 		Message: S("Success"),
@@ -30,6 +30,10 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/kris-nova/twinx/rtmp"
 
@@ -68,6 +72,60 @@ var (
 	// addr is the string that will be used as an *rtmp.Addr
 	addr string = ":"
 
+	// certFile and keyFile are used to serve rtmps:// addresses
+	certFile string
+	keyFile  string
+
+	// bufferSize, overflowPolicy and aggregateAudio configure the
+	// write queue for each destination of the stream
+	bufferSize     int64
+	overflowPolicy string
+	aggregateAudio bool
+
+	// stream is the app and stream name a proxy follows
+	stream string
+
+	// delay is the broadcast delay of a proxy
+	delay time.Duration
+
+	// auth and authPlay require publish and play clients
+	// to present an issued key
+	auth     bool
+	authPlay bool
+
+	// secret signs stream names, and expires is how long
+	// a signed stream name is valid
+	secret  string
+	expires time.Duration
+
+	// allow and deny rules for the remote address
+	// of publish and play clients
+	allowPublish cli.StringSlice
+	denyPublish  cli.StringSlice
+	allowPlay    cli.StringSlice
+	denyPlay     cli.StringSlice
+
+	// proxyGracePeriod keeps proxies connected after a stream is unpublished
+	proxyGracePeriod time.Duration
+
+	// dvrRetention and dvrMaxMB bound the DVR of each stream, and
+	// last and output are the clip to save from the DVR
+	dvrRetention time.Duration
+	dvrMaxMB     int64
+	last         time.Duration
+	output       string
+
+	// slateFile is an FLV file looped to the proxies while there is no publisher
+	slateFile string
+
+	// Connection limits for the RTMP server
+	maxConnections      int64
+	maxConnectionsPerIP int64
+	maxHandshakes       int64
+	handshakeTimeout    time.Duration
+	idleTimeout         time.Duration
+	maxPublishKbps      int64
+
 	globalFlags = []cli.Flag{
 		&cli.BoolFlag{
 			Name:        "verbose",
@@ -124,7 +182,7 @@ func RunWithOptions(opt *RuntimeOptions) error {
 						Name:      "start",
 						Usage:     "Start a local RTMP server, which can be relayed to other RTMP servers such as YouTube or Twitch.",
 						UsageText: ``,
-						Flags: allFlags([]cli.Flag{
+						Flags: allFlags(append([]cli.Flag{
 							&cli.StringFlag{
 								Name:        "addr",
 								Aliases:     []string{"a"},
@@ -132,7 +190,75 @@ func RunWithOptions(opt *RuntimeOptions) error {
 								Usage:       `Full connection address for a local RTMP server. "rtmp://localhost:1935/{app}/{key}"`,
 								Destination: &addr,
 							},
-						}),
+							&cli.StringFlag{
+								Name:        "cert",
+								Usage:       `PEM certificate file used to serve "rtmps://" addresses.`,
+								Destination: &certFile,
+							},
+							&cli.StringFlag{
+								Name:        "key",
+								Usage:       `PEM private key file used to serve "rtmps://" addresses.`,
+								Destination: &keyFile,
+							},
+							&cli.BoolFlag{
+								Name:        "auth",
+								Usage:       `Require publish clients to use a key issued with "twinx rtmp key issue".`,
+								Destination: &auth,
+							},
+							&cli.BoolFlag{
+								Name:        "auth-play",
+								Usage:       `Require play clients to use an issued key as well.`,
+								Destination: &authPlay,
+							},
+							&cli.StringFlag{
+								Name:        "secret",
+								Usage:       `Secret used to sign stream names with "twinx rtmp key sign". Defaults to a random secret.`,
+								EnvVars:     []string{"TWINX_RTMP_SECRET"},
+								Destination: &secret,
+							},
+							&cli.StringSliceFlag{
+								Name:        "allow-publish",
+								Usage:       `Only allow publish clients from a CIDR range, IP or "all". May be repeated.`,
+								Destination: &allowPublish,
+							},
+							&cli.StringSliceFlag{
+								Name:        "deny-publish",
+								Usage:       `Deny publish clients from a CIDR range, IP or "all". May be repeated.`,
+								Destination: &denyPublish,
+							},
+							&cli.StringSliceFlag{
+								Name:        "allow-play",
+								Usage:       `Only allow play clients from a CIDR range, IP or "all". May be repeated.`,
+								Destination: &allowPlay,
+							},
+							&cli.StringSliceFlag{
+								Name:        "deny-play",
+								Usage:       `Deny play clients from a CIDR range, IP or "all". May be repeated.`,
+								Destination: &denyPlay,
+							},
+							&cli.DurationFlag{
+								Name:        "proxy-grace-period",
+								Usage:       "Keep proxies connected for this long after a stream is unpublished, so the stream can be published again without the backends seeing it end.",
+								Destination: &proxyGracePeriod,
+							},
+							&cli.DurationFlag{
+								Name:        "dvr-retention",
+								Usage:       `Keep this much of each stream, so it can be saved with "twinx rtmp clip". 0 disables the DVR.`,
+								Value:       rtmp.DefaultDVRRetention,
+								Destination: &dvrRetention,
+							},
+							&cli.Int64Flag{
+								Name:        "dvr-max-mb",
+								Usage:       "The most memory, in megabytes, the DVR of each stream can use.",
+								Value:       int64(rtmp.DefaultDVRMaximumSizeBytes / 1024 / 1024),
+								Destination: &dvrMaxMB,
+							},
+							&cli.StringFlag{
+								Name:        "slate",
+								Usage:       `An FLV file, such as "be right back", to loop to the proxies while there is no publisher. The proxies switch back to the stream at the next keyframe.`,
+								Destination: &slateFile,
+							},
+						}, append(queueFlags("each play client or proxy"), limitFlags()...)...)),
 						Action: func(c *cli.Context) error {
 							// Get Linux Stream
 							x, err := twinx.GetActiveStream()
@@ -147,8 +273,61 @@ func RunWithOptions(opt *RuntimeOptions) error {
 								return fmt.Errorf("invalid rtmp addr %s: %v", addr, err)
 							}
 
+							if parsedAddr.TLS() && (certFile == "" || keyFile == "") {
+								return fmt.Errorf("rtmps requires --cert and --key")
+							}
+							_, err = rtmp.ParseOverflowPolicy(overflowPolicy)
+							if err != nil {
+								return err
+							}
+							_, err = rtmp.NewAccessList(allowPublish.Value(), denyPublish.Value())
+							if err != nil {
+								return err
+							}
+							_, err = rtmp.NewAccessList(allowPlay.Value(), denyPlay.Value())
+							if err != nil {
+								return err
+							}
+							if slateFile != "" {
+								// The daemon reads the file, from its own working directory
+								slateFile, err = filepath.Abs(slateFile)
+								if err != nil {
+									return fmt.Errorf("invalid slate: %v", err)
+								}
+								_, err = rtmp.LoadSlate(slateFile)
+								if err != nil {
+									return fmt.Errorf("invalid slate: %v", err)
+								}
+							}
+							handshakeTimeoutMs := handshakeTimeout.Milliseconds()
+							idleTimeoutMs := idleTimeout.Milliseconds()
+							maxPublishBitrate := maxPublishKbps * 1000
 							ack, err := x.Client.StartRTMP(context.TODO(), &activestreamer.RTMPHost{
-								Addr: addr,
+								Addr:           addr,
+								BufferSize:     bufferSize,
+								CertFile:       twinx.S(certFile),
+								KeyFile:        twinx.S(keyFile),
+								OverflowPolicy: twinx.S(overflowPolicy),
+								AggregateAudio: aggregateAudio,
+								Auth:           auth || authPlay,
+								AuthPlay:       authPlay,
+								Secret:         twinx.S(secret),
+								AllowPublish:   allowPublish.Value(),
+								DenyPublish:    denyPublish.Value(),
+								AllowPlay:      allowPlay.Value(),
+								DenyPlay:       denyPlay.Value(),
+
+								ProxyGracePeriod: proxyGracePeriod.Milliseconds(),
+								DvrRetention:     dvrRetention.Milliseconds(),
+								DvrMaxSize:       dvrMaxMB * 1024 * 1024,
+								Slate:            twinx.S(slateFile),
+
+								MaxConnections:      &maxConnections,
+								MaxConnectionsPerIP: &maxConnectionsPerIP,
+								MaxHandshakes:       &maxHandshakes,
+								HandshakeTimeout:    &handshakeTimeoutMs,
+								IdleTimeout:         &idleTimeoutMs,
+								MaxPublishBitrate:   &maxPublishBitrate,
 							})
 							if err != nil {
 								return fmt.Errorf("starting RTMP server: %v", err)
@@ -159,7 +338,11 @@ func RunWithOptions(opt *RuntimeOptions) error {
 								logger.Always("OBS > Settings > Stream")
 								logger.Always(" Service:            'Custom'")
 								logger.Always(" Server:             '%s://%s/%s'", parsedAddr.Scheme(), parsedAddr.Host(), parsedAddr.App())
-								logger.Always(" Stream Key:         '%s'", parsedAddr.Key())
+								if auth || authPlay {
+									logger.Always(" Stream Key:         'twinx rtmp key issue %s/<stream>'", parsedAddr.App())
+								} else {
+									logger.Always(" Stream Key:         '%s'", parsedAddr.Key())
+								}
 								logger.Always(" Use Authentication: 'no'")
 								return nil
 							}
@@ -187,11 +370,238 @@ func RunWithOptions(opt *RuntimeOptions) error {
 							return fmt.Errorf("stopping RTMP server: %s", *ack.Message)
 						},
 					},
+					{
+						Name:      "key",
+						Usage:     "Issue, sign and revoke publish keys for streams.",
+						UsageText: ``,
+						Flags:     allFlags([]cli.Flag{}),
+						Action: func(c *cli.Context) error {
+							cli.ShowSubcommandHelp(c)
+							return nil
+						},
+						Subcommands: []*cli.Command{
+							{
+								Name:      "issue",
+								Usage:     "Issue a new key for a stream, revoking any previous key.",
+								UsageText: `twinx rtmp key issue <app/stream>`,
+								Flags:     allFlags([]cli.Flag{}),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 1 {
+										return fmt.Errorf("usage: twinx rtmp key issue <app/stream>")
+									}
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									key, err := x.Client.IssueKey(context.TODO(), &activestreamer.StreamKey{
+										Stream: args.Get(0),
+									})
+									if err != nil {
+										return fmt.Errorf("issue key: %v", err)
+									}
+									app := strings.Split(key.Stream, "/")[0]
+									logger.Always("Success! Publish to the app '%s' with the stream key:", app)
+									logger.Always("%s", key.GetKey())
+									return nil
+								},
+							},
+							{
+								Name:      "revoke",
+								Usage:     "Revoke the key for a stream.",
+								UsageText: `twinx rtmp key revoke <app/stream>`,
+								Flags:     allFlags([]cli.Flag{}),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 1 {
+										return fmt.Errorf("usage: twinx rtmp key revoke <app/stream>")
+									}
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									ack, err := x.Client.RevokeKey(context.TODO(), &activestreamer.StreamKey{
+										Stream: args.Get(0),
+									})
+									if err != nil {
+										return fmt.Errorf("revoke key: %v", err)
+									}
+									if ack.Success {
+										logger.Always("Success!")
+										return nil
+									}
+									return fmt.Errorf("revoke key: %s", *ack.Message)
+								},
+							},
+							{
+								Name:      "sign",
+								Usage:     "Sign a stream name that can be used in place of a key until it expires.",
+								UsageText: `twinx rtmp key sign --expires 2h <app/stream>`,
+								Flags: allFlags([]cli.Flag{
+									&cli.DurationFlag{
+										Name:        "expires",
+										Usage:       "How long the signed stream name is valid.",
+										Value:       time.Hour,
+										Destination: &expires,
+									},
+								}),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 1 {
+										return fmt.Errorf("usage: twinx rtmp key sign --expires 2h <app/stream>")
+									}
+									if expires < time.Second {
+										return fmt.Errorf("invalid --expires %v", expires)
+									}
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									key, err := x.Client.SignKey(context.TODO(), &activestreamer.StreamKey{
+										Stream:  args.Get(0),
+										Expires: int64(expires / time.Second),
+									})
+									if err != nil {
+										return fmt.Errorf("sign key: %v", err)
+									}
+									app := strings.Split(key.Stream, "/")[0]
+									logger.Always("Success! Publish to the app '%s' for %v with the stream key:", app, expires)
+									logger.Always("%s", key.GetKey())
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:      "clip",
+						Usage:     "Save the last minutes of a stream from the DVR as an FLV file.",
+						UsageText: `twinx rtmp clip --last 2m -o clip.flv`,
+						Flags: allFlags([]cli.Flag{
+							&cli.DurationFlag{
+								Name:        "last",
+								Usage:       "How much of the stream to save. The clip begins on the keyframe after this point.",
+								Value:       rtmp.DefaultDVRRetention,
+								Destination: &last,
+							},
+							&cli.StringFlag{
+								Name:        "output",
+								Aliases:     []string{"o"},
+								Usage:       "The FLV file to write.",
+								Value:       "clip.flv",
+								Destination: &output,
+							},
+							&cli.StringFlag{
+								Name:        "stream",
+								Usage:       `The app and stream name to save, such as "twinx/camera". Defaults to the first published stream.`,
+								Destination: &stream,
+							},
+						}),
+						Action: func(c *cli.Context) error {
+							if last < 0 {
+								return fmt.Errorf("invalid --last %v", last)
+							}
+							// The daemon writes the file, from its own working directory
+							path, err := filepath.Abs(output)
+							if err != nil {
+								return fmt.Errorf("invalid output %s: %v", output, err)
+							}
+							x, err := twinx.GetActiveStream()
+							if err != nil {
+								return fmt.Errorf("unable to find active running stream: %v", err)
+							}
+							ack, err := x.Client.ClipRTMP(context.TODO(), &activestreamer.Clip{
+								Stream: twinx.S(stream),
+								Last:   last.Milliseconds(),
+								Path:   path,
+							})
+							if err != nil {
+								return fmt.Errorf("clip: %v", err)
+							}
+							if ack.Success {
+								logger.Always("Success! Saved %s", path)
+								return nil
+							}
+							return fmt.Errorf("clip: %s", *ack.Message)
+						},
+					},
+					{
+						Name:      "input",
+						Usage:     "List and switch the inputs (encoders) publishing a stream.",
+						UsageText: ``,
+						Flags:     allFlags([]cli.Flag{}),
+						Action: func(c *cli.Context) error {
+							cli.ShowSubcommandHelp(c)
+							return nil
+						},
+						Subcommands: []*cli.Command{
+							{
+								Name:      "ls",
+								Aliases:   []string{"list"},
+								Usage:     "List the inputs of a stream and their status.",
+								UsageText: ``,
+								Flags:     allFlags([]cli.Flag{inputStreamFlag()}),
+								Action: func(c *cli.Context) error {
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									list, err := x.Client.ListInputs(context.TODO(), &activestreamer.InputSelection{
+										Stream: twinx.S(stream),
+									})
+									if err != nil {
+										return fmt.Errorf("list inputs: %v", err)
+									}
+									w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+									fmt.Fprintln(w, "NAME\tPRIORITY\tADDR\tACTIVE\tHEALTHY\tFORCED")
+									for _, in := range list.Inputs {
+										fmt.Fprintf(w, "%s\t%d\t%s\t%t\t%t\t%t\n", in.Name, in.Priority, in.Addr, in.Active, in.Healthy, in.Forced)
+									}
+									return w.Flush()
+								},
+							},
+							{
+								Name:      "use",
+								Usage:     "Force a stream to follow an input while it is healthy. The stream switches at the next keyframe.",
+								UsageText: `twinx rtmp input use <name>`,
+								Flags:     allFlags([]cli.Flag{inputStreamFlag()}),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 1 {
+										return fmt.Errorf("usage: twinx rtmp input use <name>")
+									}
+									err := useInput(args.Get(0))
+									if err != nil {
+										return err
+									}
+									logger.Always("Success! Switching to input %s at the next keyframe", args.Get(0))
+									return nil
+								},
+							},
+							{
+								Name:      "auto",
+								Usage:     "Follow the healthy input with the lowest priority again.",
+								UsageText: `twinx rtmp input auto`,
+								Flags:     allFlags([]cli.Flag{inputStreamFlag()}),
+								Action: func(c *cli.Context) error {
+									err := useInput("")
+									if err != nil {
+										return err
+									}
+									logger.Always("Success!")
+									return nil
+								},
+							},
+						},
+					},
 					{
 						Name:      "proxy",
 						Usage:     "Proxy (forward/relay) the RTMP stream to multiple backends such as YouTube and Twitch.",
 						UsageText: ``,
-						Flags:     allFlags([]cli.Flag{}),
+						Flags: allFlags(append(queueFlags("the proxy"), &cli.StringFlag{
+							Name:        "stream",
+							Usage:       `The app and stream name to proxy, such as "twinx/camera". Defaults to the first published stream.`,
+							Destination: &stream,
+						}, delayFlag())),
 						Action: func(c *cli.Context) error {
 							args := c.Args()
 							if args.Len() != 1 {
@@ -202,6 +612,13 @@ func RunWithOptions(opt *RuntimeOptions) error {
 							if err != nil {
 								return fmt.Errorf("invalid rtmp url %s: %v", addr, err)
 							}
+							_, err = rtmp.ParseOverflowPolicy(overflowPolicy)
+							if err != nil {
+								return err
+							}
+							if delay < 0 {
+								return fmt.Errorf("invalid --delay %v", delay)
+							}
 							logger.Info("Connecting %s...", parsedAddr.Host())
 
 							x, err := twinx.GetActiveStream()
@@ -209,17 +626,154 @@ func RunWithOptions(opt *RuntimeOptions) error {
 								return fmt.Errorf("unable to find active running stream: %v", err)
 							}
 							ack, err := x.Client.ProxyRTMP(context.TODO(), &activestreamer.RTMPHost{
-								Addr: addr,
+								Addr:           addr,
+								BufferSize:     bufferSize,
+								OverflowPolicy: twinx.S(overflowPolicy),
+								AggregateAudio: aggregateAudio,
+								Stream:         twinx.S(stream),
+								Delay:          delay.Milliseconds(),
 							})
 							if err != nil {
 								return fmt.Errorf("proxy RTMP: %v", err)
 							}
 							if ack.Success {
-								logger.Always("Success!")
+								logger.Always("Success! Proxy ID: %s", ack.GetId())
 								return nil
 							}
 							return fmt.Errorf("proxy RTMP: %s", *ack.Message)
 						},
+						Subcommands: []*cli.Command{
+							{
+								Name:      "ls",
+								Aliases:   []string{"list"},
+								Usage:     "List the proxy destinations and their status.",
+								UsageText: ``,
+								Flags:     allFlags([]cli.Flag{}),
+								Action: func(c *cli.Context) error {
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									list, err := x.Client.ListProxies(context.TODO(), &activestreamer.Null{})
+									if err != nil {
+										return fmt.Errorf("list proxies: %v", err)
+									}
+									w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+									fmt.Fprintln(w, "ID\tADDR\tSTREAM\tCONNECTED\tDELAY\tPACKETS TX\tDROPPED\tRECONNECTS\tRTT\tLAST ERROR")
+									for _, p := range list.Proxies {
+										source := p.GetStream()
+										if source == "" {
+											source = "*"
+										}
+										fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%v\t%d\t%d\t%d\t%dms\t%s\n", p.Id, p.Addr, source, p.Connected, time.Duration(p.Delay)*time.Millisecond, p.PacketsTX, p.PacketsDropped, p.Reconnects, p.Rtt, p.GetLastError())
+									}
+									return w.Flush()
+								},
+							},
+							{
+								Name:      "rm",
+								Aliases:   []string{"remove"},
+								Usage:     "Unpublish and remove a proxy destination by ID.",
+								UsageText: `twinx rtmp proxy rm <id>`,
+								Flags:     allFlags([]cli.Flag{}),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 1 {
+										return fmt.Errorf("usage: twinx rtmp proxy rm <id>")
+									}
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									ack, err := x.Client.RemoveProxy(context.TODO(), &activestreamer.ProxyID{
+										Id: args.Get(0),
+									})
+									if err != nil {
+										return fmt.Errorf("remove proxy: %v", err)
+									}
+									if ack.Success {
+										logger.Always("Success!")
+										return nil
+									}
+									return fmt.Errorf("remove proxy: %s", *ack.Message)
+								},
+							},
+							{
+								Name:      "replace",
+								Usage:     "Replace a proxy destination by ID, such as when a stream key is rotated.",
+								UsageText: `twinx rtmp proxy replace <id> <host:port/app/stream-key>`,
+								Flags:     allFlags(append(queueFlags("the proxy"), delayFlag())),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 2 {
+										return fmt.Errorf("usage: twinx rtmp proxy replace <id> <host:port/app/stream-key>")
+									}
+									addr := args.Get(1)
+									_, err := rtmp.NewURLAddr(addr)
+									if err != nil {
+										return fmt.Errorf("invalid rtmp url %s: %v", addr, err)
+									}
+									_, err = rtmp.ParseOverflowPolicy(overflowPolicy)
+									if err != nil {
+										return err
+									}
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									ack, err := x.Client.ReplaceProxy(context.TODO(), &activestreamer.ProxyReplacement{
+										Id: args.Get(0),
+										Host: &activestreamer.RTMPHost{
+											Addr:           addr,
+											BufferSize:     bufferSize,
+											OverflowPolicy: twinx.S(overflowPolicy),
+											AggregateAudio: aggregateAudio,
+											Delay:          delay.Milliseconds(),
+										},
+									})
+									if err != nil {
+										return fmt.Errorf("replace proxy: %v", err)
+									}
+									if ack.Success {
+										logger.Always("Success! Proxy ID: %s", ack.GetId())
+										return nil
+									}
+									return fmt.Errorf("replace proxy: %s", *ack.Message)
+								},
+							},
+							{
+								Name:      "delay",
+								Usage:     "Change the broadcast delay of a proxy destination while it is publishing.",
+								UsageText: `twinx rtmp proxy delay <id> <delay>`,
+								Flags:     allFlags([]cli.Flag{}),
+								Action: func(c *cli.Context) error {
+									args := c.Args()
+									if args.Len() != 2 {
+										return fmt.Errorf("usage: twinx rtmp proxy delay <id> <delay>")
+									}
+									newDelay, err := time.ParseDuration(args.Get(1))
+									if err != nil || newDelay < 0 {
+										return fmt.Errorf("invalid delay %s", args.Get(1))
+									}
+									x, err := twinx.GetActiveStream()
+									if err != nil {
+										return fmt.Errorf("unable to find active running stream: %v", err)
+									}
+									ack, err := x.Client.DelayProxy(context.TODO(), &activestreamer.ProxyDelay{
+										Id:    args.Get(0),
+										Delay: newDelay.Milliseconds(),
+									})
+									if err != nil {
+										return fmt.Errorf("delay proxy: %v", err)
+									}
+									if ack.Success {
+										logger.Always("Success! Proxy %s is moving to a %v delay", args.Get(0), newDelay)
+										return nil
+									}
+									return fmt.Errorf("delay proxy: %s", *ack.Message)
+								},
+							},
+						},
 					},
 				},
 			},
@@ -480,6 +1034,109 @@ func allFlags(flags []cli.Flag) []cli.Flag {
 	return append(globalFlags, flags...)
 }
 
+// queueFlags are the write queue flags for each destination of a stream
+func queueFlags(target string) []cli.Flag {
+	return []cli.Flag{
+		&cli.Int64Flag{
+			Name:        "buffer-size",
+			Usage:       fmt.Sprintf("Number of packets queued for %s before the overflow policy is applied.", target),
+			Value:       int64(rtmp.MaximumPacketQueueRecords),
+			Destination: &bufferSize,
+		},
+		&cli.StringFlag{
+			Name:        "overflow",
+			Usage:       fmt.Sprintf(`What to do when %s cannot keep up with the stream. "drop" non-keyframe video, or "disconnect".`, target),
+			Value:       string(rtmp.DefaultOverflowPolicy),
+			Destination: &overflowPolicy,
+		},
+		&cli.BoolFlag{
+			Name:        "aggregate-audio",
+			Usage:       fmt.Sprintf("Write small audio messages queued for %s as a single aggregate message.", target),
+			Destination: &aggregateAudio,
+		},
+	}
+}
+
+// delayFlag is the broadcast delay of a proxy.
+func delayFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:        "delay",
+		Usage:       "Delay the stream to the proxy, such as 30s. Play clients are never delayed.",
+		Destination: &delay,
+	}
+}
+
+// inputStreamFlag is the stream to list or switch the inputs of.
+func inputStreamFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "stream",
+		Usage:       `The app and stream name, such as "twinx/camera". Defaults to the first published stream.`,
+		Destination: &stream,
+	}
+}
+
+// useInput will switch the input a stream follows. An empty name
+// follows the healthy input with the lowest priority.
+func useInput(name string) error {
+	x, err := twinx.GetActiveStream()
+	if err != nil {
+		return fmt.Errorf("unable to find active running stream: %v", err)
+	}
+	ack, err := x.Client.UseInput(context.TODO(), &activestreamer.InputSelection{
+		Stream: twinx.S(stream),
+		Name:   twinx.S(name),
+	})
+	if err != nil {
+		return fmt.Errorf("use input: %v", err)
+	}
+	if !ack.Success {
+		return fmt.Errorf("use input: %s", *ack.Message)
+	}
+	return nil
+}
+
+// limitFlags are the connection limits for the RTMP server.
+// A value of 0 will disable a limit.
+func limitFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.Int64Flag{
+			Name:        "max-connections",
+			Usage:       "Maximum number of clients.",
+			Value:       int64(rtmp.DefaultMaxConnections),
+			Destination: &maxConnections,
+		},
+		&cli.Int64Flag{
+			Name:        "max-connections-per-ip",
+			Usage:       "Maximum number of clients from one IP address.",
+			Value:       int64(rtmp.DefaultMaxConnectionsPerIP),
+			Destination: &maxConnectionsPerIP,
+		},
+		&cli.Int64Flag{
+			Name:        "max-handshakes",
+			Usage:       "Maximum number of clients in the handshake at the same time.",
+			Value:       int64(rtmp.DefaultMaxHandshakes),
+			Destination: &maxHandshakes,
+		},
+		&cli.DurationFlag{
+			Name:        "handshake-timeout",
+			Usage:       "Time a client has to complete the handshake.",
+			Value:       rtmp.DefaultHandshakeTimeout,
+			Destination: &handshakeTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "idle-timeout",
+			Usage:       "Disconnect clients that have not sent anything for this long. Play clients are never idle.",
+			Value:       rtmp.DefaultIdleTimeout,
+			Destination: &idleTimeout,
+		},
+		&cli.Int64Flag{
+			Name:        "max-publish-kbps",
+			Usage:       "Maximum inbound kilobits per second for each publish client.",
+			Destination: &maxPublishKbps,
+		},
+	}
+}
+
 // DefaultSubCommandHelpTemplate is taken from https://github.com/urfave/cli/blob/master/template.go
 const DefaultSubCommandHelpTemplate = `NAME:
    {{.HelpName}} - {{.Usage}}
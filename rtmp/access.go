@@ -0,0 +1,135 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AccessAll is a rule that will match every address, similar
+// to "allow publish all" in the Nginx RTMP module.
+const AccessAll string = "all"
+
+// AccessList is a set of allow and deny rules for the remote
+// address of a publish or play client.
+//
+// An address is denied if it matches any deny rule. Otherwise, if there
+// are allow rules, the address must match one. A nil *AccessList will
+// allow every address.
+type AccessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewAccessList will parse allow and deny rules, which are CIDR ranges,
+// IP addresses, or AccessAll.
+//  192.168.1.0/24
+//  10.0.0.7
+//  all
+func NewAccessList(allow, deny []string) (*AccessList, error) {
+	l := &AccessList{}
+	for _, rule := range allow {
+		ipNets, err := parseAccessRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		l.allow = append(l.allow, ipNets...)
+	}
+	for _, rule := range deny {
+		ipNets, err := parseAccessRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		l.deny = append(l.deny, ipNets...)
+	}
+	return l, nil
+}
+
+// Allowed will return true if the address is allowed by the rules.
+func (l *AccessList) Allowed(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		// Only TCP addresses can be matched
+		return len(l.allow) == 0 && len(l.deny) == 0
+	}
+	for _, ipNet := range l.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range l.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAccessRule will parse a single CIDR range, IP address, or AccessAll.
+func parseAccessRule(rule string) ([]*net.IPNet, error) {
+	rule = strings.TrimSpace(rule)
+	if rule == AccessAll {
+		_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+		_, v6, _ := net.ParseCIDR("::/0")
+		return []*net.IPNet{v4, v6}, nil
+	}
+	if strings.Contains(rule, "/") {
+		_, ipNet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access rule %q: %v", rule, err)
+		}
+		return []*net.IPNet{ipNet}, nil
+	}
+	ip := net.ParseIP(rule)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid access rule %q: expected CIDR, IP or %q", rule, AccessAll)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return []*net.IPNet{{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+}
+
+// addrIP will return the IP of a TCP address, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *URLAddr:
+		return addrIP(a.Addr)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	l, err := NewAccessList([]string{"192.168.1.0/24", "10.0.0.7"}, []string{"192.168.1.13"})
+	if err != nil {
+		t.Fatalf("access list: %v", err)
+	}
+	for ip, expected := range map[string]bool{
+		"192.168.1.12": true,
+		"192.168.1.13": false,
+		"10.0.0.7":     true,
+		"10.0.0.8":     false,
+		"::1":          false,
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1935}
+		if actual := l.Allowed(addr); actual != expected {
+			t.Errorf("%s: expected allowed %v, got %v", ip, expected, actual)
+		}
+	}
+
+	all, err := NewAccessList(nil, []string{AccessAll})
+	if err != nil {
+		t.Fatalf("access list: %v", err)
+	}
+	if all.Allowed(&net.TCPAddr{IP: net.ParseIP("::1")}) {
+		t.Errorf("expected deny all to deny IPv6")
+	}
+	var none *AccessList
+	if !none.Allowed(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Errorf("expected a nil access list to allow every address")
+	}
+	if _, err := NewAccessList([]string{"localhost"}, nil); err == nil {
+		t.Errorf("expected an error for an invalid rule")
+	}
+}
+
+// TestServerDenyPublish will deny publish clients from localhost, and
+// expect a publisher to be rejected while play clients can connect.
+func TestServerDenyPublish(t *testing.T) {
+	listener, err := Listen("localhost:1947/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deny, err := NewAccessList(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("access list: %v", err)
+	}
+	server := NewServer()
+	server.SetPublishAccess(deny)
+	go server.Serve(listener)
+	defer server.Close()
+
+	publisher := testPublish(t, "localhost:1947/twinx/denied")
+	defer publisher.Close()
+	done := make(chan error)
+	go func() {
+		done <- publisher.RoutePackets()
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), CommandNetStreamPublishBadName) {
+			t.Errorf("expected %s, got %v", CommandNetStreamPublishBadName, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("publisher was not rejected")
+	}
+	if server.liveStream("") != nil {
+		t.Errorf("expected no live stream")
+	}
+
+	server.SetPlayAccess(deny)
+	netConn, err := net.Dial("tcp", "localhost:1947")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer netConn.Close()
+	netConn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := netConn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,151 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 7.1.6. Aggregate Message
+//
+// An aggregate message is a single message that contains a series of
+// RTMP sub-messages. Each sub-message has the same layout as an FLV tag.
+//
+//  +---------+----------+---------------+------------+-----------+
+//  | Type(1) | Size(3)  | Timestamp(3)  | TS Ext(1)  | Stream(3) |
+//  +---------+----------+---------------+------------+-----------+
+//  | Data (Size bytes)  | Back Pointer(4), the size of the header  |
+//  |                    | and the data of this sub-message         |
+//  +--------------------+------------------------------------------+
+//
+// The message stream ID of the aggregate overrides the stream ID of the
+// sub-messages, and the timestamp of the aggregate is the timestamp of
+// the first sub-message. The sub-message timestamps are relative to it.
+
+const (
+	aggregateHeaderBytes      int = 11
+	aggregateBackPointerBytes int = 4
+)
+
+// splitAggregate will return the sub-messages of an aggregate message.
+//
+// The sub-messages share the payload of the aggregate, and are rebased
+// onto the timestamp of the aggregate. A sub-message earlier than the
+// first sub-message is given the timestamp of the aggregate.
+func splitAggregate(x *ChunkStream) ([]*ChunkStream, error) {
+	var subs []*ChunkStream
+	var first uint32
+	data := x.Data
+	for len(data) > 0 {
+		if len(data) < aggregateHeaderBytes {
+			return nil, fmt.Errorf("aggregate message: truncated sub-message header")
+		}
+		typeID := uint32(data[0])
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		timestamp := uint32(data[7])<<24 | uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6])
+		switch typeID {
+		case AudioMessageID, VideoMessageID, DataMessageAMF0ID, DataMessageAMF3ID:
+		default:
+			return nil, fmt.Errorf("aggregate message: unsupported sub-message type %d", typeID)
+		}
+		end := aggregateHeaderBytes + size
+		if len(data) < end {
+			return nil, fmt.Errorf("aggregate message: sub-message length %d exceeds %d remaining bytes", size, len(data)-aggregateHeaderBytes)
+		}
+		if len(subs) == 0 {
+			first = timestamp
+		}
+
+		// A sub-message before the first is clamped to the
+		// timestamp of the aggregate, and never wraps around.
+		delta := int64(timestamp) - int64(first)
+		if delta < 0 {
+			delta = 0
+		}
+		subs = append(subs, &ChunkStream{
+			Timestamp: x.Timestamp + uint32(delta),
+			Length:    uint32(size),
+			TypeID:    typeID,
+			StreamID:  x.StreamID,
+			Data:      data[aggregateHeaderBytes:end:end],
+			payload:   x.payload,
+		})
+		data = data[end:]
+
+		// Some servers omit the back pointer of the last sub-message
+		if len(data) == 0 {
+			break
+		}
+		if len(data) < aggregateBackPointerBytes {
+			return nil, fmt.Errorf("aggregate message: truncated back pointer")
+		}
+		data = data[aggregateBackPointerBytes:]
+	}
+	return subs, nil
+}
+
+// newAggregate will return a single aggregate message for a
+// series of messages on the same message stream.
+func newAggregate(messages []*ChunkStream) *ChunkStream {
+	size := 0
+	for _, x := range messages {
+		size += aggregateHeaderBytes + len(x.Data) + aggregateBackPointerBytes
+	}
+	data := make([]byte, size)
+	i := 0
+	for _, x := range messages {
+		data[i] = byte(x.TypeID)
+		putUint24(data[i+1:], uint32(len(x.Data)))
+		putUint24(data[i+4:], x.Timestamp)
+		data[i+7] = byte(x.Timestamp >> 24)
+		putUint24(data[i+8:], 0)
+		i += aggregateHeaderBytes
+		i += copy(data[i:], x.Data)
+		binary.BigEndian.PutUint32(data[i:], uint32(aggregateHeaderBytes+len(x.Data)))
+		i += aggregateBackPointerBytes
+	}
+	return &ChunkStream{
+		Timestamp: messages[0].Timestamp,
+		Length:    uint32(size),
+		TypeID:    AggregateMessageID,
+		StreamID:  messages[0].StreamID,
+		CSID:      messages[0].CSID,
+		Data:      data,
+	}
+}
+
+// isAggregatable returns true for audio that can be written
+// as part of an aggregate message.
+func isAggregatable(x *ChunkStream) bool {
+	return x.TypeID == AudioMessageID && len(x.Data) <= AggregateAudioMaximumMessageBytes && !isAACSequenceHeader(x)
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
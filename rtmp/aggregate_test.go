@@ -0,0 +1,245 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// testSubMessage will return an aggregate sub-message, as sent by FMS.
+func testSubMessage(typeID uint32, timestamp uint32, data []byte, backPointer bool) []byte {
+	size := len(data)
+	b := []byte{
+		byte(typeID),
+		byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24),
+		0, 0, 0,
+	}
+	b = append(b, data...)
+	if backPointer {
+		tag := aggregateHeaderBytes + size
+		b = append(b, byte(tag>>24), byte(tag>>16), byte(tag>>8), byte(tag))
+	}
+	return b
+}
+
+func TestSplitAggregate(t *testing.T) {
+	video := testVideo(FRAME_KEY, AVC_NALU).Data
+	audio := testAudio(AAC_RAW).Data
+	var data []byte
+	data = append(data, testSubMessage(VideoMessageID, 0x01000010, video, true)...)
+	data = append(data, testSubMessage(AudioMessageID, 0x01000020, audio, true)...)
+	// The last back pointer is optional
+	data = append(data, testSubMessage(AudioMessageID, 0x01000040, audio, false)...)
+
+	x := &ChunkStream{TypeID: AggregateMessageID, Timestamp: 5000, StreamID: 7, Length: uint32(len(data)), Data: data}
+	subs, err := splitAggregate(x)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(subs) != 3 {
+		t.Fatalf("expected 3 sub-messages, got %d", len(subs))
+	}
+	expected := []struct {
+		typeID    uint32
+		timestamp uint32
+		data      []byte
+	}{
+		{VideoMessageID, 5000, video},
+		{AudioMessageID, 5016, audio},
+		{AudioMessageID, 5048, audio},
+	}
+	for i, e := range expected {
+		sub := subs[i]
+		if sub.TypeID != e.typeID || sub.Timestamp != e.timestamp || sub.StreamID != 7 {
+			t.Errorf("sub-message %d: expected type %d at %d on stream 7, got type %d at %d on stream %d", i, e.typeID, e.timestamp, sub.TypeID, sub.Timestamp, sub.StreamID)
+		}
+		if !bytes.Equal(sub.Data, e.data) || int(sub.Length) != len(e.data) {
+			t.Errorf("sub-message %d: unexpected data %v", i, sub.Data)
+		}
+	}
+}
+
+func TestSplitAggregateOutOfOrder(t *testing.T) {
+	audio := testAudio(AAC_RAW).Data
+	var data []byte
+	data = append(data, testSubMessage(AudioMessageID, 1000, audio, true)...)
+	data = append(data, testSubMessage(AudioMessageID, 980, audio, true)...)
+	data = append(data, testSubMessage(AudioMessageID, 1020, audio, true)...)
+
+	x := &ChunkStream{TypeID: AggregateMessageID, Timestamp: 5000, StreamID: 1, Length: uint32(len(data)), Data: data}
+	subs, err := splitAggregate(x)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	// The earlier sub-message is clamped to the aggregate
+	for i, timestamp := range []uint32{5000, 5000, 5020} {
+		if subs[i].Timestamp != timestamp {
+			t.Errorf("sub-message %d: expected %d, got %d", i, timestamp, subs[i].Timestamp)
+		}
+	}
+}
+
+func TestSplitAggregateInvalid(t *testing.T) {
+	audio := testAudio(AAC_RAW).Data
+	valid := testSubMessage(AudioMessageID, 0, audio, true)
+	tests := map[string][]byte{
+		"truncated header":       valid[:aggregateHeaderBytes-1],
+		"truncated data":         valid[:aggregateHeaderBytes+1],
+		"truncated back pointer": append(append([]byte{}, valid...), testSubMessage(AudioMessageID, 0, audio, true)[:len(valid)-2]...),
+		"unsupported type":       testSubMessage(CommandMessageAMF0ID, 0, audio, true),
+		"nested aggregate":       testSubMessage(AggregateMessageID, 0, valid, true),
+	}
+	for name, data := range tests {
+		x := &ChunkStream{TypeID: AggregateMessageID, Length: uint32(len(data)), Data: data}
+		if _, err := splitAggregate(x); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNewAggregate(t *testing.T) {
+	var messages []*ChunkStream
+	for i := 0; i < 3; i++ {
+		x := testAudio(AAC_RAW)
+		x.Timestamp = 0xfffff0 + uint32(i)*0x10
+		messages = append(messages, x)
+	}
+	x := newAggregate(messages)
+	if x.TypeID != AggregateMessageID || x.Timestamp != messages[0].Timestamp || x.StreamID != 1 || int(x.Length) != len(x.Data) {
+		t.Fatalf("unexpected aggregate header %+v", x)
+	}
+	subs, err := splitAggregate(x)
+	if err != nil {
+		t.Fatalf("split: %v", err)
+	}
+	if len(subs) != len(messages) {
+		t.Fatalf("expected %d sub-messages, got %d", len(messages), len(subs))
+	}
+	for i, sub := range subs {
+		if sub.Timestamp != messages[i].Timestamp || !bytes.Equal(sub.Data, messages[i].Data) {
+			t.Errorf("sub-message %d: expected %d %v, got %d %v", i, messages[i].Timestamp, messages[i].Data, sub.Timestamp, sub.Data)
+		}
+	}
+}
+
+func TestStreamWriterAggregateAudio(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	conn := newTestConn(c)
+	conn.SetAggregateAudio(true)
+	w := newStreamWriter(conn, 16, OverflowPolicyDisconnect)
+	for i, x := range []*ChunkStream{
+		testAudio(AAC_SEQHDR),
+		testAudio(AAC_RAW),
+		testAudio(AAC_RAW),
+		testAudio(AAC_RAW),
+		testVideo(FRAME_KEY, AVC_NALU),
+		testAudio(AAC_RAW),
+	} {
+		x.Timestamp = uint32(i) * 20
+		if _, err := w.enqueue(x); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	go w.run()
+	defer w.close()
+
+	reader := newTestConn(s)
+	expected := []struct {
+		typeID    uint32
+		timestamp uint32
+		subs      int
+	}{
+		// The sequence header is never aggregated
+		{AudioMessageID, 0, 0},
+		{AggregateMessageID, 20, 3},
+		{VideoMessageID, 80, 0},
+		// Audio is never held back to be aggregated
+		{AudioMessageID, 100, 0},
+	}
+	for i, e := range expected {
+		var x ChunkStream
+		if err := reader.Read(&x); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if x.TypeID != e.typeID || x.Timestamp != e.timestamp {
+			t.Fatalf("message %d: expected type %d at %d, got type %d at %d", i, e.typeID, e.timestamp, x.TypeID, x.Timestamp)
+		}
+		if x.TypeID != AggregateMessageID {
+			continue
+		}
+		subs, err := splitAggregate(&x)
+		if err != nil {
+			t.Fatalf("split: %v", err)
+		}
+		if len(subs) != e.subs {
+			t.Fatalf("expected %d sub-messages, got %d", e.subs, len(subs))
+		}
+		for j, sub := range subs {
+			if sub.Timestamp != e.timestamp+uint32(j)*20 {
+				t.Errorf("sub-message %d: expected timestamp %d, got %d", j, e.timestamp+uint32(j)*20, sub.Timestamp)
+			}
+		}
+	}
+}
+
+// TestServerPublishAggregate will publish an aggregate message, and
+// expect the sub-messages to be routed to the stream.
+func TestServerPublishAggregate(t *testing.T) {
+	listener, err := Listen("localhost:1949/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	camera := testPublish(t, "localhost:1949/twinx/aggregate")
+	defer camera.Close()
+	go camera.RoutePackets()
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/aggregate") != nil
+	})
+
+	avcSeq := testVideo(FRAME_KEY, AVC_SEQHDR)
+	aacSeq := testAudio(AAC_SEQHDR)
+	aacSeq.Timestamp = 10
+	err = camera.conn.Write(newAggregate([]*ChunkStream{avcSeq, aacSeq}))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	camera.Flush()
+	waitFor(t, "sequence headers", func() bool {
+		s := Multiplex("twinx/aggregate")
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return len(s.gop.Headers()) == 2
+	})
+}
@@ -0,0 +1,357 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// AMFVersion is the Action Message Format used to encode a value.
+//
+// AMF0 is used by every RTMP client for commands and metadata. Clients
+// that connect with objectEncoding 3 will send AMF3 values, which are
+// embedded in AMF0 messages with the avmplus-object marker.
+type AMFVersion uint8
+
+const (
+	AMF0 AMFVersion = 0
+	AMF3 AMFVersion = 3
+)
+
+// AMF0 markers
+// AMF0 Specification 2.1
+const (
+	amf0Number      byte = 0x00
+	amf0Boolean     byte = 0x01
+	amf0String      byte = 0x02
+	amf0Object      byte = 0x03
+	amf0MovieClip   byte = 0x04
+	amf0Null        byte = 0x05
+	amf0Undefined   byte = 0x06
+	amf0Reference   byte = 0x07
+	amf0ECMAArray   byte = 0x08
+	amf0ObjectEnd   byte = 0x09
+	amf0StrictArray byte = 0x0a
+	amf0Date        byte = 0x0b
+	amf0LongString  byte = 0x0c
+	amf0Unsupported byte = 0x0d
+	amf0RecordSet   byte = 0x0e
+	amf0XMLDocument byte = 0x0f
+	amf0TypedObject byte = 0x10
+	amf0AVMPlus     byte = 0x11
+)
+
+// AMF3 markers
+// AMF3 Specification 3.1
+const (
+	amf3Undefined byte = 0x00
+	amf3Null      byte = 0x01
+	amf3False     byte = 0x02
+	amf3True      byte = 0x03
+	amf3Integer   byte = 0x04
+	amf3Double    byte = 0x05
+	amf3String    byte = 0x06
+	amf3XMLDoc    byte = 0x07
+	amf3Date      byte = 0x08
+	amf3Array     byte = 0x09
+	amf3Object    byte = 0x0a
+	amf3XML       byte = 0x0b
+	amf3ByteArray byte = 0x0c
+)
+
+const (
+	amf0StringMaximumBytes = 0xffff
+	amf3IntegerMinimum     = -1 << 28
+	amf3IntegerMaximum     = 1<<28 - 1
+	amf3U29Maximum         = 1<<29 - 1
+)
+
+// AMFObject is an anonymous object.
+type AMFObject map[string]interface{}
+
+// AMFECMAArray is an associative array, such as onMetaData.
+type AMFECMAArray map[string]interface{}
+
+// AMFArray is a strict (dense) array.
+type AMFArray []interface{}
+
+// AMFTypedObject is an object with a class name.
+type AMFTypedObject struct {
+	Type   string
+	Object AMFObject
+}
+
+// AMFXMLDocument is an XML document, which is sent as a string.
+type AMFXMLDocument string
+
+// AMFDecoder will decode AMF values.
+//
+// Reference tables are scoped to a message, so a new decoder should
+// be used for each message. DecodeBatch will do this for you.
+type AMFDecoder struct {
+	// AMF0 complex objects
+	refs []interface{}
+
+	// AMF3 reference tables
+	strings []string
+	objects []interface{}
+	traits  []amf3Trait
+}
+
+// AMFEncoder will encode AMF values.
+//
+// Reference tables are scoped to a message, so a new encoder should
+// be used for each message. EncodeBatch will do this for you.
+type AMFEncoder struct {
+	// AMF3 reference tables
+	strings map[string]int
+	objects map[uintptr]int
+	traits  map[string]int
+	count   int
+}
+
+// amf3Trait describes the members of an AMF3 object.
+type amf3Trait struct {
+	class          string
+	externalizable bool
+	dynamic        bool
+	members        []string
+}
+
+// DecodeBatch will decode every value in a message.
+func (d *AMFDecoder) DecodeBatch(r io.Reader, ver AMFVersion) ([]interface{}, error) {
+	*d = AMFDecoder{}
+	var values []interface{}
+	for {
+		v, err := d.Decode(r, ver)
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+}
+
+// Decode will decode the next value. io.EOF is returned only if
+// there are no more values.
+func (d *AMFDecoder) Decode(r io.Reader, ver AMFVersion) (interface{}, error) {
+	switch ver {
+	case AMF0:
+		return d.decodeAMF0(r)
+	case AMF3:
+		return d.decodeAMF3(r)
+	}
+	return nil, fmt.Errorf("decode amf: unsupported version %d", ver)
+}
+
+// EncodeBatch will encode every value as one message.
+func (e *AMFEncoder) EncodeBatch(w io.Writer, ver AMFVersion, values ...interface{}) error {
+	*e = AMFEncoder{}
+	for _, v := range values {
+		if err := e.Encode(w, v, ver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode will encode a value.
+//
+// Objects are encoded with their keys sorted, so that the encoding
+// of a message is always the same.
+func (e *AMFEncoder) Encode(w io.Writer, v interface{}, ver AMFVersion) error {
+	switch ver {
+	case AMF0:
+		return e.encodeAMF0(w, v)
+	case AMF3:
+		return e.encodeAMF3(w, v)
+	}
+	return fmt.Errorf("encode amf: unsupported version %d", ver)
+}
+
+// DecodeAMF will decode a message, such as the payload of a command.
+func DecodeAMF(data []byte, ver AMFVersion) ([]interface{}, error) {
+	d := &AMFDecoder{}
+	return d.DecodeBatch(bytes.NewReader(data), ver)
+}
+
+// EncodeAMF will encode values as a message.
+func EncodeAMF(ver AMFVersion, values ...interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	e := &AMFEncoder{}
+	err := e.EncodeBatch(b, ver, values...)
+	return b.Bytes(), err
+}
+
+// amfPayload will return the AMF0 payload of a command, data,
+// or shared object message.
+//
+// The AMF3 messages (type 17, 15 and 16) begin with a single format
+// byte, and the values are AMF0 which switch to AMF3 as needed.
+func amfPayload(x *ChunkStream) []byte {
+	switch x.TypeID {
+	case CommandMessageAMF3ID, DataMessageAMF3ID, SharedObjectMessageAMF3ID:
+		if len(x.Data) > 0 && x.Data[0] == 0 {
+			return x.Data[1:]
+		}
+	}
+	return x.Data
+}
+
+const (
+	SetDataFrame string = "@setDataFrame"
+	OnMetaData   string = "onMetaData"
+)
+
+// addSetDataFrame will prefix metadata with @setDataFrame, which is
+// how a publish client sends metadata to a server.
+func addSetDataFrame(data []byte) ([]byte, error) {
+	v, err := (&AMFDecoder{}).Decode(bytes.NewReader(data), AMF0)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata, expected string got %T", v)
+	}
+	if name == SetDataFrame {
+		return data, nil
+	}
+	prefix, err := EncodeAMF(AMF0, SetDataFrame)
+	if err != nil {
+		return nil, err
+	}
+	return append(prefix, data...), nil
+}
+
+// removeSetDataFrame will remove the @setDataFrame prefix from
+// metadata, which is how a server sends metadata to a play client.
+func removeSetDataFrame(data []byte) ([]byte, error) {
+	v, err := (&AMFDecoder{}).Decode(bytes.NewReader(data), AMF0)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata, expected string got %T", v)
+	}
+	if name != SetDataFrame {
+		return data, nil
+	}
+	return data[3+len(SetDataFrame):], nil
+}
+
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// readFull is io.ReadFull, where any EOF is unexpected.
+func readFull(r io.Reader, b []byte) error {
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readUint(r io.Reader, n int) (uint64, error) {
+	b := make([]byte, 8)
+	if err := readFull(r, b[8-n:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func readDouble(r io.Reader) (float64, error) {
+	u, err := readUint(r, 8)
+	return math.Float64frombits(u), err
+}
+
+func writeDouble(w io.Writer, f float64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	_, err := w.Write(b)
+	return err
+}
+
+// unexpected will treat an EOF inside of a value as unexpected.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// amfNumber will return a number as a float64, and false if
+// v is not a number.
+func amfNumber(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// amfMillis will return the milliseconds since the epoch of a date.
+func amfMillis(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+// amfDate will return the date from milliseconds since the epoch.
+func amfDate(ms float64) time.Time {
+	return time.Unix(0, int64(ms*float64(time.Millisecond))).UTC()
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errAMFUnsupported = errors.New("unsupported amf type")
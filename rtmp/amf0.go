@@ -0,0 +1,289 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// decodeAMF0 will decode an AMF0 value.
+// AMF0 Specification 2.2 - 2.18
+func (d *AMFDecoder) decodeAMF0(r io.Reader) (interface{}, error) {
+	marker, err := readByte(r)
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amf0Number:
+		v, err := readDouble(r)
+		return v, err
+	case amf0Boolean:
+		b, err := readByte(r)
+		return b != 0, unexpected(err)
+	case amf0String:
+		return d.decodeAMF0String(r, 2)
+	case amf0LongString:
+		return d.decodeAMF0String(r, 4)
+	case amf0XMLDocument:
+		s, err := d.decodeAMF0String(r, 4)
+		return AMFXMLDocument(s), err
+	case amf0Object:
+		obj := AMFObject{}
+		d.refs = append(d.refs, obj)
+		return obj, d.decodeAMF0Properties(r, obj)
+	case amf0TypedObject:
+		class, err := d.decodeAMF0String(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		obj := &AMFTypedObject{Type: class, Object: AMFObject{}}
+		d.refs = append(d.refs, obj)
+		return obj, d.decodeAMF0Properties(r, obj.Object)
+	case amf0ECMAArray:
+		// The count is only a hint, the array ends with an end marker
+		if _, err := readUint(r, 4); err != nil {
+			return nil, err
+		}
+		arr := AMFECMAArray{}
+		d.refs = append(d.refs, arr)
+		return arr, d.decodeAMF0Properties(r, arr)
+	case amf0StrictArray:
+		count, err := readUint(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		ref := len(d.refs)
+		d.refs = append(d.refs, nil)
+		var arr AMFArray
+		for i := uint64(0); i < count; i++ {
+			v, err := d.decodeAMF0(r)
+			if err != nil {
+				return nil, unexpected(err)
+			}
+			arr = append(arr, v)
+		}
+		d.refs[ref] = arr
+		return arr, nil
+	case amf0Date:
+		ms, err := readDouble(r)
+		if err != nil {
+			return nil, err
+		}
+		// The time zone is reserved, and should be 0
+		if _, err := readUint(r, 2); err != nil {
+			return nil, err
+		}
+		return amfDate(ms), nil
+	case amf0Null, amf0Undefined, amf0Unsupported:
+		return nil, nil
+	case amf0Reference:
+		i, err := readUint(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if int(i) >= len(d.refs) {
+			return nil, fmt.Errorf("invalid amf0 reference %d", i)
+		}
+		return d.refs[i], nil
+	case amf0AVMPlus:
+		// Switch to AMF3 for this value, with new reference tables
+		d.strings, d.objects, d.traits = nil, nil, nil
+		v, err := d.decodeAMF3(r)
+		return v, unexpected(err)
+	case amf0MovieClip, amf0RecordSet:
+		return nil, fmt.Errorf("reserved amf0 marker 0x%02x", marker)
+	}
+	return nil, fmt.Errorf("invalid amf0 marker 0x%02x", marker)
+}
+
+func (d *AMFDecoder) decodeAMF0String(r io.Reader, size int) (string, error) {
+	n, err := readUint(r, size)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if err := readFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeAMF0Properties will decode the properties of an object
+// until the object end marker.
+func (d *AMFDecoder) decodeAMF0Properties(r io.Reader, obj map[string]interface{}) error {
+	for {
+		key, err := d.decodeAMF0String(r, 2)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			marker, err := readByte(r)
+			if err != nil {
+				return unexpected(err)
+			}
+			if marker != amf0ObjectEnd {
+				return fmt.Errorf("expected amf0 object end, got 0x%02x", marker)
+			}
+			return nil
+		}
+		v, err := d.decodeAMF0(r)
+		if err != nil {
+			return unexpected(err)
+		}
+		obj[key] = v
+	}
+}
+
+// encodeAMF0 will encode an AMF0 value. Values that can only be
+// encoded with AMF3, such as a []byte, will switch to AMF3.
+func (e *AMFEncoder) encodeAMF0(w io.Writer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		_, err := w.Write([]byte{amf0Null})
+		return err
+	case bool:
+		b := []byte{amf0Boolean, 0}
+		if v {
+			b[1] = 1
+		}
+		_, err := w.Write(b)
+		return err
+	case string:
+		return e.encodeAMF0String(w, v)
+	case AMFXMLDocument:
+		if _, err := w.Write([]byte{amf0XMLDocument}); err != nil {
+			return err
+		}
+		return e.writeAMF0String(w, string(v), 4)
+	case time.Time:
+		if _, err := w.Write([]byte{amf0Date}); err != nil {
+			return err
+		}
+		if err := writeDouble(w, amfMillis(v)); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte{0, 0})
+		return err
+	case AMFObject:
+		if _, err := w.Write([]byte{amf0Object}); err != nil {
+			return err
+		}
+		return e.encodeAMF0Properties(w, v)
+	case map[string]interface{}:
+		return e.encodeAMF0(w, AMFObject(v))
+	case *AMFTypedObject:
+		if _, err := w.Write([]byte{amf0TypedObject}); err != nil {
+			return err
+		}
+		if err := e.writeAMF0String(w, v.Type, 2); err != nil {
+			return err
+		}
+		return e.encodeAMF0Properties(w, v.Object)
+	case AMFTypedObject:
+		return e.encodeAMF0(w, &v)
+	case AMFECMAArray:
+		b := make([]byte, 5)
+		b[0] = amf0ECMAArray
+		binary.BigEndian.PutUint32(b[1:], uint32(len(v)))
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		return e.encodeAMF0Properties(w, v)
+	case AMFArray:
+		b := make([]byte, 5)
+		b[0] = amf0StrictArray
+		binary.BigEndian.PutUint32(b[1:], uint32(len(v)))
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		for _, x := range v {
+			if err := e.encodeAMF0(w, x); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		return e.encodeAMF0(w, AMFArray(v))
+	case []byte:
+		// There is no AMF0 byte array
+		if _, err := w.Write([]byte{amf0AVMPlus}); err != nil {
+			return err
+		}
+		*e = AMFEncoder{}
+		return e.encodeAMF3(w, v)
+	}
+	if f, ok := amfNumber(v); ok {
+		if _, err := w.Write([]byte{amf0Number}); err != nil {
+			return err
+		}
+		return writeDouble(w, f)
+	}
+	return fmt.Errorf("%w: amf0 %T", errAMFUnsupported, v)
+}
+
+func (e *AMFEncoder) encodeAMF0String(w io.Writer, s string) error {
+	if len(s) > amf0StringMaximumBytes {
+		if _, err := w.Write([]byte{amf0LongString}); err != nil {
+			return err
+		}
+		return e.writeAMF0String(w, s, 4)
+	}
+	if _, err := w.Write([]byte{amf0String}); err != nil {
+		return err
+	}
+	return e.writeAMF0String(w, s, 2)
+}
+
+// writeAMF0String will write a string without a marker.
+func (e *AMFEncoder) writeAMF0String(w io.Writer, s string, size int) error {
+	b := make([]byte, size, size+len(s))
+	if size == 2 {
+		binary.BigEndian.PutUint16(b, uint16(len(s)))
+	} else {
+		binary.BigEndian.PutUint32(b, uint32(len(s)))
+	}
+	_, err := w.Write(append(b, s...))
+	return err
+}
+
+func (e *AMFEncoder) encodeAMF0Properties(w io.Writer, obj map[string]interface{}) error {
+	for _, k := range sortedKeys(obj) {
+		if len(k) > amf0StringMaximumBytes {
+			return fmt.Errorf("amf0 key exceeds %d bytes", amf0StringMaximumBytes)
+		}
+		if err := e.writeAMF0String(w, k, 2); err != nil {
+			return err
+		}
+		if err := e.encodeAMF0(w, obj[k]); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, amf0ObjectEnd})
+	return err
+}
@@ -0,0 +1,508 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decodeAMF3 will decode an AMF3 value.
+// AMF3 Specification 3.2 - 3.14
+func (d *AMFDecoder) decodeAMF3(r io.Reader) (interface{}, error) {
+	marker, err := readByte(r)
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amf3Undefined, amf3Null:
+		return nil, nil
+	case amf3False:
+		return false, nil
+	case amf3True:
+		return true, nil
+	case amf3Integer:
+		u, err := readU29(r)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend the 29 bit integer
+		if u&0x10000000 != 0 {
+			return int(u) - 0x20000000, nil
+		}
+		return int(u), nil
+	case amf3Double:
+		v, err := readDouble(r)
+		return v, err
+	case amf3String:
+		return d.decodeAMF3String(r)
+	case amf3XMLDoc, amf3XML:
+		u, ref, err := d.decodeAMF3Ref(r)
+		if err != nil || ref != nil {
+			return ref, err
+		}
+		b := make([]byte, u)
+		if err := readFull(r, b); err != nil {
+			return nil, err
+		}
+		d.objects = append(d.objects, AMFXMLDocument(b))
+		return AMFXMLDocument(b), nil
+	case amf3Date:
+		_, ref, err := d.decodeAMF3Ref(r)
+		if err != nil || ref != nil {
+			return ref, err
+		}
+		ms, err := readDouble(r)
+		if err != nil {
+			return nil, err
+		}
+		d.objects = append(d.objects, amfDate(ms))
+		return amfDate(ms), nil
+	case amf3ByteArray:
+		u, ref, err := d.decodeAMF3Ref(r)
+		if err != nil || ref != nil {
+			return ref, err
+		}
+		b := make([]byte, u)
+		if err := readFull(r, b); err != nil {
+			return nil, err
+		}
+		d.objects = append(d.objects, b)
+		return b, nil
+	case amf3Array:
+		return d.decodeAMF3Array(r)
+	case amf3Object:
+		return d.decodeAMF3Object(r)
+	}
+	return nil, fmt.Errorf("unsupported amf3 marker 0x%02x", marker)
+}
+
+// decodeAMF3Ref will read the U29 header of a complex value. If the
+// value is a reference the referenced value is returned, otherwise
+// the remaining 28 bits of the header are returned.
+func (d *AMFDecoder) decodeAMF3Ref(r io.Reader) (uint32, interface{}, error) {
+	u, err := readU29(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if u&1 == 0 {
+		i := int(u >> 1)
+		if i >= len(d.objects) {
+			return 0, nil, fmt.Errorf("invalid amf3 object reference %d", i)
+		}
+		return 0, d.objects[i], nil
+	}
+	return u >> 1, nil, nil
+}
+
+func (d *AMFDecoder) decodeAMF3String(r io.Reader) (string, error) {
+	u, err := readU29(r)
+	if err != nil {
+		return "", err
+	}
+	if u&1 == 0 {
+		i := int(u >> 1)
+		if i >= len(d.strings) {
+			return "", fmt.Errorf("invalid amf3 string reference %d", i)
+		}
+		return d.strings[i], nil
+	}
+	b := make([]byte, u>>1)
+	if err := readFull(r, b); err != nil {
+		return "", err
+	}
+	s := string(b)
+	// The empty string is never sent by reference
+	if s != "" {
+		d.strings = append(d.strings, s)
+	}
+	return s, nil
+}
+
+// decodeAMF3Array will decode an array as an AMFArray, or as an
+// AMFECMAArray if it has any associative members. The dense members
+// of an AMFECMAArray are keyed by their index.
+func (d *AMFDecoder) decodeAMF3Array(r io.Reader) (interface{}, error) {
+	count, ref, err := d.decodeAMF3Ref(r)
+	if err != nil || ref != nil {
+		return ref, err
+	}
+	i := len(d.objects)
+	d.objects = append(d.objects, nil)
+	assoc := AMFECMAArray{}
+	for {
+		key, err := d.decodeAMF3String(r)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		v, err := d.decodeAMF3(r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		assoc[key] = v
+	}
+	dense := make(AMFArray, count)
+	for j := range dense {
+		v, err := d.decodeAMF3(r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		dense[j] = v
+	}
+	if len(assoc) == 0 {
+		d.objects[i] = dense
+		return dense, nil
+	}
+	for j, v := range dense {
+		assoc[strconv.Itoa(j)] = v
+	}
+	d.objects[i] = assoc
+	return assoc, nil
+}
+
+// decodeAMF3Object will decode an anonymous object as an AMFObject,
+// and an object with a class name as an *AMFTypedObject.
+func (d *AMFDecoder) decodeAMF3Object(r io.Reader) (interface{}, error) {
+	u, ref, err := d.decodeAMF3Ref(r)
+	if err != nil || ref != nil {
+		return ref, err
+	}
+	var trait amf3Trait
+	if u&1 == 0 {
+		i := int(u >> 1)
+		if i >= len(d.traits) {
+			return nil, fmt.Errorf("invalid amf3 trait reference %d", i)
+		}
+		trait = d.traits[i]
+	} else {
+		trait.externalizable = u&2 != 0
+		trait.dynamic = u&4 != 0
+		trait.class, err = d.decodeAMF3String(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < u>>3; i++ {
+			member, err := d.decodeAMF3String(r)
+			if err != nil {
+				return nil, err
+			}
+			trait.members = append(trait.members, member)
+		}
+		d.traits = append(d.traits, trait)
+	}
+	if trait.externalizable {
+		return nil, fmt.Errorf("%w: amf3 externalizable class %q", errAMFUnsupported, trait.class)
+	}
+
+	obj := AMFObject{}
+	var v interface{} = obj
+	if trait.class != "" {
+		v = &AMFTypedObject{Type: trait.class, Object: obj}
+	}
+	d.objects = append(d.objects, v)
+	for _, member := range trait.members {
+		x, err := d.decodeAMF3(r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		obj[member] = x
+	}
+	for trait.dynamic {
+		key, err := d.decodeAMF3String(r)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		x, err := d.decodeAMF3(r)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		obj[key] = x
+	}
+	return v, nil
+}
+
+// encodeAMF3 will encode an AMF3 value.
+func (e *AMFEncoder) encodeAMF3(w io.Writer, v interface{}) error {
+	if e.strings == nil {
+		e.strings = map[string]int{}
+		e.objects = map[uintptr]int{}
+		e.traits = map[string]int{}
+	}
+	switch v := v.(type) {
+	case nil:
+		_, err := w.Write([]byte{amf3Null})
+		return err
+	case bool:
+		if v {
+			_, err := w.Write([]byte{amf3True})
+			return err
+		}
+		_, err := w.Write([]byte{amf3False})
+		return err
+	case string:
+		if _, err := w.Write([]byte{amf3String}); err != nil {
+			return err
+		}
+		return e.writeAMF3String(w, v)
+	case AMFXMLDocument:
+		e.count++
+		if _, err := w.Write([]byte{amf3XMLDoc}); err != nil {
+			return err
+		}
+		if err := writeU29(w, uint32(len(v))<<1|1); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, string(v))
+		return err
+	case time.Time:
+		e.count++
+		if _, err := w.Write([]byte{amf3Date, 0x01}); err != nil {
+			return err
+		}
+		return writeDouble(w, amfMillis(v))
+	case []byte:
+		e.count++
+		if _, err := w.Write([]byte{amf3ByteArray}); err != nil {
+			return err
+		}
+		if err := writeU29(w, uint32(len(v))<<1|1); err != nil {
+			return err
+		}
+		_, err := w.Write(v)
+		return err
+	case AMFArray:
+		e.count++
+		if _, err := w.Write([]byte{amf3Array}); err != nil {
+			return err
+		}
+		// The associative portion is always empty
+		if err := writeU29(w, uint32(len(v))<<1|1); err != nil {
+			return err
+		}
+		if err := e.writeAMF3String(w, ""); err != nil {
+			return err
+		}
+		for _, x := range v {
+			if err := e.encodeAMF3(w, x); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		return e.encodeAMF3(w, AMFArray(v))
+	case AMFECMAArray:
+		if _, err := w.Write([]byte{amf3Array}); err != nil {
+			return err
+		}
+		if ok, err := e.writeAMF3Ref(w, v); ok || err != nil {
+			return err
+		}
+		// The dense portion is always empty
+		if err := writeU29(w, 1); err != nil {
+			return err
+		}
+		return e.writeAMF3Members(w, v)
+	case AMFObject:
+		if _, err := w.Write([]byte{amf3Object}); err != nil {
+			return err
+		}
+		if ok, err := e.writeAMF3Ref(w, v); ok || err != nil {
+			return err
+		}
+		err := e.writeAMF3Trait(w, amf3Trait{dynamic: true})
+		if err != nil {
+			return err
+		}
+		return e.writeAMF3Members(w, v)
+	case map[string]interface{}:
+		return e.encodeAMF3(w, AMFObject(v))
+	case *AMFTypedObject:
+		if _, err := w.Write([]byte{amf3Object}); err != nil {
+			return err
+		}
+		if ok, err := e.writeAMF3Ref(w, v); ok || err != nil {
+			return err
+		}
+		trait := amf3Trait{class: v.Type, members: sortedKeys(v.Object)}
+		if err := e.writeAMF3Trait(w, trait); err != nil {
+			return err
+		}
+		for _, member := range trait.members {
+			if err := e.encodeAMF3(w, v.Object[member]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case AMFTypedObject:
+		return e.encodeAMF3(w, &v)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := rv.Int(); i >= amf3IntegerMinimum && i <= amf3IntegerMaximum {
+			return e.writeAMF3Integer(w, uint32(i))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i := rv.Uint(); i <= amf3IntegerMaximum {
+			return e.writeAMF3Integer(w, uint32(i))
+		}
+	}
+	if f, ok := amfNumber(v); ok {
+		if _, err := w.Write([]byte{amf3Double}); err != nil {
+			return err
+		}
+		return writeDouble(w, f)
+	}
+	return fmt.Errorf("%w: amf3 %T", errAMFUnsupported, v)
+}
+
+func (e *AMFEncoder) writeAMF3Integer(w io.Writer, i uint32) error {
+	if _, err := w.Write([]byte{amf3Integer}); err != nil {
+		return err
+	}
+	return writeU29(w, i&amf3U29Maximum)
+}
+
+// writeAMF3String will write a string without a marker, or a
+// reference to a string that has already been written.
+func (e *AMFEncoder) writeAMF3String(w io.Writer, s string) error {
+	if i, ok := e.strings[s]; ok {
+		return writeU29(w, uint32(i)<<1)
+	}
+	if s != "" {
+		e.strings[s] = len(e.strings)
+	}
+	if err := writeU29(w, uint32(len(s))<<1|1); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// writeAMF3Ref will write a reference to an object that has already
+// been written, and will return true. Otherwise the object is added
+// to the reference table.
+func (e *AMFEncoder) writeAMF3Ref(w io.Writer, v interface{}) (bool, error) {
+	ptr := reflect.ValueOf(v).Pointer()
+	if i, ok := e.objects[ptr]; ok {
+		return true, writeU29(w, uint32(i)<<1)
+	}
+	e.objects[ptr] = e.count
+	e.count++
+	return false, nil
+}
+
+// writeAMF3Trait will write the traits of an object, or a reference
+// to traits that have already been written.
+func (e *AMFEncoder) writeAMF3Trait(w io.Writer, trait amf3Trait) error {
+	key := fmt.Sprintf("%s/%t/%s", trait.class, trait.dynamic, strings.Join(trait.members, ","))
+	if i, ok := e.traits[key]; ok {
+		return writeU29(w, uint32(i)<<2|1)
+	}
+	e.traits[key] = len(e.traits)
+	u := uint32(len(trait.members))<<4 | 0x03
+	if trait.dynamic {
+		u |= 0x08
+	}
+	if err := writeU29(w, u); err != nil {
+		return err
+	}
+	if err := e.writeAMF3String(w, trait.class); err != nil {
+		return err
+	}
+	for _, member := range trait.members {
+		if err := e.writeAMF3String(w, member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAMF3Members will write the dynamic members of an object or
+// the associative members of an array, and the empty string.
+func (e *AMFEncoder) writeAMF3Members(w io.Writer, obj map[string]interface{}) error {
+	for _, k := range sortedKeys(obj) {
+		if k == "" {
+			continue
+		}
+		if err := e.writeAMF3String(w, k); err != nil {
+			return err
+		}
+		if err := e.encodeAMF3(w, obj[k]); err != nil {
+			return err
+		}
+	}
+	return e.writeAMF3String(w, "")
+}
+
+// readU29 will read a variable length 29 bit integer.
+// AMF3 Specification 1.3.1
+func readU29(r io.Reader) (uint32, error) {
+	var u uint32
+	for i := 0; i < 4; i++ {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		if i == 3 {
+			return u<<8 | uint32(b), nil
+		}
+		u = u<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			return u, nil
+		}
+	}
+	return u, nil
+}
+
+func writeU29(w io.Writer, u uint32) error {
+	var b []byte
+	switch {
+	case u < 0x80:
+		b = []byte{byte(u)}
+	case u < 0x4000:
+		b = []byte{byte(u>>7) | 0x80, byte(u & 0x7f)}
+	case u < 0x200000:
+		b = []byte{byte(u>>14) | 0x80, byte(u>>7) | 0x80, byte(u & 0x7f)}
+	case u <= amf3U29Maximum:
+		b = []byte{byte(u>>22) | 0x80, byte(u>>15) | 0x80, byte(u>>8) | 0x80, byte(u)}
+	default:
+		return fmt.Errorf("amf3 integer %d exceeds 29 bits", u)
+	}
+	_, err := w.Write(b)
+	return err
+}
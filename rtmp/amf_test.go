@@ -0,0 +1,455 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The raw AMF0 helpers build fixtures without the encoder.
+
+func rawString(s string) []byte {
+	b := []byte{amf0String, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(s)))
+	return append(b, s...)
+}
+
+func rawNumber(f float64) []byte {
+	b := make([]byte, 9)
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+	return b
+}
+
+func rawNull() []byte {
+	return []byte{amf0Null}
+}
+
+// rawObject will build an object from key and raw value pairs.
+func rawObject(marker byte, pairs ...interface{}) []byte {
+	b := []byte{marker}
+	if marker == amf0ECMAArray {
+		b = append(b, 0, 0, 0, byte(len(pairs)/2))
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		key := pairs[i].(string)
+		b = append(b, byte(len(key)>>8), byte(len(key)))
+		b = append(b, key...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return append(b, 0, 0, amf0ObjectEnd)
+}
+
+func concat(values ...[]byte) []byte {
+	return bytes.Join(values, nil)
+}
+
+// TestAMFCapturedCommands will round trip the commands in the
+// captures of OBS publishing to Nginx in docs/bug-publish-response.md.
+//
+// Each capture is the size of the frame on the loopback interface,
+// which is 66 bytes of Ethernet, IP and TCP headers, the chunk header
+// and the AMF0 payload.
+func TestAMFCapturedCommands(t *testing.T) {
+	const frameOverhead = 66
+	tests := []struct {
+		capture string
+		frame   int
+		header  int
+		raw     []byte
+		values  []interface{}
+	}{
+		{
+			capture: "connect('twinx')",
+			frame:   252,
+			header:  12,
+			raw: concat(rawString("connect"), rawNumber(1), rawObject(amf0Object,
+				"app", rawString("twinx"),
+				"type", rawString("nonprivate"),
+				"flashVer", rawString("FMLE/3.0 (compatible; FMSc/1.0)"),
+				"swfUrl", rawString("rtmp://localhost:1935/twinx"),
+				"tcUrl", rawString("rtmp://localhost:1935/twinx"),
+			)),
+			values: []interface{}{"connect", 1.0, AMFObject{
+				"app":      "twinx",
+				"type":     "nonprivate",
+				"flashVer": "FMLE/3.0 (compatible; FMSc/1.0)",
+				"swfUrl":   "rtmp://localhost:1935/twinx",
+				"tcUrl":    "rtmp://localhost:1935/twinx",
+			}},
+		},
+		{
+			capture: "_result('NetConnection.Connect.Success')",
+			frame:   268,
+			header:  12,
+			raw: concat(rawString("_result"), rawNumber(1), rawObject(amf0Object,
+				"fmsVer", rawString("FMS/3,0,1,123"),
+				"capabilities", rawNumber(31),
+			), rawObject(amf0Object,
+				"level", rawString("status"),
+				"code", rawString("NetConnection.Connect.Success"),
+				"description", rawString("Connection succeeded."),
+				"objectEncoding", rawNumber(0),
+			)),
+			values: []interface{}{"_result", 1.0, AMFObject{
+				"fmsVer":       "FMS/3,0,1,123",
+				"capabilities": 31.0,
+			}, AMFObject{
+				"level":          "status",
+				"code":           "NetConnection.Connect.Success",
+				"description":    "Connection succeeded.",
+				"objectEncoding": 0.0,
+			}},
+		},
+		{
+			capture: "releaseStream('1234')",
+			frame:   107,
+			header:  8,
+			raw:     concat(rawString("releaseStream"), rawNumber(2), rawNull(), rawString("1234")),
+			values:  []interface{}{"releaseStream", 2.0, nil, "1234"},
+		},
+		{
+			capture: "FCPublish('1234')",
+			frame:   103,
+			header:  8,
+			raw:     concat(rawString("FCPublish"), rawNumber(3), rawNull(), rawString("1234")),
+			values:  []interface{}{"FCPublish", 3.0, nil, "1234"},
+		},
+		{
+			capture: "createStream()",
+			frame:   99,
+			header:  8,
+			raw:     concat(rawString("createStream"), rawNumber(4), rawNull()),
+			values:  []interface{}{"createStream", 4.0, nil},
+		},
+		{
+			capture: "_result()",
+			frame:   107,
+			header:  12,
+			raw:     concat(rawString("_result"), rawNumber(4), rawNull(), rawNumber(1)),
+			values:  []interface{}{"_result", 4.0, nil, 1.0},
+		},
+		{
+			capture: "publish('1234')",
+			frame:   112,
+			header:  12,
+			raw:     concat(rawString("publish"), rawNumber(5), rawNull(), rawString("1234"), rawString("live")),
+			values:  []interface{}{"publish", 5.0, nil, "1234", "live"},
+		},
+		{
+			capture: "onStatus('NetStream.Publish.Start')",
+			frame:   183,
+			header:  12,
+			raw: concat(rawString("onStatus"), rawNumber(0), rawNull(), rawObject(amf0Object,
+				"level", rawString("status"),
+				"code", rawString("NetStream.Publish.Start"),
+				"description", rawString("Start publishing"),
+			)),
+			values: []interface{}{"onStatus", 0.0, nil, AMFObject{
+				"level":       "status",
+				"code":        "NetStream.Publish.Start",
+				"description": "Start publishing",
+			}},
+		},
+		{
+			capture: "FCUnpublish()",
+			frame:   105,
+			header:  8,
+			raw:     concat(rawString("FCUnpublish"), rawNumber(6), rawNull(), rawString("1234")),
+			values:  []interface{}{"FCUnpublish", 6.0, nil, "1234"},
+		},
+		{
+			capture: "deleteStream()",
+			frame:   108,
+			header:  8,
+			raw:     concat(rawString("deleteStream"), rawNumber(7), rawNull(), rawNumber(1)),
+			values:  []interface{}{"deleteStream", 7.0, nil, 1.0},
+		},
+		{
+			capture: "onStatus('NetStream.Unpublish.Success')",
+			frame:   186,
+			header:  12,
+			raw: concat(rawString("onStatus"), rawNumber(0), rawNull(), rawObject(amf0Object,
+				"level", rawString("status"),
+				"code", rawString("NetStream.Unpublish.Success"),
+				"description", rawString("Stop publishing"),
+			)),
+			values: []interface{}{"onStatus", 0.0, nil, AMFObject{
+				"level":       "status",
+				"code":        "NetStream.Unpublish.Success",
+				"description": "Stop publishing",
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.capture, func(t *testing.T) {
+			at := assert.New(t)
+			at.Equal(test.frame, frameOverhead+test.header+len(test.raw), "fixture does not match the captured frame")
+
+			values, err := DecodeAMF(test.raw, AMF0)
+			at.NoError(err)
+			at.Equal(test.values, values)
+
+			// Keys are sorted when encoding, so compare the length
+			// and the decoded values rather than the bytes.
+			encoded, err := EncodeAMF(AMF0, values...)
+			at.NoError(err)
+			at.Equal(len(test.raw), len(encoded))
+			values, err = DecodeAMF(encoded, AMF0)
+			at.NoError(err)
+			at.Equal(test.values, values)
+		})
+	}
+}
+
+// TestAMFMetaData will round trip the onMetaData ECMA array
+// sent by OBS.
+func TestAMFMetaData(t *testing.T) {
+	at := assert.New(t)
+	raw := concat(rawString(SetDataFrame), rawString(OnMetaData), rawObject(amf0ECMAArray,
+		"duration", rawNumber(0),
+		"fileSize", rawNumber(0),
+		"width", rawNumber(1280),
+		"height", rawNumber(720),
+		"videocodecid", rawNumber(7),
+		"videodatarate", rawNumber(2500),
+		"framerate", rawNumber(30),
+		"audiocodecid", rawNumber(10),
+		"audiodatarate", rawNumber(160),
+		"audiosamplerate", rawNumber(48000),
+		"audiosamplesize", rawNumber(16),
+		"audiochannels", rawNumber(2),
+		"stereo", []byte{amf0Boolean, 1},
+		"2.1", []byte{amf0Boolean, 0},
+		"encoder", rawString("obs-output module (libobs version 27.0.1-3)"),
+	))
+	values, err := DecodeAMF(raw, AMF0)
+	at.NoError(err)
+	at.Len(values, 3)
+	metaData, ok := values[2].(AMFECMAArray)
+	at.True(ok, "expected an ECMA array, got %T", values[2])
+	at.Equal(1280.0, metaData["width"])
+	at.Equal(true, metaData["stereo"])
+
+	md, err := MetaDataMapToInstance(values[2])
+	at.NoError(err)
+	at.Equal(720, md.Height)
+	at.Equal("obs-output module (libobs version 27.0.1-3)", md.Encoder)
+
+	encoded, err := EncodeAMF(AMF0, values...)
+	at.NoError(err)
+	at.Equal(len(raw), len(encoded))
+	again, err := DecodeAMF(encoded, AMF0)
+	at.NoError(err)
+	at.Equal(values, again)
+
+	// @setDataFrame is removed for play clients, and added back
+	data, err := removeSetDataFrame(raw)
+	at.NoError(err)
+	at.Equal(raw[3+len(SetDataFrame):], data)
+	data, err = addSetDataFrame(data)
+	at.NoError(err)
+	at.Equal(raw, data)
+}
+
+func TestAMF0Types(t *testing.T) {
+	at := assert.New(t)
+	date := time.Date(2021, 10, 14, 12, 45, 0, 0, time.UTC)
+	values := []interface{}{
+		AMFArray{1.0, "two", nil, true},
+		date,
+		strings.Repeat("x", amf0StringMaximumBytes+1),
+		&AMFTypedObject{Type: "twinx.Stream", Object: AMFObject{"name": "camera"}},
+		AMFXMLDocument("<twinx/>"),
+		AMFObject{"nested": AMFECMAArray{"key": AMFObject{}}},
+	}
+	encoded, err := EncodeAMF(AMF0, values...)
+	at.NoError(err)
+	at.Equal(amf0LongString, encoded[bytes.Index(encoded, []byte("xxx"))-5])
+	decoded, err := DecodeAMF(encoded, AMF0)
+	at.NoError(err)
+	at.Equal(values, decoded)
+}
+
+func TestAMF0Reference(t *testing.T) {
+	at := assert.New(t)
+	raw := concat(
+		rawObject(amf0Object, "app", rawString("twinx")),
+		rawObject(amf0Object, "first", []byte{amf0Reference, 0, 0}),
+	)
+	values, err := DecodeAMF(raw, AMF0)
+	at.NoError(err)
+	at.Equal(AMFObject{"first": AMFObject{"app": "twinx"}}, values[1])
+
+	_, err = DecodeAMF([]byte{amf0Reference, 0, 1}, AMF0)
+	at.Error(err)
+}
+
+// TestAMF3Connect will decode a connect command from a client that
+// connects with objectEncoding 3, with the command object in AMF3.
+func TestAMF3Connect(t *testing.T) {
+	at := assert.New(t)
+	raw := concat([]byte{0}, rawString("connect"), rawNumber(1), []byte{
+		amf0AVMPlus, amf3Object, 0x0b, 0x01,
+		0x07, 'a', 'p', 'p', amf3String, 0x0b, 't', 'w', 'i', 'n', 'x',
+		0x1d, 'o', 'b', 'j', 'e', 'c', 't', 'E', 'n', 'c', 'o', 'd', 'i', 'n', 'g', amf3Integer, 0x03,
+		0x01,
+	})
+	x := &ChunkStream{TypeID: CommandMessageAMF3ID, Data: raw}
+	values, err := DecodeAMF(amfPayload(x), AMF0)
+	at.NoError(err)
+	at.Equal([]interface{}{"connect", 1.0, AMFObject{"app": "twinx", "objectEncoding": 3}}, values)
+
+	info, err := ConnectInfoMapToInstance(values[2])
+	at.NoError(err)
+	at.Equal(int(AMF3), info.ObjectEncoding)
+	at.Equal("twinx", info.App)
+}
+
+// TestAMF3References will decode string, trait and object references,
+// and encode the same references.
+func TestAMF3References(t *testing.T) {
+	at := assert.New(t)
+	raw := []byte{
+		amf3Array, 0x09, 0x01,
+		// A typed object with one sealed member
+		amf3Object, 0x13, 0x0b, 'P', 'o', 'i', 'n', 't', 0x03, 'x', amf3Integer, 0x01,
+		// A second object with the same traits
+		amf3Object, 0x01, amf3Integer, 0x02,
+		// The first object again
+		amf3Object, 0x02,
+		// The class name again
+		amf3String, 0x00,
+	}
+	values, err := DecodeAMF(raw, AMF3)
+	at.NoError(err)
+	arr, ok := values[0].(AMFArray)
+	at.True(ok, "expected array, got %T", values[0])
+	at.Len(arr, 4)
+	at.Equal(&AMFTypedObject{Type: "Point", Object: AMFObject{"x": 1}}, arr[0])
+	at.Equal(&AMFTypedObject{Type: "Point", Object: AMFObject{"x": 2}}, arr[1])
+	at.True(arr[0] == arr[2], "expected the same object")
+	at.Equal("Point", arr[3])
+
+	encoded, err := EncodeAMF(AMF3, arr)
+	at.NoError(err)
+	at.Equal(raw, encoded)
+}
+
+func TestAMF3Types(t *testing.T) {
+	at := assert.New(t)
+	date := time.Date(2021, 10, 14, 12, 45, 0, 0, time.UTC)
+	values := []interface{}{
+		nil, true, false,
+		-1, amf3IntegerMaximum, amf3IntegerMinimum, 1.5,
+		"twinx", "",
+		date,
+		[]byte{0x01, 0x02},
+		AMFArray{1, "twinx"},
+		AMFECMAArray{"width": 1280, "codec": "twinx"},
+		AMFObject{"nested": AMFObject{"name": "twinx"}},
+		AMFXMLDocument("<twinx/>"),
+	}
+	encoded, err := EncodeAMF(AMF3, values...)
+	at.NoError(err)
+	decoded, err := DecodeAMF(encoded, AMF3)
+	at.NoError(err)
+	at.Equal(values, decoded)
+
+	// Integers beyond 29 bits are doubles
+	encoded, err = EncodeAMF(AMF3, amf3IntegerMaximum+1)
+	at.NoError(err)
+	at.Equal(amf3Double, encoded[0])
+}
+
+// A []byte has no AMF0 type, and is switched to AMF3.
+func TestAMF0SwitchToAMF3(t *testing.T) {
+	at := assert.New(t)
+	encoded, err := EncodeAMF(AMF0, "bytes", []byte{0xff})
+	at.NoError(err)
+	at.Equal(concat(rawString("bytes"), []byte{amf0AVMPlus, amf3ByteArray, 0x03, 0xff}), encoded)
+	decoded, err := DecodeAMF(encoded, AMF0)
+	at.NoError(err)
+	at.Equal([]interface{}{"bytes", []byte{0xff}}, decoded)
+}
+
+func TestAMF3U29(t *testing.T) {
+	at := assert.New(t)
+	for _, u := range []uint32{0, 0x7f, 0x80, 0x3fff, 0x4000, 0x1fffff, 0x200000, amf3U29Maximum} {
+		b := &bytes.Buffer{}
+		at.NoError(writeU29(b, u))
+		got, err := readU29(b)
+		at.NoError(err)
+		at.Equal(u, got)
+	}
+	at.Error(writeU29(&bytes.Buffer{}, amf3U29Maximum+1))
+}
+
+func TestAMFTruncated(t *testing.T) {
+	raw := concat(rawString("connect"), rawNumber(1))
+	for i := 1; i < len(raw); i++ {
+		if i == 10 {
+			// The end of the first value
+			continue
+		}
+		if _, err := DecodeAMF(raw[:i], AMF0); err == nil {
+			t.Errorf("expected error decoding %d of %d bytes", i, len(raw))
+		}
+	}
+}
+
+// A server will respond to an AMF3 client with AMF3 command messages.
+func TestServerConnWriteMsgAMF3(t *testing.T) {
+	at := assert.New(t)
+	buf := &bytes.Buffer{}
+	s := NewServerConn(&Conn{
+		rw:        NewReadWriter(buf, 1024),
+		chunkSize: DefaultRTMPChunkSizeBytes,
+	})
+	s.connectInfo = &ConnectInfo{ObjectEncoding: int(AMF3)}
+	at.NoError(s.writeMsg(3, 0, CommandType_Result, 1, nil))
+	s.Flush()
+
+	reader := &Conn{
+		pool:      NewPool(),
+		rw:        NewReadWriter(buf, 1024),
+		chunkSize: DefaultRTMPChunkSizeBytes,
+		chunks:    make(map[uint32]ChunkStream),
+	}
+	var x ChunkStream
+	at.NoError(reader.Read(&x))
+	at.Equal(CommandMessageAMF3ID, x.TypeID)
+	at.Equal(byte(0), x.Data[0])
+	values, err := DecodeAMF(amfPayload(&x), AMF0)
+	at.NoError(err)
+	at.Equal([]interface{}{CommandType_Result, 1.0, nil}, values)
+}
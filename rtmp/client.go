@@ -26,17 +26,64 @@
 
 package rtmp
 
+import (
+	"crypto/tls"
+	"time"
+)
+
 type Client struct {
-	conn *ClientConn
+	conn           *ClientConn
+	tlsConfig      *tls.Config
+	writeQueueSize int
+	overflowPolicy OverflowPolicy
+	aggregateAudio bool
+	pingInterval   time.Duration
+	delay          time.Duration
 }
 
 func NewClient() *Client {
-	return &Client{}
+	return &Client{
+		pingInterval: DefaultPingInterval,
+	}
+}
+
+// SetTLSConfig will override the TLS configuration used to Dial() rtmps:// addresses.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+// SetWriteQueueSize will set the number of packets queued for this client
+// when it is used as a proxy destination.
+func (c *Client) SetWriteQueueSize(size int) {
+	c.writeQueueSize = size
+}
+
+// SetOverflowPolicy will set what happens when this client is used as a proxy
+// destination and is unable to keep up with the stream.
+func (c *Client) SetOverflowPolicy(policy OverflowPolicy) {
+	c.overflowPolicy = policy
+}
+
+// SetAggregateAudio will write queued audio as aggregate messages when this
+// client is used as a proxy destination.
+func (c *Client) SetAggregateAudio(aggregate bool) {
+	c.aggregateAudio = aggregate
+}
+
+// SetPingInterval will set how often a PingRequest is sent when this client
+// is used as a proxy destination. An interval of 0 will never ping.
+func (c *Client) SetPingInterval(interval time.Duration) {
+	c.pingInterval = interval
+}
+
+// SetDelay will hold the stream for delay before it is written, when this
+// client is used as a proxy destination.
+func (c *Client) SetDelay(delay time.Duration) {
+	c.delay = delay
 }
 
 func (c *Client) Dial(address string) error {
-	clientConn := NewClientConn()
-	err := clientConn.Dial(address)
+	clientConn, err := c.dial(address)
 	if err != nil {
 		return err
 	}
@@ -44,6 +91,22 @@ func (c *Client) Dial(address string) error {
 	return nil
 }
 
+// dial will return a new ClientConn for the address with the
+// configuration of the client, without replacing Client().
+func (c *Client) dial(address string) (*ClientConn, error) {
+	clientConn := NewClientConn()
+	clientConn.SetTLSConfig(c.tlsConfig)
+	err := clientConn.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	clientConn.conn.SetWriteQueueSize(c.writeQueueSize)
+	clientConn.conn.SetOverflowPolicy(c.overflowPolicy)
+	clientConn.conn.SetAggregateAudio(c.aggregateAudio)
+	clientConn.conn.SetDelay(c.delay)
+	return clientConn, nil
+}
+
 func (c *Client) Play() error {
 	err := c.conn.Play()
 	if err != nil {
@@ -41,13 +41,12 @@ package rtmp
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 
-	"github.com/gwuhaolin/livego/av"
-
-	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/kris-nova/logger"
 )
 
@@ -64,17 +63,22 @@ type ClientConn struct {
 	// This will be sent during Publish()
 	virtualMetaData *MetaData
 
-	encoder *amf.Encoder
-	decoder *amf.Decoder
-	bytesw  *bytes.Buffer
+	// tlsConfig is used to dial rtmps:// addresses.
+	// If nil the default URLAddr.TLSConfig() is used.
+	tlsConfig *tls.Config
+
+	decoder *AMFDecoder
+
+	// streaming is set by StreamBegin, and cleared by StreamEOF.
+	// recorded is set by StreamIsRecorded.
+	streaming bool
+	recorded  bool
 }
 
 func NewClientConn() *ClientConn {
 	return &ClientConn{
 		transID: 1,
-		bytesw:  bytes.NewBuffer(nil),
-		encoder: &amf.Encoder{},
-		decoder: &amf.Decoder{},
+		decoder: &AMFDecoder{},
 	}
 }
 
@@ -84,7 +88,7 @@ func (cc *ClientConn) Dial(address string) error {
 		return fmt.Errorf("client dial: %v", err)
 	}
 	logger.Info(rtmpMessage(fmt.Sprintf("client.Dial %s", urlAddr.Host()), conn))
-	conn, err := urlAddr.NewConn()
+	conn, err := urlAddr.NewConnTLS(cc.tlsConfig)
 	if err != nil {
 		return fmt.Errorf("new conn from addr: %v", err)
 	}
@@ -94,15 +98,40 @@ func (cc *ClientConn) Dial(address string) error {
 	return nil
 }
 
+// SetTLSConfig will override the TLS configuration used to Dial() rtmps:// addresses.
+func (cc *ClientConn) SetTLSConfig(config *tls.Config) {
+	cc.tlsConfig = config
+}
+
 // Publish will hang and attempt to start a Publish stream
 // with a configured server.
 func (cc *ClientConn) Publish() error {
-	cc.method = ClientMethodPlay
+	err := cc.publishStart()
+	if err != nil {
+		return err
+	}
+
+	err = cc.RoutePackets()
+	if err != nil {
+		logger.Critical(err.Error())
+	}
+
+	return nil
+}
+
+// publishStart will handshake, connect, and publish to the configured
+// server. Packets can be written to the conn once publishStart returns.
+func (cc *ClientConn) publishStart() error {
+	cc.method = ClientMethodPublish
 	logger.Info(rtmpMessage("client.Publish", pub))
 	err := cc.initialTX()
 	if err != nil {
 		return err
 	}
+	err = cc.Flush()
+	if err != nil {
+		return err
+	}
 
 	// Read until the server is connected
 	for !cc.connected {
@@ -121,13 +150,26 @@ func (cc *ClientConn) Publish() error {
 	if err != nil {
 		return err
 	}
+	return cc.Flush()
+}
 
-	err = cc.RoutePackets()
+// Unpublish will tell the server the stream has ended, and
+// close the connection.
+func (cc *ClientConn) Unpublish() error {
+	defer cc.Close()
+	logger.Info(rtmpMessage("client.Unpublish", stop))
+
+	// Never hang on a remote that has stopped reading
+	cc.conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
+	_, err := cc.oosFCUnpublishTX()
 	if err != nil {
-		logger.Critical(err.Error())
+		return err
 	}
-
-	return nil
+	_, err = cc.deleteStreamTX()
+	if err != nil {
+		return err
+	}
+	return cc.Flush()
 }
 
 // Play will attempt to start a Play stream
@@ -143,6 +185,10 @@ func (cc *ClientConn) Play() error {
 	if err != nil {
 		return err
 	}
+	err = cc.Flush()
+	if err != nil {
+		return err
+	}
 
 	err = cc.RoutePackets()
 	if err != nil {
@@ -158,10 +204,8 @@ func (cc *ClientConn) RoutePackets() error {
 	for {
 		x, err = cc.NextChunk()
 		if err != nil {
-			if err != WellKnownClosedClientError {
-				return err
-			}
-			continue
+			// The server has closed the connection
+			return err
 		}
 		err = cc.Route(x)
 		if err != nil {
@@ -173,7 +217,6 @@ func (cc *ClientConn) RoutePackets() error {
 		}
 		//fmt.Println("Boops....")
 	}
-	return nil
 }
 
 func (cc *ClientConn) Route(x *ChunkStream) error {
@@ -186,7 +229,7 @@ func (cc *ClientConn) Route(x *ChunkStream) error {
 	case AbortMessageID:
 		logger.Critical("unsupported messageID: %s", typeIDString(x))
 	case AcknowledgementMessageID:
-		panic("ackMessage")
+		logger.Debug(rtmpMessage(typeIDString(x), rx))
 	case WindowAcknowledgementSizeMessageID:
 		size := binary.BigEndian.Uint32(x.Data)
 		logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s [%d]", thisFunctionName(), "WindowAckSize", size), rx))
@@ -208,12 +251,16 @@ func (cc *ClientConn) Route(x *ChunkStream) error {
 		return cc.handleUserControl(x)
 	case CommandMessageAMF0ID, CommandMessageAMF3ID:
 		logger.Debug(rtmpMessage(typeIDString(x), rx))
-		xReader := bytes.NewReader(x.Data)
-		values, err := cc.LogDecodeBatch(xReader, amf.AMF0)
-		if err != nil && err != io.EOF {
+		xReader := bytes.NewReader(amfPayload(x))
+		values, err := cc.LogDecodeBatch(xReader, AMF0)
+		if err != nil {
 			return fmt.Errorf("decoding bytes from play(%s) client: %v", cc.urladdr.SafeURL(), err)
 		}
 		x.batchedValues = values
+		err = commandError(values)
+		if err != nil {
+			return err
+		}
 		for k, v := range values {
 			switch v.(type) {
 			case string:
@@ -259,8 +306,8 @@ func (cc *ClientConn) Route(x *ChunkStream) error {
 						return fmt.Errorf("invalid publish")
 					}
 				}
-			case amf.Object:
-				entity := v.(amf.Object)
+			case AMFObject:
+				entity := v.(AMFObject)
 				switch cc.curcmdName {
 				case CommandConnect:
 					code, ok := entity[ConnEventCode]
@@ -270,7 +317,7 @@ func (cc *ClientConn) Route(x *ChunkStream) error {
 				case CommandPublish:
 					code, ok := entity[ConnEventCode]
 					if ok && code.(string) != CommandNetStreamPublishStart {
-						return fmt.Errorf("publish error: %d", code)
+						return fmt.Errorf("publish error: %v", code)
 					}
 				}
 			}
@@ -285,7 +332,17 @@ func (cc *ClientConn) Route(x *ChunkStream) error {
 	case VideoMessageID:
 		logger.Critical("unsupported messageID: %s", typeIDString(x))
 	case AggregateMessageID:
-		logger.Critical("unsupported messageID: %s", typeIDString(x))
+		logger.Debug(rtmpMessage(typeIDString(x), rx))
+		subs, err := splitAggregate(x)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			err = cc.Route(sub)
+			if err != nil {
+				return err
+			}
+		}
 	default:
 		logger.Critical("unsupported messageID: %s", typeIDString(x))
 	}
@@ -293,13 +350,25 @@ func (cc *ClientConn) Route(x *ChunkStream) error {
 }
 
 func (cc *ClientConn) handleUserControl(x *ChunkStream) error {
-	logger.Debug(rtmpMessage("handleUserControl", rx))
-	if x.Length == UserMessagePingRequest {
-		logger.Debug(rtmpMessage("handleUserControl.PingResponse", tx))
-		tx := newChunkStream(UserControlMessageID, 6, UserMessagePingResponse)
-		return cc.Write(tx)
+	event, err := cc.conn.handleUserControl(x)
+	if err != nil {
+		return err
+	}
+	switch event.Type {
+	case StreamBegin:
+		cc.streaming = true
+	case StreamEOF:
+		logger.Info(rtmpMessage(fmt.Sprintf("%s stream %d ended", cc.urladdr.SafeURL(), event.StreamID), stop))
+		cc.streaming = false
+	case StreamDry:
+		logger.Debug(rtmpMessage(fmt.Sprintf("%s stream %d has no data", cc.urladdr.SafeURL(), event.StreamID), warn))
+	case StreamIsRecorded:
+		cc.recorded = true
+	case UserMessagePingResponse:
+		M().Lock()
+		P(cc.conn.ID()).ProxyRTT = cc.conn.RTT()
+		M().Unlock()
 	}
-
 	return nil
 }
 
@@ -334,7 +403,7 @@ func (cc *ClientConn) sendMetaData() error {
 		return nil
 	}
 	logger.Debug(rtmpMessage("sendMetaData", tx))
-	md := make(amf.Object)
+	md := make(AMFECMAArray)
 	// //2021-10-13T10:48:38-07:00 [Debug     ]    [2] (map[2.1:false 3.1:false 4.0:false 4.1:false 5.1:false 7.1:false
 	// audiochannels:2 audiocodecid:10 audiodatarate:160 audiosamplerate:48000 audiosamplesize:16 duration:0
 	// encoder:obs-output module (libobs version 27.0.1-3) fileSize:0 framerate:30 height:720 stereo:true
@@ -365,7 +434,7 @@ func (cc *ClientConn) sendMetaData() error {
 
 // ==========================================================================================
 
-func (cc *ClientConn) LogDecodeBatch(r io.Reader, ver amf.Version) (ret []interface{}, err error) {
+func (cc *ClientConn) LogDecodeBatch(r io.Reader, ver AMFVersion) (ret []interface{}, err error) {
 	vs, err := cc.decoder.DecodeBatch(r, ver)
 	//for k, v := range vs {
 	//	logger.Debug("  [%+v] (%+v)", k, v)
@@ -374,10 +443,10 @@ func (cc *ClientConn) LogDecodeBatch(r io.Reader, ver amf.Version) (ret []interf
 }
 
 func (cc *ClientConn) Write(c *ChunkStream) error {
-	if c.TypeID == av.TAG_SCRIPTDATAAMF0 ||
-		c.TypeID == av.TAG_SCRIPTDATAAMF3 {
+	if c.TypeID == TAG_SCRIPTDATAAMF0 ||
+		c.TypeID == TAG_SCRIPTDATAAMF3 {
 		var err error
-		if c.Data, err = amf.MetaDataReform(c.Data, amf.ADD); err != nil {
+		if c.Data, err = addSetDataFrame(c.Data); err != nil {
 			return err
 		}
 		c.Length = uint32(len(c.Data))
@@ -407,14 +476,28 @@ func (cc *ClientConn) Close() {
 	cc.conn.Close()
 }
 
+// commandError will return the error sent by the server in an _error
+// response, or an error onStatus, such as NetStream.Play.StreamNotFound.
+func commandError(values []interface{}) error {
+	if len(values) < 4 {
+		return nil
+	}
+	event, ok := values[3].(AMFObject)
+	if !ok || event[ConnEventLevel] != ConnEventError {
+		return nil
+	}
+	return fmt.Errorf("%v: %v: %v", values[0], event[ConnEventCode], event[ConnEventDescription])
+}
+
 func (cc *ClientConn) writeMsg(args ...interface{}) (*ChunkStream, error) {
-	cc.bytesw.Reset()
-	for _, v := range args {
-		if _, err := cc.encoder.Encode(cc.bytesw, v, amf.AMF0); err != nil {
-			return nil, err
-		}
+	// Every message is encoded into its own buffer, so the data of a
+	// ChunkStream is never overwritten by the next command.
+	bytesw := bytes.NewBuffer(nil)
+	encoder := &AMFEncoder{}
+	if err := encoder.EncodeBatch(bytesw, AMF0, args...); err != nil {
+		return nil, err
 	}
-	msg := cc.bytesw.Bytes()
+	msg := bytesw.Bytes()
 	c := ChunkStream{
 		Format:    0,
 		CSID:      3,
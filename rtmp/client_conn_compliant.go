@@ -42,53 +42,15 @@ package rtmp
 import (
 	"errors"
 	"fmt"
-	"io"
-	"time"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
-
-	"github.com/gwuhaolin/livego/utils/pio"
 	"github.com/kris-nova/logger"
 )
 
 func (cc *ClientConn) handshake() error {
-	var err error
-	var random [(1 + 1536*2) * 2]byte
-	C0C1C2 := random[:1536*2+1]
-	C0 := C0C1C2[:1]
-	C0C1 := C0C1C2[:1536+1]
-	C2 := C0C1C2[1536+1:]
-	S0S1S2 := random[1536*2+1:]
-	C0[0] = 3
-	// > C0C1
-	cc.conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
-	if _, err = cc.conn.rw.Write(C0C1); err != nil {
-		return err
-	}
-	cc.conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
-	if err = cc.conn.rw.Flush(); err != nil {
-		return err
-	}
-
-	// < S0S1S2
-	cc.conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
-	if _, err = io.ReadFull(cc.conn.rw, S0S1S2); err != nil {
-		return err
-	}
-
-	S1 := S0S1S2[1 : 1536+1]
-	if ver := pio.U32BE(S1[4:8]); ver != 0 {
-		C2 = S1
-	} else {
-		C2 = S1
-	}
-
-	// > C2
-	cc.conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
-	if _, err = cc.conn.rw.Write(C2); err != nil {
+	err := cc.conn.HandshakeClient()
+	if err != nil {
 		return err
 	}
-	cc.conn.SetDeadline(time.Time{})
 	logger.Debug(rtmpMessage(thisFunctionName(), hs))
 	return nil
 }
@@ -100,7 +62,7 @@ func (cc *ClientConn) connectRX(x *ChunkStream) error {
 
 func (cc *ClientConn) connectTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	event := make(amf.Object)
+	event := make(AMFObject)
 	event[ConnInfoKeyApp] = cc.urladdr.App()
 	event[ConnInfoKeyType] = "nonprivate"
 	event[ConnInfoKeyFlashVer] = DefaultServerFMSVersion
@@ -168,7 +130,7 @@ func (cc *ClientConn) playTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
 	cc.transID++
 	cc.curcmdName = CommandPlay
-	return cc.writeMsg(CommandPlay, 0, nil, cc.urladdr.Key())
+	return cc.writeMsg(CommandPlay, 0, nil, cc.urladdr.StreamName())
 }
 
 func (cc *ClientConn) play2RX(x *ChunkStream) error {
@@ -188,7 +150,9 @@ func (cc *ClientConn) deleteStreamRX(x *ChunkStream) error {
 
 func (cc *ClientConn) deleteStreamTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	cc.transID++
+	cc.curcmdName = CommandDeleteStream
+	return cc.writeMsg(CommandDeleteStream, 0, nil, float64(cc.streamid))
 }
 
 func (cc *ClientConn) receiveAudioRX(x *ChunkStream) error {
@@ -232,8 +196,11 @@ func (cc *ClientConn) receiveVideoTX() (*ChunkStream, error) {
 func (cc *ClientConn) publishRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
 	cc.transID = int(x.batchedValues[1].(float64))
-	if len(x.batchedValues) > 2 {
+	if len(x.batchedValues) > 3 {
 		logger.Debug("%+v", x.batchedValues[3])
+		if event, ok := x.batchedValues[3].(AMFObject); ok && event[ConnEventLevel] == ConnEventError {
+			return fmt.Errorf("publish error: %v: %v", event[ConnEventCode], event[ConnEventDescription])
+		}
 	}
 	return nil
 }
@@ -288,7 +255,7 @@ func (cc *ClientConn) publishTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
 	cc.transID++
 	cc.curcmdName = CommandPublish
-	x, err := cc.writeMsg(CommandPublish, cc.transID, nil, cc.urladdr.Key(), PublishCommandLive)
+	x, err := cc.writeMsg(CommandPublish, cc.transID, nil, cc.urladdr.StreamName(), PublishCommandLive)
 	if err != nil {
 		return nil, fmt.Errorf("publish command write: %v", err)
 	}
@@ -327,7 +294,7 @@ func (cc *ClientConn) oosFCPublishRX(x *ChunkStream) error {
 func (cc *ClientConn) oosFCPublishTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
 	cc.transID++
-	return cc.writeMsg(CommandFCPublish, cc.transID, nil, cc.urladdr.Key())
+	return cc.writeMsg(CommandFCPublish, cc.transID, nil, cc.urladdr.StreamName())
 }
 
 func (cc *ClientConn) oosReleaseStreamRX(x *ChunkStream) error {
@@ -342,5 +309,17 @@ func (cc *ClientConn) oosReleaseStreamRX(x *ChunkStream) error {
 func (cc *ClientConn) oosReleaseStreamTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
 	cc.transID++
-	return cc.writeMsg(CommandReleaseStream, cc.transID, nil, cc.urladdr.Key())
+	return cc.writeMsg(CommandReleaseStream, cc.transID, nil, cc.urladdr.StreamName())
+}
+
+func (cc *ClientConn) oosFCUnpublishRX(x *ChunkStream) error {
+	logger.Debug(rtmpMessage(thisFunctionName(), rx))
+	return defaultUnimplemented()
+}
+
+func (cc *ClientConn) oosFCUnpublishTX() (*ChunkStream, error) {
+	logger.Debug(rtmpMessage(thisFunctionName(), tx))
+	cc.transID++
+	cc.curcmdName = CommandFCUnpublish
+	return cc.writeMsg(CommandFCUnpublish, cc.transID, nil, cc.urladdr.StreamName())
 }
@@ -61,6 +61,10 @@ var (
 	// verbose enables log verbosity
 	verbose bool = true
 
+	// certFile and keyFile are used to serve rtmps:// addresses
+	certFile string
+	keyFile  string
+
 	globalFlags = []cli.Flag{
 		&cli.BoolFlag{
 			Name:        "verbose",
@@ -96,7 +100,18 @@ func main() {
 				Name:    "server",
 				Aliases: []string{"s"},
 				Usage:   "Start a server that can accept client (play/publish) streams.",
-				Flags:   globalFlags,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:        "cert",
+						Usage:       `PEM certificate file used to serve "rtmps://" addresses.`,
+						Destination: &certFile,
+					},
+					&cli.StringFlag{
+						Name:        "key",
+						Usage:       `PEM private key file used to serve "rtmps://" addresses.`,
+						Destination: &keyFile,
+					},
+				}, globalFlags...),
 				Action: func(c *cli.Context) error {
 					args := c.Args()
 					var raw string
@@ -166,6 +181,9 @@ func RunServer(raw string) error {
 	go rtmp.PrintMetrics(time.Second * 5)
 
 	rtmpServer := rtmp.NewServer()
+	if certFile != "" || keyFile != "" {
+		return rtmpServer.ListenAndServeTLS(raw, certFile, keyFile)
+	}
 	rtmpListener, err := rtmp.Listen(raw)
 	if err != nil {
 		return err
@@ -208,16 +226,10 @@ func RunProxy(server, forward string) error {
 		return err
 	}
 
-	go func() {
-		err := rtmpServer.Proxy(forward)
-		if err != nil {
-			logger.Critical(err.Error())
-			os.Exit(1)
-		}
-
-	}()
-
-	// Start the server before we proxy
-	err = rtmpServer.Serve(rtmpListener)
-	return err
+	// The proxy will start when a publisher starts
+	err = rtmpServer.Proxy(forward)
+	if err != nil {
+		return err
+	}
+	return rtmpServer.Serve(rtmpListener)
 }
@@ -40,11 +40,12 @@
 package rtmp
 
 import (
+	"crypto/rand"
 	"fmt"
+	"math/big"
 
 	"github.com/kris-nova/logger"
 
-	"github.com/gwuhaolin/livego/utils/uid"
 	"github.com/patrickmn/go-cache"
 )
 
@@ -87,18 +88,31 @@ func GetStaticPushUrlList(appname string) ([]string, bool) {
 	return nil, true
 }
 
+// RoomKeysType maps a channel to a single key, and a key back to
+// the channel. The server uses the channel as the app and stream
+// name, such as "twinx/camera".
 type RoomKeysType struct {
 	localCache *cache.Cache
 }
 
-var RoomKeys = &RoomKeysType{
-	localCache: cache.New(cache.NoExpiration, 0),
+var RoomKeys = NewRoomKeys()
+
+func NewRoomKeys() *RoomKeysType {
+	return &RoomKeysType{
+		localCache: cache.New(cache.NoExpiration, 0),
+	}
 }
 
+// SetKey will issue a new key for the channel. Any existing
+// key for the channel is revoked.
 func (r *RoomKeysType) SetKey(channel string) (key string, err error) {
 
+	r.DeleteChannel(channel)
 	for {
-		key = uid.RandStringRunes(48)
+		key, err = randomString(DefaultRoomKeyLength)
+		if err != nil {
+			return "", err
+		}
 		if _, found := r.localCache.Get(key); !found {
 			r.localCache.SetDefault(channel, key)
 			r.localCache.SetDefault(key, channel)
@@ -151,3 +165,18 @@ func (r *RoomKeysType) DeleteKey(key string) bool {
 	}
 	return false
 }
+
+// randomString will generate a string of length n from
+// StreamKeyRandomBytePool using crypto/rand.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(StreamKeyRandomBytePool)))
+	for i := range b {
+		x, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("crypto/rand: %v", err)
+		}
+		b[i] = StreamKeyRandomBytePool[x.Int64()]
+	}
+	return string(b), nil
+}
@@ -40,9 +40,12 @@
 package rtmp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -67,6 +70,37 @@ type Conn struct {
 	rw          *ReadWriter
 	pool        *Pool
 	chunks      map[uint32]ChunkStream
+
+	// pending is the length of the incomplete messages
+	// being read from each chunk stream
+	pending int
+
+	// wmtx guards writes, as a conn can be written to from
+	// both a stream writer and its own read loop.
+	wmtx sync.Mutex
+
+	// headers is the last header written to each chunk
+	// stream, and is guarded by wmtx.
+	headers map[uint32]*chunkHeader
+
+	// writeQueueSize and overflowPolicy are used when
+	// the conn is added to a Stream.
+	writeQueueSize int
+	overflowPolicy OverflowPolicy
+
+	// aggregateAudio will write queued audio as aggregate
+	// messages when the conn is added to a Stream.
+	aggregateAudio bool
+
+	// delay is the broadcast delay when the conn is added to a
+	// Stream, and is guarded by the lock of the Stream.
+	delay time.Duration
+
+	// rtt is the last round trip time to the peer in nanoseconds,
+	// and bufferLength is the last SetBufferLength from the peer.
+	// Both are accessed atomically.
+	rtt          int64
+	bufferLength uint32
 }
 
 func NewConn(c net.Conn) *Conn {
@@ -76,9 +110,10 @@ func NewConn(c net.Conn) *Conn {
 		//remoteChunkSize:     DefaultRTMPChunkSizeBytes,
 		windowAckSize: DefaultWindowAcknowledgementSizeBytes,
 		//remoteWindowAckSize: DefaultWindowAcknowledgementSizeBytes,
-		pool:   NewPool(),
-		rw:     NewReadWriter(c, DefaultConnBufferSizeBytes),
-		chunks: make(map[uint32]ChunkStream),
+		pool:    DefaultPool,
+		rw:      NewReadWriter(c, DefaultConnBufferSizeBytes),
+		chunks:  make(map[uint32]ChunkStream),
+		headers: make(map[uint32]*chunkHeader),
 	}
 	return conn
 }
@@ -101,22 +136,48 @@ func (conn *Conn) Read(c *ChunkStream) error {
 		csid := h & 0x3f
 		cs, ok := conn.chunks[csid]
 		if !ok {
+			if len(conn.chunks) >= DefaultConnMaximumChunkStreams {
+				return fmt.Errorf("maximum chunk streams %d", DefaultConnMaximumChunkStreams)
+			}
 			cs = ChunkStream{}
 			conn.chunks[csid] = cs
 		}
 		cs.tmpFormat = format
 		cs.CSID = csid
+		reading := cs.remain != 0
+		if reading && format != 3 {
+			// A new message header restarts the chunk
+			// stream, and the incomplete message is lost.
+			conn.pending -= int(cs.Length)
+			cs.abandon()
+			reading = false
+		}
 		err = cs.readChunk(conn.rw, conn.chunkSize, conn.pool)
 		if err != nil {
 			return WellKnownClosedClientError
 		}
 
-		conn.chunks[csid] = cs
+		// Bound the memory for incomplete messages
+		if !reading && !cs.full() {
+			conn.pending += int(cs.Length)
+			if conn.pending > DefaultConnMaximumPendingBytes {
+				return fmt.Errorf("incomplete messages exceed %d bytes", DefaultConnMaximumPendingBytes)
+			}
+		}
+		if reading && cs.full() {
+			conn.pending -= int(cs.Length)
+		}
 
 		if cs.full() {
+			// The reader owns the payload, and the
+			// chunk stream will begin a new payload.
 			*c = cs
+			cs.payload = nil
+			cs.Data = nil
+			conn.chunks[csid] = cs
 			break
 		}
+		conn.chunks[csid] = cs
 	}
 
 	// RTMP Can update chunk size so let's just check.
@@ -126,6 +187,8 @@ func (conn *Conn) Read(c *ChunkStream) error {
 		conn.chunkSize = chunkSize
 	} else if c.TypeID == WindowAcknowledgementSizeMessageID {
 		conn.windowAckSize = binary.BigEndian.Uint32(c.Data)
+	} else if c.TypeID == AbortMessageID && len(c.Data) >= 4 {
+		conn.abort(binary.BigEndian.Uint32(c.Data))
 	}
 
 	// We should now have a complete chunk.
@@ -135,14 +198,88 @@ func (conn *Conn) Read(c *ChunkStream) error {
 	return nil
 }
 
+// abort will discard the incomplete message of a chunk stream,
+// such as when the peer has sent an Abort Message.
+func (conn *Conn) abort(csid uint32) {
+	cs, ok := conn.chunks[csid]
+	if !ok || cs.remain == 0 {
+		return
+	}
+	conn.pending -= int(cs.Length)
+	cs.abandon()
+	conn.chunks[csid] = cs
+}
+
+// SetWriteQueueSize will set the maximum number of packets queued
+// for this conn when it is added to a Stream.
+func (conn *Conn) SetWriteQueueSize(size int) {
+	conn.writeQueueSize = size
+}
+
+// SetOverflowPolicy will set what happens when this conn is unable
+// to keep up with a Stream.
+func (conn *Conn) SetOverflowPolicy(policy OverflowPolicy) {
+	conn.overflowPolicy = policy
+}
+
+// SetAggregateAudio will write small audio messages that are queued
+// together as a single aggregate message, when this conn is added to
+// a Stream.
+func (conn *Conn) SetAggregateAudio(aggregate bool) {
+	conn.aggregateAudio = aggregate
+}
+
+// SetDelay will hold every packet for delay before it is queued,
+// when this conn is added to a Stream. Use Stream.SetDelay to change
+// the delay of a conn that has been added.
+func (conn *Conn) SetDelay(delay time.Duration) {
+	conn.delay = delay
+}
+
 func (conn *Conn) Write(c *ChunkStream) error {
+	conn.wmtx.Lock()
+	defer conn.wmtx.Unlock()
 	if c.TypeID == SetChunkSizeMessageID {
 		conn.chunkSize = binary.BigEndian.Uint32(c.Data)
 	}
-	return c.writeChunk(conn.rw, int(conn.chunkSize))
+	conn.rw.resizeWriter(writeBufferSize(conn.chunkSize))
+	return c.writeChunk(conn.rw, int(conn.chunkSize), conn.header(c))
+}
+
+// header will return the last header written to the chunk stream
+// of the message.
+//
+// This must be called while holding wmtx.
+func (conn *Conn) header(c *ChunkStream) *chunkHeader {
+	if conn.headers == nil {
+		conn.headers = make(map[uint32]*chunkHeader)
+	}
+	c.defaultCSID()
+	h, ok := conn.headers[c.CSID]
+	if !ok {
+		h = &chunkHeader{}
+		conn.headers[c.CSID] = h
+	}
+	return h
+}
+
+// writeBufferSize is the size of the write buffer for a chunk size. The
+// buffer will hold a full chunk, up to DefaultConnMaximumBufferSizeBytes.
+// Larger chunks are written without the buffer.
+func writeBufferSize(chunkSize uint32) int {
+	size := int(chunkSize + DefaultChunkHeaderMaximumBytes)
+	if size < DefaultConnBufferSizeBytes {
+		return DefaultConnBufferSizeBytes
+	}
+	if size > DefaultConnMaximumBufferSizeBytes {
+		return DefaultConnMaximumBufferSizeBytes
+	}
+	return size
 }
 
 func (conn *Conn) Flush() error {
+	conn.wmtx.Lock()
+	defer conn.wmtx.Unlock()
 	return conn.rw.Flush()
 }
 
@@ -215,7 +352,7 @@ func (conn *Conn) ack(size uint32) error {
 	}
 	if conn.ackReceived >= conn.windowAckSize {
 		cs := conn.newChunkStreamAck(conn.ackReceived)
-		err := cs.writeChunk(conn.rw, int(conn.chunkSize))
+		err := conn.Write(cs)
 		conn.ackReceived = 0
 		if err != nil {
 			return err
@@ -239,3 +376,24 @@ func (conn *Conn) streamBegin() *ChunkStream {
 	}
 	return &x
 }
+
+// playFailed will encode a NetStream.Play.Failed onStatus message for
+// the play client on streamID.
+func (conn *Conn) playFailed(streamID uint32, description string) (*ChunkStream, error) {
+	event := make(AMFObject)
+	event[ConnEventLevel] = ConnEventError
+	event[ConnEventCode] = CommandNetStreamPlayFailed
+	event[ConnEventDescription] = description
+	b := &bytes.Buffer{}
+	encoder := &AMFEncoder{}
+	if err := encoder.EncodeBatch(b, AMF0, CommandTypeOnStatus, 0, nil, event); err != nil {
+		return nil, err
+	}
+	return &ChunkStream{
+		CSID:     3,
+		TypeID:   CommandMessageAMF0ID,
+		StreamID: streamID,
+		Length:   uint32(b.Len()),
+		Data:     b.Bytes(),
+	}, nil
+}
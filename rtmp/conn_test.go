@@ -131,11 +131,12 @@ func TestSetChunksizeForWrite(t *testing.T) {
 	at.Equal(err, nil)
 	conn.Flush()
 
+	// The same audio is a type 2 header, in one chunk
 	buf.Reset()
 	err = conn.Write(&audio)
 	at.Equal(err, nil)
 	conn.Flush()
-	at.Equal(len(buf.Bytes()), 145)
+	at.Equal(len(buf.Bytes()), 137)
 }
 
 func TestSetChunksize(t *testing.T) {
@@ -216,7 +217,7 @@ func TestConnWrite(t *testing.T) {
 	err := conn.Write(&c1)
 	at.Equal(err, nil)
 	conn.Flush()
-	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0x28, 0x0, 0x0, 0x3, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3})
+	at.Equal(wr.Bytes(), []byte{0x3, 0x0, 0x0, 0x28, 0x0, 0x0, 0x3, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3})
 
 	//for type 1
 	wr.Reset()
@@ -230,7 +231,7 @@ func TestConnWrite(t *testing.T) {
 	err = conn.Write(&c1)
 	at.Equal(err, nil)
 	conn.Flush()
-	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0x50, 0x0, 0x0, 0x4, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
+	at.Equal(wr.Bytes(), []byte{0x43, 0x0, 0x0, 0x28, 0x0, 0x0, 0x4, 0x8, 0x1, 0x2, 0x3, 0x4})
 
 	//for type 2
 	wr.Reset()
@@ -238,5 +239,109 @@ func TestConnWrite(t *testing.T) {
 	err = conn.Write(&c1)
 	at.Equal(err, nil)
 	conn.Flush()
-	at.Equal(wr.Bytes(), []byte{0x4, 0x0, 0x0, 0xa0, 0x0, 0x0, 0x4, 0x8, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
+	at.Equal(wr.Bytes(), []byte{0x83, 0x0, 0x0, 0x50, 0x1, 0x2, 0x3, 0x4})
+
+	//for type 3
+	wr.Reset()
+	c1.Timestamp = 240
+	err = conn.Write(&c1)
+	at.Equal(err, nil)
+	conn.Flush()
+	at.Equal(wr.Bytes(), []byte{0xc3, 0x1, 0x2, 0x3, 0x4})
+
+	//a new message stream is a type 0 header
+	wr.Reset()
+	c1.StreamID = 1
+	c1.Timestamp = 280
+	err = conn.Write(&c1)
+	at.Equal(err, nil)
+	conn.Flush()
+	at.Equal(wr.Bytes(), []byte{0x3, 0x0, 0x1, 0x18, 0x0, 0x0, 0x4, 0x8, 0x1, 0x0, 0x0, 0x0, 0x1, 0x2, 0x3, 0x4})
+}
+
+// Compressed headers must be read back as the original messages.
+func TestConnWriteCompressedRead(t *testing.T) {
+	at := assert.New(t)
+	wr := bytes.NewBuffer(nil)
+	writer := &Conn{
+		rw:        NewReadWriter(wr, 1024),
+		chunkSize: 128,
+	}
+	timestamps := []uint32{0, 23, 46, 69, 92, 200}
+	for _, ts := range timestamps {
+		x := testAudio(AAC_RAW)
+		x.Timestamp = ts
+		at.Equal(writer.Write(x), nil)
+	}
+	large := &ChunkStream{TypeID: VideoMessageID, Timestamp: 300, Length: 300, Data: make([]byte, 300), StreamID: 1}
+	at.Equal(writer.Write(large), nil)
+	writer.Flush()
+
+	reader := &Conn{
+		pool:      NewPool(),
+		rw:        NewReadWriter(wr, 1024),
+		chunkSize: 128,
+		chunks:    make(map[uint32]ChunkStream),
+	}
+	for _, ts := range timestamps {
+		var x ChunkStream
+		at.Equal(reader.Read(&x), nil)
+		at.Equal(x.Timestamp, ts)
+		at.Equal(x.TypeID, uint32(AudioMessageID))
+		at.Equal(len(x.Data), 3)
+	}
+	var x ChunkStream
+	at.Equal(reader.Read(&x), nil)
+	at.Equal(x.Timestamp, uint32(300))
+	at.Equal(len(x.Data), 300)
+}
+
+// A chunk stream that begins a new message before the last one is
+// complete should not hold the incomplete message against the limit.
+func TestConnReadRestartedMessage(t *testing.T) {
+	at := assert.New(t)
+	var data []byte
+	for i := 0; i < 64; i++ {
+		data = append(data, 0x06, 0x00, 0x00, 0x00, 0x00, 0x01, 0x33, 0x09, 0x01, 0x00, 0x00, 0x00)
+		data = append(data, make([]byte, 128)...)
+	}
+	data = append(data, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x33, 0x09, 0x01, 0x00, 0x00, 0x00)
+	data = append(data, make([]byte, 51)...)
+	conn := &Conn{
+		pool:          NewPool(),
+		rw:            NewReadWriter(bytes.NewBuffer(data), 1024),
+		chunkSize:     128,
+		windowAckSize: 2500000,
+		chunks:        make(map[uint32]ChunkStream),
+	}
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(int(c.Length), 51)
+	at.Equal(conn.pending, 0)
+}
+
+// An Abort Message should discard the incomplete message of a chunk
+// stream, and its length.
+func TestConnReadAbortMessage(t *testing.T) {
+	at := assert.New(t)
+	data := []byte{
+		0x06, 0x00, 0x00, 0x00, 0x00, 0x01, 0x33, 0x09, 0x01, 0x00, 0x00, 0x00,
+	}
+	data = append(data, make([]byte, 128)...)
+	data = append(data, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00, 0x00)
+	data = append(data, 0x00, 0x00, 0x00, 0x06)
+	conn := &Conn{
+		pool:          NewPool(),
+		rw:            NewReadWriter(bytes.NewBuffer(data), 1024),
+		chunkSize:     128,
+		windowAckSize: 2500000,
+		chunks:        make(map[uint32]ChunkStream),
+	}
+	var c ChunkStream
+	err := conn.Read(&c)
+	at.Equal(err, nil)
+	at.Equal(c.TypeID, AbortMessageID)
+	at.Equal(conn.pending, 0)
+	at.Equal(int(conn.chunks[6].remain), 0)
 }
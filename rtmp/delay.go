@@ -0,0 +1,238 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// delayLine holds the packets for one destination, and releases each
+// packet once it has been held for the delay. This is a broadcast delay
+// between the publisher and a remote server such as Twitch or YouTube.
+//
+// The packets are never changed, only the time they are released. When
+// the delay is changed, the current delay moves toward the new delay by
+// DelayAdjustRate of each second. The destination is written slower or
+// faster than real time until it reaches the new delay, and the
+// timestamps it receives are always continuous.
+//
+// The delay line retains the payload of every held packet, and releases
+// it once the packet has been released or dropped.
+type delayLine struct {
+	mtx       sync.Mutex
+	target    time.Duration
+	current   time.Duration
+	adjusted  time.Time
+	packets   []delayedPacket
+	sizeBytes int
+	maxBytes  int
+	closed    bool
+	wake      chan struct{}
+
+	// release is called for each packet once it is due, from the
+	// delay line go routine. An error will close the delay line.
+	release func(x *ChunkStream) error
+}
+
+type delayedPacket struct {
+	x        *ChunkStream
+	received time.Time
+}
+
+func newDelayLine(delay time.Duration, release func(x *ChunkStream) error) *delayLine {
+	return &delayLine{
+		target:   delay,
+		current:  delay,
+		adjusted: time.Now(),
+		maxBytes: DefaultDelayMaximumSizeBytes,
+		wake:     make(chan struct{}, 1),
+		release:  release,
+	}
+}
+
+// setDelay will change the delay. The current delay moves
+// toward the new delay over time.
+func (d *delayLine) setDelay(delay time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.adjust(time.Now())
+	d.target = delay
+	d.signal()
+}
+
+// delay returns the current delay, and the delay it is moving toward.
+func (d *delayLine) delay() (current, target time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.adjust(time.Now())
+	return d.current, d.target
+}
+
+// push will hold a packet, and return an error if the held
+// packets are larger than maxBytes.
+func (d *delayLine) push(x *ChunkStream) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.sizeBytes+len(x.Data) > d.maxBytes {
+		return fmt.Errorf("delay full (%d packets, %d bytes)", len(d.packets), d.sizeBytes)
+	}
+	d.append(x)
+	return nil
+}
+
+// hold will hold packets regardless of the size.
+func (d *delayLine) hold(packets ...*ChunkStream) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, x := range packets {
+		d.append(x)
+	}
+}
+
+// append will retain and hold a packet.
+//
+// This must be called while holding the lock.
+func (d *delayLine) append(x *ChunkStream) {
+	if d.closed {
+		return
+	}
+	x.retain()
+	d.packets = append(d.packets, delayedPacket{x: x, received: time.Now()})
+	d.sizeBytes += len(x.Data)
+	d.signal()
+}
+
+// signal will wake the delay line go routine without blocking.
+func (d *delayLine) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// adjust will move the current delay toward the target.
+//
+// This must be called while holding the lock.
+func (d *delayLine) adjust(now time.Time) {
+	step := time.Duration(float64(now.Sub(d.adjusted)) * DelayAdjustRate)
+	d.adjusted = now
+	switch {
+	case d.current < d.target:
+		d.current += step
+		if d.current > d.target {
+			d.current = d.target
+		}
+	case d.current > d.target:
+		d.current -= step
+		if d.current < d.target {
+			d.current = d.target
+		}
+	}
+}
+
+// due will remove the packets that have been held for the current
+// delay, and return how long to wait for the next packet. A wait
+// of 0 will wait until a packet is held.
+//
+// This must be called while holding the lock.
+func (d *delayLine) due(now time.Time) ([]*ChunkStream, time.Duration) {
+	d.adjust(now)
+	var packets []*ChunkStream
+	for len(d.packets) > 0 && now.Sub(d.packets[0].received) >= d.current {
+		x := d.packets[0].x
+		d.packets[0] = delayedPacket{}
+		d.packets = d.packets[1:]
+		d.sizeBytes -= len(x.Data)
+		packets = append(packets, x)
+	}
+	if len(d.packets) == 0 {
+		return packets, 0
+	}
+	wait := d.current - now.Sub(d.packets[0].received)
+	if d.current != d.target && wait > DelayAdjustInterval {
+		// The current delay is moving, and the next
+		// packet may be due sooner
+		wait = DelayAdjustInterval
+	}
+	return packets, wait
+}
+
+// run will release packets as they are due, until the
+// delay line is closed.
+func (d *delayLine) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		d.mtx.Lock()
+		if d.closed {
+			d.mtx.Unlock()
+			return
+		}
+		packets, wait := d.due(time.Now())
+		d.mtx.Unlock()
+
+		for i, x := range packets {
+			err := d.release(x)
+			if err != nil {
+				for _, x := range packets[i:] {
+					x.release()
+				}
+				d.close()
+				return
+			}
+			x.release()
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// close will drop every held packet, and stop the delay line.
+func (d *delayLine) close() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.closed = true
+	for _, p := range d.packets {
+		p.x.release()
+	}
+	d.packets = nil
+	d.sizeBytes = 0
+	d.signal()
+}
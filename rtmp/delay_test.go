@@ -0,0 +1,125 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelayLine(t *testing.T) {
+	released := make(chan *ChunkStream, 8)
+	d := newDelayLine(time.Millisecond*200, func(x *ChunkStream) error {
+		released <- x
+		return nil
+	})
+	go d.run()
+	defer d.close()
+
+	start := time.Now()
+	key := testVideo(FRAME_KEY, AVC_NALU)
+	inter := testVideo(FRAME_INTER, AVC_NALU)
+	d.push(key)
+	d.push(inter)
+	for _, expected := range []*ChunkStream{key, inter} {
+		select {
+		case x := <-released:
+			if x != expected {
+				t.Fatalf("expected packets to be released in order")
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout waiting for delayed packet")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Fatalf("expected packets to be held for 200ms, released after %v", elapsed)
+	}
+}
+
+func TestDelayLineAdjust(t *testing.T) {
+	d := newDelayLine(time.Second*10, nil)
+	now := d.adjusted
+	d.append(testVideo(FRAME_KEY, AVC_NALU))
+	received := d.packets[0].received
+
+	// Reduce the delay, which moves at DelayAdjustRate
+	d.target = 0
+	packets, wait := d.due(now.Add(time.Second * 4))
+	if len(packets) != 0 {
+		t.Fatalf("expected no packets to be due, got %d", len(packets))
+	}
+	if d.current != time.Second*8 {
+		t.Fatalf("expected current delay 8s, got %v", d.current)
+	}
+	if wait != DelayAdjustInterval {
+		t.Fatalf("expected to check again in %v, got %v", DelayAdjustInterval, wait)
+	}
+
+	// The packet is due once it has been held for the current delay
+	packets, wait = d.due(received.Add(time.Second * 7))
+	if len(packets) != 1 || wait != 0 {
+		t.Fatalf("expected 1 packet to be due, got %d (wait %v)", len(packets), wait)
+	}
+
+	// Increase the delay
+	d.target = time.Second * 20
+	d.due(d.adjusted.Add(time.Second * 40))
+	if d.current != d.target {
+		t.Fatalf("expected current delay %v, got %v", d.target, d.current)
+	}
+}
+
+// TestServerProxyDelay will unpublish a stream, and expect a destination
+// with a broadcast delay to be kept connected for the delay.
+func TestServerProxyDelay(t *testing.T) {
+	remote, commands := fakeRemote(t, "localhost:1957")
+	defer remote.Close()
+
+	server := NewServer()
+	d, err := server.ProxyWithClient(NewClient(), "rtmp://localhost:1957/live/delay")
+	if err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	defer server.RemoveProxy(d.ID())
+	err = server.SetProxyDelay(d.ID(), time.Millisecond*300)
+	if err != nil {
+		t.Fatalf("set delay: %v", err)
+	}
+	if err := server.SetProxyDelay("missing", time.Second); err == nil {
+		t.Fatalf("expected an error for a missing proxy")
+	}
+
+	publisher := testPublisher(t, server, "localhost:1958/twinx/delay")
+	expectCommands(t, commands, "delay", CommandPublish)
+	server.UnpublishClient(publisher)
+	if !d.Running() {
+		t.Fatalf("expected destination to be kept for the delay")
+	}
+	expectCommands(t, commands, "delay", CommandFCUnpublish, CommandDeleteStream)
+	if d.Running() {
+		t.Fatalf("expected destination to be stopped after the delay")
+	}
+}
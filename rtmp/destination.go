@@ -0,0 +1,383 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kris-nova/logger"
+)
+
+const (
+	// DefaultReconnectBackoffMinimum is the first delay before
+	// redialing a failed destination. The delay doubles with each
+	// failed attempt, up to DefaultReconnectBackoffMaximum.
+	DefaultReconnectBackoffMinimum time.Duration = time.Second * 1
+	DefaultReconnectBackoffMaximum time.Duration = time.Second * 60
+
+	// DefaultReconnectBackoffReset is how long a destination must
+	// stay connected before the backoff is reset.
+	DefaultReconnectBackoffReset time.Duration = time.Second * 60
+)
+
+// Destination is a supervised proxy destination.
+//
+// A Destination will publish a Stream to a remote server such as
+// Twitch or YouTube. If the remote fails, the destination will redial
+// with exponential backoff, publish again, and resume the stream at
+// the next keyframe.
+//
+// A Destination can be stopped and started again, such as when
+// the local publisher unpublishes, and later publishes again.
+type Destination struct {
+	raw     string
+	urladdr *URLAddr
+	client  *Client
+
+	// source is the app and stream name the destination follows,
+	// such as "twinx/camera". If empty, the destination will follow
+	// the first stream published to the server.
+	source string
+
+	backoffMinimum time.Duration
+	backoffMaximum time.Duration
+
+	mtx       sync.Mutex
+	stream    *Stream
+	conn      *ClientConn
+	connected bool
+	running   bool
+	stop      chan struct{}
+	done      chan struct{}
+
+	// delay is the broadcast delay of the destination, which
+	// can be changed while the destination is publishing.
+	delay time.Duration
+}
+
+// NewDestination will create a Destination for the raw address. The client
+// is used to dial the address, and can be configured before calling Start().
+func NewDestination(client *Client, raw string) (*Destination, error) {
+	urladdr, err := NewURLAddr(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %v", err)
+	}
+	return &Destination{
+		raw:            raw,
+		urladdr:        urladdr,
+		client:         client,
+		backoffMinimum: DefaultReconnectBackoffMinimum,
+		backoffMaximum: DefaultReconnectBackoffMaximum,
+		delay:          client.delay,
+	}, nil
+}
+
+// SetBackoff will override the minimum and maximum reconnect delay.
+func (d *Destination) SetBackoff(minimum, maximum time.Duration) {
+	d.backoffMinimum = minimum
+	d.backoffMaximum = maximum
+}
+
+// SetSource will set the app and stream name the destination follows.
+// SetSource should be called before the destination is added to a server.
+func (d *Destination) SetSource(source string) {
+	d.source = strings.Trim(source, "/")
+}
+
+// Source is the app and stream name the destination follows, or
+// empty if the destination follows the first published stream.
+func (d *Destination) Source() string {
+	return d.source
+}
+
+// SetDelay will set the broadcast delay of the destination. SetDelay
+// can be called while the destination is publishing, and the stream
+// will move to the new delay without a break in the timestamps.
+func (d *Destination) SetDelay(delay time.Duration) {
+	d.mtx.Lock()
+	d.delay = delay
+	stream, conn := d.stream, d.conn
+	d.mtx.Unlock()
+	if conn != nil {
+		stream.SetDelay(conn.conn, delay)
+	}
+}
+
+// Delay is the broadcast delay of the destination.
+func (d *Destination) Delay() time.Duration {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.delay
+}
+
+// URLAddr is the address of the remote server.
+func (d *Destination) URLAddr() *URLAddr {
+	return d.urladdr
+}
+
+// ID is the stable identifier of the destination.
+func (d *Destination) ID() string {
+	return d.urladdr.ID()
+}
+
+// Connected will return true if the destination is currently
+// publishing to the remote server.
+func (d *Destination) Connected() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.connected
+}
+
+// Running will return true if the destination has been started,
+// and has not been stopped.
+func (d *Destination) Running() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.running
+}
+
+// Start will connect and publish the stream to the destination, and
+// then supervise the destination until Stop() is called.
+//
+// An error is returned only if the first connection fails.
+// Start is a no-op if the destination is already running.
+func (d *Destination) Start(stream *Stream) error {
+	stop, done, ok := d.begin(stream)
+	if !ok {
+		return nil
+	}
+	cc, err := d.connect(stop)
+	if err != nil {
+		d.Stop()
+		return err
+	}
+	go d.supervise(stream, stop, done, cc)
+	return nil
+}
+
+// Run will publish the stream to the destination in the background,
+// and supervise the destination until Stop() is called.
+//
+// Unlike Start(), Run will never return an error. If the first
+// connection fails, the destination will be redialed with backoff.
+func (d *Destination) Run(stream *Stream) {
+	stop, done, ok := d.begin(stream)
+	if !ok {
+		return
+	}
+	go d.supervise(stream, stop, done, nil)
+}
+
+// Stop will unpublish and close the destination, and it will
+// not be redialed until the destination is started again.
+func (d *Destination) Stop() {
+	d.mtx.Lock()
+	if !d.running {
+		d.mtx.Unlock()
+		return
+	}
+	d.running = false
+	d.connected = false
+	close(d.stop)
+	cc, done := d.conn, d.done
+	d.mtx.Unlock()
+
+	// The ClientConn belongs to the supervise goroutine, which will
+	// unpublish once RoutePackets() returns. The read deadline wakes
+	// RoutePackets() up, and Stop waits for the unpublish without
+	// holding the lock so Status() and Run() never wait on a slow remote.
+	if cc != nil {
+		cc.conn.SetReadDeadline(time.Now())
+		<-done
+	}
+	logger.Info(rtmpMessage(fmt.Sprintf("destination %s stopped", d.urladdr.SafeURL()), stop))
+}
+
+// begin will mark the destination as running, and return the stop
+// and done channels for this run. If the destination is already
+// running, begin will return false.
+func (d *Destination) begin(stream *Stream) (chan struct{}, chan struct{}, bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.running {
+		return nil, nil, false
+	}
+	d.running = true
+	d.stream = stream
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	return d.stop, d.done, true
+}
+
+func (d *Destination) connect(stop chan struct{}) (*ClientConn, error) {
+	// Each attempt has its own ClientConn, so a supervise goroutine
+	// from an earlier run never shares a conn with this one.
+	cc, err := d.client.dial(d.raw)
+	if err != nil {
+		return nil, err
+	}
+	err = cc.publishStart()
+	if err != nil {
+		cc.Close()
+		return nil, err
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if stopped(stop) {
+		cc.Close()
+		return nil, fmt.Errorf("destination stopped")
+	}
+	cc.conn.SetDelay(d.delay)
+	d.conn = cc
+	return cc, nil
+}
+
+// supervise will route packets for the connection until it fails,
+// and then redial the destination. If cc is nil, the destination
+// is dialed first. Once the destination is stopped, supervise will
+// unpublish and close done.
+func (d *Destination) supervise(stream *Stream, stop, done chan struct{}, cc *ClientConn) {
+	defer close(done)
+	attempt := 0
+	resume := false
+	for {
+		if cc == nil {
+			var err error
+			cc, err = d.connect(stop)
+			if err != nil {
+				if stopped(stop) {
+					return
+				}
+				d.failure(err)
+				if !d.wait(stop, attempt) {
+					return
+				}
+				attempt++
+				continue
+			}
+		}
+		connected := time.Now()
+		var err error
+		if resume {
+			err = stream.ResumeConn(cc.conn)
+		} else {
+			err = stream.AddConn(cc.conn)
+		}
+		if err == nil {
+			logger.Info(rtmpMessage(fmt.Sprintf("destination %s publishing", d.urladdr.SafeURL()), proxy))
+			d.setConnected(stop, true)
+			stopPing := cc.conn.ping(d.client.pingInterval)
+			err = cc.RoutePackets()
+			stopPing()
+			d.setConnected(stop, false)
+			resume = true
+		}
+		d.mtx.Lock()
+		if d.conn == cc {
+			d.conn = nil
+		}
+		d.mtx.Unlock()
+		stream.RemoveConn(cc.conn)
+		if stopped(stop) {
+			err = cc.Unpublish()
+			if err != nil {
+				logger.Debug(rtmpMessage(fmt.Sprintf("destination %s unpublish: %v", d.urladdr.SafeURL(), err), warn))
+			}
+			return
+		}
+		cc.Close()
+		cc = nil
+		d.failure(err)
+		if time.Since(connected) > DefaultReconnectBackoffReset {
+			attempt = 0
+		}
+		if !d.wait(stop, attempt) {
+			return
+		}
+		attempt++
+	}
+}
+
+// wait will sleep for the backoff of the attempt before the destination
+// is redialed. If the destination is stopped, wait will return false.
+func (d *Destination) wait(stop chan struct{}, attempt int) bool {
+	select {
+	case <-stop:
+		return false
+	case <-time.After(d.backoff(attempt)):
+	}
+	M().Lock()
+	P(d.ID()).ProxyReconnects++
+	M().Unlock()
+	logger.Info(rtmpMessage(fmt.Sprintf("destination %s reconnecting (attempt %d)", d.urladdr.SafeURL(), attempt+1), conn))
+	return true
+}
+
+func (d *Destination) failure(err error) {
+	if err == nil {
+		err = fmt.Errorf("destination closed")
+	}
+	logger.Critical("destination %s failed: %v", d.urladdr.SafeURL(), err)
+	M().Lock()
+	defer M().Unlock()
+	p := P(d.ID())
+	p.ProxyLastError = err.Error()
+	p.ProxyLastErrorTime = time.Now()
+}
+
+// backoff returns the delay before the next reconnect attempt.
+func (d *Destination) backoff(attempt int) time.Duration {
+	delay := d.backoffMinimum
+	for i := 0; i < attempt; i++ {
+		delay = delay * 2
+		if delay >= d.backoffMaximum {
+			return d.backoffMaximum
+		}
+	}
+	return delay
+}
+
+func (d *Destination) setConnected(stop chan struct{}, connected bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if stopped(stop) {
+		return
+	}
+	d.connected = connected
+}
+
+// stopped will return true once the stop channel has been closed.
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,511 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDestinationReconnect will close the first connection to a
+// destination, and expect the destination to redial, publish, and
+// receive the sequence headers again.
+func TestDestinationReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:1938")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	resumed := make(chan struct{})
+	go func() {
+		for accepted := 0; ; accepted++ {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn := newTestConn(netConn)
+			server := NewServerConn(conn)
+			if err := server.handshake(); err != nil {
+				netConn.Close()
+				continue
+			}
+			if accepted == 0 {
+				// Fail the first connection
+				netConn.Close()
+				continue
+			}
+			for {
+				x, err := server.NextChunk()
+				if err != nil {
+					return
+				}
+				if isAVCSequenceHeader(x) {
+					close(resumed)
+					return
+				}
+			}
+		}
+	}()
+
+	stream := NewStream("destination-reconnect")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	stream.Write(testVideo(FRAME_KEY, AVC_SEQHDR))
+
+	d, err := NewDestination(NewClient(), "rtmp://localhost:1938/twinx/reconnect")
+	if err != nil {
+		t.Fatalf("new destination: %v", err)
+	}
+	d.SetBackoff(time.Millisecond*10, time.Millisecond*50)
+	err = d.Start(stream)
+	if err != nil {
+		t.Fatalf("start destination: %v", err)
+	}
+	defer d.Stop()
+
+	select {
+	case <-resumed:
+	case <-time.After(time.Second * 10):
+		t.Fatalf("destination did not reconnect")
+	}
+
+	M().Lock()
+	p := P(d.ID())
+	reconnects, lastError := p.ProxyReconnects, p.ProxyLastError
+	M().Unlock()
+	if reconnects < 1 {
+		t.Errorf("expected at least 1 reconnect, got %d", reconnects)
+	}
+	if lastError == "" {
+		t.Errorf("expected last error to be recorded")
+	}
+}
+
+// TestDestinationTeardown will close the connection to a destination,
+// and expect the closed connection to be forgotten while the
+// destination waits to redial.
+func TestDestinationTeardown(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:1964")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := NewServerConn(newTestConn(netConn))
+			if err := server.handshake(); err == nil {
+				server.NextChunk()
+			}
+			netConn.Close()
+		}
+	}()
+
+	stream := NewStream("destination-teardown")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	d, err := NewDestination(NewClient(), "rtmp://localhost:1964/twinx/teardown")
+	if err != nil {
+		t.Fatalf("new destination: %v", err)
+	}
+	d.SetBackoff(time.Minute, time.Minute)
+	err = d.Start(stream)
+	if err != nil {
+		t.Fatalf("start destination: %v", err)
+	}
+	defer d.Stop()
+	waitFor(t, "the closed conn to be forgotten", func() bool {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		return d.conn == nil
+	})
+	d.SetDelay(time.Second)
+}
+
+// TestDestinationStopWhileRouting will stop a destination while the
+// remote is sending commands, and expect the destination to unpublish.
+// Run with -race to check the ClientConn is not shared with Stop().
+func TestDestinationStopWhileRouting(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:1965")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	commands := make(chan string, 64)
+	go func() {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+		server := NewServerConn(newTestConn(netConn))
+		if err := server.handshake(); err != nil {
+			return
+		}
+		// The commands are written with their own Conn, so the chunk
+		// size read from the destination is not shared with the writer.
+		writer := NewServerConn(newTestConn(netConn))
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			event := AMFObject{
+				ConnEventLevel:       ConnEventStatus,
+				ConnEventCode:        CommandNetStreamPublishStart,
+				ConnEventDescription: "Start publishing",
+			}
+			for !stopped(done) {
+				if writer.writeMsg(5, 1, CommandTypeOnStatus, 0, nil, event) != nil {
+					return
+				}
+				if writer.Flush() != nil {
+					return
+				}
+			}
+		}()
+		for {
+			x, err := server.NextChunk()
+			if err != nil {
+				return
+			}
+			if x.TypeID != CommandMessageAMF0ID {
+				continue
+			}
+			vs, _ := server.decoder.DecodeBatch(bytes.NewReader(x.Data), AMF0)
+			if len(vs) == 0 {
+				continue
+			}
+			name, _ := vs[0].(string)
+			commands <- name
+		}
+	}()
+
+	stream := NewStream("destination-stop")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	d, err := NewDestination(NewClient(), "rtmp://localhost:1965/twinx/stop")
+	if err != nil {
+		t.Fatalf("new destination: %v", err)
+	}
+	err = d.Start(stream)
+	if err != nil {
+		t.Fatalf("start destination: %v", err)
+	}
+	waitFor(t, "the destination to connect", d.Connected)
+	time.Sleep(time.Millisecond * 50)
+	d.Stop()
+
+	received := map[string]bool{}
+	timeout := time.After(time.Second * 5)
+	for !received[CommandFCUnpublish] || !received[CommandDeleteStream] {
+		select {
+		case name := <-commands:
+			received[name] = true
+		case <-timeout:
+			t.Fatalf("destination did not unpublish, received %v", received)
+		}
+	}
+}
+
+func TestDestinationBackoff(t *testing.T) {
+	d := &Destination{
+		backoffMinimum: time.Second,
+		backoffMaximum: time.Second * 5,
+	}
+	for attempt, expected := range []time.Duration{
+		time.Second,
+		time.Second * 2,
+		time.Second * 4,
+		time.Second * 5,
+		time.Second * 5,
+	} {
+		if actual := d.backoff(attempt); actual != expected {
+			t.Errorf("attempt %d: expected %v, got %v", attempt, expected, actual)
+		}
+	}
+}
+
+// fakeRemote will accept destinations, and send the command names
+// received from each destination by stream key.
+func fakeRemote(t *testing.T, address string) (net.Listener, chan [2]string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	commands := make(chan [2]string, 64)
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer netConn.Close()
+				conn := newTestConn(netConn)
+				server := NewServerConn(conn)
+				if err := server.handshake(); err != nil {
+					return
+				}
+				var key string
+				for {
+					x, err := server.NextChunk()
+					if err != nil {
+						return
+					}
+					if x.TypeID != CommandMessageAMF0ID {
+						continue
+					}
+					vs, _ := server.decoder.DecodeBatch(bytes.NewReader(x.Data), AMF0)
+					if len(vs) == 0 {
+						continue
+					}
+					name, _ := vs[0].(string)
+					if name == CommandPublish && len(vs) > 3 {
+						key, _ = vs[3].(string)
+					}
+					commands <- [2]string{key, name}
+				}
+			}()
+		}
+	}()
+	return listener, commands
+}
+
+// expectCommands will wait for the destination with the stream key
+// to send each of the command names to a fakeRemote.
+func expectCommands(t *testing.T, commands chan [2]string, key string, names ...string) {
+	received := map[string]bool{}
+	timeout := time.After(time.Second * 5)
+	for len(received) < len(names) {
+		select {
+		case cmd := <-commands:
+			for _, name := range names {
+				if cmd[1] != name {
+					continue
+				}
+				if cmd[0] != key {
+					t.Fatalf("unexpected %s for destination %q", cmd[1], cmd[0])
+				}
+				received[name] = true
+			}
+		case <-timeout:
+			t.Fatalf("destination %q did not send %v", key, names)
+		}
+	}
+}
+
+// testPublisher will register a fake publish client with the server.
+func testPublisher(t *testing.T, server *Server, raw string) *ServerConn {
+	urladdr, err := NewURLAddr(raw)
+	if err != nil {
+		t.Fatalf("url: %v", err)
+	}
+	publisher := NewServerConn(&Conn{URLAddr: *urladdr, chunkSize: DefaultRTMPChunkSizeBytes})
+	publisher.server = server
+	publisher.streamName = streamName(urladdr.App(), urladdr.Key())
+	err = server.PublishClient(publisher)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	return publisher
+}
+
+func TestServerProxyManagement(t *testing.T) {
+	remote, commands := fakeRemote(t, "localhost:1939")
+	defer remote.Close()
+
+	server := NewServer()
+	publisher := testPublisher(t, server, "localhost:1940/twinx/management")
+	defer server.UnpublishClient(publisher)
+
+	a, err := server.ProxyWithClient(NewClient(), "rtmp://localhost:1939/live/a")
+	if err != nil {
+		t.Fatalf("proxy a: %v", err)
+	}
+	b, err := server.ProxyWithClient(NewClient(), "rtmp://localhost:1939/live/b")
+	if err != nil {
+		t.Fatalf("proxy b: %v", err)
+	}
+	if a.ID() == b.ID() {
+		t.Fatalf("expected unique IDs for destinations on the same host")
+	}
+	if len(server.Proxies()) != 2 {
+		t.Fatalf("expected 2 proxies, got %d", len(server.Proxies()))
+	}
+
+	err = server.RemoveProxy(a.ID())
+	if err != nil {
+		t.Fatalf("remove proxy: %v", err)
+	}
+	expectCommands(t, commands, "a", CommandFCUnpublish, CommandDeleteStream)
+	if len(server.Proxies()) != 1 || !b.Running() {
+		t.Fatalf("expected remaining destination to be unaffected")
+	}
+
+	c, err := server.ReplaceProxy(b.ID(), NewClient(), "rtmp://localhost:1939/live/c")
+	if err != nil {
+		t.Fatalf("replace proxy: %v", err)
+	}
+	proxies := server.Proxies()
+	if len(proxies) != 1 || proxies[0].ID() != c.ID() || b.Running() {
+		t.Fatalf("expected destination %s to be replaced by %s", b.ID(), c.ID())
+	}
+	server.RemoveProxy(c.ID())
+
+	if err := server.RemoveProxy("deadbeef"); err == nil {
+		t.Errorf("expected error removing unknown proxy")
+	}
+}
+
+// TestServerProxyBeforePublish will add a destination before there is a
+// publisher, and expect the destination to follow the publisher.
+func TestServerProxyBeforePublish(t *testing.T) {
+	remote, commands := fakeRemote(t, "localhost:1941")
+	defer remote.Close()
+
+	server := NewServer()
+	d, err := server.ProxyWithClient(NewClient(), "rtmp://localhost:1941/live/early")
+	if err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	if d.Running() {
+		t.Fatalf("expected destination to wait for a publisher")
+	}
+
+	for i := 0; i < 2; i++ {
+		publisher := testPublisher(t, server, "localhost:1942/twinx/early")
+		expectCommands(t, commands, "early", CommandPublish)
+		server.UnpublishClient(publisher)
+		expectCommands(t, commands, "early", CommandFCUnpublish, CommandDeleteStream)
+		if d.Running() || len(server.Proxies()) != 1 {
+			t.Fatalf("expected destination to be stopped, and kept")
+		}
+	}
+}
+
+// TestServerRestart will close a server, and serve again.
+func TestServerRestart(t *testing.T) {
+	server := NewServer()
+	err := server.Proxy("rtmp://localhost:1943/live/restart")
+	if err != nil {
+		t.Fatalf("proxy before serve: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		listener, err := Listen("localhost:1944/twinx/restart")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		served := make(chan error)
+		go func() {
+			served <- server.Serve(listener)
+		}()
+		time.Sleep(time.Millisecond * 100)
+		err = server.Close()
+		if err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Fatalf("serve: %v", err)
+		}
+	}
+	if len(server.Proxies()) != 1 {
+		t.Errorf("expected destination to survive a restart")
+	}
+}
+
+// TestServerProxyGracePeriod will unpublish a stream, and expect the
+// destination to be kept connected until the grace period has passed.
+func TestServerProxyGracePeriod(t *testing.T) {
+	remote, commands := fakeRemote(t, "localhost:1951")
+	defer remote.Close()
+
+	server := NewServer()
+	server.SetProxyGracePeriod(time.Millisecond * 200)
+	d, err := server.ProxyWithClient(NewClient(), "rtmp://localhost:1951/live/grace")
+	if err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	defer server.RemoveProxy(d.ID())
+
+	publisher := testPublisher(t, server, "localhost:1952/twinx/grace")
+	expectCommands(t, commands, "grace", CommandPublish)
+
+	// Publish again within the grace period
+	server.UnpublishClient(publisher)
+	if !d.Running() {
+		t.Fatalf("expected destination to be kept for the grace period")
+	}
+	publisher = testPublisher(t, server, "localhost:1952/twinx/grace")
+	select {
+	case cmd := <-commands:
+		t.Fatalf("expected destination to continue, got %v", cmd)
+	case <-time.After(time.Millisecond * 400):
+	}
+	if !d.Running() {
+		t.Fatalf("expected destination to continue with the new publisher")
+	}
+
+	// Unpublish for longer than the grace period
+	server.UnpublishClient(publisher)
+	expectCommands(t, commands, "grace", CommandFCUnpublish, CommandDeleteStream)
+	if d.Running() {
+		t.Fatalf("expected destination to be stopped after the grace period")
+	}
+}
+
+// TestServerCloseGracePeriod will close a server while a destination
+// is kept for the grace period, and expect the destination to stop.
+func TestServerCloseGracePeriod(t *testing.T) {
+	remote, commands := fakeRemote(t, "localhost:1966")
+	defer remote.Close()
+
+	server := NewServer()
+	server.SetProxyGracePeriod(time.Minute)
+	d, err := server.ProxyWithClient(NewClient(), "rtmp://localhost:1966/live/close")
+	if err != nil {
+		t.Fatalf("proxy: %v", err)
+	}
+	publisher := testPublisher(t, server, "localhost:1967/twinx/close")
+	expectCommands(t, commands, "close", CommandPublish)
+	server.UnpublishClient(publisher)
+	if !d.Running() {
+		t.Fatalf("expected destination to be kept for the grace period")
+	}
+
+	server.Close()
+	expectCommands(t, commands, "close", CommandFCUnpublish, CommandDeleteStream)
+	server.mtx.Lock()
+	lingering := len(server.lingering)
+	server.mtx.Unlock()
+	if d.Running() || lingering != 0 {
+		t.Fatalf("expected destination to be stopped, and the timer to be stopped")
+	}
+	if len(server.Proxies()) != 1 {
+		t.Fatalf("expected destination to be kept")
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"time"
+)
+
+// DVR is a time-bounded ring buffer of the media tags of a stream, so
+// that the last minutes of a live stream can be saved as a clip.
+//
+// Every audio, video, and metadata message is kept for retention, and
+// the buffer is never larger than maxSizeBytes. The oldest tags are
+// dropped first. The keyframes are indexed, so a clip can always begin
+// on a keyframe.
+//
+// The metadata and sequence headers that have been dropped are kept,
+// as they still apply to the tags that remain.
+//
+// The DVR retains the payload of every tag, and releases it when the
+// tag is dropped.
+type DVR struct {
+	retention    time.Duration
+	maxSizeBytes int
+
+	tags      []dvrTag
+	sizeBytes int
+
+	// first is the index of tags[0] since the DVR was created, and
+	// keyframes are the indices of the buffered video keyframes.
+	first     uint64
+	keyframes []uint64
+
+	metaData     *ChunkStream
+	avcSeqHeader *ChunkStream
+	aacSeqHeader *ChunkStream
+}
+
+type dvrTag struct {
+	x        *ChunkStream
+	received time.Time
+}
+
+func NewDVR(retention time.Duration, maxSizeBytes int) *DVR {
+	return &DVR{
+		retention:    retention,
+		maxSizeBytes: maxSizeBytes,
+	}
+}
+
+// Cache will buffer a packet, and drop the tags that are older than
+// the retention or beyond the size of the buffer.
+func (d *DVR) Cache(x *ChunkStream) {
+	d.cache(x, time.Now())
+}
+
+func (d *DVR) cache(x *ChunkStream, now time.Time) {
+	switch x.TypeID {
+	case AudioMessageID, VideoMessageID, DataMessageAMF0ID:
+	default:
+		return
+	}
+	if isKeyFrame(x) && !isAVCSequenceHeader(x) {
+		d.keyframes = append(d.keyframes, d.first+uint64(len(d.tags)))
+	}
+	x.retain()
+	d.tags = append(d.tags, dvrTag{x: x, received: now})
+	d.sizeBytes += len(x.Data)
+	for len(d.tags) > 0 && (d.sizeBytes > d.maxSizeBytes || now.Sub(d.tags[0].received) > d.retention) {
+		d.drop()
+	}
+}
+
+// drop will remove the oldest tag from the buffer.
+func (d *DVR) drop() {
+	x := d.tags[0].x
+	d.tags[0] = dvrTag{}
+	d.tags = d.tags[1:]
+	d.sizeBytes -= len(x.Data)
+	if len(d.keyframes) > 0 && d.keyframes[0] == d.first {
+		d.keyframes = d.keyframes[1:]
+	}
+	d.first++
+	if header := d.header(x); header != nil {
+		if *header != nil {
+			(*header).release()
+		}
+		*header = x
+		return
+	}
+	x.release()
+}
+
+// header will return the header that x replaces, or nil if x
+// is not metadata or a sequence header.
+func (d *DVR) header(x *ChunkStream) **ChunkStream {
+	switch {
+	case x.TypeID == DataMessageAMF0ID:
+		return &d.metaData
+	case isAVCSequenceHeader(x):
+		return &d.avcSeqHeader
+	case isAACSequenceHeader(x):
+		return &d.aacSeqHeader
+	}
+	return nil
+}
+
+// Clip will return the buffered packets since the first keyframe in the
+// last duration, behind the metadata and sequence headers that apply to
+// them. A duration of 0 will return everything since the first keyframe.
+//
+// The payload of every packet is retained, and must be released by
+// the caller.
+func (d *DVR) Clip(last time.Duration) ([]*ChunkStream, error) {
+	return d.clip(last, time.Now())
+}
+
+func (d *DVR) clip(last time.Duration, now time.Time) ([]*ChunkStream, error) {
+	start := -1
+	for _, keyframe := range d.keyframes {
+		i := int(keyframe - d.first)
+		if last <= 0 || now.Sub(d.tags[i].received) <= last {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("no keyframe buffered in the last %v", last)
+	}
+	packets := d.from(start)
+	for _, x := range packets {
+		x.retain()
+	}
+	return packets, nil
+}
+
+// seek will return the buffered packets since the last keyframe at or
+// before offset, and the time of the first keyframe buffered. The time
+// of each packet is mapped with timestamp, such as the timestamp it
+// is written to a play client with. If no keyframe is buffered, ok is
+// false.
+//
+// The packets are not retained.
+func (d *DVR) seek(offset uint32, timestamp func(x *ChunkStream) uint32) (packets []*ChunkStream, earliest uint32, ok bool) {
+	if len(d.keyframes) == 0 {
+		return nil, 0, false
+	}
+	start := int(d.keyframes[0] - d.first)
+	earliest = timestamp(d.tags[start].x)
+	for _, keyframe := range d.keyframes[1:] {
+		i := int(keyframe - d.first)
+		if timestamp(d.tags[i].x) > offset {
+			break
+		}
+		start = i
+	}
+	return d.from(start), earliest, true
+}
+
+// from will return the buffered packets since tags[start], behind the
+// metadata and sequence headers that apply to them.
+func (d *DVR) from(start int) []*ChunkStream {
+	// The headers that apply are the last headers
+	// buffered before the start.
+	headers := &DVR{
+		metaData:     d.metaData,
+		avcSeqHeader: d.avcSeqHeader,
+		aacSeqHeader: d.aacSeqHeader,
+	}
+	for _, tag := range d.tags[:start] {
+		if header := headers.header(tag.x); header != nil {
+			*header = tag.x
+		}
+	}
+	var packets []*ChunkStream
+	for _, x := range []*ChunkStream{headers.metaData, headers.avcSeqHeader, headers.aacSeqHeader} {
+		if x != nil {
+			packets = append(packets, x)
+		}
+	}
+	for _, tag := range d.tags[start:] {
+		packets = append(packets, tag.x)
+	}
+	return packets
+}
+
+// reset will drop every tag and header.
+func (d *DVR) reset() {
+	for len(d.tags) > 0 {
+		d.drop()
+	}
+	for _, x := range []*ChunkStream{d.metaData, d.avcSeqHeader, d.aacSeqHeader} {
+		if x != nil {
+			x.release()
+		}
+	}
+	d.metaData = nil
+	d.avcSeqHeader = nil
+	d.aacSeqHeader = nil
+}
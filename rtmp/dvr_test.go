@@ -0,0 +1,207 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestDVRClip(t *testing.T) {
+	d := NewDVR(time.Minute, DefaultGOPCacheMaximumSizeBytes)
+	start := time.Now()
+	meta := &ChunkStream{TypeID: DataMessageAMF0ID, Length: 1, Data: []byte{0}, StreamID: 1}
+	avcSeq := testVideo(FRAME_KEY, AVC_SEQHDR)
+	aacSeq := testAudio(AAC_SEQHDR)
+	key1 := testVideo(FRAME_KEY, AVC_NALU)
+	key2 := testVideo(FRAME_KEY, AVC_NALU)
+	inter := testVideo(FRAME_INTER, AVC_NALU)
+	audio := testAudio(AAC_RAW)
+
+	for i, x := range []*ChunkStream{
+		meta, avcSeq, aacSeq,
+		key1, inter, audio,
+		key2, inter, audio,
+	} {
+		d.cache(x, start.Add(time.Duration(i)*10*time.Second))
+	}
+
+	// The headers and the first GOP have expired, and the
+	// headers are kept for the second GOP
+	now := start.Add(115 * time.Second)
+	d.cache(inter, now)
+	if len(d.tags) != 4 {
+		t.Fatalf("expected 4 buffered tags, got %d", len(d.tags))
+	}
+	expected := []*ChunkStream{meta, avcSeq, aacSeq, key2, inter, audio, inter}
+	actual, err := d.clip(0, now)
+	if err != nil {
+		t.Fatalf("unable to clip: %v", err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("unexpected packet at position %d", i)
+		}
+	}
+
+	// A clip always begins on a keyframe
+	_, err = d.clip(15*time.Second, now)
+	if err == nil {
+		t.Fatalf("expected no keyframe in the last 15s")
+	}
+	actual, err = d.clip(60*time.Second, now)
+	if err != nil {
+		t.Fatalf("unable to clip: %v", err)
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(actual))
+	}
+}
+
+func TestDVRMaximumSize(t *testing.T) {
+	d := NewDVR(time.Minute, 12)
+	now := time.Now()
+	d.cache(testVideo(FRAME_KEY, AVC_NALU), now)
+	d.cache(testVideo(FRAME_INTER, AVC_NALU), now)
+	if len(d.keyframes) != 1 {
+		t.Fatalf("expected 1 keyframe, got %d", len(d.keyframes))
+	}
+	d.cache(testVideo(FRAME_INTER, AVC_NALU), now)
+	if d.sizeBytes > 12 || len(d.tags) != 2 {
+		t.Fatalf("expected 2 tags in 12 bytes, got %d tags in %d bytes", len(d.tags), d.sizeBytes)
+	}
+	if len(d.keyframes) != 0 {
+		t.Fatalf("expected the keyframe to be dropped, got %d keyframes", len(d.keyframes))
+	}
+	if _, err := d.clip(0, now); err == nil {
+		t.Fatalf("expected no keyframe to clip from")
+	}
+	d.cache(testVideo(FRAME_KEY, AVC_NALU), now)
+	packets, err := d.clip(0, now)
+	if err != nil {
+		t.Fatalf("unable to clip: %v", err)
+	}
+	if len(packets) != 1 {
+		t.Fatalf("expected 1 packet, got %d", len(packets))
+	}
+}
+
+func TestDVRKeyframes(t *testing.T) {
+	d := NewDVR(time.Minute, DefaultGOPCacheMaximumSizeBytes)
+	now := time.Now()
+	d.cache(testVideo(FRAME_KEY, AVC_SEQHDR), now)
+	d.cache(testVideo(FRAME_KEY, AVC_NALU), now)
+	if len(d.keyframes) != 1 || d.keyframes[0] != 1 {
+		t.Fatalf("expected only the keyframe to be indexed, got %v", d.keyframes)
+	}
+}
+
+func TestDVRSeek(t *testing.T) {
+	d := NewDVR(time.Minute, DefaultGOPCacheMaximumSizeBytes)
+	now := time.Now()
+	avcSeq := testVideo(FRAME_KEY, AVC_SEQHDR)
+	var keyframes []*ChunkStream
+	for i, timestamp := range []uint32{1000, 1040, 2000, 2040} {
+		x := testVideo(FRAME_INTER, AVC_NALU)
+		if i%2 == 0 {
+			x = testVideo(FRAME_KEY, AVC_NALU)
+			keyframes = append(keyframes, x)
+		}
+		x.Timestamp = timestamp
+		if i == 0 {
+			d.cache(avcSeq, now)
+		}
+		d.cache(x, now)
+	}
+	timestamp := func(x *ChunkStream) uint32 {
+		return x.Timestamp
+	}
+
+	// The last keyframe at or before the offset, behind the headers
+	packets, earliest, ok := d.seek(1500, timestamp)
+	if !ok || earliest != 1000 {
+		t.Fatalf("expected the earliest time to be 1000, got %d", earliest)
+	}
+	if len(packets) != 5 || packets[0] != avcSeq || packets[1] != keyframes[0] {
+		t.Fatalf("expected the headers and 4 packets from 1000, got %d packets", len(packets))
+	}
+	packets, _, _ = d.seek(5000, timestamp)
+	if len(packets) != 3 || packets[0] != avcSeq || packets[1] != keyframes[1] {
+		t.Fatalf("expected the headers and 2 packets from 2000, got %d packets", len(packets))
+	}
+
+	d.reset()
+	if _, _, ok := d.seek(0, timestamp); ok {
+		t.Fatalf("expected no keyframe to seek to")
+	}
+}
+
+// TestServerClip will publish a stream, and expect the DVR to save
+// it as an FLV file beginning on the keyframe.
+func TestServerClip(t *testing.T) {
+	listener, err := Listen("localhost:1956/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.SetDVR(time.Minute, DefaultDVRMaximumSizeBytes)
+	go server.Serve(listener)
+	defer server.Close()
+
+	camera := testPublish(t, "localhost:1956/twinx/clip")
+	defer camera.Close()
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/clip") != nil
+	})
+	for i, x := range []*ChunkStream{
+		testVideo(FRAME_INTER, AVC_NALU), // Before the first keyframe, never clipped
+		testVideo(FRAME_KEY, AVC_SEQHDR),
+		testVideo(FRAME_KEY, AVC_NALU),
+		testVideo(FRAME_INTER, AVC_NALU),
+	} {
+		x.Timestamp = uint32(1000 + i*33)
+		err = camera.conn.Write(x)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	camera.Flush()
+
+	// The FLV header, and 3 tags of 5 bytes
+	size := flvHeaderBytes + flvPreviousSizeBytes + 3*(aggregateHeaderBytes+5+flvPreviousSizeBytes)
+	buf := &bytes.Buffer{}
+	waitFor(t, "clip", func() bool {
+		buf.Reset()
+		return server.Clip("twinx/clip", time.Minute, buf) == nil && buf.Len() == size
+	})
+	if err := server.Clip("twinx/missing", time.Minute, buf); err == nil {
+		t.Fatalf("expected an error for a missing stream")
+	}
+}
@@ -0,0 +1,464 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kris-nova/logger"
+)
+
+// OverflowPolicy decides what a stream writer will do when
+// a destination is unable to keep up with the stream, and
+// its write queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowPolicyDropFrames will drop queued non-keyframe video
+	// and skip video until the next keyframe. Audio, metadata, and
+	// keyframes are never dropped. If the queue is still full the
+	// destination is disconnected.
+	OverflowPolicyDropFrames OverflowPolicy = "drop"
+
+	// OverflowPolicyDisconnect will disconnect the destination
+	// as soon as its write queue is full.
+	OverflowPolicyDisconnect OverflowPolicy = "disconnect"
+
+	DefaultOverflowPolicy OverflowPolicy = OverflowPolicyDropFrames
+)
+
+// ParseOverflowPolicy will return a valid OverflowPolicy
+// or an error. The empty string is the DefaultOverflowPolicy.
+func ParseOverflowPolicy(raw string) (OverflowPolicy, error) {
+	switch OverflowPolicy(raw) {
+	case "":
+		return DefaultOverflowPolicy, nil
+	case OverflowPolicyDropFrames, OverflowPolicyDisconnect:
+		return OverflowPolicy(raw), nil
+	}
+	return "", fmt.Errorf("invalid overflow policy %q, must be one of: %s, %s", raw, OverflowPolicyDropFrames, OverflowPolicyDisconnect)
+}
+
+// streamWriter is the single writer for one destination
+// of a Stream.
+//
+// Packets are queued without blocking the Stream, and written
+// to the conn from the writer's own go routine. The queue is
+// bounded by packets and by bytes, and the OverflowPolicy is
+// applied when it is full.
+//
+// The writer retains the payload of every queued packet, and
+// releases it once the packet is written or dropped.
+//
+// If aggregateAudio is set, small audio packets that are queued
+// together are written as a single aggregate message.
+type streamWriter struct {
+	conn           *Conn
+	size           int
+	maxBytes       int
+	policy         OverflowPolicy
+	aggregateAudio bool
+
+	mtx        sync.Mutex
+	cond       *sync.Cond
+	queue      []*ChunkStream
+	queueBytes int
+	closed     bool
+
+	// skipping is set after video has been dropped. Any
+	// video before the next keyframe cannot be decoded.
+	skipping bool
+	dropped  int
+
+	// batch is reused by next() for the packets of each write.
+	batch []*ChunkStream
+
+	// paused is set while a play client has paused the stream.
+	// Only sequence headers are queued until the client unpauses.
+	paused bool
+
+	// noAudio and noVideo are set when a play client has sent
+	// receiveAudio or receiveVideo with false.
+	noAudio bool
+	noVideo bool
+
+	// streamID is the message stream of a play client. If set,
+	// messages are written to the message stream instead of the
+	// message stream they were published on.
+	streamID uint32
+
+	// offset is added to the timestamp of every packet after a
+	// discontinuity, and last is the last timestamp written, so
+	// that the timestamps written are always monotonic.
+	offset int64
+	last   uint32
+
+	// delay holds every packet for the broadcast delay of a
+	// destination before it is queued. If nil, packets are
+	// queued right away.
+	delay *delayLine
+
+	// onError is called once, from the writer go routine, if
+	// a write to the conn fails.
+	onError func(w *streamWriter, err error)
+}
+
+func newStreamWriter(c *Conn, size int, policy OverflowPolicy) *streamWriter {
+	if size <= 0 {
+		size = MaximumPacketQueueRecords
+	}
+	if policy == "" {
+		policy = DefaultOverflowPolicy
+	}
+	w := &streamWriter{
+		conn:           c,
+		size:           size,
+		maxBytes:       DefaultWriteQueueMaximumSizeBytes,
+		policy:         policy,
+		aggregateAudio: c.aggregateAudio,
+	}
+	w.cond = sync.NewCond(&w.mtx)
+	return w
+}
+
+// enqueue will queue a packet for the conn without blocking. If the
+// destination has a broadcast delay, the packet is held until it is due.
+//
+// The number of packets dropped to queue x is returned, and an error
+// is returned if the destination should be disconnected.
+func (w *streamWriter) enqueue(x *ChunkStream) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		return 0, fmt.Errorf("write to closed stream writer")
+	}
+	if w.delay != nil {
+		return 0, w.delay.push(x)
+	}
+	dropped := w.dropped
+	err := w.admit(x)
+	return w.dropped - dropped, err
+}
+
+// release will queue a packet once it has been held for the delay.
+// The packets dropped to queue x are counted in the metrics of the conn.
+func (w *streamWriter) release(x *ChunkStream) error {
+	w.mtx.Lock()
+	if w.closed {
+		w.mtx.Unlock()
+		return fmt.Errorf("write to closed stream writer")
+	}
+	dropped := w.dropped
+	err := w.admit(x)
+	dropped = w.dropped - dropped
+	w.mtx.Unlock()
+	if dropped > 0 {
+		M().Lock()
+		P(w.conn.ID()).ProxyTotalPacketsDropped += dropped
+		M().Unlock()
+	}
+	if err != nil {
+		w.fail(err)
+	}
+	return err
+}
+
+// admit will apply the filters and the OverflowPolicy, and queue x.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) admit(x *ChunkStream) error {
+	if w.filtered(x) {
+		return nil
+	}
+	if isDroppable(x) && w.skipping {
+		w.dropped++
+		return nil
+	}
+	if isKeyFrame(x) && !isAVCSequenceHeader(x) {
+		w.skipping = false
+	}
+	if w.full(x) {
+		if w.policy == OverflowPolicyDisconnect {
+			return fmt.Errorf("write queue full (%d packets, %d bytes)", len(w.queue), w.queueBytes)
+		}
+		w.dropFrames()
+		if isDroppable(x) {
+			w.dropped++
+			return nil
+		}
+		if w.full(x) {
+			return fmt.Errorf("write queue full (%d packets, %d bytes) after dropping frames", len(w.queue), w.queueBytes)
+		}
+	}
+	w.push(x)
+	w.cond.Signal()
+	return nil
+}
+
+// filtered returns true if the play client does not receive x. The
+// sequence headers are always received, so that the client can decode
+// the stream when it receives audio or video again.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) filtered(x *ChunkStream) bool {
+	if isAVCSequenceHeader(x) || isAACSequenceHeader(x) {
+		return false
+	}
+	switch x.TypeID {
+	case AudioMessageID:
+		return w.paused || w.noAudio
+	case VideoMessageID:
+		return w.paused || w.noVideo
+	}
+	return w.paused
+}
+
+// discard will release every queued packet.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) discard() {
+	for i, x := range w.queue {
+		x.release()
+		w.queue[i] = nil
+	}
+	w.queue = w.queue[:0]
+	w.queueBytes = 0
+}
+
+// replay will queue packets regardless of the queue size. If the
+// destination has a broadcast delay, the packets are held first.
+func (w *streamWriter) replay(packets []*ChunkStream) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.delay != nil {
+		w.delay.hold(packets...)
+		return
+	}
+	for _, x := range packets {
+		w.push(x)
+	}
+	w.cond.Signal()
+}
+
+// setDelay will set the broadcast delay of the destination. A writer
+// without a delay begins holding packets, and moves toward the delay
+// like any other change, so the packets already queued stay in order.
+func (w *streamWriter) setDelay(delay time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.closed {
+		return
+	}
+	if w.delay == nil {
+		if delay == 0 {
+			return
+		}
+		w.delay = newDelayLine(0, w.release)
+		go w.delay.run()
+	}
+	w.delay.setDelay(delay)
+}
+
+// full returns true if there is no room in the queue for x.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) full(x *ChunkStream) bool {
+	return len(w.queue) >= w.size || w.queueBytes+len(x.Data) > w.maxBytes
+}
+
+// push will retain and queue a packet.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) push(x *ChunkStream) {
+	x.retain()
+	w.queue = append(w.queue, x)
+	w.queueBytes += len(x.Data)
+}
+
+// dropFrames will remove all non-keyframe video from the queue
+// and skip video until the next keyframe.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) dropFrames() {
+	queue := w.queue[:0]
+	for _, x := range w.queue {
+		if isDroppable(x) {
+			w.dropped++
+			w.queueBytes -= len(x.Data)
+			x.release()
+			continue
+		}
+		queue = append(queue, x)
+	}
+	for i := len(queue); i < len(w.queue); i++ {
+		w.queue[i] = nil
+	}
+	w.queue = queue
+	w.skipping = true
+	logger.Debug(rtmpMessage(fmt.Sprintf("Dropping frames for %s (%d dropped)", w.conn.SafeURL(), w.dropped), warn))
+}
+
+// run will write queued packets to the conn until the writer
+// is closed. The conn is flushed each time the queue is drained.
+func (w *streamWriter) run() {
+	for {
+		w.mtx.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mtx.Unlock()
+			return
+		}
+		packets := w.next()
+		timestamp := w.timestamp(packets[0])
+		drained := len(w.queue) == 0
+		w.mtx.Unlock()
+
+		// Each destination writes its own copy of the chunk,
+		// as writing will mutate the chunk headers. The payload
+		// is shared, and is never copied.
+		y := *packets[0]
+		if len(packets) > 1 {
+			y = *newAggregate(packets)
+		}
+		if w.streamID != 0 && y.StreamID != 0 {
+			y.StreamID = w.streamID
+		}
+		y.Timestamp = timestamp
+		err := w.conn.Write(&y)
+		for i, x := range packets {
+			x.release()
+			packets[i] = nil
+		}
+		if err == nil && drained {
+			err = w.conn.Flush()
+		}
+		if err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// timestamp will return the timestamp to write for x. After a
+// discontinuity, the timestamps are rebased to follow the last
+// timestamp written.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) timestamp(x *ChunkStream) uint32 {
+	timestamp := w.peekTimestamp(x)
+	if x.discontinuity {
+		w.offset = int64(w.last) + int64(DiscontinuityGapMilliseconds) - int64(x.Timestamp)
+	}
+	if timestamp > w.last {
+		w.last = timestamp
+	}
+	return timestamp
+}
+
+// peekTimestamp returns the timestamp x would be written with, if it
+// were written next.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) peekTimestamp(x *ChunkStream) uint32 {
+	offset := w.offset
+	if x.discontinuity {
+		offset = int64(w.last) + int64(DiscontinuityGapMilliseconds) - int64(x.Timestamp)
+	}
+	timestamp := int64(x.Timestamp) + offset
+	if timestamp < 0 {
+		return 0
+	}
+	return uint32(timestamp)
+}
+
+// isDestination returns true if the writer is for a proxy destination.
+func (w *streamWriter) isDestination() bool {
+	return w.streamID == 0
+}
+
+// isPlay returns true if the writer is for a play client, which
+// writes to the message stream the client plays on.
+func (w *streamWriter) isPlay() bool {
+	return w.streamID != 0
+}
+
+// fail will close the writer, and remove the destination.
+func (w *streamWriter) fail(err error) {
+	w.close()
+	if w.onError != nil {
+		w.onError(w, err)
+	}
+}
+
+// next will remove the next packet from the queue. If aggregateAudio
+// is set, the audio queued behind an audio packet is removed with it,
+// up to AggregateMaximumSizeBytes.
+//
+// This must be called while holding the lock.
+func (w *streamWriter) next() []*ChunkStream {
+	n := 1
+	if w.aggregateAudio && isAggregatable(w.queue[0]) {
+		size := aggregateHeaderBytes + len(w.queue[0].Data) + aggregateBackPointerBytes
+		for n < len(w.queue) {
+			x := w.queue[n]
+			size += aggregateHeaderBytes + len(x.Data) + aggregateBackPointerBytes
+			if !isAggregatable(x) || x.discontinuity || x.StreamID != w.queue[0].StreamID || x.Timestamp < w.queue[0].Timestamp || size > AggregateMaximumSizeBytes {
+				break
+			}
+			n++
+		}
+	}
+	packets := append(w.batch[:0], w.queue[:n]...)
+	w.batch = packets
+	for i := 0; i < n; i++ {
+		w.queueBytes -= len(w.queue[i].Data)
+		w.queue[i] = nil
+	}
+	w.queue = w.queue[n:]
+	return packets
+}
+
+func (w *streamWriter) close() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.closed = true
+	w.discard()
+	w.queue = nil
+	if w.delay != nil {
+		w.delay.close()
+	}
+	w.cond.Broadcast()
+}
+
+// isDroppable returns true for video that can be dropped without
+// losing the ability to decode the stream from the next keyframe.
+func isDroppable(x *ChunkStream) bool {
+	return x.TypeID == VideoMessageID && !isKeyFrame(x) && !isAVCSequenceHeader(x)
+}
@@ -0,0 +1,359 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamWriterReplay(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	g := NewGOPCache(DefaultGOPCacheMaximumSizeBytes)
+	g.Cache(testVideo(FRAME_KEY, AVC_SEQHDR))
+	g.Cache(testVideo(FRAME_KEY, AVC_NALU))
+
+	w := newStreamWriter(newTestConn(c), 1, OverflowPolicyDisconnect)
+	w.replay(g.Packets())
+	go w.run()
+	defer w.close()
+
+	reader := newTestConn(s)
+	for i := 0; i < 2; i++ {
+		var x ChunkStream
+		err := reader.Read(&x)
+		if err != nil {
+			t.Fatalf("unable to read replayed packet: %v", err)
+		}
+		if i == 0 && !isAVCSequenceHeader(&x) {
+			t.Errorf("expected AVC sequence header first")
+		}
+		if i == 1 && !isKeyFrame(&x) {
+			t.Errorf("expected keyframe second")
+		}
+	}
+}
+
+func TestStreamWriterDropFrames(t *testing.T) {
+	w := newStreamWriter(&Conn{}, 3, OverflowPolicyDropFrames)
+	for _, x := range []*ChunkStream{
+		testVideo(FRAME_KEY, AVC_NALU),
+		testVideo(FRAME_INTER, AVC_NALU),
+		testVideo(FRAME_INTER, AVC_NALU),
+	} {
+		if _, err := w.enqueue(x); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	// The queue is full, audio should replace the queued inter frames
+	dropped, err := w.enqueue(testAudio(AAC_RAW))
+	if err != nil {
+		t.Fatalf("enqueue audio: %v", err)
+	}
+	if dropped != 2 {
+		t.Errorf("expected enqueue to count 2 dropped, got %d", dropped)
+	}
+	if len(w.queue) != 2 || w.dropped != 2 {
+		t.Fatalf("expected 2 queued and 2 dropped, got %d queued and %d dropped", len(w.queue), w.dropped)
+	}
+
+	// Inter frames are skipped until the next keyframe
+	dropped, _ = w.enqueue(testVideo(FRAME_INTER, AVC_NALU))
+	if len(w.queue) != 2 || w.dropped != 3 || dropped != 1 {
+		t.Fatalf("expected inter frame to be skipped, got %d queued and %d dropped", len(w.queue), w.dropped)
+	}
+	w.enqueue(testVideo(FRAME_KEY, AVC_NALU))
+	if len(w.queue) != 3 || w.skipping {
+		t.Fatalf("expected keyframe to resume video, got %d queued", len(w.queue))
+	}
+}
+
+func TestStreamWriterFilter(t *testing.T) {
+	w := newStreamWriter(&Conn{}, 16, OverflowPolicyDropFrames)
+	w.noVideo = true
+	for _, x := range []*ChunkStream{
+		testVideo(FRAME_KEY, AVC_SEQHDR),
+		testVideo(FRAME_KEY, AVC_NALU),
+		testAudio(AAC_RAW),
+	} {
+		if _, err := w.enqueue(x); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	if len(w.queue) != 2 || isKeyFrame(w.queue[1]) {
+		t.Fatalf("expected sequence header and audio to be queued, got %d queued", len(w.queue))
+	}
+
+	// Only sequence headers are queued while paused
+	w.paused = true
+	w.enqueue(testAudio(AAC_SEQHDR))
+	w.enqueue(testAudio(AAC_RAW))
+	if len(w.queue) != 3 || w.dropped != 0 {
+		t.Fatalf("expected 3 queued and 0 dropped while paused, got %d queued and %d dropped", len(w.queue), w.dropped)
+	}
+}
+
+func TestStreamWriterDisconnect(t *testing.T) {
+	w := newStreamWriter(&Conn{}, 1, OverflowPolicyDisconnect)
+	if _, err := w.enqueue(testAudio(AAC_RAW)); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if _, err := w.enqueue(testAudio(AAC_RAW)); err == nil {
+		t.Fatalf("expected full queue to disconnect")
+	}
+}
+
+func TestStreamSlowDestination(t *testing.T) {
+	newDestination := func(raw string, size int) (*Conn, net.Conn) {
+		addr, err := NewURLAddr(raw)
+		if err != nil {
+			t.Fatalf("invalid addr: %v", err)
+		}
+		c, s := net.Pipe()
+		conn := newTestConn(c)
+		conn.URLAddr = *addr
+		conn.SetWriteQueueSize(size)
+		return conn, s
+	}
+
+	const packets = 64
+	stream := NewStream("slow-destination")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+
+	// Nothing will ever read from the slow destination
+	slow, slowPeer := newDestination("rtmp://localhost:1936/twinx/slow", 8)
+	defer slowPeer.Close()
+	fast, fastPeer := newDestination("rtmp://localhost:1935/twinx/fast", packets)
+	defer fastPeer.Close()
+	for _, c := range []*Conn{slow, fast} {
+		if err := stream.AddConn(c); err != nil {
+			t.Fatalf("add conn: %v", err)
+		}
+	}
+
+	received := make(chan int)
+	go func() {
+		reader := newTestConn(fastPeer)
+		count := 0
+		for {
+			var x ChunkStream
+			if err := reader.Read(&x); err != nil {
+				return
+			}
+			if x.TypeID == AudioMessageID {
+				count++
+				if count == packets {
+					received <- count
+					return
+				}
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < packets; i++ {
+			stream.Write(testAudio(AAC_RAW))
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("stream write blocked on slow destination")
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("fast destination did not receive all packets")
+	}
+
+	stream.mtx.Lock()
+	_, ok := stream.writers[writerKey{conn: slow}]
+	stream.mtx.Unlock()
+	if ok {
+		t.Errorf("expected slow destination to be disconnected")
+	}
+}
+
+// TestStreamSlowPlayClient will overflow a play client, and expect only
+// the NetStream to be removed and sent NetStream.Play.Failed.
+func TestStreamSlowPlayClient(t *testing.T) {
+	addr, err := NewURLAddr("rtmp://localhost:1935/twinx/slow-play")
+	if err != nil {
+		t.Fatalf("invalid addr: %v", err)
+	}
+	c, s := net.Pipe()
+	defer s.Close()
+	conn := newTestConn(c)
+	conn.URLAddr = *addr
+	conn.SetWriteQueueSize(1)
+	conn.SetOverflowPolicy(OverflowPolicyDisconnect)
+	stream := NewStream("slow-play-client")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	if err := stream.AddPlayConn(conn, 1); err != nil {
+		t.Fatalf("add play conn: %v", err)
+	}
+
+	// Nothing reads from the play client until it has been removed
+	waitFor(t, "the play client to be removed", func() bool {
+		stream.Write(testAudio(AAC_RAW))
+		stream.mtx.Lock()
+		defer stream.mtx.Unlock()
+		_, ok := stream.writers[writerKey{conn, 1}]
+		return !ok
+	})
+
+	reader := newTestConn(s)
+	s.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		var x ChunkStream
+		if err := reader.Read(&x); err != nil {
+			t.Fatalf("expected %s before the conn closed: %v", CommandNetStreamPlayFailed, err)
+		}
+		if x.TypeID != CommandMessageAMF0ID {
+			continue
+		}
+		vs, err := (&AMFDecoder{}).DecodeBatch(bytes.NewReader(x.Data), AMF0)
+		if err != nil || len(vs) < 4 {
+			t.Fatalf("invalid command: %v", err)
+		}
+		event, _ := vs[3].(AMFObject)
+		if event[ConnEventCode] != CommandNetStreamPlayFailed {
+			continue
+		}
+		if x.StreamID != 1 {
+			t.Errorf("expected status on stream 1, got %d", x.StreamID)
+		}
+		break
+	}
+}
+
+// TestStreamSeekWhileDraining will seek a play client while its writer
+// is writing, and should be run with -race.
+func TestStreamSeekWhileDraining(t *testing.T) {
+	addr, err := NewURLAddr("rtmp://localhost:1935/twinx/seek")
+	if err != nil {
+		t.Fatalf("invalid addr: %v", err)
+	}
+	c, s := net.Pipe()
+	defer s.Close()
+	conn := newTestConn(c)
+	conn.URLAddr = *addr
+	// Audio is never dropped, so the queue holds every packet
+	conn.SetWriteQueueSize(2048)
+	stream := NewStream("seek-while-draining")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	if err := stream.AddPlayConn(conn, 1); err != nil {
+		t.Fatalf("add play conn: %v", err)
+	}
+	defer stream.RemovePlayConn(conn, 1)
+
+	go func() {
+		reader := newTestConn(s)
+		for {
+			var x ChunkStream
+			if err := reader.Read(&x); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	seeked := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(seeked)
+				return
+			default:
+			}
+			_, err := stream.Seek(conn, 1, 0)
+			if err != nil && err != errSeekInvalidTime {
+				seeked <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1024; i++ {
+		x := testAudio(AAC_RAW)
+		x.Timestamp = uint32(i * 20)
+		stream.Write(x)
+	}
+	close(done)
+	if err := <-seeked; err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+}
+
+// TestStreamResumePlayConnAt will switch a play client to a stream with
+// a DVR at an offset, and expect it to play from the DVR.
+func TestStreamResumePlayConnAt(t *testing.T) {
+	addr, err := NewURLAddr("rtmp://localhost:1935/twinx/play2")
+	if err != nil {
+		t.Fatalf("invalid addr: %v", err)
+	}
+	c, s := net.Pipe()
+	defer s.Close()
+	conn := newTestConn(c)
+	conn.URLAddr = *addr
+	stream := NewStream("resume-play-conn-at")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	stream.SetDVR(time.Minute, DefaultDVRMaximumSizeBytes)
+	for _, timestamp := range []uint32{1000, 1040, 2000} {
+		x := testVideo(FRAME_INTER, AVC_NALU)
+		if timestamp%1000 == 0 {
+			x = testVideo(FRAME_KEY, AVC_NALU)
+		}
+		x.Timestamp = timestamp
+		stream.Write(x)
+	}
+	if err := stream.ResumePlayConnAt(conn, 1, 1500); err != nil {
+		t.Fatalf("resume play conn: %v", err)
+	}
+	defer stream.RemovePlayConn(conn, 1)
+
+	reader := newTestConn(s)
+	s.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for _, expected := range []uint32{1000, 1040, 2000} {
+		var x ChunkStream
+		for x.TypeID != VideoMessageID {
+			if err := reader.Read(&x); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+		}
+		if x.Timestamp != expected {
+			t.Errorf("expected %d from the DVR, got %d", expected, x.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FLV File Format
+//
+// An FLV file is a header, followed by a series of tags. Each tag has
+// the same layout as the sub-message of an aggregate message, and is
+// followed by the size of the previous tag.
+//
+//  +--------+------------+----------+----------------+------------------+
+//  | FLV(3) | Version(1) | Flags(1) | Header Size(4) | Previous Size(4) |
+//  +--------+------------+----------+----------------+------------------+
+//  | Tag | Previous Size(4) | Tag | Previous Size(4) | ...              |
+//  +-----+------------------+-----+------------------+------------------+
+//
+// The flags have 0x04 set if the file has audio, and 0x01 set if the
+// file has video.
+
+const (
+	flvHeaderBytes       int  = 9
+	flvVersion           byte = 1
+	flvFlagAudio         byte = 0x04
+	flvFlagVideo         byte = 0x01
+	flvPreviousSizeBytes int  = 4
+
+	// flvDiscontinuityMilliseconds is how far a timestamp can go back
+	// before it is a new publisher, rather than interleaved audio and
+	// video.
+	flvDiscontinuityMilliseconds int64 = 1000
+)
+
+// WriteFLV will write a series of messages as an FLV file.
+//
+// The first packets should be the metadata and sequence headers, and
+// the first video should be a keyframe. Timestamps are rebased so the
+// file begins at 0. After a discontinuity, such as when the input has
+// been switched, the file continues DiscontinuityGapMilliseconds after
+// the last timestamp written. If the timestamps start again without a
+// discontinuity, the file continues from the last timestamp written.
+//
+// Only audio, video, and AMF0 metadata are written.
+func WriteFLV(w io.Writer, packets []*ChunkStream) error {
+	var flags byte
+	for _, x := range packets {
+		switch x.TypeID {
+		case AudioMessageID:
+			flags |= flvFlagAudio
+		case VideoMessageID:
+			flags |= flvFlagVideo
+		}
+	}
+	header := make([]byte, flvHeaderBytes+flvPreviousSizeBytes)
+	copy(header, "FLV")
+	header[3] = flvVersion
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], uint32(flvHeaderBytes))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	var (
+		started, rebase bool
+		base, written   int64
+		last            int64
+	)
+	for _, x := range packets {
+		// The discontinuity can be on the headers before the media
+		if x.discontinuity {
+			rebase = true
+		}
+		data := x.Data
+		switch x.TypeID {
+		case AudioMessageID, VideoMessageID:
+		case DataMessageAMF0ID:
+			var err error
+			if data, err = removeSetDataFrame(data); err != nil {
+				return fmt.Errorf("flv metadata: %v", err)
+			}
+		default:
+			continue
+		}
+
+		// The headers before the first media are written at 0
+		var timestamp int64
+		if isMedia(x) {
+			ts := int64(x.Timestamp)
+			if !started {
+				base = ts
+				started = true
+			} else if rebase {
+				base = ts - written - int64(DiscontinuityGapMilliseconds)
+			} else if ts+flvDiscontinuityMilliseconds < last {
+				base = ts - written
+			}
+			rebase = false
+			last = ts
+			if timestamp = ts - base; timestamp < 0 {
+				timestamp = 0
+			}
+			written = timestamp
+		} else if started {
+			timestamp = written
+		}
+		if err := writeFLVTag(w, x.TypeID, uint32(timestamp), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFLV will read the tags of an FLV file as messages. Only audio,
+// video, and AMF0 metadata are returned.
+func ReadFLV(r io.Reader) ([]*ChunkStream, error) {
+	header := make([]byte, flvHeaderBytes)
+	if err := readFull(r, header); err != nil {
+		return nil, fmt.Errorf("flv header: %v", err)
+	}
+	if string(header[:3]) != "FLV" {
+		return nil, fmt.Errorf("invalid flv signature %q", header[:3])
+	}
+	size := binary.BigEndian.Uint32(header[5:])
+	if size < uint32(flvHeaderBytes) {
+		return nil, fmt.Errorf("invalid flv header size %d", size)
+	}
+	// Skip the rest of the header, and the first previous tag size
+	if _, err := io.CopyN(io.Discard, r, int64(size)-int64(flvHeaderBytes)+int64(flvPreviousSizeBytes)); err != nil {
+		return nil, fmt.Errorf("flv header: %v", err)
+	}
+
+	var packets []*ChunkStream
+	tag := make([]byte, aggregateHeaderBytes)
+	for {
+		_, err := io.ReadFull(r, tag)
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("flv tag %d: %v", len(packets), err)
+		}
+		typeID := uint32(tag[0])
+		size := int(tag[1])<<16 | int(tag[2])<<8 | int(tag[3])
+		timestamp := uint32(tag[7])<<24 | uint32(tag[4])<<16 | uint32(tag[5])<<8 | uint32(tag[6])
+		if size > DefaultMaximumMessageSizeBytes {
+			return nil, fmt.Errorf("flv tag %d: size %d exceeds maximum %d", len(packets), size, DefaultMaximumMessageSizeBytes)
+		}
+		data := make([]byte, size+flvPreviousSizeBytes)
+		if err := readFull(r, data); err != nil {
+			return nil, fmt.Errorf("flv tag %d: %v", len(packets), err)
+		}
+		switch typeID {
+		case AudioMessageID, VideoMessageID, DataMessageAMF0ID:
+		default:
+			continue
+		}
+		packets = append(packets, &ChunkStream{
+			Timestamp: timestamp,
+			Length:    uint32(size),
+			TypeID:    typeID,
+			Data:      data[:size:size],
+		})
+	}
+}
+
+// writeFLVTag will write a single tag, and the size of the tag.
+func writeFLVTag(w io.Writer, typeID, timestamp uint32, data []byte) error {
+	tag := make([]byte, aggregateHeaderBytes)
+	tag[0] = byte(typeID)
+	putUint24(tag[1:], uint32(len(data)))
+	putUint24(tag[4:], timestamp)
+	tag[7] = byte(timestamp >> 24)
+	putUint24(tag[8:], 0)
+	if _, err := w.Write(tag); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	size := make([]byte, flvPreviousSizeBytes)
+	binary.BigEndian.PutUint32(size, uint32(aggregateHeaderBytes+len(data)))
+	_, err := w.Write(size)
+	return err
+}
+
+// isMedia returns true for audio and video that are not
+// sequence headers.
+func isMedia(x *ChunkStream) bool {
+	switch x.TypeID {
+	case AudioMessageID:
+		return !isAACSequenceHeader(x)
+	case VideoMessageID:
+		return !isAVCSequenceHeader(x)
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteFLV(t *testing.T) {
+	metaData, err := EncodeAMF(AMF0, SetDataFrame, "onMetaData", map[string]interface{}{"width": 1280.0})
+	if err != nil {
+		t.Fatalf("unable to encode metadata: %v", err)
+	}
+	meta := &ChunkStream{TypeID: DataMessageAMF0ID, Length: uint32(len(metaData)), Data: metaData, Timestamp: 10}
+	avcSeq := testVideo(FRAME_KEY, AVC_SEQHDR)
+	avcSeq.Timestamp = 20
+	key := testVideo(FRAME_KEY, AVC_NALU)
+	key.Timestamp = 5000
+	audio := testAudio(AAC_RAW)
+	audio.Timestamp = 4990
+	inter := testVideo(FRAME_INTER, AVC_NALU)
+	inter.Timestamp = 5033
+	// Published again, the timestamps start again
+	again := testVideo(FRAME_KEY, AVC_NALU)
+	again.Timestamp = 0
+	// The input is switched, forward and then a little back,
+	// with the sequence header marked as the discontinuity
+	forward := testVideo(FRAME_KEY, AVC_NALU)
+	forward.Timestamp = 9000
+	forward.discontinuity = true
+	backSeq := testVideo(FRAME_KEY, AVC_SEQHDR)
+	backSeq.Timestamp = 8800
+	backSeq.discontinuity = true
+	back := testVideo(FRAME_KEY, AVC_NALU)
+	back.Timestamp = 8800
+
+	buf := &bytes.Buffer{}
+	err = WriteFLV(buf, []*ChunkStream{meta, avcSeq, key, audio, inter, again, forward, backSeq, back})
+	if err != nil {
+		t.Fatalf("unable to write flv: %v", err)
+	}
+	b := buf.Bytes()
+	if string(b[:3]) != "FLV" || b[3] != 1 || b[4] != flvFlagAudio|flvFlagVideo {
+		t.Fatalf("invalid flv header: %v", b[:flvHeaderBytes])
+	}
+	b = b[flvHeaderBytes+flvPreviousSizeBytes:]
+
+	expected := []struct {
+		typeID    uint32
+		timestamp uint32
+	}{
+		{TAG_SCRIPTDATAAMF0, 0},
+		{TAG_VIDEO, 0},
+		{TAG_VIDEO, 0},
+		{TAG_AUDIO, 0},
+		{TAG_VIDEO, 33},
+		{TAG_VIDEO, 33},
+		{TAG_VIDEO, 66},
+		{TAG_VIDEO, 66},
+		{TAG_VIDEO, 99},
+	}
+	for i, e := range expected {
+		typeID := uint32(b[0])
+		size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		timestamp := uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+		if typeID != e.typeID || timestamp != e.timestamp {
+			t.Errorf("tag %d: expected type %d at %d, got type %d at %d", i, e.typeID, e.timestamp, typeID, timestamp)
+		}
+		data := b[aggregateHeaderBytes : aggregateHeaderBytes+size]
+		if typeID == TAG_SCRIPTDATAAMF0 {
+			vs, err := DecodeAMF(data, AMF0)
+			if err != nil || len(vs) != 2 || vs[0] != "onMetaData" {
+				t.Errorf("expected onMetaData without @setDataFrame, got %v %v", vs, err)
+			}
+		}
+		b = b[aggregateHeaderBytes+size:]
+		previous := binary.BigEndian.Uint32(b)
+		if int(previous) != aggregateHeaderBytes+size {
+			t.Errorf("tag %d: expected previous tag size %d, got %d", i, aggregateHeaderBytes+size, previous)
+		}
+		b = b[flvPreviousSizeBytes:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("expected %d tags, got %d more bytes", len(expected), len(b))
+	}
+}
+
+func TestReadFLV(t *testing.T) {
+	key := testVideo(FRAME_KEY, AVC_NALU)
+	key.Timestamp = 1000
+	audio := testAudio(AAC_RAW)
+	audio.Timestamp = 1010
+	buf := &bytes.Buffer{}
+	err := WriteFLV(buf, []*ChunkStream{testVideo(FRAME_KEY, AVC_SEQHDR), key, audio})
+	if err != nil {
+		t.Fatalf("unable to write flv: %v", err)
+	}
+	packets, err := ReadFLV(buf)
+	if err != nil {
+		t.Fatalf("unable to read flv: %v", err)
+	}
+	if len(packets) != 3 {
+		t.Fatalf("expected 3 packets, got %d", len(packets))
+	}
+	if !isAVCSequenceHeader(packets[0]) || !isKeyFrame(packets[1]) || packets[2].TypeID != AudioMessageID {
+		t.Errorf("unexpected packets")
+	}
+	if packets[2].Timestamp != 10 || !bytes.Equal(packets[2].Data, audio.Data) {
+		t.Errorf("expected audio at 10, got %d", packets[2].Timestamp)
+	}
+
+	if _, err := ReadFLV(bytes.NewReader([]byte("FLX"))); err == nil {
+		t.Fatalf("expected an error for an invalid flv")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+
+	"github.com/kris-nova/logger"
+)
+
+// GOPCache holds everything a conn that joins a stream mid-broadcast
+// needs to begin decoding right away.
+//
+// The onMetaData, the AVC and AAC sequence headers, and every packet
+// since the most recent video keyframe are cached. Each keyframe resets
+// the cached group of pictures (GOP).
+//
+// If a GOP grows beyond maxSizeBytes we drop it rather than replaying
+// a partial GOP, and begin caching again on the next keyframe.
+//
+// The cache retains the payload of every cached packet, and releases
+// it when the packet is replaced or dropped.
+type GOPCache struct {
+	metaData     *ChunkStream
+	avcSeqHeader *ChunkStream
+	aacSeqHeader *ChunkStream
+	gop          []*ChunkStream
+	gopSizeBytes int
+	maxSizeBytes int
+}
+
+func NewGOPCache(maxSizeBytes int) *GOPCache {
+	return &GOPCache{
+		maxSizeBytes: maxSizeBytes,
+	}
+}
+
+// Cache will inspect a packet, and cache it if it is needed
+// to begin decoding the stream.
+func (g *GOPCache) Cache(x *ChunkStream) {
+	switch x.TypeID {
+	case DataMessageAMF0ID, DataMessageAMF3ID:
+		g.replace(&g.metaData, x)
+	case AudioMessageID:
+		if isAACSequenceHeader(x) {
+			g.replace(&g.aacSeqHeader, x)
+			return
+		}
+		g.append(x)
+	case VideoMessageID:
+		if isAVCSequenceHeader(x) {
+			g.replace(&g.avcSeqHeader, x)
+			return
+		}
+		if isKeyFrame(x) {
+			g.reset()
+		}
+		g.append(x)
+	}
+}
+
+// replace will cache x in place of a cached header.
+func (g *GOPCache) replace(cached **ChunkStream, x *ChunkStream) {
+	x.retain()
+	if *cached != nil {
+		(*cached).release()
+	}
+	*cached = x
+}
+
+// reset will drop the cached GOP.
+func (g *GOPCache) reset() {
+	for _, x := range g.gop {
+		x.release()
+	}
+	g.gop = nil
+	g.gopSizeBytes = 0
+}
+
+func (g *GOPCache) append(x *ChunkStream) {
+	if len(g.gop) == 0 && !isKeyFrame(x) {
+		// A GOP always begins on a keyframe
+		return
+	}
+	if g.gopSizeBytes+len(x.Data) > g.maxSizeBytes {
+		logger.Debug(rtmpMessage(fmt.Sprintf("GOP cache exceeded %d bytes, dropping GOP", g.maxSizeBytes), warn))
+		g.reset()
+		return
+	}
+	x.retain()
+	g.gop = append(g.gop, x)
+	g.gopSizeBytes += len(x.Data)
+}
+
+// Packets returns the cached packets in the order they should be
+// replayed to a new conn.
+func (g *GOPCache) Packets() []*ChunkStream {
+	return append(g.Headers(), g.gop...)
+}
+
+// Headers returns the cached metadata and sequence headers, without
+// the GOP.
+func (g *GOPCache) Headers() []*ChunkStream {
+	var packets []*ChunkStream
+	for _, x := range []*ChunkStream{g.metaData, g.avcSeqHeader, g.aacSeqHeader} {
+		if x != nil {
+			packets = append(packets, x)
+		}
+	}
+	return packets
+}
+
+func isKeyFrame(x *ChunkStream) bool {
+	if x.TypeID != VideoMessageID || len(x.Data) < 1 {
+		return false
+	}
+	return x.Data[0]>>4 == FRAME_KEY
+}
+
+func isAVCSequenceHeader(x *ChunkStream) bool {
+	if x.TypeID != VideoMessageID || len(x.Data) < 2 {
+		return false
+	}
+	return x.Data[0]&0x0f == VIDEO_H264 && x.Data[1] == AVC_SEQHDR
+}
+
+func isAACSequenceHeader(x *ChunkStream) bool {
+	if x.TypeID != AudioMessageID || len(x.Data) < 2 {
+		return false
+	}
+	return x.Data[0]>>4 == SOUND_AAC && x.Data[1] == AAC_SEQHDR
+}
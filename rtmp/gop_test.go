@@ -0,0 +1,92 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"testing"
+)
+
+func testVideo(frameType, avcType uint8) *ChunkStream {
+	data := []byte{frameType<<4 | VIDEO_H264, avcType, 0, 0, 0}
+	return &ChunkStream{TypeID: VideoMessageID, Length: uint32(len(data)), Data: data, StreamID: 1}
+}
+
+func testAudio(aacType uint8) *ChunkStream {
+	data := []byte{SOUND_AAC<<4 | SOUND_44Khz<<2 | SOUND_16BIT<<1 | SOUND_STEREO, aacType, 0}
+	return &ChunkStream{TypeID: AudioMessageID, Length: uint32(len(data)), Data: data, StreamID: 1}
+}
+
+func TestGOPCache(t *testing.T) {
+	g := NewGOPCache(DefaultGOPCacheMaximumSizeBytes)
+	meta := &ChunkStream{TypeID: DataMessageAMF0ID, Length: 1, Data: []byte{0}, StreamID: 1}
+	avcSeq := testVideo(FRAME_KEY, AVC_SEQHDR)
+	aacSeq := testAudio(AAC_SEQHDR)
+	key1 := testVideo(FRAME_KEY, AVC_NALU)
+	key2 := testVideo(FRAME_KEY, AVC_NALU)
+	inter := testVideo(FRAME_INTER, AVC_NALU)
+	audio := testAudio(AAC_RAW)
+
+	for _, x := range []*ChunkStream{
+		meta, avcSeq, aacSeq,
+		testVideo(FRAME_INTER, AVC_NALU), // Before the first keyframe, never cached
+		key1, inter, audio,
+		key2, inter, audio,
+	} {
+		g.Cache(x)
+	}
+
+	expected := []*ChunkStream{meta, avcSeq, aacSeq, key2, inter, audio}
+	actual := g.Packets()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d cached packets, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("unexpected packet at position %d", i)
+		}
+	}
+}
+
+func TestGOPCacheMaximumSize(t *testing.T) {
+	g := NewGOPCache(12)
+	g.Cache(testVideo(FRAME_KEY, AVC_NALU))
+	g.Cache(testVideo(FRAME_INTER, AVC_NALU))
+	if len(g.Packets()) != 2 {
+		t.Fatalf("expected 2 cached packets, got %d", len(g.Packets()))
+	}
+	g.Cache(testVideo(FRAME_INTER, AVC_NALU))
+	if len(g.Packets()) != 0 {
+		t.Fatalf("expected oversized GOP to be dropped, got %d packets", len(g.Packets()))
+	}
+	g.Cache(testVideo(FRAME_INTER, AVC_NALU))
+	if len(g.Packets()) != 0 {
+		t.Fatalf("expected caching to resume on a keyframe, got %d packets", len(g.Packets()))
+	}
+	g.Cache(testVideo(FRAME_KEY, AVC_NALU))
+	if len(g.Packets()) != 1 {
+		t.Fatalf("expected 1 cached packet, got %d", len(g.Packets()))
+	}
+}
@@ -43,12 +43,11 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math/rand"
 	"time"
-
-	"github.com/gwuhaolin/livego/utils/pio"
 )
 
 func hsMakeDigest(key []byte, src []byte, gap int) (dst []byte) {
@@ -95,8 +94,8 @@ func hsCreate01(p []byte, time uint32, ver uint32, key []byte) {
 	p[0] = 3
 	p1 := p[1:]
 	rand.Read(p1[8:])
-	pio.PutU32BE(p1[0:4], time)
-	pio.PutU32BE(p1[4:8], ver)
+	binary.BigEndian.PutUint32(p1[0:4], time)
+	binary.BigEndian.PutUint32(p1[4:8], ver)
 	gap := hsCalcDigestPos(p1, 8)
 	digest := hsMakeDigest(key, p1, gap)
 	copy(p1[gap:], digest)
@@ -109,17 +108,41 @@ func hsCreate2(p []byte, key []byte) {
 	copy(p[gap:], digest)
 }
 
+// hsVerify2 will validate the digest at the end of a C2 or S2 packet.
+//
+// The peer creates the packet with hsCreate2() using a digest
+// of our own C1 (or S1) signed with the peer's full key.
+func hsVerify2(p []byte, key []byte) bool {
+	gap := len(p) - 32
+	digest := hsMakeDigest(key, p, gap)
+	return bytes.Equal(p[gap:], digest)
+}
+
+// HandshakeClient will perform the complex (digest based, FP9) client
+// handshake.
+//
+// The server's S1 and S2 digests are validated. If the server responds
+// with a simple handshake (S1 version 0) the client will fall back to
+// the simple handshake and echo S1 as C2.
 func (conn *Conn) HandshakeClient() (err error) {
 	var random [(1 + 1536*2) * 2]byte
 
 	C0C1C2 := random[:1536*2+1]
-	C0 := C0C1C2[:1]
 	C0C1 := C0C1C2[:1536+1]
+	C1 := C0C1C2[1 : 1536+1]
 	C2 := C0C1C2[1536+1:]
 
 	S0S1S2 := random[1536*2+1:]
+	S0 := S0S1S2[:1]
+	S1 := S0S1S2[1 : 1536+1]
+	S2 := S0S1S2[1536+1:]
+
+	// C0 is set to 3 in hsCreate01()
+	hsCreate01(C0C1, 0, HandshakeClientVersion, HandshakeClientPartial30)
+	gap := hsCalcDigestPos(C1, 8)
+	C1Digest := make([]byte, 32)
+	copy(C1Digest, C1[gap:gap+32])
 
-	C0[0] = 3
 	// > C0C1
 	conn.Conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
 	if _, err = conn.rw.Write(C0C1); err != nil {
@@ -135,12 +158,29 @@ func (conn *Conn) HandshakeClient() (err error) {
 	if _, err = io.ReadFull(conn.rw, S0S1S2); err != nil {
 		return
 	}
+	if S0[0] != 3 {
+		err = fmt.Errorf("rtmp: handshake version=%d invalid", S0[0])
+		return
+	}
 
-	S1 := S0S1S2[1 : 1536+1]
-	if ver := pio.U32BE(S1[4:8]); ver != 0 {
-		C2 = S1
+	if ver := binary.BigEndian.Uint32(S1[4:8]); ver != 0 {
+		var ok bool
+		var digest []byte
+		if ok, digest = hsParse1(S1, HandshakeServerPartial36, HandshakeClientKey); !ok {
+			err = fmt.Errorf("rtmp: handshake client: S1 digest invalid")
+			return
+		}
+
+		// S2 is signed with a digest of our C1. Some servers will
+		// send a simple S2 (an echo of C1) which is also valid.
+		if !hsVerify2(S2, hsMakeDigest(HandshakeServerKey, C1Digest, -1)) && !bytes.Equal(S2, C1) {
+			err = fmt.Errorf("rtmp: handshake client: S2 digest invalid")
+			return
+		}
+		hsCreate2(C2, digest)
 	} else {
-		C2 = S1
+		// Simple handshake
+		copy(C2, S1)
 	}
 
 	// > C2
@@ -148,6 +188,10 @@ func (conn *Conn) HandshakeClient() (err error) {
 	if _, err = conn.rw.Write(C2); err != nil {
 		return
 	}
+	conn.Conn.SetDeadline(time.Now().Add(TimeoutDurationSeconds))
+	if err = conn.rw.Flush(); err != nil {
+		return
+	}
 	conn.Conn.SetDeadline(time.Time{})
 	return
 }
@@ -180,10 +224,10 @@ func (conn *Conn) HandshakeServer() (err error) {
 
 	S0[0] = 3
 
-	clitime := pio.U32BE(C1[0:4])
+	clitime := binary.BigEndian.Uint32(C1[0:4])
 	srvtime := clitime
 	srvver := uint32(0x0d0e0a0d)
-	cliver := pio.U32BE(C1[4:8])
+	cliver := binary.BigEndian.Uint32(C1[4:8])
 
 	if cliver != 0 {
 		var ok bool
@@ -0,0 +1,112 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn:      c,
+		rw:        NewReadWriter(c, 4096),
+		chunkSize: DefaultRTMPChunkSizeBytes,
+		chunks:    make(map[uint32]ChunkStream),
+		pool:      NewPool(),
+	}
+}
+
+func TestHandshakeComplex(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	server := NewServerConn(newTestConn(s))
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.handshake()
+	}()
+	err := newTestConn(c).HandshakeClient()
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+}
+
+// simpleHandshakeServer will respond to C0C1 with an S1 version of 0
+// and echo C1 back as S2. If corruptS1 is set, S1 carries an invalid digest.
+func simpleHandshakeServer(t *testing.T, s net.Conn, corruptS1 bool) {
+	C0C1 := make([]byte, 1537)
+	if _, err := io.ReadFull(s, C0C1); err != nil {
+		t.Errorf("read C0C1: %v", err)
+		return
+	}
+	S0S1S2 := make([]byte, 1+1536*2)
+	if corruptS1 {
+		hsCreate01(S0S1S2[:1537], 0, 0x0d0e0a0d, []byte("not the server key"))
+	} else {
+		S0S1S2[0] = 3
+	}
+	copy(S0S1S2[1537:], C0C1[1:])
+	if _, err := s.Write(S0S1S2); err != nil {
+		t.Errorf("write S0S1S2: %v", err)
+		return
+	}
+	C2 := make([]byte, 1536)
+	if _, err := io.ReadFull(s, C2); err != nil {
+		return
+	}
+	if !bytes.Equal(C2, S0S1S2[1:1537]) {
+		t.Errorf("simple handshake C2 does not echo S1")
+	}
+}
+
+func TestHandshakeSimpleFallback(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go simpleHandshakeServer(t, s, false)
+	err := newTestConn(c).HandshakeClient()
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+}
+
+func TestHandshakeInvalidDigest(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go simpleHandshakeServer(t, s, true)
+	err := newTestConn(c).HandshakeClient()
+	if err == nil || !strings.Contains(err.Error(), "S1 digest invalid") {
+		t.Fatalf("expected S1 digest error, got: %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/kris-nova/logger"
+)
+
+// Input is a publisher of a stream.
+//
+// A stream can be published by more than one encoder, such as OBS
+// and a hardware encoder, and each is an input of the stream. Only
+// the active input is written to the destinations and play clients,
+// which follow the healthy input with the lowest priority value, or
+// the input chosen with UseInput. Every switch is at a keyframe of
+// the new input, and is a discontinuity so the timestamps never go back.
+type Input struct {
+	Name     string
+	Priority int
+	Addr     string
+	Active   bool
+	Healthy  bool
+	Forced   bool
+}
+
+// streamInput is the state of an input, guarded by the lock of
+// the stream.
+type streamInput struct {
+	name     string
+	priority int
+	addr     string
+
+	// headers are the metadata and sequence headers of the input,
+	// which are written first when the stream switches to the input
+	headers GOPCache
+
+	// lastMedia is when the input last sent audio or video
+	lastMedia time.Time
+}
+
+func newStreamInput(name string, priority int, addr string) *streamInput {
+	if name == "" {
+		name = DefaultInputName
+	}
+	return &streamInput{
+		name:     name,
+		priority: priority,
+		addr:     addr,
+	}
+}
+
+// publishInput will return the input named by a publish client in the
+// query of the stream name, such as "camera?input=backup&priority=1".
+func publishInput(name string, addr net.Addr) (*streamInput, error) {
+	_, query := splitQuery(name)
+	priority := 0
+	if raw := query.Get(QueryPriority); raw != "" {
+		var err error
+		priority, err = strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input priority %q", raw)
+		}
+	}
+	return newStreamInput(query.Get(QueryInput), priority, addr.String()), nil
+}
+
+// cache will keep the headers of the input, and when the input was
+// last sent media.
+func (in *streamInput) cache(x *ChunkStream, now time.Time) {
+	switch {
+	case x.TypeID == DataMessageAMF0ID || x.TypeID == DataMessageAMF3ID:
+		in.headers.replace(&in.headers.metaData, x)
+	case isAVCSequenceHeader(x):
+		in.headers.replace(&in.headers.avcSeqHeader, x)
+	case isAACSequenceHeader(x):
+		in.headers.replace(&in.headers.aacSeqHeader, x)
+	case isMedia(x):
+		in.lastMedia = now
+	}
+}
+
+// healthy will return true if the input has sent media within
+// InputHealthTimeout.
+func (in *streamInput) healthy(now time.Time) bool {
+	return !in.lastMedia.IsZero() && now.Sub(in.lastMedia) <= InputHealthTimeout
+}
+
+// switchable will return true if the stream can switch to the input
+// at x, which is a keyframe, or any media if the input has no video.
+func (in *streamInput) switchable(x *ChunkStream) bool {
+	if in.headers.avcSeqHeader == nil {
+		return isMedia(x)
+	}
+	return isKeyFrame(x) && !isAVCSequenceHeader(x)
+}
+
+// release will drop the cached headers.
+func (in *streamInput) release() {
+	for _, cached := range []**ChunkStream{&in.headers.metaData, &in.headers.avcSeqHeader, &in.headers.aacSeqHeader} {
+		if *cached != nil {
+			(*cached).release()
+			*cached = nil
+		}
+	}
+}
+
+// addInput will add a publisher to the stream. The first input is
+// active right away, and the stream will switch to any other input at
+// its first keyframe, if it is preferred.
+func (s *Stream) addInput(in *streamInput) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, existing := range s.inputs {
+		if existing.name == in.name {
+			return fmt.Errorf("input %s already publishing to %s", in.name, s.key)
+		}
+	}
+	if len(s.inputs) == 0 {
+		s.active = in
+	}
+	s.inputs = append(s.inputs, in)
+	sort.SliceStable(s.inputs, func(i, j int) bool {
+		return s.inputs[i].priority < s.inputs[j].priority
+	})
+	s.selectInput(time.Now())
+	return nil
+}
+
+// removeInput will remove a publisher from the stream. If the input
+// was active, the stream switches to the next healthy input at its
+// next keyframe.
+func (s *Stream) removeInput(in *streamInput) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, existing := range s.inputs {
+		if existing == in {
+			s.inputs = append(s.inputs[:i], s.inputs[i+1:]...)
+			break
+		}
+	}
+	if s.active == in {
+		s.active = nil
+		// The cached GOP will never be decoded after the next keyframe
+		s.gop.reset()
+	}
+	if s.next == in {
+		s.next = nil
+	}
+	in.release()
+	s.selectInput(time.Now())
+}
+
+// Inputs will return the publishers of the stream, sorted by priority.
+func (s *Stream) Inputs() []Input {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := time.Now()
+	var inputs []Input
+	for _, in := range s.inputs {
+		inputs = append(inputs, Input{
+			Name:     in.name,
+			Priority: in.priority,
+			Addr:     in.addr,
+			Active:   in == s.active,
+			Healthy:  in.healthy(now),
+			Forced:   in.name == s.forced,
+		})
+	}
+	return inputs
+}
+
+// UseInput will force the stream to follow an input while it is
+// healthy, regardless of priority. The stream switches at the next
+// keyframe of the input. An empty name will follow the healthy input
+// with the lowest priority value again.
+func (s *Stream) UseInput(name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if name != "" {
+		found := false
+		for _, in := range s.inputs {
+			if in.name == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown input %s for stream %s", name, s.key)
+		}
+	}
+	s.forced = name
+	s.selectInput(time.Now())
+	return nil
+}
+
+// selectInput will choose the input the stream should follow, which
+// is the forced input or the healthy input with the lowest priority
+// value. If there is no healthy input the active input is kept.
+//
+// This must be called while holding the lock.
+func (s *Stream) selectInput(now time.Time) {
+	var best *streamInput
+	for _, in := range s.inputs {
+		if !in.healthy(now) {
+			continue
+		}
+		if in.name == s.forced {
+			best = in
+			break
+		}
+		if best == nil {
+			best = in
+		}
+	}
+	switch {
+	case best == nil || best == s.active:
+		s.next = nil
+	case best != s.next:
+		logger.Info(rtmpMessage(fmt.Sprintf("Switching %s to input %s at the next keyframe", s.key, best.name), stream))
+		s.next = best
+	}
+}
+
+// writeInput will write a packet from an input if the input is active,
+// or switch to the input at the packet. A nil input is always written.
+// writeInput will return true if the packet was written.
+//
+// This must be called while holding the lock.
+func (s *Stream) writeInput(in *streamInput, x *ChunkStream) bool {
+	if in == nil {
+		s.write(x)
+		return true
+	}
+	now := time.Now()
+	in.cache(x, now)
+	s.selectInput(now)
+	switch {
+	case in == s.active:
+		s.write(x)
+		return true
+	case in == s.next && in.switchable(x):
+		s.switchInput(x)
+		return true
+	}
+	return false
+}
+
+// switchInput will make next the active input at x. The headers of the
+// input are written first, and the first packet is a discontinuity so
+// that every writer rebases the timestamps of the input.
+//
+// This must be called while holding the lock.
+func (s *Stream) switchInput(x *ChunkStream) {
+	logger.Info(rtmpMessage(fmt.Sprintf("Input %s is live on %s", s.next.name, s.key), stream))
+	s.active, s.next = s.next, nil
+	packets := discontinuity(s.active.headers.Headers(), x.Timestamp)
+	if len(packets) == 0 {
+		packets = discontinuity([]*ChunkStream{x}, x.Timestamp)
+	} else {
+		packets = append(packets, x)
+	}
+	for _, y := range packets {
+		s.write(y)
+	}
+}
+
+// Inputs will return the publishers of a stream. An empty name is
+// the first stream published to the server.
+func (s *Server) Inputs(name string) ([]Input, error) {
+	live, err := s.publishedStream(name)
+	if err != nil {
+		return nil, err
+	}
+	return live.Inputs(), nil
+}
+
+// UseInput will force a stream to follow an input, such as the backup
+// encoder, while it is healthy. An empty input will follow the healthy
+// input with the lowest priority value again.
+func (s *Server) UseInput(name, input string) error {
+	live, err := s.publishedStream(name)
+	if err != nil {
+		return err
+	}
+	return live.UseInput(input)
+}
+
+// publishedStream will return a published stream, or the first stream
+// published to the server if name is empty.
+func (s *Server) publishedStream(name string) (*Stream, error) {
+	live := s.liveStream(name)
+	if live == nil {
+		return nil, fmt.Errorf("stream not published: %s", name)
+	}
+	return live, nil
+}
@@ -0,0 +1,219 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPublishInput(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1935}
+	in, err := publishInput("camera?input=backup&priority=2", addr)
+	if err != nil {
+		t.Fatalf("publish input: %v", err)
+	}
+	if in.name != "backup" || in.priority != 2 || in.addr != "127.0.0.1:1935" {
+		t.Errorf("unexpected input %s priority %d from %s", in.name, in.priority, in.addr)
+	}
+	in, err = publishInput("camera", addr)
+	if err != nil || in.name != DefaultInputName || in.priority != 0 {
+		t.Errorf("expected the default input, got %v %v", in, err)
+	}
+	if _, err := publishInput("camera?priority=first", addr); err == nil {
+		t.Errorf("expected an error for an invalid priority")
+	}
+}
+
+// TestStreamInputs will publish a primary and a backup input to a stream,
+// and expect a destination to follow the preferred healthy input, switching
+// at keyframes with monotonic timestamps.
+func TestStreamInputs(t *testing.T) {
+	addr, err := NewURLAddr("rtmp://localhost:1935/twinx/inputs")
+	if err != nil {
+		t.Fatalf("invalid addr: %v", err)
+	}
+	c, peer := net.Pipe()
+	defer peer.Close()
+	conn := newTestConn(c)
+	conn.URLAddr = *addr
+
+	stream := NewStream("inputs")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	if err := stream.AddConn(conn); err != nil {
+		t.Fatalf("add conn: %v", err)
+	}
+	defer stream.RemoveConn(conn)
+
+	primary := newStreamInput("primary", 0, "")
+	backup := newStreamInput("backup", 1, "")
+	if err := stream.addInput(primary); err != nil {
+		t.Fatalf("add primary: %v", err)
+	}
+	if err := stream.addInput(backup); err != nil {
+		t.Fatalf("add backup: %v", err)
+	}
+	if err := stream.addInput(newStreamInput("backup", 2, "")); err == nil {
+		t.Fatalf("expected an error adding an input twice")
+	}
+
+	// Packets are marked with their input in the last byte
+	write := func(in *streamInput, frameType, avcType uint8, timestamp uint32) {
+		x := testVideo(frameType, avcType)
+		x.Timestamp = timestamp
+		if in == backup {
+			x.Data[4] = 1
+		}
+		stream.publish(in, x)
+	}
+	reader := newTestConn(peer)
+	var last uint32
+	read := func() *ChunkStream {
+		for {
+			x := &ChunkStream{}
+			if err := reader.Read(x); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if x.TypeID != VideoMessageID {
+				continue
+			}
+			if x.Timestamp < last {
+				t.Fatalf("timestamp went back from %d to %d", last, x.Timestamp)
+			}
+			last = x.Timestamp
+			return x
+		}
+	}
+	expect := func(in *streamInput, frameType, avcType uint8) {
+		x := read()
+		marked := byte(0)
+		if in == backup {
+			marked = 1
+		}
+		if x.Data[0]>>4 != frameType || x.Data[1] != avcType || x.Data[4] != marked {
+			t.Fatalf("expected %s frame %d/%d, got %v", in.name, frameType, avcType, x.Data)
+		}
+	}
+	active := func() string {
+		for _, in := range stream.Inputs() {
+			if in.Active {
+				return in.Name
+			}
+		}
+		return ""
+	}
+
+	write(primary, FRAME_KEY, AVC_SEQHDR, 5000)
+	write(primary, FRAME_KEY, AVC_NALU, 5000)
+	expect(primary, FRAME_KEY, AVC_SEQHDR)
+	expect(primary, FRAME_KEY, AVC_NALU)
+
+	// The backup is healthy, but the primary is preferred
+	write(backup, FRAME_KEY, AVC_SEQHDR, 100)
+	write(backup, FRAME_KEY, AVC_NALU, 100)
+	if active() != "primary" {
+		t.Fatalf("expected the primary input, got %s", active())
+	}
+
+	// Forcing the backup switches at its next keyframe
+	if err := stream.UseInput("backup"); err != nil {
+		t.Fatalf("use input: %v", err)
+	}
+	write(backup, FRAME_INTER, AVC_NALU, 133)
+	write(primary, FRAME_INTER, AVC_NALU, 5033)
+	write(backup, FRAME_KEY, AVC_NALU, 166)
+	expect(primary, FRAME_INTER, AVC_NALU)
+	expect(backup, FRAME_KEY, AVC_SEQHDR)
+	expect(backup, FRAME_KEY, AVC_NALU)
+	if active() != "backup" {
+		t.Fatalf("expected the backup input, got %s", active())
+	}
+	if err := stream.UseInput("missing"); err == nil {
+		t.Fatalf("expected an error for an unknown input")
+	}
+
+	// Back to the primary at its next keyframe
+	if err := stream.UseInput(""); err != nil {
+		t.Fatalf("use input: %v", err)
+	}
+	write(primary, FRAME_INTER, AVC_NALU, 5066)
+	write(primary, FRAME_KEY, AVC_NALU, 5100)
+	expect(primary, FRAME_KEY, AVC_SEQHDR)
+	expect(primary, FRAME_KEY, AVC_NALU)
+
+	// The primary stops sending media, and the backup takes over
+	stream.mtx.Lock()
+	primary.lastMedia = time.Now().Add(-2 * InputHealthTimeout)
+	stream.mtx.Unlock()
+	write(backup, FRAME_KEY, AVC_NALU, 200)
+	expect(backup, FRAME_KEY, AVC_SEQHDR)
+	expect(backup, FRAME_KEY, AVC_NALU)
+
+	// The backup disconnects, and the primary returns
+	stream.removeInput(backup)
+	write(primary, FRAME_KEY, AVC_NALU, 5200)
+	expect(primary, FRAME_KEY, AVC_SEQHDR)
+	expect(primary, FRAME_KEY, AVC_NALU)
+	if inputs := stream.Inputs(); len(inputs) != 1 || !inputs[0].Active || !inputs[0].Healthy {
+		t.Fatalf("expected the primary input, got %+v", inputs)
+	}
+}
+
+func TestServerInputs(t *testing.T) {
+	server := NewServer()
+	primary := testPublisher(t, server, "localhost:1959/twinx/failover")
+	backup := NewServerConn(&Conn{chunkSize: DefaultRTMPChunkSizeBytes})
+	backup.server = server
+	backup.streamName = "twinx/failover"
+	backup.input = newStreamInput("backup", 1, "")
+	if err := server.PublishClient(backup); err != nil {
+		t.Fatalf("publish backup: %v", err)
+	}
+	inputs, err := server.Inputs("twinx/failover")
+	if err != nil {
+		t.Fatalf("inputs: %v", err)
+	}
+	if len(inputs) != 2 || inputs[0].Name != DefaultInputName || !inputs[0].Active || inputs[1].Name != "backup" {
+		t.Fatalf("unexpected inputs %+v", inputs)
+	}
+	if err := server.UseInput("twinx/failover", "backup"); err != nil {
+		t.Fatalf("use input: %v", err)
+	}
+
+	// The stream is published until the last input is gone
+	server.UnpublishClient(primary)
+	if server.liveStream("twinx/failover") == nil {
+		t.Fatalf("expected the stream to be published by the backup")
+	}
+	server.UnpublishClient(backup)
+	if server.liveStream("twinx/failover") != nil {
+		t.Fatalf("expected the stream to be unpublished")
+	}
+	if _, err := server.Inputs("twinx/failover"); err == nil {
+		t.Fatalf("expected an error for an unpublished stream")
+	}
+}
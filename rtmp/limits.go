@@ -0,0 +1,147 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Limits protect a Server from too many, or abusive, clients.
+// A zero value for any limit will disable the limit.
+type Limits struct {
+	// MaxConnections is the total number of clients
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the number of clients from one IP address
+	MaxConnectionsPerIP int
+
+	// MaxHandshakes is the number of clients that can be
+	// in the handshake at the same time
+	MaxHandshakes int
+
+	// HandshakeTimeout is the time a client has to complete the handshake
+	HandshakeTimeout time.Duration
+
+	// IdleTimeout is the time a client can go without sending anything,
+	// before it is disconnected. Play clients are never idle.
+	IdleTimeout time.Duration
+
+	// MaxPublishBitrate is the maximum inbound bits per second
+	// for a publish client, averaged over DefaultBitrateWindow
+	MaxPublishBitrate int64
+}
+
+// DefaultLimits are the limits for a new Server.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxConnections:      DefaultMaxConnections,
+		MaxConnectionsPerIP: DefaultMaxConnectionsPerIP,
+		MaxHandshakes:       DefaultMaxHandshakes,
+		HandshakeTimeout:    DefaultHandshakeTimeout,
+		IdleTimeout:         DefaultIdleTimeout,
+	}
+}
+
+// admit will count a new client from addr against the limits. Every
+// admitted client must be released, and every handshake finished.
+func (s *Server) admit(addr net.Addr) error {
+	ip := addr.String()
+	if x := addrIP(addr); x != nil {
+		ip = x.String()
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.limits.MaxConnections > 0 && s.connections >= s.limits.MaxConnections {
+		return fmt.Errorf("maximum connections %d", s.limits.MaxConnections)
+	}
+	if s.limits.MaxConnectionsPerIP > 0 && s.connectionsPerIP[ip] >= s.limits.MaxConnectionsPerIP {
+		return fmt.Errorf("maximum connections per IP %d", s.limits.MaxConnectionsPerIP)
+	}
+	if s.limits.MaxHandshakes > 0 && s.handshakes >= s.limits.MaxHandshakes {
+		return fmt.Errorf("maximum concurrent handshakes %d", s.limits.MaxHandshakes)
+	}
+	s.connections++
+	s.connectionsPerIP[ip]++
+	s.handshakes++
+	return nil
+}
+
+// handshakeDone will release the handshake of an admitted client.
+func (s *Server) handshakeDone() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.handshakes--
+}
+
+// release will release an admitted client from addr.
+func (s *Server) release(addr net.Addr) {
+	ip := addr.String()
+	if x := addrIP(addr); x != nil {
+		ip = x.String()
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.connections--
+	s.connectionsPerIP[ip]--
+	if s.connectionsPerIP[ip] <= 0 {
+		delete(s.connectionsPerIP, ip)
+	}
+}
+
+// bitrate will measure the inbound bits per second of a publish
+// client over a window, and fail when the maximum is exceeded.
+type bitrate struct {
+	maximum int64
+	window  time.Duration
+	start   time.Time
+	bits    int64
+}
+
+func newBitrate(maximum int64, window time.Duration) *bitrate {
+	return &bitrate{
+		maximum: maximum,
+		window:  window,
+	}
+}
+
+// add will count n bytes received at now. An error is returned as soon
+// as the bits received in the window exceed the maximum for the window.
+func (b *bitrate) add(n int, now time.Time) error {
+	if b == nil || b.maximum <= 0 {
+		return nil
+	}
+	if now.Sub(b.start) >= b.window {
+		b.start = now
+		b.bits = 0
+	}
+	b.bits += int64(n) * 8
+	if b.bits > b.maximum*int64(b.window/time.Millisecond)/1000 {
+		return fmt.Errorf("maximum publish bitrate %d bits/s exceeded", b.maximum)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServerLimits will connect clients over the limits, and
+// expect them to be closed before the handshake.
+func TestServerLimits(t *testing.T) {
+	listener, err := Listen("localhost:1948/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.SetLimits(Limits{
+		MaxConnectionsPerIP: 1,
+		HandshakeTimeout:    time.Millisecond * 500,
+	})
+	go server.Serve(listener)
+	defer server.Close()
+
+	first, err := net.Dial("tcp", "localhost:1948")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	second, err := net.Dial("tcp", "localhost:1948")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer second.Close()
+	expectClosed(t, second, time.Millisecond*400)
+
+	// The first client never sends a handshake
+	expectClosed(t, first, time.Second*2)
+	waitFor(t, "the client to be released", func() bool {
+		server.mtx.Lock()
+		defer server.mtx.Unlock()
+		return server.connections == 0 && server.handshakes == 0 && len(server.connectionsPerIP) == 0
+	})
+}
+
+// expectClosed will expect the server to close conn within timeout.
+func expectClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("expected %s to be closed, got %v", conn.LocalAddr(), err)
+	}
+}
+
+func TestBitrate(t *testing.T) {
+	b := newBitrate(8000, time.Second)
+	now := time.Now()
+	if err := b.add(1000, now); err != nil {
+		t.Errorf("expected 8000 bits to be allowed: %v", err)
+	}
+	if err := b.add(1, now.Add(time.Millisecond*500)); err == nil {
+		t.Errorf("expected 8008 bits in 1s to exceed the maximum")
+	}
+	if err := b.add(1000, now.Add(time.Second)); err != nil {
+		t.Errorf("expected a new window: %v", err)
+	}
+
+	var unlimited *bitrate
+	if err := unlimited.add(1<<30, now); err != nil {
+		t.Errorf("expected no limit: %v", err)
+	}
+}
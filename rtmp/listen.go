@@ -26,6 +26,7 @@
 package rtmp
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 
@@ -55,6 +56,9 @@ func Listen(address string) (*Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("rtmp URL addr: %v", err)
 	}
+	if addr.TLS() {
+		return nil, fmt.Errorf("rtmps listen: missing certificate, use ListenTLS()")
+	}
 	listener, err := net.Listen(DefaultProtocol, addr.Host())
 	if err != nil {
 		return nil, fmt.Errorf("rtmp listen: %v", err)
@@ -66,6 +70,39 @@ func Listen(address string) (*Listener, error) {
 	}, nil
 }
 
+// ListenTLS will listen for rtmps:// clients such as OBS using
+// the certificate and private key PEM files.
+func ListenTLS(address, certFile, keyFile string) (*Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("rtmps load key pair: %v", err)
+	}
+	return ListenTLSConfig(address, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// ListenTLSConfig will listen for rtmps:// clients with an existing TLS configuration.
+func ListenTLSConfig(address string, config *tls.Config) (*Listener, error) {
+	addr, err := NewURLAddr(address)
+	if err != nil {
+		return nil, fmt.Errorf("rtmp URL addr: %v", err)
+	}
+	if !addr.TLS() {
+		return nil, fmt.Errorf("rtmps listen: invalid scheme %s", addr.Scheme())
+	}
+	listener, err := tls.Listen(DefaultProtocol, addr.Host(), config)
+	if err != nil {
+		return nil, fmt.Errorf("rtmps listen: %v", err)
+	}
+	logger.Info(rtmpMessage(fmt.Sprintf("server.ListenTLS %s", addr.Host()), listen))
+	return &Listener{
+		Listener: listener,
+		addr:     addr,
+	}, nil
+}
+
 func (l *Listener) Accept() (net.Conn, error) {
 	return l.Listener.Accept()
 }
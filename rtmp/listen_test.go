@@ -0,0 +1,124 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const (
+	TestTLSAddr string = "rtmps://localhost:1937/twinx/12345"
+)
+
+// selfSignedTLS will generate a localhost certificate, and
+// a pool that trusts it.
+func selfSignedTLS(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: DefaultLocalHost},
+		DNSNames:     []string{DefaultLocalHost},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, pool
+}
+
+func TestClientHandshakeTLS(t *testing.T) {
+	cert, pool := selfSignedTLS(t)
+	listener, err := ListenTLSConfig(TestTLSAddr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatalf("listen tls: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := NewServerConn(&Conn{
+				Conn:      netConn,
+				rw:        NewReadWriter(netConn, 4096),
+				chunkSize: DefaultRTMPChunkSizeBytes,
+				chunks:    make(map[uint32]ChunkStream),
+			})
+			go func() {
+				defer netConn.Close()
+				server.handshake()
+			}()
+		}
+	}()
+
+	// Verification should fail without trusting the certificate
+	untrusted := NewClientConn()
+	err = untrusted.Dial(TestTLSAddr)
+	if err == nil {
+		untrusted.Close()
+		t.Fatalf("expected certificate verification failure")
+	}
+
+	client := NewClientConn()
+	client.SetTLSConfig(&tls.Config{RootCAs: pool})
+	err = client.Dial(TestTLSAddr)
+	if err != nil {
+		t.Fatalf("unable to dial tls client: %v", err)
+	}
+	defer client.Close()
+	err = client.handshake()
+	if err != nil {
+		t.Errorf("tls handshake: %v", err)
+	}
+}
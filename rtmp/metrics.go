@@ -55,30 +55,48 @@ type Metrics struct {
 	PacketsPerSecond     float64
 	StartTime            time.Time
 
-	// Proxies is a map indexed on SafeURL()
+	// Proxies is a map indexed on URLAddr.ID()
 	Proxies map[string]*ProxyMetrics
 
+	// ClientRTT is the round trip time to each connected
+	// client, indexed on the remote address.
+	ClientRTT map[string]time.Duration
+
 	sync.Mutex
 }
 
 type ProxyMetrics struct {
-	ProxyAddrTX         string
-	ProxyTotalBytesTX   int
-	ProxyTotalPacketsTX int
-	ProxyKeyHash        string
+	ProxyAddrTX              string
+	ProxyTotalBytesTX        int
+	ProxyTotalPacketsTX      int
+	ProxyTotalPacketsDropped int
+	ProxyKeyHash             string
+
+	// ProxyReconnects is the number of times the proxy has been
+	// redialed after a failure, and ProxyLastError is the most
+	// recent failure.
+	ProxyReconnects    int
+	ProxyLastError     string
+	ProxyLastErrorTime time.Time
+
+	// ProxyRTT is the round trip time of the last ping.
+	ProxyRTT time.Duration
 }
 
-var m *Metrics
+var (
+	m     *Metrics
+	mOnce sync.Once
+)
 
 // M is a metrics singleton
 func M() *Metrics {
-	if m == nil {
+	mOnce.Do(func() {
 		m = &Metrics{
-			Proxies: make(map[string]*ProxyMetrics),
+			Proxies:   make(map[string]*ProxyMetrics),
+			ClientRTT: make(map[string]time.Duration),
 		}
 		go m.begin()
-		return m
-	}
+	})
 	return m
 }
 
@@ -113,10 +131,15 @@ func (metrics *Metrics) begin() {
 		//	nsec := d % Second
 		//	return float64(sec) + float64(nsec)/1e9
 
+		// Calculate once per second, rather than spinning
+		// and starving the stream writers.
+		time.Sleep(time.Second * 1)
+		metrics.Lock()
 		if metrics.ServerTotalBytesRX != 0 {
 			d := float64(metrics.ServerTotalPacketsRX-metrics.ServerPacketOffset) / time.Since(metrics.StartTime).Seconds()
 			metrics.PacketsPerSecond = d
 		}
+		metrics.Unlock()
 	}
 }
 
@@ -134,11 +157,20 @@ func (metrics *Metrics) String() string {
 	s += fmt.Sprintf("     Bytes RX :  [%d]\n", metrics.ServerTotalBytesRX)
 	s += fmt.Sprintf("   Packets RX :  [%d]\n", metrics.ServerTotalPacketsRX)
 	s += fmt.Sprintf(" Packets /sec :  [%f]\n", metrics.PacketsPerSecond)
+	for addr, rtt := range metrics.ClientRTT {
+		s += fmt.Sprintf("    ← Client [%s] RTT :  [%s]\n", addr, rtt)
+	}
 	for name, proxy := range metrics.Proxies {
-		s += fmt.Sprintf("    → Proxy Forward Addr [%s]\n", name)
+		s += fmt.Sprintf("    → Proxy Forward Addr [%s] (%s)\n", proxy.ProxyAddrTX, name)
 		s += fmt.Sprintf("           Stream :  [%s]\n", proxy.ProxyKeyHash)
 		s += fmt.Sprintf("        Bytes  TX :  [%d]\n", proxy.ProxyTotalBytesTX)
 		s += fmt.Sprintf("       Packets TX :  [%d]\n", proxy.ProxyTotalPacketsTX)
+		s += fmt.Sprintf("  Packets Dropped :  [%d]\n", proxy.ProxyTotalPacketsDropped)
+		s += fmt.Sprintf("       Reconnects :  [%d]\n", proxy.ProxyReconnects)
+		s += fmt.Sprintf("              RTT :  [%s]\n", proxy.ProxyRTT)
+		if proxy.ProxyLastError != "" {
+			s += fmt.Sprintf("       Last Error :  [%s] %s\n", proxy.ProxyLastErrorTime.Format(time.RFC3339), proxy.ProxyLastError)
+		}
 	}
 	return s
 }
@@ -0,0 +1,141 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"math"
+)
+
+// 7.2.2. NetStream Commands
+//
+// A NetConnection can support multiple NetStreams, each created with
+// createStream and identified by its message stream ID. The ServerConn
+// accepted by the server is the NetConnection, and each NetStream is a
+// ServerConn of its own that publishes to, or plays from, one stream.
+//
+// Commands and media are routed to a NetStream by the message stream ID
+// of the message. Messages on stream 0, from clients that publish or
+// play before the createStream response, are for the first NetStream.
+// Messages on a stream the client has not created are answered with
+// _error, or dropped.
+
+// netStream will return the NetStream with the message stream ID, or
+// nil if the client has not created the stream. Only createStream will
+// allocate a NetStream, except for the first NetStream of a client that
+// sends a message on stream 0 before it creates a stream.
+func (s *ServerConn) netStream(id uint32) *ServerConn {
+	if id == 0 {
+		id = 1
+		if len(s.streams) == 0 && s.lastStreamID == 0 {
+			ns, _ := s.createStream()
+			return ns
+		}
+	}
+	return s.streams[id]
+}
+
+// createStream will create the next NetStream. A connection can have
+// no more than DefaultConnMaximumNetStreams NetStreams at once.
+func (s *ServerConn) createStream() (*ServerConn, error) {
+	if len(s.streams) >= DefaultConnMaximumNetStreams {
+		return nil, fmt.Errorf("maximum net streams %d", DefaultConnMaximumNetStreams)
+	}
+	if s.lastStreamID == math.MaxUint32 {
+		return nil, fmt.Errorf("no stream IDs remaining")
+	}
+	if s.streams == nil {
+		s.streams = make(map[uint32]*ServerConn)
+	}
+	id := s.lastStreamID + 1
+	ns := NewServerConn(s.conn)
+	ns.streamID = id
+	ns.server = s.server
+	ns.connectInfo = s.connectInfo
+	ns.connectPacket = s.connectPacket
+	ns.idleTimeout = s.idleTimeout
+	ns.bitrate = s.bitrate
+	s.streams[id] = ns
+	s.lastStreamID = id
+	return ns, nil
+}
+
+// deleteStream will remove a NetStream, and return nil if it does
+// not exist.
+func (s *ServerConn) deleteStream(id uint32) *ServerConn {
+	ns, ok := s.streams[id]
+	if !ok {
+		return nil
+	}
+	delete(s.streams, id)
+	return ns
+}
+
+// publishStreams will return the NetStreams that publish with a name,
+// as sent by the client with publish.
+func (s *ServerConn) publishStreams(name string) []*ServerConn {
+	var streams []*ServerConn
+	for _, ns := range s.streams {
+		if ns.publishInfo != nil && ns.publishInfo.Name == name {
+			streams = append(streams, ns)
+		}
+	}
+	return streams
+}
+
+// isPlaying returns true if any NetStream of the connection is a
+// play client.
+func (s *ServerConn) isPlaying() bool {
+	s.server.mtx.Lock()
+	defer s.server.mtx.Unlock()
+	if s.clientType == PlayClient {
+		return true
+	}
+	for _, ns := range s.streams {
+		if ns.clientType == PlayClient {
+			return true
+		}
+	}
+	return false
+}
+
+// statusIDs are the chunk stream and message stream IDs for the
+// onStatus messages of a NetStream.
+func (s *ServerConn) statusIDs() (uint32, uint32) {
+	var csid, streamID uint32 = 3, 1
+	if s.connectPacket != nil {
+		csid, streamID = s.connectPacket.CSID, s.connectPacket.StreamID
+	}
+	if s.streamID != 0 {
+		streamID = s.streamID
+	}
+	return csid, streamID
+}
+
+// clientID is unique for each NetStream of each client.
+func (s *ServerConn) clientID() string {
+	return fmt.Sprintf("%s/%d", s.conn.RemoteAddr(), s.streamID)
+}
@@ -0,0 +1,304 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+// TestServerNetStreams will publish and play on two NetStreams of one
+// connection, and expect each message to be routed by stream ID.
+func TestServerNetStreams(t *testing.T) {
+	listener, err := Listen("localhost:1954/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := NewClient()
+	err = client.Dial("localhost:1954/twinx/one")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := client.Client()
+	defer cc.Close()
+	cc.method = ClientMethodPublish
+	err = cc.initialTX()
+	if err == nil {
+		_, err = cc.writeMsg(CommandCreateStream, 5, nil)
+	}
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("create streams: %v", err)
+	}
+	for {
+		vs := expectCommand(t, cc, CommandType_Result)
+		if vs[1] == float64(5) {
+			if vs[3] != float64(2) {
+				t.Fatalf("expected stream 2, got %v", vs[3])
+			}
+			break
+		}
+	}
+
+	two := testPublish(t, "localhost:1954/twinx/two")
+	defer two.Close()
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/two") != nil
+	})
+
+	// Publish on stream 1, and play on stream 2
+	cc.streamid = 1
+	_, err = cc.writeMsg(CommandPublish, 0, nil, "one", PublishCommandLive)
+	if err == nil {
+		cc.streamid = 2
+		_, err = cc.writeMsg(CommandPlay, 0, nil, "two")
+	}
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("publish and play: %v", err)
+	}
+	expectStatus(t, cc, CommandNetStreamPublishStart)
+	expectStatus(t, cc, CommandNetStreamPlayStart)
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/one") != nil
+	})
+
+	// The stream published on another connection is played on stream 2
+	err = two.Write(testVideo(FRAME_KEY, AVC_NALU))
+	if err == nil {
+		err = two.Flush()
+	}
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	cc.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for {
+		x, err := cc.NextChunk()
+		if err != nil {
+			t.Fatalf("waiting for video: %v", err)
+		}
+		if x.TypeID == VideoMessageID {
+			if x.StreamID != 2 {
+				t.Errorf("expected video on stream 2, got %d", x.StreamID)
+			}
+			break
+		}
+	}
+
+	// Deleting the play stream will not unpublish stream 1
+	cc.streamid = 0
+	_, err = cc.writeMsg(CommandDeleteStream, 0, nil, float64(2))
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("delete stream: %v", err)
+	}
+	waitFor(t, "play stream to be deleted", func() bool {
+		server.mtx.Lock()
+		defer server.mtx.Unlock()
+		return len(server.playClients) == 0
+	})
+	if server.liveStream("twinx/one") == nil {
+		t.Errorf("expected stream 1 to be publishing")
+	}
+
+	// Deleting stream 0, which was never created, is ignored
+	_, err = cc.writeMsg(CommandDeleteStream, 0, nil, float64(0))
+	if err == nil {
+		_, err = cc.writeMsg(CommandCreateStream, 6, nil)
+	}
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("delete stream 0: %v", err)
+	}
+	for {
+		vs := expectCommand(t, cc, CommandType_Result)
+		if vs[1] == float64(6) {
+			break
+		}
+	}
+	if server.liveStream("twinx/one") == nil {
+		t.Errorf("expected stream 1 to be publishing after deleting stream 0")
+	}
+}
+
+// TestServerNetStreamLimits will create more NetStreams than a connection
+// is allowed, and send commands on streams that were never created.
+func TestServerNetStreamLimits(t *testing.T) {
+	listener, err := Listen("localhost:1960/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := NewClient()
+	err = client.Dial("localhost:1960/twinx/limits")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := client.Client()
+	defer cc.Close()
+	cc.method = ClientMethodPlay
+	err = cc.initialTX()
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	// initialTX has created stream 1
+	for i := 1; i < DefaultConnMaximumNetStreams; i++ {
+		_, err = cc.writeMsg(CommandCreateStream, 10+i, nil)
+		if err != nil {
+			t.Fatalf("create stream: %v", err)
+		}
+	}
+	_, err = cc.writeMsg(CommandCreateStream, 99, nil)
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("create stream: %v", err)
+	}
+	expectError(t, cc, 99, CommandNetConnectionCallFailed)
+
+	// Commands on a stream that was never created are not answered
+	// with a new NetStream
+	cc.streamid = 0xFFFFFFFF
+	_, err = cc.writeMsg(CommandPlay, 7, nil, "limits")
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectError(t, cc, 7, CommandNetConnectionCallFailed)
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if len(server.playClients) != 0 {
+		t.Errorf("expected no play clients, got %d", len(server.playClients))
+	}
+}
+
+// TestServerNetStreamsPlay will play one stream on two NetStreams of one
+// connection, and then play another stream on one of them.
+func TestServerNetStreamsPlay(t *testing.T) {
+	listener, err := Listen("localhost:1962/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	for _, name := range []string{"first", "second"} {
+		publisher := testPublish(t, "localhost:1962/twinx/"+name)
+		defer publisher.Close()
+		waitFor(t, "publisher", func() bool {
+			return server.liveStream("twinx/"+name) != nil
+		})
+	}
+
+	client := NewClient()
+	err = client.Dial("localhost:1962/twinx/first")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := client.Client()
+	defer cc.Close()
+	cc.method = ClientMethodPlay
+	err = cc.initialTX()
+	if err == nil {
+		_, err = cc.writeMsg(CommandCreateStream, 5, nil)
+	}
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("create streams: %v", err)
+	}
+	for {
+		vs := expectCommand(t, cc, CommandType_Result)
+		if vs[1] == float64(5) {
+			break
+		}
+	}
+	writers := func(name string) int {
+		s := Multiplex(name)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return len(s.writers)
+	}
+
+	// Both NetStreams play the first stream
+	for _, id := range []uint32{1, 2} {
+		cc.streamid = id
+		_, err = cc.writeMsg(CommandPlay, 0, nil, "first")
+		if err != nil {
+			t.Fatalf("play: %v", err)
+		}
+	}
+	err = cc.Flush()
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, cc, CommandNetStreamPlayStart)
+	expectStatus(t, cc, CommandNetStreamPlayStart)
+	waitFor(t, "both NetStreams to play", func() bool {
+		return writers("twinx/first") == 2
+	})
+
+	// Playing again on stream 1 will stop playing the first stream
+	cc.streamid = 1
+	_, err = cc.writeMsg(CommandPlay, 0, nil, "second")
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, cc, CommandNetStreamPlayStart)
+	waitFor(t, "stream 1 to play the second stream", func() bool {
+		return writers("twinx/second") == 1
+	})
+	if n := writers("twinx/first"); n != 1 {
+		t.Errorf("expected 1 writer for the first stream, got %d", n)
+	}
+}
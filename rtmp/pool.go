@@ -26,23 +26,118 @@
 
 package rtmp
 
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kris-nova/logger"
+)
+
+// Pool is a slab allocator for message payloads.
+//
+// Payloads are taken from size classes, which are powers of two from
+// PoolMinimumClassBytes to PoolMaximumClassBytes. Larger payloads are
+// allocated, and are never pooled.
+//
+// A payload is reference counted. The reader of a message owns the
+// first reference, and everything that keeps the message after it has
+// been routed (the GOP cache, and the write queue of each destination)
+// must Retain() the payload and Release() it when it is done. The bytes
+// are shared, and are never copied for each destination.
+//
+// A payload that is never released is garbage collected as usual.
 type Pool struct {
-	pos int
-	buf []byte
+	classes []sync.Pool
 }
 
-func (pool *Pool) Get(size int) []byte {
-	if DefaultMaximumPoolSizeBytes-pool.pos < size {
-		pool.pos = 0
-		pool.buf = make([]byte, DefaultMaximumPoolSizeBytes)
-	}
-	b := pool.buf[pool.pos : pool.pos+size]
-	pool.pos += size
-	return b
+// Payload is a reference counted buffer from a Pool.
+type Payload struct {
+	buf  []byte
+	refs int32
+	pool *Pool
 }
 
+// poolDebug will panic when a payload is released too many times.
+// poolDebug is only set by tests, so a reference counting bug is
+// logged and never takes down the server.
+var poolDebug = false
+
+// DefaultPool is shared by every Conn.
+var DefaultPool = NewPool()
+
 func NewPool() *Pool {
-	return &Pool{
-		buf: make([]byte, DefaultMaximumPoolSizeBytes),
+	pool := &Pool{}
+	for size := PoolMinimumClassBytes; size <= PoolMaximumClassBytes; size *= 2 {
+		pool.classes = append(pool.classes, sync.Pool{})
+	}
+	return pool
+}
+
+// class will return the index of the smallest size class for size,
+// or -1 if the size is larger than every class.
+func (pool *Pool) class(size int) int {
+	class := 0
+	for classSize := PoolMinimumClassBytes; classSize < size; classSize *= 2 {
+		class++
+	}
+	if class >= len(pool.classes) {
+		return -1
+	}
+	return class
+}
+
+// Get will return a payload of at least size bytes, with one reference.
+func (pool *Pool) Get(size int) *Payload {
+	class := pool.class(size)
+	if class < 0 {
+		return &Payload{
+			buf:  make([]byte, size),
+			refs: 1,
+		}
+	}
+	if p, ok := pool.classes[class].Get().(*Payload); ok {
+		p.refs = 1
+		return p
+	}
+	return &Payload{
+		buf:  make([]byte, PoolMinimumClassBytes<<class),
+		refs: 1,
+		pool: pool,
+	}
+}
+
+// Bytes will return the first size bytes of the payload.
+func (p *Payload) Bytes(size int) []byte {
+	return p.buf[:size]
+}
+
+// Retain will add a reference to the payload.
+func (p *Payload) Retain() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt32(&p.refs, 1)
+}
+
+// Release will remove a reference to the payload. The payload is
+// returned to the pool when the last reference is released, and
+// must not be used again.
+func (p *Payload) Release() {
+	if p == nil {
+		return
+	}
+	refs := atomic.AddInt32(&p.refs, -1)
+	if refs < 0 {
+		if poolDebug {
+			panic(fmt.Sprintf("payload released %d times too many", -refs))
+		}
+		logger.Critical("payload released %d times too many", -refs)
+		atomic.CompareAndSwapInt32(&p.refs, refs, 0)
+		return
+	}
+	if refs > 0 || p.pool == nil {
+		return
 	}
+	p.pool.classes[p.pool.class(len(p.buf))].Put(p)
 }
@@ -0,0 +1,232 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPoolClasses(t *testing.T) {
+	pool := NewPool()
+	p := pool.Get(1)
+	if len(p.buf) != PoolMinimumClassBytes || p.pool != pool {
+		t.Errorf("expected %d byte pooled payload, got %d bytes", PoolMinimumClassBytes, len(p.buf))
+	}
+	p = pool.Get(PoolMinimumClassBytes + 1)
+	if len(p.buf) != PoolMinimumClassBytes*2 {
+		t.Errorf("expected %d byte payload, got %d bytes", PoolMinimumClassBytes*2, len(p.buf))
+	}
+	p = pool.Get(PoolMaximumClassBytes + 1)
+	if len(p.buf) != PoolMaximumClassBytes+1 || p.pool != nil {
+		t.Errorf("expected large payload to be allocated and never pooled")
+	}
+}
+
+func TestPayloadRelease(t *testing.T) {
+	p := NewPool().Get(16)
+	p.Retain()
+	p.Release()
+	if p.refs != 1 {
+		t.Fatalf("expected 1 reference, got %d", p.refs)
+	}
+	p.Release()
+	p.Release()
+	if p.refs != 0 {
+		t.Errorf("expected over-release to clamp at 0 references, got %d", p.refs)
+	}
+
+	poolDebug = true
+	defer func() {
+		poolDebug = false
+		if recover() == nil {
+			t.Errorf("expected panic when released too many times")
+		}
+	}()
+	p.Release()
+}
+
+// A payload must never be overwritten by the next message read
+// from the same chunk stream while it is still owned.
+func TestConnReadOwnership(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		writer := newTestConn(c)
+		for _, b := range []byte{0x01, 0x02} {
+			x := testVideo(FRAME_KEY, AVC_NALU)
+			x.Data[2] = b
+			writer.Write(x)
+		}
+		writer.Flush()
+	}()
+
+	reader := newTestConn(s)
+	var first, second ChunkStream
+	if err := reader.Read(&first); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := reader.Read(&second); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if first.Data[2] != 0x01 || second.Data[2] != 0x02 {
+		t.Errorf("expected payloads 1 and 2, got %d and %d", first.Data[2], second.Data[2])
+	}
+	first.release()
+	second.release()
+}
+
+func TestConnMaximumMessageSize(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go func() {
+		x := testVideo(FRAME_KEY, AVC_NALU)
+		x.Length = uint32(DefaultMaximumMessageSizeBytes + 1)
+		w := NewReadWriter(c, DefaultConnBufferSizeBytes)
+		x.CSID = 6
+		x.writeHeader(w)
+		w.Flush()
+	}()
+	var x ChunkStream
+	if err := newTestConn(s).Read(&x); err == nil {
+		t.Errorf("expected message larger than %d bytes to be rejected", DefaultMaximumMessageSizeBytes)
+	}
+}
+
+// BenchmarkStreamFanout will publish to a Stream with 20 destinations,
+// and report the steady-state resident memory of the process. Every
+// conn is created with NewConn, as the server and clients create them.
+//
+//	go test -run xxx -bench StreamFanout -benchtime 20000x ./rtmp
+//
+// With 1 publisher and 20 destinations, before payloads were pooled by
+// size class each conn held its own 512MiB pool and read buffer:
+//
+//	before: 62465 heap-MiB  3027-3539 rss-MiB
+//	after:  2.1-7.5 heap-MiB  14.6-21.0 rss-MiB
+func BenchmarkStreamFanout(b *testing.B) {
+	const (
+		destinations = 20
+		chunkSize    = 4096
+		gopPackets   = 60
+		keyFrame     = 64 * 1024
+		interFrame   = 8 * 1024
+	)
+
+	stream := NewStream("benchmark-fanout")
+	stream.SetChunkSize(chunkSize)
+	for i := 0; i < destinations; i++ {
+		addr, err := NewURLAddr("rtmp://localhost:1935/twinx/destination" + strconv.Itoa(i))
+		if err != nil {
+			b.Fatalf("invalid addr: %v", err)
+		}
+		c, s := net.Pipe()
+		defer s.Close()
+		conn := NewConn(c)
+		conn.URLAddr = *addr
+		if err := stream.AddConn(conn); err != nil {
+			b.Fatalf("add conn: %v", err)
+		}
+		go io.Copy(ioutil.Discard, s)
+	}
+
+	// The publisher writes over a pipe, and every message is read
+	// from a pooled payload exactly as the server would read it.
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	publisher := NewConn(c)
+	reader := NewConn(s)
+	reader.chunkSize = chunkSize
+	go func() {
+		publisher.Write(publisher.newChunkStreamSetChunkSize(chunkSize))
+		for i := 0; i < b.N; i++ {
+			size := interFrame
+			frameType := uint8(FRAME_INTER)
+			if i%gopPackets == 0 {
+				size = keyFrame
+				frameType = FRAME_KEY
+			}
+			data := make([]byte, size)
+			data[0] = frameType<<4 | VIDEO_H264
+			data[1] = AVC_NALU
+			err := publisher.Write(&ChunkStream{TypeID: VideoMessageID, Length: uint32(size), Data: data, StreamID: 1})
+			if err != nil {
+				return
+			}
+			publisher.Flush()
+		}
+	}()
+
+	b.ResetTimer()
+	var x ChunkStream
+	if err := reader.Read(&x); err != nil {
+		b.Fatalf("read: %v", err)
+	}
+	for i := 0; i < b.N; i++ {
+		var x ChunkStream
+		if err := reader.Read(&x); err != nil {
+			b.Fatalf("read: %v", err)
+		}
+		b.SetBytes(int64(x.Length))
+		stream.Write(&x)
+		x.release()
+	}
+	b.StopTimer()
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	b.ReportMetric(float64(stats.HeapInuse)/(1024*1024), "heap-MiB")
+	if rss, ok := residentBytes(); ok {
+		b.ReportMetric(float64(rss)/(1024*1024), "rss-MiB")
+	}
+}
+
+// residentBytes will return the resident set size of the process.
+func residentBytes() (int, bool) {
+	raw, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, false
+	}
+	return pages * os.Getpagesize(), true
+}
@@ -46,10 +46,6 @@ import (
 	"fmt"
 	"io"
 	"time"
-
-	"github.com/gwuhaolin/livego/utils/pio"
-
-	"github.com/gwuhaolin/livego/av"
 )
 
 var (
@@ -71,6 +67,10 @@ var (
 		0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xAE,
 	}
 
+	// HandshakeClientVersion is the version we send in C1. Any non-zero
+	// version will signal a complex (digest based) handshake to the server.
+	HandshakeClientVersion uint32 = 0x80000702
+
 	HandshakeClientPartial30 []byte = HandshakeClientKey[:30]
 	HandshakeServerPartial36 []byte = HandshakeServerKey[:36]
 )
@@ -81,6 +81,68 @@ const (
 	// connection timeouts.
 	TimeoutDurationSeconds time.Duration = 1 * time.Second
 
+	// Limits for a new Server, which can be changed with SetLimits()
+	DefaultMaxConnections      int           = 256
+	DefaultMaxConnectionsPerIP int           = 32
+	DefaultMaxHandshakes       int           = 16
+	DefaultHandshakeTimeout    time.Duration = 10 * time.Second
+	DefaultIdleTimeout         time.Duration = 30 * time.Second
+
+	// DefaultBitrateWindow is the window the inbound bitrate of a
+	// publish client is averaged over
+	DefaultBitrateWindow time.Duration = 5 * time.Second
+
+	// DefaultPingInterval is how often a PingRequest is sent to
+	// each client and proxy destination to measure round trip time
+	DefaultPingInterval time.Duration = 10 * time.Second
+
+	// The DVR of a stream keeps the last DefaultDVRRetention of the
+	// stream, in no more than DefaultDVRMaximumSizeBytes
+	DefaultDVRRetention        time.Duration = 2 * time.Minute
+	DefaultDVRMaximumSizeBytes int           = 1024 * 1024 * 256
+
+	// When the broadcast delay of a destination is changed, the delay
+	// moves toward the new delay by DelayAdjustRate of each second,
+	// and is checked at least every DelayAdjustInterval. The packets
+	// held for a destination are no larger than DefaultDelayMaximumSizeBytes.
+	DelayAdjustRate              float64       = 0.5
+	DelayAdjustInterval          time.Duration = 100 * time.Millisecond
+	DefaultDelayMaximumSizeBytes int           = 1024 * 1024 * 256
+
+	// DiscontinuityGapMilliseconds is the gap between the last timestamp
+	// a destination was sent and the first timestamp after it switches
+	// between publishers, or the publisher and a slate
+	DiscontinuityGapMilliseconds uint32 = 33
+
+	// An input of a stream is healthy while it has sent audio or video
+	// within InputHealthTimeout. Publishers that do not name their input
+	// are DefaultInputName, so only one of them can publish a stream.
+	InputHealthTimeout time.Duration = 2 * time.Second
+	DefaultInputName   string        = "default"
+
+	// Message payloads are taken from a Pool of size classes.
+	// The largest classes are for video keyframes.
+	PoolMinimumClassBytes int = 256
+	PoolMaximumClassBytes int = 1024 * 1024 * 4
+
+	// Memory is bounded for each Conn. A message can be no larger than
+	// DefaultMaximumMessageSizeBytes, the incomplete messages of a conn
+	// can be no larger than DefaultConnMaximumPendingBytes, a conn can
+	// have no more than DefaultConnMaximumChunkStreams chunk streams, and
+	// no more than DefaultConnMaximumNetStreams NetStreams.
+	DefaultMaximumMessageSizeBytes int    = 1024 * 1024 * 8
+	DefaultConnMaximumPendingBytes int    = 1024 * 1024 * 16
+	DefaultConnMaximumChunkStreams int    = 64
+	DefaultConnMaximumNetStreams   int    = 8
+	DefaultChunkHeaderMaximumBytes uint32 = 18
+
+	// Queued audio can be written as a single aggregate message. Only
+	// audio messages up to AggregateAudioMaximumMessageBytes are
+	// aggregated, and an aggregate is no larger than
+	// AggregateMaximumSizeBytes.
+	AggregateAudioMaximumMessageBytes int = 1024
+	AggregateMaximumSizeBytes         int = 1024 * 16
+
 	// Chunk Size
 	// 5.4.1 Set Chunk Size
 	// The maximum chunk size defaults to 128 bytes, but the client or the
@@ -91,8 +153,10 @@ const (
 	DefaultRTMPChunkSizeBytesLarge        uint32 = DefaultRTMPChunkSizeBytes * 64
 	DefaultWindowAcknowledgementSizeBytes uint32 = 2500000
 	DefaultPeerBandwidthSizeBytes         uint32 = 2500000
-	DefaultMaximumPoolSizeBytes           int    = 1024 * 1024 * 512
-	DefaultConnBufferSizeBytes            int    = 1024 * 1024 * 512
+	DefaultConnBufferSizeBytes            int    = 1024 * 4
+	DefaultConnMaximumBufferSizeBytes     int    = 1024 * 64
+	DefaultGOPCacheMaximumSizeBytes       int    = 1024 * 1024 * 32
+	DefaultWriteQueueMaximumSizeBytes     int    = 1024 * 1024 * 32
 	DefaultServerFMSVersion               string = "FMS/3,0,1,123"
 
 	ClientMethodPlay    ClientMethod = "play"
@@ -126,9 +190,14 @@ const (
 	CommandConnect         string = "connect"
 	CommandCreateStream    string = "createStream"
 	CommandPlay            string = "play"
+	CommandPlay2           string = "play2"
 	CommandPublish         string = "publish"
 	CommandDeleteStream    string = "deleteStream"
 	CommandGetStreamLength string = "getStreamLength"
+	CommandReceiveAudio    string = "receiveAudio"
+	CommandReceiveVideo    string = "receiveVideo"
+	CommandSeek            string = "seek"
+	CommandPause           string = "pause"
 
 	// These commands are used, but not found in the spec
 
@@ -144,9 +213,12 @@ const (
 	//
 	// These are used to inform the sender about the status of the requested commands.
 
-	CommandType_Result  = "_result"
-	CommandType_Error   = "_error"
-	CommandTypeOnStatus = "onStatus"
+	CommandType_Result       = "_result"
+	CommandType_Error        = "_error"
+	CommandTypeOnStatus      = "onStatus"
+	CommandTypeOnBWDone      = "onBWDone"
+	CommandTypeOnFCPublish   = "onFCPublish"
+	CommandTypeOnFCUnpublish = "onFCUnpublish"
 
 	// 7.2.2. NetStream Commands
 	//
@@ -157,11 +229,23 @@ const (
 
 	CommandNetStreamPublishStart   = "NetStream.Publish.Start"
 	CommandNetStreamPublishNotify  = "NetStream.Publish.Notify"
+	CommandNetStreamPublishBadName = "NetStream.Publish.BadName"
+	CommandNetStreamPlayFailed     = "NetStream.Play.Failed"
 	CommandNetStreamPlayStart      = "NetStream.Play.Start"
+	CommandNetStreamPlayNotFound   = "NetStream.Play.StreamNotFound"
+	CommandNetStreamPlayTransition = "NetStream.Play.Transition"
+	CommandNetStreamSeekNotify     = "NetStream.Seek.Notify"
+	CommandNetStreamSeekInvalid    = "NetStream.Seek.InvalidTime"
+	CommandNetStreamPauseNotify    = "NetStream.Pause.Notify"
+	CommandNetStreamUnpauseNotify  = "NetStream.Unpause.Notify"
+	CommandNetStreamPlayUnpublish  = "NetStream.Play.UnpublishNotify"
+	CommandNetStreamPlayPublish    = "NetStream.Play.PublishNotify"
+	CommandNetStreamUnpublish      = "NetStream.Unpublish.Success"
 	CommandNetStreamPlayReset      = "NetStream.Play.Reset"
 	CommandNetStreamDataStart      = "NetStream.Data.Start"
 	CommandNetStreamConnectSuccess = "NetConnection.Connect.Success"
-	CommandOnBWDone                = "CommandOnBWDone"
+	CommandNetConnectionRejected   = "NetConnection.Connect.Rejected"
+	CommandNetConnectionCallFailed = "NetConnection.Call.Failed"
 
 	// 7.1.2.  Data Message
 	//
@@ -190,9 +274,17 @@ const (
 	DefaultLo                string = "127.0.0.1"
 	DefaultLocalPort         string = "1935"
 	DefaultScheme            string = "rtmp"
+	DefaultSchemeTLS         string = "rtmps"
+	DefaultTLSPort           string = "443"
 	DefaultRTMPApp           string = "twinx"
 	DefaultGenerateKeyLength int    = 20
 	DefaultGenerateKeyPrefix string = "twinx_"
+	DefaultRoomKeyLength     int    = 48
+	DefaultSecretLength      int    = 48
+	QueryExpires             string = "expires"
+	QuerySignature           string = "sig"
+	QueryInput               string = "input"
+	QueryPriority            string = "priority"
 	StreamKeyRandomBytePool  string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 	TAG_AUDIO                   uint32 = 8
@@ -269,6 +361,10 @@ type ChunkStream struct {
 	// Data is the set of bytes in the Chunk. The chunk payload.
 	Data []byte
 
+	// payload owns Data for a message read from a Conn, and is
+	// nil for messages that are created in memory.
+	payload *Payload
+
 	Format    uint32
 	CSID      uint32
 	timeDelta uint32
@@ -286,6 +382,12 @@ type ChunkStream struct {
 	//
 	// the LogDecodeBatch method should respect this
 	batchedValues []interface{}
+
+	// discontinuity is set on the first message a destination is sent
+	// after the stream has switched between the publisher and a slate.
+	// The destination rebases the timestamps that follow, so that the
+	// timestamps it writes are always monotonic.
+	discontinuity bool
 }
 
 type ClientMethod string
@@ -294,11 +396,83 @@ func (chunkStream *ChunkStream) full() bool {
 	return chunkStream.got
 }
 
-func (chunkStream *ChunkStream) new(pool *Pool) {
+func (chunkStream *ChunkStream) new(pool *Pool) error {
+	if int(chunkStream.Length) > DefaultMaximumMessageSizeBytes {
+		return fmt.Errorf("message length %d exceeds maximum %d", chunkStream.Length, DefaultMaximumMessageSizeBytes)
+	}
+	if pool == nil {
+		pool = DefaultPool
+	}
 	chunkStream.got = false
 	chunkStream.index = 0
 	chunkStream.remain = chunkStream.Length
-	chunkStream.Data = pool.Get(int(chunkStream.Length))
+	chunkStream.payload = pool.Get(int(chunkStream.Length))
+	chunkStream.Data = chunkStream.payload.Bytes(int(chunkStream.Length))
+	return nil
+}
+
+// retain will add a reference to the payload of the message,
+// for as long as the message is kept after it has been routed.
+func (chunkStream *ChunkStream) retain() {
+	chunkStream.payload.Retain()
+}
+
+// release will remove a reference to the payload of the message.
+func (chunkStream *ChunkStream) release() {
+	chunkStream.payload.Release()
+}
+
+// abandon will release the incomplete message being read, so the
+// chunk stream can begin a new message.
+func (chunkStream *ChunkStream) abandon() {
+	chunkStream.release()
+	chunkStream.payload = nil
+	chunkStream.Data = nil
+	chunkStream.index = 0
+	chunkStream.remain = 0
+}
+
+// chunkHeader is the last message header written to a chunk stream.
+//
+// 5.3.1.2. Chunk Message Header
+//
+// A message header can be compressed (type 1, 2, or 3) when it shares
+// the message stream ID, length, type, or timestamp delta with the
+// previous message sent on the same chunk stream.
+type chunkHeader struct {
+	timestamp uint32
+	timeDelta uint32
+	length    uint32
+	typeID    uint32
+	streamID  uint32
+
+	// written is set once a message has been written
+	written bool
+
+	// hasDelta is set when the last header carried a timestamp
+	// delta, which a type 3 header for a new message will repeat.
+	hasDelta bool
+}
+
+// headerFormat will return the most compressed header type that can
+// be used to write the message after prev. The first message written
+// to a chunk stream always has a type 0 header.
+func (chunkStream *ChunkStream) headerFormat(prev *chunkHeader) uint32 {
+	if prev == nil || !prev.written || chunkStream.StreamID != prev.streamID || chunkStream.Timestamp < prev.timestamp {
+		return 0
+	}
+	delta := chunkStream.Timestamp - prev.timestamp
+	if delta >= 0xffffff {
+		// Extended timestamps are only sent with type 0 headers
+		return 0
+	}
+	if chunkStream.Length != prev.length || chunkStream.TypeID != prev.typeID {
+		return 1
+	}
+	if prev.hasDelta && delta == prev.timeDelta {
+		return 3
+	}
+	return 2
 }
 
 func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
@@ -319,10 +493,15 @@ func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
 	}
 	//Chunk Message Header
 	ts := chunkStream.Timestamp
+	if chunkStream.Format == 1 || chunkStream.Format == 2 {
+		// Type 1 and 2 headers carry the timestamp delta
+		ts = chunkStream.timeDelta
+	}
 	if chunkStream.Format == 3 {
 		goto END
 	}
-	if chunkStream.Timestamp > 0xffffff {
+	chunkStream.exited = ts >= 0xffffff
+	if chunkStream.exited {
 		ts = 0xffffff
 	}
 	w.WriteUintBE(ts, 3)
@@ -340,29 +519,53 @@ func (chunkStream *ChunkStream) writeHeader(w *ReadWriter) error {
 	w.WriteUintLE(chunkStream.StreamID, 4)
 END:
 	//Extended Timestamp
-	if ts >= 0xffffff {
-		w.WriteUintBE(chunkStream.Timestamp, 4)
+	if chunkStream.exited {
+		if chunkStream.Format == 1 || chunkStream.Format == 2 {
+			w.WriteUintBE(chunkStream.timeDelta, 4)
+		} else {
+			w.WriteUintBE(chunkStream.Timestamp, 4)
+		}
 	}
 	return w.WriteError()
 }
 
-func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
-	if chunkStream.TypeID == av.TAG_AUDIO {
+// defaultCSID will choose a chunk stream for the message type, if the
+// message does not have one. Chunk stream IDs 0 and 1 are reserved.
+func (chunkStream *ChunkStream) defaultCSID() {
+	if chunkStream.CSID >= 2 {
+		return
+	}
+	switch chunkStream.TypeID {
+	case TAG_AUDIO:
 		chunkStream.CSID = 4
-	} else if chunkStream.TypeID == av.TAG_VIDEO ||
-		chunkStream.TypeID == av.TAG_SCRIPTDATAAMF0 ||
-		chunkStream.TypeID == av.TAG_SCRIPTDATAAMF3 {
+	case TAG_VIDEO, TAG_SCRIPTDATAAMF0, TAG_SCRIPTDATAAMF3:
 		chunkStream.CSID = 6
+	default:
+		chunkStream.CSID = 3
+	}
+}
+
+// writeChunk will write the message as chunks of chunkSize.
+//
+// The message header is compressed against prev, the last header
+// written to the same chunk stream, and prev is updated. If prev
+// is nil a type 0 header is always written.
+func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize int, prev *chunkHeader) error {
+	chunkStream.defaultCSID()
+	format := chunkStream.headerFormat(prev)
+	if format != 0 {
+		chunkStream.timeDelta = chunkStream.Timestamp - prev.timestamp
+		chunkStream.exited = false
 	}
 
 	totalLen := uint32(0)
 	numChunks := (chunkStream.Length / uint32(chunkSize))
 	for i := uint32(0); i <= numChunks; i++ {
-		if totalLen == chunkStream.Length {
+		if totalLen == chunkStream.Length && i > 0 {
 			break
 		}
 		if i == 0 {
-			chunkStream.Format = uint32(0)
+			chunkStream.Format = format
 		} else {
 			chunkStream.Format = uint32(3)
 		}
@@ -382,6 +585,17 @@ func (chunkStream *ChunkStream) writeChunk(w *ReadWriter, chunkSize int) error {
 		}
 	}
 
+	if prev != nil {
+		*prev = chunkHeader{
+			timestamp: chunkStream.Timestamp,
+			timeDelta: chunkStream.timeDelta,
+			length:    chunkStream.Length,
+			typeID:    chunkStream.TypeID,
+			streamID:  chunkStream.StreamID,
+			written:   true,
+			hasDelta:  format != 0,
+		}
+	}
 	return nil
 
 }
@@ -412,7 +626,9 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		} else {
 			chunkStream.exited = false
 		}
-		chunkStream.new(pool)
+		if err := chunkStream.new(pool); err != nil {
+			return err
+		}
 	case 1:
 		chunkStream.Format = chunkStream.tmpFormat
 		timeStamp, _ := r.ReadUintBE(3)
@@ -426,7 +642,9 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		}
 		chunkStream.timeDelta = timeStamp
 		chunkStream.Timestamp += timeStamp
-		chunkStream.new(pool)
+		if err := chunkStream.new(pool); err != nil {
+			return err
+		}
 	case 2:
 		chunkStream.Format = chunkStream.tmpFormat
 		timeStamp, _ := r.ReadUintBE(3)
@@ -438,7 +656,9 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 		}
 		chunkStream.timeDelta = timeStamp
 		chunkStream.Timestamp += timeStamp
-		chunkStream.new(pool)
+		if err := chunkStream.new(pool); err != nil {
+			return err
+		}
 	case 3:
 		if chunkStream.remain == 0 {
 			switch chunkStream.Format {
@@ -456,7 +676,9 @@ func (chunkStream *ChunkStream) readChunk(r *ReadWriter, chunkSize uint32, pool
 				}
 				chunkStream.Timestamp += timedet
 			}
-			chunkStream.new(pool)
+			if err := chunkStream.new(pool); err != nil {
+				return err
+			}
 		} else {
 			if chunkStream.exited {
 				b, err := r.Peek(4)
@@ -499,7 +721,7 @@ func newChunkStream(typeID, length, payload uint32) *ChunkStream {
 		Length:   length,
 		Data:     make([]byte, length),
 	}
-	pio.PutU32BE(ret.Data[:length], payload)
+	binary.BigEndian.PutUint32(ret.Data[:length], payload)
 	return &ret
 }
 
@@ -658,6 +880,7 @@ const (
 	ConnEventDescription    string = "description"
 	ConnEventObjectEncoding string = "objectEncoding"
 	ConnEventStatus         string = "status"
+	ConnEventError          string = "error"
 )
 
 type PublishInfo struct {
@@ -669,12 +892,29 @@ type ReadWriter struct {
 	*bufio.ReadWriter
 	readError  error
 	writeError error
+
+	// w is the underlying writer, kept to resize the write buffer
+	w io.Writer
 }
 
 func NewReadWriter(rw io.ReadWriter, bufSize int) *ReadWriter {
 	return &ReadWriter{
 		ReadWriter: bufio.NewReadWriter(bufio.NewReaderSize(rw, bufSize), bufio.NewWriterSize(rw, bufSize)),
+		w:          rw,
+	}
+}
+
+// resizeWriter will replace the write buffer with a buffer of size bytes.
+// The write buffer can only be resized when it is empty.
+func (rw *ReadWriter) resizeWriter(size int) bool {
+	if rw.Writer.Size() == size {
+		return true
+	}
+	if rw.Writer.Buffered() != 0 || rw.w == nil {
+		return false
 	}
+	rw.Writer = bufio.NewWriterSize(rw.w, size)
+	return true
 }
 
 func (rw *ReadWriter) Read(p []byte) (int, error) {
@@ -127,6 +127,13 @@ type CompliantMember interface {
 	//2021-10-15T10:41:44-07:00 [Debug     ]    [3] (live_733531528_k9ZMBZXSUfOuGCrquQbgeXmLa5Y5ve)
 	oosReleaseStreamRX(x *ChunkStream) error
 	oosReleaseStreamTX() (*ChunkStream, error)
+
+	//2021-10-15T10:41:44-07:00 [Debug     ]    [0] (FCUnpublish)
+	//2021-10-15T10:41:44-07:00 [Debug     ]    [1] (5)
+	//2021-10-15T10:41:44-07:00 [Debug     ]    [2] (<nil>)
+	//2021-10-15T10:41:44-07:00 [Debug     ]    [3] (live_733531528_k9ZMBZXSUfOuGCrquQbgeXmLa5Y5ve)
+	oosFCUnpublishRX(x *ChunkStream) error
+	oosFCUnpublishTX() (*ChunkStream, error)
 }
 
 type ChunkStreamRouter interface {
@@ -89,7 +89,7 @@ func TestWriteChunk(t *testing.T) {
 
 	bf := bytes.NewBuffer(nil)
 	w := NewReadWriter(bf, 1024)
-	err := chunkinc.writeChunk(w, 128)
+	err := chunkinc.writeChunk(w, 128, nil)
 	w.Flush()
 	at.Equal(err, nil)
 	at.Equal(len(bf.Bytes()), 321)
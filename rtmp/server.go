@@ -27,8 +27,14 @@
 package rtmp
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kris-nova/logger"
 )
@@ -67,26 +73,295 @@ type Server struct {
 	// [ Publish ] -- (1234) --> [ Server ] -- (5678) --> [ Proxy Publish ]
 
 	// playClients are clients connected to the server, that have been registered
-	// as play clients
+	// as play clients, indexed on the remote address and message stream ID
 	playClients map[string]*ServerConn
 
 	// publishClients are clients connected to the server, that have been registered
-	// as publish clients
-	publishClients map[string]*ServerConn
+	// as publish clients, indexed on the app and stream name. Each client is
+	// an input of the stream, such as a primary and a backup encoder.
+	publishClients map[string][]*ServerConn
 
-	// proxyPublishClients are clients connected to the server that will be used
+	// publishOrder is the stream names in the order they were published
+	publishOrder []string
+
+	// destinations are supervised clients that will be used
 	// to proxy the RTMP as a new publish client on a remote backend.
 	//
 	// These are known as "push" clients in the Nginx module.
-	proxyPublishClients map[string]*ClientConn
+	destinations map[string]*Destination
+
+	mtx sync.Mutex
+
+	// writeQueueSize, overflowPolicy and aggregateAudio are the
+	// defaults for every play client and proxy added to the server.
+	writeQueueSize int
+	overflowPolicy OverflowPolicy
+	aggregateAudio bool
+
+	// pingInterval is how often each client and proxy is sent
+	// a PingRequest, to measure the round trip time.
+	pingInterval time.Duration
+
+	// proxyGracePeriod is how long destinations are kept connected
+	// after a stream is unpublished, and lingering are the timers
+	// that will stop them, indexed on the stream name.
+	proxyGracePeriod time.Duration
+	lingering        map[string]*time.Timer
+
+	// slate is written to the destinations of a stream while it is
+	// unpublished, and slating are the streams the slate is written
+	// to, indexed on the stream name.
+	slate   *Slate
+	slating map[string]*Stream
+
+	// dvrRetention and dvrMaxSizeBytes are the DVR settings for every
+	// published stream. A retention of 0 will not buffer the streams.
+	dvrRetention    time.Duration
+	dvrMaxSizeBytes int
+
+	// keys are the issued stream keys. If keys is set, publish
+	// clients (and play clients if playAuthentication is set) must
+	// present a key issued for the stream.
+	keys               *RoomKeysType
+	playAuthentication bool
+
+	// secret is used to sign stream names that can be used
+	// in place of an issued key until they expire.
+	secret []byte
+
+	// publishAccess and playAccess are the allow and deny rules for
+	// the remote address of publish and play clients.
+	publishAccess *AccessList
+	playAccess    *AccessList
+
+	// limits are checked before anything is allocated for a client.
+	// connections, connectionsPerIP and handshakes are the
+	// admitted clients counted against the limits.
+	limits           Limits
+	connections      int
+	connectionsPerIP map[string]int
+	handshakes       int
 }
 
 func NewServer() *Server {
+	// A failure will leave the secret empty, and Sign() will fail
+	secret, _ := randomString(DefaultSecretLength)
 	return &Server{
-		proxyPublishClients: make(map[string]*ClientConn),
-		playClients:         make(map[string]*ServerConn),
-		publishClients:      make(map[string]*ServerConn),
+		destinations:     make(map[string]*Destination),
+		playClients:      make(map[string]*ServerConn),
+		publishClients:   make(map[string][]*ServerConn),
+		secret:           []byte(secret),
+		limits:           DefaultLimits(),
+		connectionsPerIP: make(map[string]int),
+		pingInterval:     DefaultPingInterval,
+		lingering:        make(map[string]*time.Timer),
+		slating:          make(map[string]*Stream),
+	}
+}
+
+// SetLimits will set the connection limits for new clients.
+func (s *Server) SetLimits(limits Limits) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.limits = limits
+}
+
+// SetPingInterval will set how often each client and proxy is sent
+// a PingRequest. An interval of 0 will never ping.
+func (s *Server) SetPingInterval(interval time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.pingInterval = interval
+}
+
+// SetProxyGracePeriod will keep the destinations of a stream connected
+// for a period after the stream is unpublished. If the stream is published
+// again within the period, the destinations continue with the new publisher
+// and the remote servers never see the stream end. A period of 0 will
+// unpublish the destinations as soon as the stream is unpublished.
+func (s *Server) SetProxyGracePeriod(period time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.proxyGracePeriod = period
+}
+
+// SetSlate will keep the destinations of a stream publishing the slate
+// while the stream is unpublished, instead of unpublishing them. When
+// the stream is published again, the destinations switch back to the
+// stream at the next keyframe. A nil slate will unpublish the destinations.
+func (s *Server) SetSlate(slate *Slate) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.slate = slate
+}
+
+// SetDVR will buffer the last retention of every published stream, up
+// to maxSizeBytes for each stream, so that it can be saved with Clip.
+// A retention of 0 will not buffer the streams.
+func (s *Server) SetDVR(retention time.Duration, maxSizeBytes int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.dvrRetention = retention
+	s.dvrMaxSizeBytes = maxSizeBytes
+}
+
+// Clip will write the last duration of a stream to w as an FLV file.
+// An empty name is the first stream published to the server.
+func (s *Server) Clip(name string, last time.Duration, w io.Writer) error {
+	var live *Stream
+	if name == "" {
+		live = s.liveStream("")
+	} else {
+		mxMtx.Lock()
+		live = mx[name]
+		mxMtx.Unlock()
+	}
+	if live == nil {
+		return fmt.Errorf("unable to find stream: %s", name)
+	}
+	return live.Clip(w, last)
+}
+
+// SetWriteQueueSize will set the default number of packets queued
+// for each play client and proxy, before the OverflowPolicy is applied.
+func (s *Server) SetWriteQueueSize(size int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.writeQueueSize = size
+}
+
+// SetOverflowPolicy will set the default OverflowPolicy for each play
+// client and proxy.
+func (s *Server) SetOverflowPolicy(policy OverflowPolicy) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.overflowPolicy = policy
+}
+
+// SetAggregateAudio will write queued audio as aggregate messages for
+// each play client and proxy.
+func (s *Server) SetAggregateAudio(aggregate bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.aggregateAudio = aggregate
+}
+
+// writeOptions returns the write queue size, OverflowPolicy, and
+// audio aggregation for each play client and proxy.
+func (s *Server) writeOptions() (int, OverflowPolicy, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.writeQueueSize, s.overflowPolicy, s.aggregateAudio
+}
+
+// SetRoomKeys will require every publish client to present a key
+// issued by keys, such as rtmp://host:port/app/key. The stream is
+// routed to the channel the key was issued for. A nil keys will
+// allow any client to publish.
+func (s *Server) SetRoomKeys(keys *RoomKeysType) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys = keys
+}
+
+// SetPlayAuthentication will require play clients to present
+// an issued key as well. SetRoomKeys must also be called.
+func (s *Server) SetPlayAuthentication(enabled bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.playAuthentication = enabled
+}
+
+// SetSecret will set the secret used to sign stream names.
+// Every server has a random secret by default, which will
+// invalidate every signed name when the server is gone.
+func (s *Server) SetSecret(secret []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.secret = secret
+}
+
+// Sign will return a stream name that can be used in place of an
+// issued key to publish or play app/name until expires.
+func (s *Server) Sign(app, name string, expires time.Time) (string, error) {
+	s.mtx.Lock()
+	secret := s.secret
+	s.mtx.Unlock()
+	return Sign(secret, app, name, expires)
+}
+
+// SetPublishAccess will set the allow and deny rules for the remote
+// address of publish clients. A nil access will allow every address.
+func (s *Server) SetPublishAccess(access *AccessList) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.publishAccess = access
+}
+
+// SetPlayAccess will set the allow and deny rules for the remote
+// address of play clients. A nil access will allow every address.
+func (s *Server) SetPlayAccess(access *AccessList) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.playAccess = access
+}
+
+// allowed will check the remote address of a client against the
+// access rules for the client type. Any client type is allowed
+// if the address is allowed to either publish or play.
+func (s *Server) allowed(addr net.Addr, clientType ServerClientType) error {
+	s.mtx.Lock()
+	publish := s.publishAccess.Allowed(addr)
+	play := s.playAccess.Allowed(addr)
+	s.mtx.Unlock()
+	switch clientType {
+	case PublishClient:
+		if !publish {
+			logger.Warning("denied publish client: %s", addr)
+			return fmt.Errorf("publish denied for %s", addr)
+		}
+	case PlayClient:
+		if !play {
+			logger.Warning("denied play client: %s", addr)
+			return fmt.Errorf("play denied for %s", addr)
+		}
+	default:
+		if !publish && !play {
+			logger.Warning("denied client: %s", addr)
+			return fmt.Errorf("denied %s", addr)
+		}
+	}
+	return nil
+}
+
+// authenticate will return the stream name for a publish or play
+// request from a client connected to app. If the server requires keys,
+// name must be a key issued for a stream of the app, or a stream name
+// signed with the server secret.
+func (s *Server) authenticate(app, name string, clientType ServerClientType) (string, error) {
+	s.mtx.Lock()
+	keys, playAuthentication, secret := s.keys, s.playAuthentication, s.secret
+	s.mtx.Unlock()
+	name, query := splitQuery(name)
+	if keys == nil || clientType == PlayClient && !playAuthentication {
+		return streamName(app, name), nil
+	}
+	if query.Get(QuerySignature) != "" {
+		err := verifySignature(secret, app, name, query, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return streamName(app, name), nil
 	}
+	channel, err := keys.GetChannel(name)
+	if err != nil {
+		// Never log the key
+		return "", fmt.Errorf("invalid key for app %s", app)
+	}
+	if !strings.HasPrefix(channel, app+"/") {
+		return "", fmt.Errorf("key not issued for app %s", app)
+	}
+	return channel, nil
 }
 
 // Proxy will configure forward addresses for the RTMP server.
@@ -94,53 +369,396 @@ func NewServer() *Server {
 // Proxy can be called before or after Serve()
 // and the backend server will be smart enough to sync clients.
 func (s *Server) Proxy(raw string) error {
+	size, policy, aggregate := s.writeOptions()
+	s.mtx.Lock()
+	pingInterval := s.pingInterval
+	s.mtx.Unlock()
 	forwardClient := NewClient()
-	err := forwardClient.Dial(raw)
+	forwardClient.SetWriteQueueSize(size)
+	forwardClient.SetOverflowPolicy(policy)
+	forwardClient.SetAggregateAudio(aggregate)
+	forwardClient.SetPingInterval(pingInterval)
+	_, err := s.ProxyWithClient(forwardClient, raw)
+	return err
+}
+
+// ProxyWithClient will add a destination to this server, using
+// a configured client to dial the destination.
+//
+// The destination will follow the first stream published to the server.
+func (s *Server) ProxyWithClient(client *Client, raw string) (*Destination, error) {
+	d, err := NewDestination(client, raw)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = s.AddProxy(d)
+	if err != nil {
+		return nil, err
 	}
-	return s.ProxyClient(forwardClient.conn)
+	return d, nil
 }
 
-// ProxyClient will add clients to this server.
+// AddProxy will add a destination to this server.
 //
 // Client forwarding is handled at the server level.
-// We trust each subsequent stream to update to the configured
-// clients as they are added.
-func (s *Server) ProxyClient(f *ClientConn) error {
-
-	// New clients will always be publishers.
-	go func() {
-		// Set Default OBS for testing
-		//logger.Warning("DEBUG sending VirtualOBSMetaData")
-		//f.virtualMetaData = VirtualOBSOutputClientMetadata()
-
-		err := f.Publish()
+// If the source of the destination is live, the destination is started
+// immediately and an error is returned if the first connection fails.
+// Otherwise the destination will be started when the source is
+// published, and stopped when the source is unpublished.
+func (s *Server) AddProxy(d *Destination) error {
+	if live := s.liveStream(d.Source()); live != nil {
+		err := d.Start(live)
 		if err != nil {
-			logger.Critical(err.Error())
+			return err
 		}
-	}()
+	}
+	logger.Info(rtmpMessage(fmt.Sprintf("server.AddClient(%s) %s", d.URLAddr().SafeURL(), d.ID()), ack))
+	s.mtx.Lock()
+	existing := s.destinations[d.ID()]
+	s.destinations[d.ID()] = d
+	s.mtx.Unlock()
+	if existing != nil {
+		existing.Stop()
+	}
+
+	// The publisher may have changed while we were dialing
+	if live := s.liveStream(d.Source()); live != nil {
+		d.Run(live)
+	} else {
+		d.Stop()
+	}
+	return nil
+}
+
+// Proxies will return all destinations of the server, sorted by ID.
+func (s *Server) Proxies() []*Destination {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	destinations := s.proxies()
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i].ID() < destinations[j].ID()
+	})
+	return destinations
+}
 
-	for !f.connected {
+// RemoveProxy will unpublish and close a single destination.
+// All other destinations are unaffected.
+func (s *Server) RemoveProxy(id string) error {
+	s.mtx.Lock()
+	d, ok := s.destinations[id]
+	delete(s.destinations, id)
+	s.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown proxy id: %s", id)
+	}
+	d.Stop()
+	return nil
+}
 
+// SetProxyDelay will change the broadcast delay of a destination, while
+// play clients of the stream stay real-time. The destination moves to
+// the new delay without a break in the timestamps.
+func (s *Server) SetProxyDelay(id string, delay time.Duration) error {
+	s.mtx.Lock()
+	d, ok := s.destinations[id]
+	s.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown proxy id: %s", id)
+	}
+	d.SetDelay(delay)
+	return nil
+}
+
+// ReplaceProxy will add a new destination for the same source, and
+// then remove the existing destination. If the new destination is
+// unable to connect, the existing destination is unaffected.
+func (s *Server) ReplaceProxy(id string, client *Client, raw string) (*Destination, error) {
+	s.mtx.Lock()
+	existing, ok := s.destinations[id]
+	s.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown proxy id: %s", id)
+	}
+	d, err := NewDestination(client, raw)
+	if err != nil {
+		return nil, err
+	}
+	d.SetSource(existing.Source())
+	err = s.AddProxy(d)
+	if err != nil {
+		return nil, err
 	}
+	if d.ID() == id {
+		// Replaced with the same address
+		return d, nil
+	}
+	return d, s.RemoveProxy(id)
+}
 
-	logger.Info(rtmpMessage(fmt.Sprintf("server.AddClient(%s)", f.urladdr.SafeURL()), ack))
-	mx := Multiplex(s.listener.URLAddr().Key())
-	mx.SetChunkSize(f.conn.chunkSize)
-	err := mx.AddConn(f.conn)
+// PublishClient will register a new publisher for a stream, and start
+// every destination that follows the stream.
+//
+// A stream can have more than one publisher, each a named input of the
+// stream, and the destinations follow the preferred input. Only one
+// client can publish each input of a stream at a time.
+func (s *Server) PublishClient(f *ServerConn) error {
+	name := f.streamName
+	if f.input == nil {
+		f.input = newStreamInput(DefaultInputName, 0, "")
+	}
+	live := f.stream()
+	s.mtx.Lock()
+	inputs := s.publishClients[name]
+	err := live.addInput(f.input)
 	if err != nil {
+		s.mtx.Unlock()
 		return err
 	}
+	f.clientType = PublishClient
+	s.publishClients[name] = append(inputs, f)
+	if len(inputs) > 0 {
+		// The stream is already published, and the destinations
+		// and play clients will switch to this input if it is preferred
+		s.mtx.Unlock()
+		logger.Info(rtmpMessage(fmt.Sprintf("Input %s (priority %d) for %s", f.input.name, f.input.priority, name), stream))
+		return nil
+	}
+	s.publishOrder = append(s.publishOrder, name)
+	destinations := s.following(name)
+	players := s.playing(name)
+	if timer, ok := s.lingering[name]; ok {
+		// The destinations kept after the last publisher are still
+		// connected, and will continue with this publisher
+		timer.Stop()
+		delete(s.lingering, name)
+	}
+	// The destinations on the slate switch to this publisher
+	// at the first keyframe
+	delete(s.slating, name)
+	retention, maxSizeBytes := s.dvrRetention, s.dvrMaxSizeBytes
+	s.mtx.Unlock()
+
+	live.SetChunkSize(f.conn.chunkSize)
+	live.SetDVR(retention, maxSizeBytes)
+	for _, d := range destinations {
+		d.Run(live)
+	}
+	for _, p := range players {
+		err := p.notifyPlay(StreamBegin, CommandNetStreamPlayPublish, fmt.Sprintf("%s is now published.", name))
+		if err != nil {
+			logger.Debug(rtmpMessage(fmt.Sprintf("publish notify %s: %v", p.conn.RemoteAddr(), err), warn))
+		}
+	}
 	return nil
 }
 
-func (s *Server) PublishClient(f *ServerConn) {
-	s.publishClients[s.listener.URLAddr().SafeURL()] = f
+// UnpublishClient will unregister a publisher, and cleanly
+// stop every destination that follows the stream. The destinations are
+// kept, and will be started again when the stream is published again.
+//
+// Play clients are sent StreamEOF and NetStream.Play.UnpublishNotify,
+// and will resume if the stream is published again.
+func (s *Server) UnpublishClient(f *ServerConn) {
+	s.unpublishClient(f)
+}
+
+// unpublishClient will return true if f was publishing, and the
+// input has been released. The stream is unpublished when there
+// are no other inputs.
+func (s *Server) unpublishClient(f *ServerConn) bool {
+	name := f.streamName
+	s.mtx.Lock()
+	inputs := s.publishClients[name]
+	i := 0
+	for i < len(inputs) && inputs[i] != f {
+		i++
+	}
+	if i == len(inputs) {
+		s.mtx.Unlock()
+		return false
+	}
+	f.clientType = UnregisteredClient
+	f.stream().removeInput(f.input)
+	if len(inputs) > 1 {
+		s.publishClients[name] = append(inputs[:i:i], inputs[i+1:]...)
+		s.mtx.Unlock()
+		logger.Info(rtmpMessage(fmt.Sprintf("Unpublish input %s of %s", f.input.name, name), stream))
+		return true
+	}
+	destinations := s.following(name)
+	delete(s.publishClients, name)
+	for i, published := range s.publishOrder {
+		if published == name {
+			s.publishOrder = append(s.publishOrder[:i], s.publishOrder[i+1:]...)
+			break
+		}
+	}
+	players := s.playing(name)
+	grace := s.proxyGracePeriod
+	slate := s.slate
+	s.mtx.Unlock()
+	logger.Info(rtmpMessage(fmt.Sprintf("Unpublish Stream %s", name), stream))
+
+	// The cached GOP will never be decoded after the next keyframe
+	f.stream().ResetGOP()
+	for _, p := range players {
+		err := p.notifyPlay(StreamEOF, CommandNetStreamPlayUnpublish, fmt.Sprintf("%s is now unpublished.", name))
+		if err != nil {
+			logger.Debug(rtmpMessage(fmt.Sprintf("unpublish notify %s: %v", p.conn.RemoteAddr(), err), warn))
+		}
+	}
+
+	// Destinations are kept connected for the grace period, unless
+	// they have no source and there is another stream to follow.
+	// A destination with a broadcast delay is kept for at least the
+	// delay, so that the end of the stream is still written.
+	var linger, stopping []*Destination
+	next := s.liveStream("")
+	for _, d := range destinations {
+		if delay := d.Delay(); delay > grace {
+			grace = delay
+		}
+	}
+	for _, d := range destinations {
+		if (grace > 0 || slate != nil) && (d.Source() != "" || next == nil) {
+			linger = append(linger, d)
+			continue
+		}
+		stopping = append(stopping, d)
+	}
+	s.stopDestinations(stopping)
+	if len(linger) > 0 && slate != nil {
+		// The destinations are kept on the slate until the
+		// stream is published again
+		logger.Info(rtmpMessage(fmt.Sprintf("Keeping %d destinations for %s on the slate", len(linger), name), proxy))
+		live := f.stream()
+		s.mtx.Lock()
+		s.slating[name] = live
+		s.mtx.Unlock()
+		live.StartSlate(slate)
+		return true
+	}
+	if len(linger) > 0 {
+		logger.Info(rtmpMessage(fmt.Sprintf("Keeping %d destinations for %s for %s", len(linger), name, grace), proxy))
+		s.mtx.Lock()
+		var timer *time.Timer
+		timer = time.AfterFunc(grace, func() {
+			s.mtx.Lock()
+			lingering := s.lingering[name] == timer
+			if lingering {
+				delete(s.lingering, name)
+			}
+			s.mtx.Unlock()
+			if lingering {
+				s.stopDestinations(linger)
+			}
+		})
+		s.lingering[name] = timer
+		s.mtx.Unlock()
+	}
+	return true
+}
+
+// stopDestinations will stop each destination, and start it again if
+// the stream it follows is live, such as a destination without a source
+// which will follow the next stream.
+func (s *Server) stopDestinations(destinations []*Destination) {
+	for _, d := range destinations {
+		d.Stop()
+	}
+	for _, d := range destinations {
+		if live := s.liveStream(d.Source()); live != nil {
+			d.Run(live)
+		}
+	}
+}
+
+// playing returns the play clients of a stream without locking.
+func (s *Server) playing(name string) []*ServerConn {
+	var players []*ServerConn
+	for _, p := range s.playClients {
+		if p.streamName == name {
+			players = append(players, p)
+		}
+	}
+	return players
 }
 
 func (s *Server) PlayClient(f *ServerConn) {
-	s.playClients[s.listener.URLAddr().SafeURL()] = f
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	f.clientType = PlayClient
+	s.playClients[f.clientID()] = f
+}
+
+// switchPlayClient will change the stream a play client plays.
+func (s *Server) switchPlayClient(f *ServerConn, name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	f.streamName = name
+}
+
+// removeClient will clean up after a client has disconnected.
+//
+// Each NetStream of the client is removed.
+func (s *Server) removeClient(f *ServerConn) {
+	for _, ns := range f.streams {
+		s.removeClient(ns)
+	}
+	s.mtx.Lock()
+	clientType := f.clientType
+	s.mtx.Unlock()
+	switch clientType {
+	case PublishClient:
+		s.UnpublishClient(f)
+	case PlayClient:
+		if stream := f.stream(); stream != nil {
+			stream.RemovePlayConn(f.conn, f.streamID)
+		}
+		s.mtx.Lock()
+		delete(s.playClients, f.clientID())
+		s.mtx.Unlock()
+	}
+}
+
+// liveStream will return the published stream for a source, or nil if
+// the source is not publishing. An empty source is the first stream
+// published to the server.
+func (s *Server) liveStream(source string) *Stream {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if source == "" {
+		if len(s.publishOrder) == 0 {
+			return nil
+		}
+		source = s.publishOrder[0]
+	}
+	inputs, ok := s.publishClients[source]
+	if !ok {
+		return nil
+	}
+	return inputs[0].stream()
+}
+
+// following returns the destinations that follow a stream without locking.
+func (s *Server) following(name string) []*Destination {
+	var destinations []*Destination
+	for _, d := range s.destinations {
+		source := d.Source()
+		if source == name || source == "" && len(s.publishOrder) > 0 && s.publishOrder[0] == name {
+			destinations = append(destinations, d)
+		}
+	}
+	return destinations
+}
+
+// proxies returns the destinations without locking.
+func (s *Server) proxies() []*Destination {
+	var destinations []*Destination
+	for _, d := range s.destinations {
+		destinations = append(destinations, d)
+	}
+	return destinations
 }
 
 func (s *Server) ListenAndServe(raw string) error {
@@ -151,6 +769,14 @@ func (s *Server) ListenAndServe(raw string) error {
 	return s.Serve(l)
 }
 
+func (s *Server) ListenAndServeTLS(raw, certFile, keyFile string) error {
+	l, err := ListenTLS(raw, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
 // Serve
 //
 // A blocking method that will listen for new connections
@@ -168,7 +794,9 @@ func (s *Server) Serve(listener net.Listener) error {
 	} else {
 		concrete = l
 	}
+	s.mtx.Lock()
 	s.listener = concrete
+	s.mtx.Unlock()
 	logger.Info(rtmpMessage("server.Serve", serve))
 
 	// At this point we should have a full RTMP listener, with a
@@ -181,8 +809,12 @@ func (s *Server) Serve(listener net.Listener) error {
 	M().Unlock()
 
 	for {
-		clientConn, err := s.listener.Accept()
+		clientConn, err := concrete.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The server has been closed
+				return nil
+			}
 			return fmt.Errorf("client conn accept: %v", err)
 		}
 		go func() {
@@ -198,6 +830,26 @@ func (s *Server) Serve(listener net.Listener) error {
 func (s *Server) handleConn(netConn net.Conn, urladdr *URLAddr) error {
 	logger.Info(rtmpMessage(fmt.Sprintf("server.Accept client %s", netConn.RemoteAddr()), new))
 
+	// Drop clients that can neither publish nor play, or are
+	// over a limit, before anything is allocated for the connection.
+	addr := netConn.RemoteAddr()
+	err := s.allowed(addr, UnregisteredClient)
+	if err != nil {
+		netConn.Close()
+		return nil
+	}
+	err = s.admit(addr)
+	if err != nil {
+		logger.Warning("rejected client %s: %v", addr, err)
+		netConn.Close()
+		return nil
+	}
+	defer s.release(addr)
+	s.mtx.Lock()
+	limits := s.limits
+	pingInterval := s.pingInterval
+	s.mtx.Unlock()
+
 	// Base connection
 	conn := NewConn(netConn)
 	conn.URLAddr = *urladdr
@@ -207,33 +859,82 @@ func (s *Server) handleConn(netConn net.Conn, urladdr *URLAddr) error {
 	// are the accepted client to the server.
 	client := NewServerConn(conn)
 	client.conn = conn
+	client.idleTimeout = limits.IdleTimeout
+	client.bitrate = newBitrate(limits.MaxPublishBitrate, DefaultBitrateWindow)
 
 	// Point all clients back to the main server
 	client.server = s
 
 	// Handshakes
-	var err error
+	var timer *time.Timer
+	if limits.HandshakeTimeout > 0 {
+		timer = time.AfterFunc(limits.HandshakeTimeout, func() {
+			logger.Warning("handshake timeout for client %s", addr)
+			netConn.Close()
+		})
+	}
 	err = client.handshake()
+	if timer != nil {
+		timer.Stop()
+	}
+	s.handshakeDone()
 	if err != nil {
+		netConn.Close()
 		return nil
 	}
 
-	go func() {
-		err = client.RoutePackets()
-		if err != nil {
-			logger.Critical(err.Error())
-			client.Close()
-		}
-	}()
-	for {
-		if client.clientType == PlayClient {
-			s.PlayClient(client)
-			return nil
-		}
-		if client.clientType == PublishClient {
-			s.PublishClient(client)
-			return nil
-		}
+	// Clients are registered as play or publish clients
+	// as they send commands.
+	stopPing := conn.ping(pingInterval)
+	err = client.RoutePackets()
+	stopPing()
+	client.Close()
+	s.removeClient(client)
+	M().Lock()
+	delete(M().ClientRTT, addr.String())
+	M().Unlock()
+	return err
+}
+
+// Close will close the listener, and disconnect every play and
+// publish client. Destinations are stopped, including those kept for
+// the grace period or on the slate, but not removed, and will be
+// started again if the server is restarted with Serve().
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	var clients []*ServerConn
+	for _, inputs := range s.publishClients {
+		clients = append(clients, inputs...)
+	}
+	for _, f := range s.playClients {
+		clients = append(clients, f)
+	}
+	listener := s.listener
+	s.mtx.Unlock()
+	for _, f := range clients {
+		f.Close()
+		s.removeClient(f)
 	}
 
+	// The destinations kept for the grace period, or on the
+	// slate, are stopped now rather than left connected.
+	s.mtx.Lock()
+	slating := s.slating
+	s.slating = make(map[string]*Stream)
+	for _, timer := range s.lingering {
+		timer.Stop()
+	}
+	s.lingering = make(map[string]*time.Timer)
+	destinations := s.proxies()
+	s.mtx.Unlock()
+	for _, live := range slating {
+		live.StopSlate()
+	}
+	for _, d := range destinations {
+		d.Stop()
+	}
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
 }
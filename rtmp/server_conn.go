@@ -45,16 +45,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
 	"github.com/kris-nova/logger"
 )
 
 type ServerClientType int
 
 const (
-	PlayClient    ServerClientType = 1
-	PublishClient ServerClientType = 2
+	// UnregisteredClient has not sent a play or publish command
+	UnregisteredClient ServerClientType = 0
+	PlayClient         ServerClientType = 1
+	PublishClient      ServerClientType = 2
 )
 
 type ServerConn struct {
@@ -83,22 +86,52 @@ type ServerConn struct {
 	// client
 	publishInfo *PublishInfo
 
+	// streamName is the app and stream name this connection
+	// publishes to, or plays from, such as "twinx/camera"
+	streamName string
+
 	metaData *MetaData
 
-	decoder *amf.Decoder
-	encoder *amf.Encoder
+	decoder *AMFDecoder
+	encoder *AMFEncoder
 	bytesw  *bytes.Buffer
 
 	// server is a pointer back to the main server instance
 	server *Server
+
+	// idleTimeout will disconnect a client that has not sent
+	// anything, unless it is a play client
+	idleTimeout time.Duration
+
+	// bitrate is the inbound bitrate limit of a publish client
+	bitrate *bitrate
+
+	// streamID is the message stream ID of a NetStream, and is 0
+	// for the NetConnection
+	streamID uint32
+
+	// streams are the NetStreams of the NetConnection, indexed on
+	// message stream ID
+	streams      map[uint32]*ServerConn
+	lastStreamID uint32
+
+	// paused is set while a play client has paused the stream
+	paused bool
+
+	// seekOffset is the offset of the last seek command, in
+	// milliseconds
+	seekOffset uint32
+
+	// input is the input of the stream a publish client publishes
+	input *streamInput
 }
 
 func NewServerConn(conn *Conn) *ServerConn {
 	return &ServerConn{
 		conn:    conn,
 		bytesw:  bytes.NewBuffer(nil),
-		decoder: &amf.Decoder{},
-		encoder: &amf.Encoder{},
+		decoder: &AMFDecoder{},
+		encoder: &AMFEncoder{},
 	}
 }
 
@@ -126,6 +159,11 @@ var clientLen int = 0
 // RoutePackets will hang and route packets for this connection
 func (s *ServerConn) RoutePackets() error {
 	for {
+		if s.idleTimeout > 0 && !s.isPlaying() {
+			s.conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		} else {
+			s.conn.SetReadDeadline(time.Time{})
+		}
 		x, err := s.NextChunk()
 		if err != nil {
 			// Terminate the client!
@@ -137,6 +175,8 @@ func (s *ServerConn) RoutePackets() error {
 			return nil
 		}
 		err = s.Route(x)
+		// The stream has retained anything it kept
+		x.release()
 		if err != nil {
 			logger.Critical(err.Error())
 		}
@@ -153,6 +193,10 @@ func (s *ServerConn) Route(x *ChunkStream) error {
 	M().ServerTotalPacketsRX++
 	M().ServerTotalBytesRX = M().ServerTotalBytesRX + int(x.Length)
 	M().Unlock()
+	return s.route(x)
+}
+
+func (s *ServerConn) route(x *ChunkStream) error {
 	switch x.TypeID {
 	case SetChunkSizeMessageID:
 		logger.Debug(rtmpMessage(typeIDString(x), rx))
@@ -179,21 +223,37 @@ func (s *ServerConn) Route(x *ChunkStream) error {
 		return s.handleCommand(x)
 	case DataMessageAMF0ID, DataMessageAMF3ID:
 		logger.Debug(rtmpMessage("DataMessage", rx))
-		return s.handleDataMessage(x)
+		ns := s.netStream(x.StreamID)
+		if ns == nil {
+			logger.Debug(rtmpMessage(fmt.Sprintf("dropped data on unknown stream %d", x.StreamID), warn))
+			return nil
+		}
+		return ns.handleDataMessage(x)
 	case SharedObjectMessageAMF0ID, SharedObjectMessageAMF3ID:
 		logger.Critical("unsupported messageID: %s", typeIDString(x))
-	case AudioMessageID:
-		err := Multiplex(s.server.listener.URLAddr().Key()).Write(x)
+	case AudioMessageID, VideoMessageID:
+		ns := s.netStream(x.StreamID)
+		if ns == nil {
+			logger.Debug(rtmpMessage(fmt.Sprintf("dropped %s on unknown stream %d", typeIDString(x), x.StreamID), warn))
+			return nil
+		}
+		live, err := ns.publishing()
 		if err != nil {
 			return err
 		}
-	case VideoMessageID:
-		err := Multiplex(s.server.listener.URLAddr().Key()).Write(x)
+		err = s.bitrate.add(len(x.Data), time.Now())
+		if err != nil {
+			// Disconnect, and the next read will end the client
+			s.Close()
+			return fmt.Errorf("publish client %s: %v", s.conn.RemoteAddr(), err)
+		}
+		err = live.publish(ns.input, x)
 		if err != nil {
 			return err
 		}
 	case AggregateMessageID:
-		logger.Critical("unsupported messageID: %s", typeIDString(x))
+		logger.Debug(rtmpMessage(typeIDString(x), rx))
+		return s.handleAggregate(x)
 	default:
 		logger.Critical("unsupported messageID: %s", typeIDString(x))
 
@@ -201,7 +261,38 @@ func (s *ServerConn) Route(x *ChunkStream) error {
 	return nil
 }
 
+// handleAggregate will route each sub-message of an aggregate
+// message as if it had been sent on its own.
+func (s *ServerConn) handleAggregate(x *ChunkStream) error {
+	subs, err := splitAggregate(x)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		err = s.route(sub)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *ServerConn) handleUserControl(x *ChunkStream) error {
+	event, err := s.conn.handleUserControl(x)
+	if err != nil {
+		return err
+	}
+	switch event.Type {
+	case SetBufferLen:
+		logger.Debug(rtmpMessage(fmt.Sprintf("client %s buffer length %dms", s.conn.RemoteAddr(), event.BufferLength), ack))
+	case UserMessagePingResponse:
+		M().Lock()
+		M().ClientRTT[s.conn.RemoteAddr().String()] = s.conn.RTT()
+		M().Unlock()
+	case StreamBegin, StreamEOF, StreamDry, StreamIsRecorded:
+		// Stream events are sent by the server
+		logger.Debug(rtmpMessage(fmt.Sprintf("ignored %s from client %s", userControlString(event.Type), s.conn.RemoteAddr()), warn))
+	}
 	return nil
 }
 
@@ -210,18 +301,23 @@ func (s *ServerConn) handleUserControl(x *ChunkStream) error {
 //2021-10-13T10:48:38-07:00 [Debug     ]    [1] (onMetaData)
 //2021-10-13T10:48:38-07:00 [Debug     ]    [2] (map[2.1:false 3.1:false 4.0:false 4.1:false 5.1:false 7.1:false audiochannels:2 audiocodecid:10 audiodatarate:160 audiosamplerate:48000 audiosamplesize:16 duration:0 encoder:obs-output module (libobs version 27.0.1-3) fileSize:0 framerate:30 height:720 stereo:true videocodecid:7 videodatarate:2500 width:1280])
 func (s *ServerConn) handleDataMessage(x *ChunkStream) error {
-	amfType := amf.AMF0
-	if x.TypeID == CommandMessageAMF3ID {
-		// Arithmetic to match AMF3 encoding
-		amfType = amf.AMF3
-		x.Data = x.Data[1:]
-	}
-	r := bytes.NewReader(x.Data)
-	vs, err := s.LogDecodeBatch(r, amf.Version(amfType))
-	if err != nil && err != io.EOF {
+	r := bytes.NewReader(amfPayload(x))
+	vs, err := s.LogDecodeBatch(r, AMF0)
+	if err != nil {
 		return err
 	}
 
+	if x.TypeID == DataMessageAMF3ID {
+		// Every destination can decode AMF0 metadata
+		data, err := EncodeAMF(AMF0, vs...)
+		if err != nil {
+			return err
+		}
+		x.TypeID = DataMessageAMF0ID
+		x.Data = data
+		x.Length = uint32(len(data))
+	}
+
 	// set batchedValues
 	x.batchedValues = vs
 
@@ -238,12 +334,11 @@ func (s *ServerConn) handleDataMessage(x *ChunkStream) error {
 	logger.Debug(rtmpMessage("MetaData", rx))
 
 	// Multiplex (and cache) the metadata for later
-
-	err = Multiplex(s.server.listener.URLAddr().Key()).AddMetaData(x)
+	live, err := s.publishing()
 	if err != nil {
 		return err
 	}
-	err = Multiplex(s.server.listener.URLAddr().Key()).Write(x)
+	err = live.addMetaData(s.input, x)
 	if err != nil {
 		return err
 	}
@@ -258,6 +353,16 @@ func (s *ServerConn) handleDataMessage(x *ChunkStream) error {
 // this is the main router for all of these commands that start out
 // as an unknown interface
 func (s *ServerConn) routeCommand(commandName string, x *ChunkStream) error {
+	// NetStream commands are only answered on a stream the
+	// client has created
+	var ns *ServerConn
+	switch commandName {
+	case CommandPublish, CommandPlay, CommandPlay2, CommandSeek, CommandPause, CommandReceiveAudio, CommandReceiveVideo:
+		ns = s.netStream(x.StreamID)
+		if ns == nil {
+			return s.errorTX(x, CommandNetConnectionCallFailed, fmt.Sprintf("Unknown stream ID (%d).", x.StreamID))
+		}
+	}
 	switch commandName {
 	case CommandConnect:
 		return s.connectRX(x)
@@ -265,55 +370,70 @@ func (s *ServerConn) routeCommand(commandName string, x *ChunkStream) error {
 		return s.createStreamRX(x)
 	case CommandPublish:
 
-		// Respond to a publish
-		err := s.publishRX(x)
+		// Respond to a publish, the publish client
+		// is registered with the server in publishRX
+		err := ns.publishRX(x)
 		if err != nil {
 			return err
 		}
-
-		// Publish client
-		s.clientType = PublishClient
-
-		// We have a new publish client, so let's create a new stream
-		Multiplex(s.server.listener.URLAddr().Key()).SetChunkSize(s.conn.chunkSize)
-		logger.Info(rtmpMessage("Publish Stream", stream))
+		logger.Info(rtmpMessage(fmt.Sprintf("Publish Stream %s", ns.streamName), stream))
 	case CommandPlay:
 
+		// A NetStream that plays again stops playing
+		// the stream it was playing before
+		if ns.clientType == PlayClient {
+			ns.stream().RemovePlayConn(ns.conn, ns.streamID)
+		}
+
 		// Respond to a play
-		err := s.playRX(x)
+		err := ns.playRX(x)
 		if err != nil {
 			return err
 		}
 
-		// Play Client
-		s.clientType = PlayClient
-
 		// Metrics
 		M().Lock()
-		P(s.server.listener.URLAddr().SafeURL()).ProxyAddrTX = s.server.listener.URLAddr().SafeURL()
-		P(s.server.listener.URLAddr().SafeURL()).ProxyKeyHash = s.server.listener.URLAddr().SafeKey()
+		P(s.server.listener.URLAddr().ID()).ProxyAddrTX = s.server.listener.URLAddr().SafeURL()
+		P(s.server.listener.URLAddr().ID()).ProxyKeyHash = s.server.listener.URLAddr().SafeKey()
 		M().Unlock()
 
 		// Add the play client as a backend to Write() to
-		err = Multiplex(s.server.listener.URLAddr().Key()).AddConn(s.conn)
+		size, policy, aggregate := s.server.writeOptions()
+		s.conn.SetWriteQueueSize(size)
+		s.conn.SetOverflowPolicy(policy)
+		s.conn.SetAggregateAudio(aggregate)
+		err = ns.stream().AddPlayConn(ns.conn, ns.streamID)
 		if err != nil {
 			return err
 		}
-		logger.Info(rtmpMessage("Play Stream", stream))
+		s.server.PlayClient(ns)
+		logger.Info(rtmpMessage(fmt.Sprintf("Play Stream %s", ns.streamName), stream))
 	case CommandFCPublish:
 		return s.oosFCPublishRX(x)
 	case CommandFCSubscribe:
 		// Less is more
 	case CommandFCUnpublish:
-		// Less is more
+		return s.oosFCUnpublishRX(x)
 	case CommandReleaseStream:
 		return s.oosReleaseStreamRX(x)
 	case CommandGetStreamLength:
 		return s.oosGetStreamLengthRX(x)
 	case CommandDeleteStream:
-		Multiplex(s.server.listener.URLAddr().Key()).RemoveConn(s.conn)
+		return s.deleteStreamRX(x)
+	case CommandPlay2:
+		return ns.play2RX(x)
+	case CommandSeek:
+		return ns.seekRX(x)
+	case CommandPause:
+		return ns.pauseRX(x)
+	case CommandReceiveAudio:
+		return ns.receiveAudioRX(x)
+	case CommandReceiveVideo:
+		return ns.receiveVideoRX(x)
 	default:
-		return fmt.Errorf("unsupported commandName: %s", commandName)
+		// Answer the command, so the client is not left waiting
+		logger.Debug(rtmpMessage(fmt.Sprintf("unsupported commandName: %s", commandName), warn))
+		return s.errorTX(x, CommandNetConnectionCallFailed, fmt.Sprintf("Method not found (%s).", commandName))
 	}
 	return nil
 }
@@ -329,18 +449,12 @@ func (s *ServerConn) oosGetStreamLengthRX(x *ChunkStream) error {
 }
 
 func (s *ServerConn) handleCommand(x *ChunkStream) error {
-	amfType := amf.AMF0
-	if x.TypeID == CommandMessageAMF3ID {
-		// Arithmetic to match AMF3 encoding
-		amfType = amf.AMF3
-		x.Data = x.Data[1:]
-	}
-	r := bytes.NewReader(x.Data)
+	r := bytes.NewReader(amfPayload(x))
 
 	// enable logging here (or in the logger...)
-	//vs, err := s.decoder.DecodeBatch(r, amf.Version(amfType))
-	vs, err := s.LogDecodeBatch(r, amf.Version(amfType))
-	if err != nil && err != io.EOF {
+	//vs, err := s.decoder.DecodeBatch(r, AMF0)
+	vs, err := s.LogDecodeBatch(r, AMF0)
+	if err != nil {
 		return err
 	}
 
@@ -367,7 +481,7 @@ func (s *ServerConn) Write(x *ChunkStream) error {
 	if x.TypeID == TAG_SCRIPTDATAAMF0 ||
 		x.TypeID == TAG_SCRIPTDATAAMF3 {
 		var err error
-		if x.Data, err = amf.MetaDataReform(x.Data, amf.DEL); err != nil {
+		if x.Data, err = removeSetDataFrame(x.Data); err != nil {
 			return err
 		}
 		x.Length = uint32(len(x.Data))
@@ -383,7 +497,7 @@ func (s *ServerConn) Read(packet *ChunkStream) (err error) {
 	return s.conn.Read(packet)
 }
 
-func (s *ServerConn) LogDecodeBatch(r io.Reader, ver amf.Version) ([]interface{}, error) {
+func (s *ServerConn) LogDecodeBatch(r io.Reader, ver AMFVersion) ([]interface{}, error) {
 
 	vs, err := s.decoder.DecodeBatch(r, ver)
 	//for k, v := range vs {
@@ -392,23 +506,138 @@ func (s *ServerConn) LogDecodeBatch(r io.Reader, ver amf.Version) ([]interface{}
 	return vs, err
 }
 
+// stream is the Stream this connection publishes to, or plays from.
+// stream will return nil until the client has sent publish or play.
+func (s *ServerConn) stream() *Stream {
+	if s.streamName == "" {
+		return nil
+	}
+	return Multiplex(s.streamName)
+}
+
+// publishing will return the Stream this connection publishes to, or
+// an error if this connection is not a publish client.
+func (s *ServerConn) publishing() (*Stream, error) {
+	if s.clientType != PublishClient {
+		return nil, fmt.Errorf("media message from %s before publish", s.conn.RemoteAddr())
+	}
+	return s.stream(), nil
+}
+
+// playing will return the Stream this connection plays, or an
+// error if this connection is not a play client.
+func (s *ServerConn) playing() (*Stream, error) {
+	if s.clientType != PlayClient {
+		return nil, fmt.Errorf("play command from %s before play", s.conn.RemoteAddr())
+	}
+	return s.stream(), nil
+}
+
+// app is the application name the client sent with connect.
+func (s *ServerConn) app() string {
+	if s.connectInfo == nil || s.connectInfo.App == "" {
+		return DefaultRTMPApp
+	}
+	return strings.Trim(s.connectInfo.App, "/")
+}
+
+// streamName will join the app and stream name into the name
+// used to route a stream, such as "twinx/camera".
+func streamName(app, name string) string {
+	return fmt.Sprintf("%s/%s", app, strings.Trim(name, "/"))
+}
+
 func (s *ServerConn) Close() {
 	s.conn.Close()
 }
 
+// newMsg will encode a command message for the client. Unlike writeMsg
+// it is safe to call from any go routine, so that the message can be
+// queued for a play client behind the packets of a Stream.
+func (s *ServerConn) newMsg(csid, streamID uint32, args ...interface{}) (*ChunkStream, error) {
+	b := &bytes.Buffer{}
+	typeID := CommandMessageAMF0ID
+	if s.connectInfo != nil && s.connectInfo.ObjectEncoding == int(AMF3) {
+		typeID = CommandMessageAMF3ID
+		b.WriteByte(0)
+	}
+	encoder := &AMFEncoder{}
+	if err := encoder.EncodeBatch(b, AMF0, args...); err != nil {
+		return nil, err
+	}
+	return &ChunkStream{
+		CSID:     csid,
+		TypeID:   typeID,
+		StreamID: streamID,
+		Length:   uint32(b.Len()),
+		Data:     b.Bytes(),
+	}, nil
+}
+
+// notifyPlay will queue a stream event, and an onStatus message, for a
+// play client behind the packets already queued by the Stream.
+func (s *ServerConn) notifyPlay(eventType uint32, code, description string) error {
+	_, streamID := s.statusIDs()
+	status, err := s.statusMsg(ConnEventStatus, code, description)
+	if err != nil {
+		return err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), code), tx))
+	return s.stream().Notify(s.conn, s.streamID, s.conn.userControlStream(eventType, streamID), status)
+}
+
+// statusMsg will encode an onStatus message for the stream, to be
+// queued for a play client behind the packets of the Stream.
+func (s *ServerConn) statusMsg(level, code, description string) (*ChunkStream, error) {
+	csid, streamID := s.statusIDs()
+	event := make(AMFObject)
+	event[ConnEventLevel] = level
+	event[ConnEventCode] = code
+	event[ConnEventDescription] = description
+	return s.newMsg(csid, streamID, CommandTypeOnStatus, 0, nil, event)
+}
+
+// status will write an onStatus message for the stream.
+func (s *ServerConn) status(level, code, description string) error {
+	x, err := s.statusMsg(level, code, description)
+	if err != nil {
+		return err
+	}
+	err = s.conn.Write(x)
+	if err != nil {
+		return err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), code), tx))
+	return nil
+}
+
+// transactionID is the transaction ID the client sent with a command,
+// or 0 if the command did not have one.
+func transactionID(x *ChunkStream) float64 {
+	if len(x.batchedValues) < 2 {
+		return 0
+	}
+	id, _ := x.batchedValues[1].(float64)
+	return id
+}
+
 func (s *ServerConn) writeMsg(csid, streamID uint32, args ...interface{}) error {
 	s.bytesw.Reset()
-	for _, v := range args {
-		if _, err := s.encoder.Encode(s.bytesw, v, amf.AMF0); err != nil {
-			return err
-		}
+	typeID := CommandMessageAMF0ID
+	if s.connectInfo != nil && s.connectInfo.ObjectEncoding == int(AMF3) {
+		// Respond in kind to a client that connected with AMF3
+		typeID = CommandMessageAMF3ID
+		s.bytesw.WriteByte(0)
+	}
+	if err := s.encoder.EncodeBatch(s.bytesw, AMF0, args...); err != nil {
+		return err
 	}
 	msg := s.bytesw.Bytes()
 	packet := ChunkStream{
 		Format:    0,
 		CSID:      csid,
 		Timestamp: 0,
-		TypeID:    20,
+		TypeID:    typeID,
 		StreamID:  streamID,
 		Length:    uint32(len(msg)),
 		Data:      msg,
@@ -39,14 +39,12 @@
 package rtmp
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"time"
 
-	"github.com/gwuhaolin/livego/protocol/amf"
-
-	"github.com/gwuhaolin/livego/utils/pio"
 	"github.com/kris-nova/logger"
 )
 
@@ -77,10 +75,10 @@ func (s *ServerConn) handshake() error {
 
 	S0[0] = 3
 
-	clitime := pio.U32BE(C1[0:4])
+	clitime := binary.BigEndian.Uint32(C1[0:4])
 	srvtime := clitime
 	srvver := uint32(0x0d0e0a0d)
-	cliver := pio.U32BE(C1[4:8])
+	cliver := binary.BigEndian.Uint32(C1[4:8])
 
 	if cliver != 0 {
 		var ok bool
@@ -126,26 +124,29 @@ func (s *ServerConn) connectRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
 	// ---
 	if len(x.batchedValues) == 0 {
-		return errors.New("missing values")
+		return s.rejectConnect(x, errors.New("missing values"))
 	}
 	if len(x.batchedValues) < 3 {
-		return fmt.Errorf("invalid connect command length [%d] < 3", len(x.batchedValues))
+		return s.rejectConnect(x, fmt.Errorf("invalid connect command length [%d] < 3", len(x.batchedValues)))
 	}
 	rxID := x.batchedValues[1]
 	id, ok := rxID.(float64)
 	if !ok {
-		return errors.New("invalid ID field")
+		return s.rejectConnect(x, errors.New("invalid ID field"))
 	}
 	s.transactionID = int64(id)
 	// ---
 
 	if id != CommandConnectWellKnownID {
-		return fmt.Errorf("invalid connect id: %v", rxID)
+		return s.rejectConnect(x, fmt.Errorf("invalid connect id: %v", rxID))
+	}
+	if s.connectInfo != nil {
+		return s.rejectConnect(x, errors.New("already connected"))
 	}
 	rxConnInfoMap := x.batchedValues[2]
 	rxConnInfo, err := ConnectInfoMapToInstance(rxConnInfoMap)
 	if err != nil {
-		return fmt.Errorf("building connect info: %v", err)
+		return s.rejectConnect(x, fmt.Errorf("building connect info: %v", err))
 	}
 	s.connectInfo = rxConnInfo
 	s.connectPacket = x
@@ -194,7 +195,7 @@ func (s *ServerConn) connectTX() (*ChunkStream, error) {
 
 	// Compliant connect response [response]
 	// TODO Use any existing meta fields
-	resp := make(amf.Object)
+	resp := make(AMFObject)
 	//if s.connectInfo == nil {
 	//	resp[ConnRespFMSVer] = DefaultServerFMSVersion
 	//} else {
@@ -204,7 +205,7 @@ func (s *ServerConn) connectTX() (*ChunkStream, error) {
 	resp[ConnRespCapabilities] = 31
 
 	// Compliant connect response [event]
-	event := make(amf.Object)
+	event := make(AMFObject)
 	event[ConnEventLevel] = ConnEventStatus
 	event[ConnEventCode] = CommandNetStreamConnectSuccess
 	event[ConnEventDescription] = "Connection succeeded."
@@ -212,10 +213,49 @@ func (s *ServerConn) connectTX() (*ChunkStream, error) {
 
 	// Write out _result message
 	err = s.writeMsg(s.connectPacket.CSID, s.connectPacket.StreamID, CommandType_Result, s.transactionID, resp, event)
+	if err != nil {
+		return nil, err
+	}
 	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), "Response [_result]"), tx))
+
+	// Clients that wait for a bandwidth check can continue
+	err = s.writeMsg(s.connectPacket.CSID, s.connectPacket.StreamID, CommandTypeOnBWDone, 0, nil)
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), CommandTypeOnBWDone), tx))
 	return nil, err
 }
 
+// rejectConnect will send NetConnection.Connect.Rejected in an _error
+// response to connect, and close the connection.
+func (s *ServerConn) rejectConnect(x *ChunkStream, reason error) error {
+	err := s.errorTX(x, CommandNetConnectionRejected, reason.Error())
+	if err == nil {
+		err = s.Flush()
+	}
+	if err != nil {
+		logger.Debug(rtmpMessage(fmt.Sprintf("%s: %v", thisFunctionName(), err), warn))
+	}
+	s.Close()
+	return fmt.Errorf("rejected %s: %v", s.conn.RemoteAddr(), reason)
+}
+
+// errorTX will send an _error response to a command, with the
+// transaction ID the client sent with the command.
+func (s *ServerConn) errorTX(x *ChunkStream, code, description string) error {
+	event := make(AMFObject)
+	event[ConnEventLevel] = ConnEventError
+	event[ConnEventCode] = code
+	event[ConnEventDescription] = description
+	err := s.writeMsg(x.CSID, x.StreamID, CommandType_Error, transactionID(x), nil, event)
+	if err != nil {
+		return err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), code), tx))
+	return nil
+}
+
+// createStreamRX will create a NetStream, and respond with the
+// message stream ID of the NetStream.
+//
 // Example raw data from logs:
 //   0: createStream
 //   1: 2
@@ -235,15 +275,19 @@ func (s *ServerConn) createStreamRX(x *ChunkStream) error {
 		return errors.New("invalid ID field, unable to type cast float64")
 	}
 	s.transactionID = int64(id)
+	_, err := s.createStream()
+	if err != nil {
+		return s.errorTX(x, CommandNetConnectionCallFailed, err.Error())
+	}
 	logger.Debug(rtmpMessage(thisFunctionName(), ack))
 
-	_, err := s.createStreamTX()
+	_, err = s.createStreamTX()
 	return err
 }
 
 func (s *ServerConn) createStreamTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), "Response [_result]"), tx))
-	err := s.writeMsg(s.connectPacket.CSID, s.connectPacket.StreamID, CommandType_Result, s.transactionID, nil, 1)
+	err := s.writeMsg(s.connectPacket.CSID, s.connectPacket.StreamID, CommandType_Result, s.transactionID, nil, s.lastStreamID)
 	return nil, err
 }
 
@@ -333,6 +377,7 @@ func (s *ServerConn) playRX(x *ChunkStream) error {
 	if len(x.batchedValues) < 4 {
 		return fmt.Errorf("invalid play command length [%d] < 4", len(x.batchedValues))
 	}
+	var err error
 
 	rxID := x.batchedValues[1]
 	id, ok := rxID.(float64)
@@ -340,9 +385,30 @@ func (s *ServerConn) playRX(x *ChunkStream) error {
 		return errors.New("invalid ID field, unable to type cast float64")
 	}
 	s.transactionID = int64(id)
+	name, ok := x.batchedValues[3].(string)
+	if !ok {
+		return errors.New("invalid stream name field, unable to type cast string")
+	}
+	err = s.server.allowed(s.conn.RemoteAddr(), PlayClient)
+	if err != nil {
+		return s.reject(CommandNetStreamPlayFailed, err)
+	}
+	s.streamName, err = s.server.authenticate(s.app(), name, PlayClient)
+	if err != nil {
+		return s.reject(CommandNetStreamPlayFailed, err)
+	}
+
+	// A start of -1 will only play a live stream, any other
+	// start will wait for the stream to be published.
+	if len(x.batchedValues) > 4 {
+		start, _ := x.batchedValues[4].(float64)
+		if start == -1 && s.server.liveStream(s.streamName) == nil {
+			return s.reject(CommandNetStreamPlayNotFound, fmt.Errorf("stream not found: %s", s.streamName))
+		}
+	}
 	logger.Debug(rtmpMessage(thisFunctionName(), ack))
 
-	_, err := s.playTX()
+	_, err = s.playTX()
 	if err != nil {
 		return err
 	}
@@ -351,14 +417,15 @@ func (s *ServerConn) playRX(x *ChunkStream) error {
 
 func (s *ServerConn) playTX() (*ChunkStream, error) {
 
-	err := s.conn.setRecorded()
+	csid, streamID := s.statusIDs()
+	err := s.conn.Write(s.conn.userControlStream(StreamIsRecorded, streamID))
 	if err != nil {
 		return nil, err
 	}
 	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), "SetRecorded"), tx))
 
 	// NetStream.Play.Reset
-	event := make(amf.Object)
+	event := make(AMFObject)
 	//event[ConnEventLevel] = ConnEventStatus
 	//event[ConnEventCode] = CommandNetStreamPlayReset
 	//event[ConnEventDescription] = "Playing and resetting stream."
@@ -371,7 +438,7 @@ func (s *ServerConn) playTX() (*ChunkStream, error) {
 	event[ConnEventLevel] = ConnEventStatus
 	event[ConnEventCode] = CommandNetStreamPlayStart
 	event[ConnEventDescription] = "Start live"
-	if err := s.writeMsg(s.connectPacket.CSID, s.connectPacket.StreamID, CommandTypeOnStatus, 0, nil, event); err != nil {
+	if err := s.writeMsg(csid, streamID, CommandTypeOnStatus, 0, nil, event); err != nil {
 		return nil, err
 	}
 	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), CommandNetStreamPlayStart), tx))
@@ -397,44 +464,229 @@ func (s *ServerConn) playTX() (*ChunkStream, error) {
 	return nil, nil
 }
 
+// play2RX will switch a play client to another stream without
+// reconnecting. Video resumes at the next keyframe of the stream, or
+// from the start offset like seek, and the client keeps receiving
+// audio and video as it did before.
+//
+// 7.2.2.2. play2
+// Unlike the play command, play2 can switch to a different bit rate
+// stream without changing the timeline of the content played.
+//
+// Example raw data from logs:
+//   0: play2
+//   1: 0
+//   2: <nil>
+//   3: map[oldStreamName:camera start:-2 streamName:camera-low transition:switch]
 func (s *ServerConn) play2RX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return defaultUnimplemented()
+	if len(x.batchedValues) < 4 {
+		return fmt.Errorf("invalid play2 command length [%d] < 4", len(x.batchedValues))
+	}
+	params, ok := x.batchedValues[3].(AMFObject)
+	if !ok {
+		return errors.New("invalid play2 parameters, unable to type cast object")
+	}
+	name, ok := params["streamName"].(string)
+	if !ok {
+		return errors.New("invalid play2 stream name, unable to type cast string")
+	}
+	old, err := s.playing()
+	if err != nil {
+		return s.errorTX(x, CommandNetConnectionCallFailed, err.Error())
+	}
+	streamName, err := s.server.authenticate(s.app(), name, PlayClient)
+	if err != nil {
+		return s.status(ConnEventError, CommandNetStreamPlayFailed, err.Error())
+	}
+	if streamName == s.streamName {
+		// The client is already playing the stream
+		_, err = s.play2TX()
+		return err
+	}
+	live := s.server.liveStream(streamName)
+	if live == nil {
+		return s.status(ConnEventError, CommandNetStreamPlayNotFound, fmt.Sprintf("stream not found: %s", streamName))
+	}
+	audio, video, err := old.Receiving(s.conn, s.streamID)
+	if err != nil {
+		return err
+	}
+	old.RemovePlayConn(s.conn, s.streamID)
+	s.server.switchPlayClient(s, streamName)
+	logger.Debug(rtmpMessage(thisFunctionName(), ack))
+
+	// The transition is sent before any packet of the stream
+	_, err = s.play2TX()
+	if err != nil {
+		return err
+	}
+	if start, ok := params["start"].(float64); ok && start >= 0 {
+		err = live.ResumePlayConnAt(s.conn, s.streamID, uint32(start))
+	} else {
+		err = live.ResumePlayConn(s.conn, s.streamID)
+	}
+	if err != nil {
+		return err
+	}
+	err = live.Receive(s.conn, s.streamID, audio, video)
+	if err != nil {
+		return err
+	}
+	logger.Info(rtmpMessage(fmt.Sprintf("Play Stream %s", s.streamName), stream))
+	return nil
 }
 
 func (s *ServerConn) play2TX() (*ChunkStream, error) {
-	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	return nil, s.status(ConnEventStatus, CommandNetStreamPlayTransition, fmt.Sprintf("Transition to %s.", s.streamName))
 }
 
+// deleteStreamRX
+//
+// 7.2.2.3. deleteStream
+// The server does not send any response to deleteStream. A publish
+// client that has not sent FCUnpublish is unpublished, and sent
+// NetStream.Unpublish.Success as nginx does. A play client is removed
+// from the stream. The NetStream is deleted, and the other NetStreams
+// of the connection are unaffected. A stream ID that was never
+// created, such as 0, is ignored.
+//
+// Example raw data from logs:
+//   0: deleteStream
+//   1: 0
+//   2: <nil>
+//   3: 1
 func (s *ServerConn) deleteStreamRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return defaultUnimplemented()
+	streamID := x.StreamID
+	if len(x.batchedValues) > 3 {
+		if id, ok := x.batchedValues[3].(float64); ok {
+			streamID = uint32(id)
+		}
+	}
+	ns := s.deleteStream(streamID)
+	if ns == nil {
+		// There is no response to deleteStream, so a stream that
+		// was never created is ignored
+		logger.Debug(rtmpMessage(fmt.Sprintf("%s unknown stream %d", thisFunctionName(), streamID), warn))
+		return nil
+	}
+	if ns.clientType == PlayClient {
+		s.server.removeClient(ns)
+		return nil
+	}
+	_, err := ns.deleteStreamTX()
+	return err
 }
 
 func (s *ServerConn) deleteStreamTX() (*ChunkStream, error) {
-	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	return nil, s.unpublish()
 }
 
+// receiveAudioRX
+//
+// 7.2.2.4. receiveAudio
+// NetStream sends the receiveAudio message to inform the server whether
+// to send or not to send the audio to the client. If the flag is set to
+// false, the server does not send any response. If the flag is set to
+// true, the server responds with status messages NetStream.Seek.Notify
+// and NetStream.Play.Start.
+//
+// Example raw data from logs:
+//   0: receiveAudio
+//   1: 0
+//   2: <nil>
+//   3: false
 func (s *ServerConn) receiveAudioRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return defaultUnimplemented()
+	receive, err := s.receiveFlag(x)
+	if err != nil {
+		return err
+	}
+	live, err := s.playing()
+	if err != nil {
+		return s.errorTX(x, CommandNetConnectionCallFailed, err.Error())
+	}
+	_, video, err := live.Receiving(s.conn, s.streamID)
+	if err != nil {
+		return err
+	}
+	err = live.Receive(s.conn, s.streamID, receive, video)
+	if err != nil || !receive {
+		return err
+	}
+	_, err = s.receiveAudioTX()
+	return err
 }
 
 func (s *ServerConn) receiveAudioTX() (*ChunkStream, error) {
-	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	return nil, s.notifyReceive("Receiving audio.")
 }
 
+// receiveVideoRX
+//
+// 7.2.2.5. receiveVideo
+// NetStream sends the receiveVideo message to inform the server whether
+// to send the video to the client or not. If the flag is set to false,
+// the server does not send any response. If the flag is set to true,
+// the server responds with NetStream.Seek.Notify and NetStream.Play.Start.
+//
+// Example raw data from logs:
+//   0: receiveVideo
+//   1: 0
+//   2: <nil>
+//   3: false
 func (s *ServerConn) receiveVideoRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return defaultUnimplemented()
+	receive, err := s.receiveFlag(x)
+	if err != nil {
+		return err
+	}
+	live, err := s.playing()
+	if err != nil {
+		return s.errorTX(x, CommandNetConnectionCallFailed, err.Error())
+	}
+	audio, _, err := live.Receiving(s.conn, s.streamID)
+	if err != nil {
+		return err
+	}
+	err = live.Receive(s.conn, s.streamID, audio, receive)
+	if err != nil || !receive {
+		return err
+	}
+	_, err = s.receiveVideoTX()
+	return err
 }
 
 func (s *ServerConn) receiveVideoTX() (*ChunkStream, error) {
-	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	return nil, s.notifyReceive("Receiving video.")
+}
+
+// receiveFlag is the flag sent with receiveAudio and receiveVideo.
+func (s *ServerConn) receiveFlag(x *ChunkStream) (bool, error) {
+	if len(x.batchedValues) < 4 {
+		return false, fmt.Errorf("invalid receive command length [%d] < 4", len(x.batchedValues))
+	}
+	receive, ok := x.batchedValues[3].(bool)
+	if !ok {
+		return false, errors.New("invalid receive flag, unable to type cast bool")
+	}
+	return receive, nil
+}
+
+// notifyReceive will queue NetStream.Seek.Notify and NetStream.Play.Start
+// for a play client, behind the packets already queued.
+func (s *ServerConn) notifyReceive(description string) error {
+	seek, err := s.statusMsg(ConnEventStatus, CommandNetStreamSeekNotify, description)
+	if err != nil {
+		return err
+	}
+	start, err := s.statusMsg(ConnEventStatus, CommandNetStreamPlayStart, description)
+	if err != nil {
+		return err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), CommandNetStreamSeekNotify), tx))
+	return s.stream().Notify(s.conn, s.streamID, seek, start)
 }
 
 //   +--------------+----------+----------------------------------------+
@@ -478,8 +730,9 @@ func (s *ServerConn) publishRX(x *ChunkStream) error {
 		return errors.New("missing values")
 	}
 	if len(x.batchedValues) < 5 {
-		return fmt.Errorf("invalid publish command length [%d] < 5", len(x.batchedValues))
+		return s.reject(CommandNetStreamPublishBadName, fmt.Errorf("invalid publish command length [%d] < 5", len(x.batchedValues)))
 	}
+	var err error
 
 	rxID := x.batchedValues[1]
 	id, ok := rxID.(float64)
@@ -487,24 +740,65 @@ func (s *ServerConn) publishRX(x *ChunkStream) error {
 		return errors.New("invalid ID field, unable to type cast float64")
 	}
 	s.transactionID = int64(id)
+	name, ok := x.batchedValues[3].(string)
+	if !ok {
+		return s.reject(CommandNetStreamPublishBadName, errors.New("invalid stream name field, unable to type cast string"))
+	}
+	publishType, ok := x.batchedValues[4].(string)
+	if !ok {
+		return s.reject(CommandNetStreamPublishBadName, errors.New("invalid publish type field, unable to type cast string"))
+	}
 	publishInfo := &PublishInfo{
-		Name: x.batchedValues[3].(string),
-		Type: x.batchedValues[4].(string),
+		Name: name,
+		Type: publishType,
 	}
 	s.publishInfo = publishInfo
+	err = s.server.allowed(s.conn.RemoteAddr(), PublishClient)
+	if err != nil {
+		return s.reject(CommandNetStreamPublishBadName, err)
+	}
+	s.streamName, err = s.server.authenticate(s.app(), publishInfo.Name, PublishClient)
+	if err != nil {
+		return s.reject(CommandNetStreamPublishBadName, err)
+	}
+	s.input, err = publishInput(publishInfo.Name, s.conn.RemoteAddr())
+	if err != nil {
+		return s.reject(CommandNetStreamPublishBadName, err)
+	}
+
+	// Register the publisher before the client is told to start
+	err = s.server.PublishClient(s)
+	if err != nil {
+		return s.reject(CommandNetStreamPublishBadName, err)
+	}
 	logger.Debug(rtmpMessage(thisFunctionName(), ack))
 
-	_, err := s.publishTX()
+	_, err = s.publishTX()
 	return err
 }
 
+// reject will send an error status to the client, and close
+// the connection.
+func (s *ServerConn) reject(code string, reason error) error {
+	err := s.status(ConnEventError, code, reason.Error())
+	if err == nil {
+		err = s.Flush()
+	}
+	if err != nil {
+		logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s: %v", thisFunctionName(), code, err), warn))
+	}
+	s.Close()
+	return fmt.Errorf("rejected %s: %v", s.conn.RemoteAddr(), reason)
+}
+
 func (s *ServerConn) publishTX() (*ChunkStream, error) {
 
-	event := make(amf.Object)
+	csid, streamID := s.statusIDs()
+	event := make(AMFObject)
 	event[ConnEventLevel] = ConnEventStatus
 	event[ConnEventCode] = CommandNetStreamPublishStart
 	event[ConnEventDescription] = "Start publishing."
-	err := s.writeMsg(s.connectPacket.CSID, s.connectPacket.StreamID, CommandTypeOnStatus, 0, nil, event)
+	err := s.writeMsg(csid, streamID, CommandTypeOnStatus, 0, nil, event)
 	if err != nil {
 		return nil, err
 	}
@@ -513,29 +807,126 @@ func (s *ServerConn) publishTX() (*ChunkStream, error) {
 	return nil, nil
 }
 
+// seekRX
+//
+// 7.2.2.7. seek
+// The client sends the seek command to seek the offset (in milliseconds)
+// within a media file or playlist. On success, the server sends a status
+// message NetStream.Seek.Notify.
+//
+// A live stream with a DVR can be played from any keyframe the DVR has
+// buffered, and the client restarts from the last keyframe at or before
+// the offset. Without a DVR, an offset at or after the cached keyframe
+// restarts the client from the keyframe. An earlier offset is answered
+// with NetStream.Seek.InvalidTime.
+//
+// Example raw data from logs:
+//   0: seek
+//   1: 0
+//   2: <nil>
+//   3: 30000
 func (s *ServerConn) seekRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return defaultUnimplemented()
+	if len(x.batchedValues) < 4 {
+		return fmt.Errorf("invalid seek command length [%d] < 4", len(x.batchedValues))
+	}
+	offset, ok := x.batchedValues[3].(float64)
+	if !ok {
+		return errors.New("invalid seek offset, unable to type cast float64")
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	s.seekOffset = uint32(offset)
+	_, err := s.playing()
+	if err != nil {
+		return s.errorTX(x, CommandNetConnectionCallFailed, err.Error())
+	}
+	_, err = s.seekTX()
+	return err
 }
 
 func (s *ServerConn) seekTX() (*ChunkStream, error) {
-	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	_, streamID := s.statusIDs()
+	seek, err := s.statusMsg(ConnEventStatus, CommandNetStreamSeekNotify, "Seeking live.")
+	if err != nil {
+		return nil, err
+	}
+	start, err := s.statusMsg(ConnEventStatus, CommandNetStreamPlayStart, "Start live")
+	if err != nil {
+		return nil, err
+	}
+	earliest, err := s.stream().Seek(s.conn, s.streamID, s.seekOffset, s.conn.userControlStream(StreamBegin, streamID), seek, start)
+	if errors.Is(err, errSeekInvalidTime) {
+		logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), CommandNetStreamSeekInvalid), tx))
+		return nil, s.status(ConnEventError, CommandNetStreamSeekInvalid, fmt.Sprintf("Seek to %d before the earliest time %d.", s.seekOffset, earliest))
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), CommandNetStreamSeekNotify), tx))
+	return nil, nil
 }
 
+// pauseRX
+//
+// 7.2.2.8. pause
+// The client sends the pause command to tell the server to pause or
+// start playing. The server sends NetStream.Pause.Notify when the stream
+// is paused, and NetStream.Unpause.Notify when the stream is unpaused.
+//
+// Delivery is held while the stream is paused, and video resumes at
+// the next keyframe.
+//
+// Example raw data from logs:
+//   0: pause
+//   1: 0
+//   2: <nil>
+//   3: true
+//   4: 12000
 func (s *ServerConn) pauseRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return defaultUnimplemented()
+	if len(x.batchedValues) < 4 {
+		return fmt.Errorf("invalid pause command length [%d] < 4", len(x.batchedValues))
+	}
+	paused, ok := x.batchedValues[3].(bool)
+	if !ok {
+		return errors.New("invalid pause flag, unable to type cast bool")
+	}
+	_, err := s.playing()
+	if err != nil {
+		return s.errorTX(x, CommandNetConnectionCallFailed, err.Error())
+	}
+	s.paused = paused
+	_, err = s.pauseTX()
+	return err
 }
 
 func (s *ServerConn) pauseTX() (*ChunkStream, error) {
-	logger.Debug(rtmpMessage(thisFunctionName(), tx))
-	return nil, defaultUnimplemented()
+	_, streamID := s.statusIDs()
+	eventType, code, description := StreamEOF, CommandNetStreamPauseNotify, "Paused live."
+	if !s.paused {
+		eventType, code, description = StreamBegin, CommandNetStreamUnpauseNotify, "Unpaused live."
+	}
+	status, err := s.statusMsg(ConnEventStatus, code, description)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), code), tx))
+	return nil, s.stream().Pause(s.conn, s.streamID, s.paused, s.conn.userControlStream(eventType, streamID), status)
 }
 
+// oosFCPublishRX is sent by OBS and FFmpeg before publish, and is
+// answered with onFCPublish.
+//
+// Example raw data from logs:
+//   0: FCPublish
+//   1: 3
+//   2: <nil>
+//   3: twinx_XVlBzgbaiCMRAjWwhTHc
 func (s *ServerConn) oosFCPublishRX(x *ChunkStream) error {
 	logger.Debug(rtmpMessage(thisFunctionName(), rx))
-	return nil
+	return s.fcStatus(x, CommandTypeOnFCPublish, CommandNetStreamPublishStart)
 }
 
 func (s *ServerConn) oosFCPublishTX() (*ChunkStream, error) {
@@ -552,3 +943,76 @@ func (s *ServerConn) oosReleaseStreamTX() (*ChunkStream, error) {
 	logger.Debug(rtmpMessage(thisFunctionName(), tx))
 	return nil, nil
 }
+
+// oosFCUnpublishRX is sent by OBS before deleteStream, when the
+// client stops streaming. The NetStreams that publish with the
+// name are unpublished.
+//
+// Example raw data from logs:
+//   0: FCUnpublish
+//   1: 5
+//   2: <nil>
+//   3: twinx_XVlBzgbaiCMRAjWwhTHc
+func (s *ServerConn) oosFCUnpublishRX(x *ChunkStream) error {
+	logger.Debug(rtmpMessage(thisFunctionName(), rx))
+	err := s.fcStatus(x, CommandTypeOnFCUnpublish, CommandNetStreamUnpublish)
+	if err != nil {
+		return err
+	}
+	var name string
+	if len(x.batchedValues) > 3 {
+		name, _ = x.batchedValues[3].(string)
+	}
+	for _, ns := range s.publishStreams(name) {
+		_, err = ns.oosFCUnpublishTX()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ServerConn) oosFCUnpublishTX() (*ChunkStream, error) {
+	return nil, s.unpublish()
+}
+
+// fcStatus will answer FCPublish or FCUnpublish, with the name
+// of the stream the client sent as the description.
+func (s *ServerConn) fcStatus(x *ChunkStream, command, code string) error {
+	var name interface{}
+	if len(x.batchedValues) > 3 {
+		name = x.batchedValues[3]
+	}
+	event := make(AMFObject)
+	event[ConnEventLevel] = ConnEventStatus
+	event[ConnEventCode] = code
+	event[ConnEventDescription] = name
+	err := s.writeMsg(x.CSID, x.StreamID, command, 0, nil, event)
+	if err != nil {
+		return err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), command), tx))
+	return nil
+}
+
+// unpublish will release the stream of a publish client, so that the
+// stream can be published again, and send NetStream.Unpublish.Success.
+//
+// It is safe to call unpublish more than once, the status is only
+// sent when the stream is released.
+func (s *ServerConn) unpublish() error {
+	if !s.server.unpublishClient(s) {
+		return nil
+	}
+	csid, streamID := s.statusIDs()
+	event := make(AMFObject)
+	event[ConnEventLevel] = ConnEventStatus
+	event[ConnEventCode] = CommandNetStreamUnpublish
+	event[ConnEventDescription] = "Stop publishing."
+	err := s.writeMsg(csid, streamID, CommandTypeOnStatus, 0, nil, event)
+	if err != nil {
+		return err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("%s.%s", thisFunctionName(), CommandNetStreamUnpublish), tx))
+	return nil
+}
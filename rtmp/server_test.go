@@ -0,0 +1,794 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPublish will dial the server, and start publishing.
+func testPublish(t *testing.T, raw string) *ClientConn {
+	client := NewClient()
+	err := client.Dial(raw)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := client.Client()
+	err = cc.publishStart()
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	return cc
+}
+
+// waitFor will poll the condition until it is true.
+func waitFor(t *testing.T, message string, condition func() bool) {
+	timeout := time.After(time.Second * 5)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", message)
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+// TestServerRouteByStreamName will publish two streams to one listener,
+// and expect each stream and play client to be routed by name.
+func TestServerRouteByStreamName(t *testing.T) {
+	listener, err := Listen("localhost:1945/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	camera := testPublish(t, "localhost:1945/twinx/camera")
+	defer camera.Close()
+	go camera.RoutePackets()
+	screen := testPublish(t, "localhost:1945/twinx/screen")
+	defer screen.Close()
+	go screen.RoutePackets()
+	waitFor(t, "publishers", func() bool {
+		return server.liveStream("twinx/camera") != nil && server.liveStream("twinx/screen") != nil
+	})
+
+	err = camera.conn.Write(testVideo(FRAME_KEY, AVC_SEQHDR))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	camera.Flush()
+	headers := func(name string) int {
+		s := Multiplex(name)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return len(s.gop.Headers())
+	}
+	waitFor(t, "camera sequence header", func() bool {
+		return headers("twinx/camera") == 1
+	})
+	if headers("twinx/screen") != 0 {
+		t.Errorf("expected camera packets to be routed to the camera stream only")
+	}
+
+	player := NewClient()
+	err = player.Dial("localhost:1945/twinx/screen")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer player.Client().Close()
+	go player.Play()
+	writers := func(name string) int {
+		s := Multiplex(name)
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		return len(s.writers)
+	}
+	waitFor(t, "play client", func() bool {
+		return writers("twinx/screen") == 1
+	})
+	if writers("twinx/camera") != 0 {
+		t.Errorf("expected play client to be routed to the screen stream only")
+	}
+
+	duplicate := NewServerConn(&Conn{})
+	duplicate.streamName = "twinx/camera"
+	if err := server.PublishClient(duplicate); err == nil {
+		t.Errorf("expected error publishing a stream twice")
+	}
+}
+
+func TestServerAuthenticate(t *testing.T) {
+	keys := NewRoomKeys()
+	key, err := keys.SetKey("twinx/camera")
+	if err != nil {
+		t.Fatalf("set key: %v", err)
+	}
+	if len(key) != DefaultRoomKeyLength {
+		t.Errorf("expected key length %d, got %d", DefaultRoomKeyLength, len(key))
+	}
+
+	server := NewServer()
+	name, err := server.authenticate("twinx", "anything", PublishClient)
+	if err != nil || name != "twinx/anything" {
+		t.Errorf("expected any publish without keys, got %q %v", name, err)
+	}
+
+	server.SetRoomKeys(keys)
+	for _, tc := range []struct {
+		app, name  string
+		clientType ServerClientType
+		expected   string
+	}{
+		{"twinx", key, PublishClient, "twinx/camera"},
+		{"twinx", "camera", PublishClient, ""},
+		{"other", key, PublishClient, ""},
+		{"twinx", "camera", PlayClient, "twinx/camera"},
+	} {
+		name, err := server.authenticate(tc.app, tc.name, tc.clientType)
+		if tc.expected == "" && err == nil {
+			t.Errorf("expected %s/%s to be rejected", tc.app, tc.name)
+		}
+		if tc.expected != "" && name != tc.expected {
+			t.Errorf("expected %s/%s to route to %q, got %q %v", tc.app, tc.name, tc.expected, name, err)
+		}
+	}
+
+	server.SetPlayAuthentication(true)
+	if _, err := server.authenticate("twinx", "camera", PlayClient); err == nil {
+		t.Errorf("expected play without a key to be rejected")
+	}
+
+	rotated, err := keys.SetKey("twinx/camera")
+	if err != nil {
+		t.Fatalf("set key: %v", err)
+	}
+	if _, err := server.authenticate("twinx", key, PublishClient); err == nil {
+		t.Errorf("expected the previous key to be revoked")
+	}
+	keys.DeleteChannel("twinx/camera")
+	if _, err := server.authenticate("twinx", rotated, PublishClient); err == nil {
+		t.Errorf("expected the deleted key to be revoked")
+	}
+}
+
+func TestServerSignedStream(t *testing.T) {
+	server := NewServer()
+	server.SetRoomKeys(NewRoomKeys())
+	signed, err := server.Sign("twinx", "guest", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	name, err := server.authenticate("twinx", signed, PublishClient)
+	if err != nil || name != "twinx/guest" {
+		t.Errorf("expected signed stream to route to twinx/guest, got %q %v", name, err)
+	}
+
+	expired, err := server.Sign("twinx", "guest", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	for _, tc := range []struct {
+		app, name string
+	}{
+		{"twinx", expired},
+		{"other", signed},
+		{"twinx", strings.Replace(signed, "guest", "camera", 1)},
+		{"twinx", "guest?expires=9999999999&sig=deadbeef"},
+	} {
+		if _, err := server.authenticate(tc.app, tc.name, PublishClient); err == nil {
+			t.Errorf("expected %s/%s to be rejected", tc.app, tc.name)
+		}
+	}
+
+	server.SetSecret([]byte("rotated"))
+	if _, err := server.authenticate("twinx", signed, PublishClient); err == nil {
+		t.Errorf("expected a new secret to invalidate signed streams")
+	}
+}
+
+// TestServerPublishBadName will publish with an invalid key, and
+// expect the client to be rejected.
+func TestServerPublishBadName(t *testing.T) {
+	listener, err := Listen("localhost:1946/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.SetRoomKeys(NewRoomKeys())
+	go server.Serve(listener)
+	defer server.Close()
+
+	publisher := testPublish(t, "localhost:1946/twinx/invalid")
+	defer publisher.Close()
+	done := make(chan error)
+	go func() {
+		done <- publisher.RoutePackets()
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), CommandNetStreamPublishBadName) {
+			t.Errorf("expected %s, got %v", CommandNetStreamPublishBadName, err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("publisher was not rejected")
+	}
+	if server.liveStream("") != nil {
+		t.Errorf("expected no live stream")
+	}
+}
+
+// expectStatus will read from a client until an onStatus message with
+// the code is received, and return the User Control events before it.
+func expectStatus(t *testing.T, cc *ClientConn, code string) []uint32 {
+	var events []uint32
+	cc.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	defer cc.conn.SetReadDeadline(time.Time{})
+	for {
+		x, err := cc.NextChunk()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", code, err)
+		}
+		switch x.TypeID {
+		case UserControlMessageID:
+			event, err := parseUserControl(x)
+			if err != nil {
+				t.Fatalf("user control: %v", err)
+			}
+			events = append(events, event.Type)
+		case CommandMessageAMF0ID, CommandMessageAMF3ID:
+			vs, err := DecodeAMF(amfPayload(x), AMF0)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			for _, v := range vs {
+				if status, ok := v.(AMFObject); ok && status[ConnEventCode] == code {
+					return events
+				}
+			}
+		}
+	}
+}
+
+// TestServerUnpublish will stop and start a publisher, and expect the
+// publisher and play client to be sent the status of the stream.
+func TestServerUnpublish(t *testing.T) {
+	listener, err := Listen("localhost:1950/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	publisher := testPublish(t, "localhost:1950/twinx/again")
+	defer publisher.Close()
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/again") != nil
+	})
+
+	client := NewClient()
+	err = client.Dial("localhost:1950/twinx/again")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	player := client.Client()
+	defer player.Close()
+	player.method = ClientMethodPlay
+	err = player.initialTX()
+	if err == nil {
+		_, err = player.playTX()
+	}
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamPlayStart)
+
+	// OBS will send FCUnpublish and deleteStream when it stops streaming
+	_, err = publisher.oosFCUnpublishTX()
+	if err == nil {
+		_, err = publisher.deleteStreamTX()
+	}
+	if err == nil {
+		err = publisher.Flush()
+	}
+	if err != nil {
+		t.Fatalf("unpublish: %v", err)
+	}
+	expectStatus(t, publisher, CommandNetStreamUnpublish)
+	events := expectStatus(t, player, CommandNetStreamPlayUnpublish)
+	if len(events) == 0 || events[len(events)-1] != StreamEOF {
+		t.Errorf("expected StreamEOF before %s, got %v", CommandNetStreamPlayUnpublish, events)
+	}
+	if server.liveStream("twinx/again") != nil {
+		t.Fatalf("expected stream to be released")
+	}
+
+	// The same stream can be published again, and the play client resumes
+	again := testPublish(t, "localhost:1950/twinx/again")
+	defer again.Close()
+	events = expectStatus(t, player, CommandNetStreamPlayPublish)
+	if len(events) == 0 || events[len(events)-1] != StreamBegin {
+		t.Errorf("expected StreamBegin before %s, got %v", CommandNetStreamPlayPublish, events)
+	}
+}
+
+// expectCommand will read from a client until the command is received,
+// and return the decoded values of the command.
+func expectCommand(t *testing.T, cc *ClientConn, name string) []interface{} {
+	cc.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	defer cc.conn.SetReadDeadline(time.Time{})
+	for {
+		x, err := cc.NextChunk()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", name, err)
+		}
+		if x.TypeID != CommandMessageAMF0ID && x.TypeID != CommandMessageAMF3ID {
+			continue
+		}
+		vs, err := DecodeAMF(amfPayload(x), AMF0)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if len(vs) > 0 && vs[0] == name {
+			return vs
+		}
+	}
+}
+
+// expectError will expect an _error response with the transaction ID
+// and code.
+func expectError(t *testing.T, cc *ClientConn, id float64, code string) {
+	vs := expectCommand(t, cc, CommandType_Error)
+	if len(vs) < 4 || vs[1] != id {
+		t.Fatalf("expected %s for transaction %v, got %v", CommandType_Error, id, vs)
+	}
+	event, ok := vs[3].(AMFObject)
+	if !ok || event[ConnEventCode] != code || event[ConnEventDescription] == "" {
+		t.Fatalf("expected %s, got %v", code, vs[3])
+	}
+}
+
+// TestServerStatusResponses will send commands the server can not
+// complete, and expect a status or error response for each.
+func TestServerStatusResponses(t *testing.T) {
+	listener, err := Listen("localhost:1953/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	client := NewClient()
+	err = client.Dial("localhost:1953/twinx/status")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	cc := client.Client()
+	defer cc.Close()
+	cc.method = ClientMethodPlay
+	err = cc.initialTX()
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	expectCommand(t, cc, CommandTypeOnBWDone)
+	vs := expectCommand(t, cc, CommandTypeOnFCPublish)
+	if event, ok := vs[3].(AMFObject); !ok || event[ConnEventDescription] != "status" || event[ConnEventLevel] != ConnEventStatus {
+		t.Errorf("expected %s for status, got %v", CommandTypeOnFCPublish, vs)
+	}
+
+	// Unsupported commands are answered with the transaction ID
+	_, err = cc.writeMsg("getBogus", 7, nil)
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectError(t, cc, 7, CommandNetConnectionCallFailed)
+
+	// A second connect is rejected
+	_, err = cc.writeMsg(CommandConnect, CommandConnectWellKnownID, AMFObject{ConnInfoKeyApp: "twinx"})
+	if err == nil {
+		err = cc.Flush()
+	}
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	expectError(t, cc, CommandConnectWellKnownID, CommandNetConnectionRejected)
+
+	// Play a stream that is not live, with a start of -1
+	client = NewClient()
+	err = client.Dial("localhost:1953/twinx/missing")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	player := client.Client()
+	defer player.Close()
+	player.method = ClientMethodPlay
+	err = player.initialTX()
+	if err == nil {
+		_, err = player.writeMsg(CommandPlay, 0, nil, "missing", -1)
+	}
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamPlayNotFound)
+
+	// A publish without a string stream name is rejected
+	client = NewClient()
+	err = client.Dial("localhost:1953/twinx/malformed")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	publisher := client.Client()
+	defer publisher.Close()
+	publisher.method = ClientMethodPublish
+	err = publisher.initialTX()
+	if err == nil {
+		_, err = publisher.writeMsg(CommandPublish, 0, nil, 1234, PublishCommandLive)
+	}
+	if err == nil {
+		err = publisher.Flush()
+	}
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	expectStatus(t, publisher, CommandNetStreamPublishBadName)
+}
+
+// TestServerPlayControl will pause, filter and switch the stream of a
+// play client, and expect the client to receive only what it asked for.
+func TestServerPlayControl(t *testing.T) {
+	listener, err := Listen("localhost:1955/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	a := testPublish(t, "localhost:1955/twinx/a")
+	defer a.Close()
+	b := testPublish(t, "localhost:1955/twinx/b")
+	defer b.Close()
+	waitFor(t, "publishers", func() bool {
+		return server.liveStream("twinx/a") != nil && server.liveStream("twinx/b") != nil
+	})
+
+	client := NewClient()
+	err = client.Dial("localhost:1955/twinx/a")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	player := client.Client()
+	defer player.Close()
+	player.method = ClientMethodPlay
+	send := func(args ...interface{}) {
+		_, err := player.writeMsg(args...)
+		if err == nil {
+			err = player.Flush()
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", args[0], err)
+		}
+	}
+	publish := func(cc *ClientConn, packets ...*ChunkStream) {
+		for _, x := range packets {
+			err := cc.Write(x)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+		}
+		err := cc.Flush()
+		if err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+	}
+	// media will read until a message of typeID, and return the
+	// media messages before it
+	media := func(typeID uint32) []uint32 {
+		var types []uint32
+		player.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		defer player.conn.SetReadDeadline(time.Time{})
+		for {
+			x, err := player.NextChunk()
+			if err != nil {
+				t.Fatalf("waiting for %d: %v", typeID, err)
+			}
+			if x.TypeID == typeID {
+				return types
+			}
+			if x.TypeID == AudioMessageID || x.TypeID == VideoMessageID {
+				types = append(types, x.TypeID)
+			}
+		}
+	}
+	err = player.initialTX()
+	if err == nil {
+		_, err = player.playTX()
+	}
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamPlayStart)
+
+	// Audio only
+	send(CommandReceiveVideo, 0, nil, false)
+	send(CommandReceiveAudio, 0, nil, true)
+	expectStatus(t, player, CommandNetStreamSeekNotify)
+	publish(a, testVideo(FRAME_KEY, AVC_NALU), testAudio(AAC_RAW))
+	if types := media(AudioMessageID); len(types) != 0 {
+		t.Errorf("expected audio only, got %v", types)
+	}
+
+	// Nothing is delivered while paused
+	send(CommandPause, 0, nil, true, 0)
+	events := expectStatus(t, player, CommandNetStreamPauseNotify)
+	if len(events) == 0 || events[len(events)-1] != StreamEOF {
+		t.Errorf("expected StreamEOF before %s, got %v", CommandNetStreamPauseNotify, events)
+	}
+	publish(a, testAudio(AAC_RAW))
+	time.Sleep(time.Millisecond * 100)
+	send(CommandPause, 0, nil, false, 0)
+	if types := media(CommandMessageAMF0ID); len(types) != 0 {
+		t.Errorf("expected nothing while paused, got %v", types)
+	}
+
+	// Switch to b, and keep receiving audio only
+	send(CommandPlay2, 0, nil, AMFObject{"streamName": "b", "oldStreamName": "a", "transition": "switch"})
+	expectStatus(t, player, CommandNetStreamPlayTransition)
+
+	// Switching to b again is acknowledged, and b keeps playing
+	send(CommandPlay2, 0, nil, AMFObject{"streamName": "b", "oldStreamName": "b", "transition": "switch"})
+	expectStatus(t, player, CommandNetStreamPlayTransition)
+	publish(b, testVideo(FRAME_KEY, AVC_NALU), testAudio(AAC_RAW))
+	if types := media(AudioMessageID); len(types) != 0 {
+		t.Errorf("expected audio only from b, got %v", types)
+	}
+	send(CommandReceiveVideo, 0, nil, true)
+	expectStatus(t, player, CommandNetStreamSeekNotify)
+	publish(b, testVideo(FRAME_KEY, AVC_NALU))
+	media(VideoMessageID)
+	stream := Multiplex("twinx/a")
+	stream.mtx.Lock()
+	writers := len(stream.writers)
+	stream.mtx.Unlock()
+	if writers != 0 {
+		t.Errorf("expected player to be removed from a, got %d writers", writers)
+	}
+}
+
+// TestServerSeek will seek a play client within the cached GOP, and
+// before it, and expect playback to resume from the cached keyframe.
+func TestServerSeek(t *testing.T) {
+	listener, err := Listen("localhost:1961/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	go server.Serve(listener)
+	defer server.Close()
+
+	publisher := testPublish(t, "localhost:1961/twinx/seek")
+	defer publisher.Close()
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/seek") != nil
+	})
+
+	client := NewClient()
+	err = client.Dial("localhost:1961/twinx/seek")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	player := client.Client()
+	defer player.Close()
+	player.method = ClientMethodPlay
+	err = player.initialTX()
+	if err == nil {
+		_, err = player.playTX()
+	}
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamPlayStart)
+
+	for _, timestamp := range []uint32{1000, 5000, 5040} {
+		x := testVideo(FRAME_INTER, AVC_NALU)
+		if timestamp%1000 == 0 {
+			x = testVideo(FRAME_KEY, AVC_NALU)
+		}
+		x.Timestamp = timestamp
+		err = publisher.Write(x)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	err = publisher.Flush()
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	// video will read until the next video message, and return
+	// its timestamp
+	video := func() uint32 {
+		player.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		defer player.conn.SetReadDeadline(time.Time{})
+		for {
+			x, err := player.NextChunk()
+			if err != nil {
+				t.Fatalf("waiting for video: %v", err)
+			}
+			if x.TypeID == VideoMessageID {
+				return x.Timestamp
+			}
+		}
+	}
+	for video() != 5040 {
+		// Drain the live packets
+	}
+
+	// Within the cached GOP, playback resumes from the keyframe
+	_, err = player.writeMsg(CommandSeek, 0, nil, 6000)
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamSeekNotify)
+	if timestamp := video(); timestamp != 5000 {
+		t.Errorf("expected playback to resume at 5000, got %d", timestamp)
+	}
+	if timestamp := video(); timestamp != 5040 {
+		t.Errorf("expected 5040 after the keyframe, got %d", timestamp)
+	}
+
+	// Before the cached GOP, the seek is refused
+	_, err = player.writeMsg(CommandSeek, 0, nil, 2000)
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamSeekInvalid)
+}
+
+// TestServerSeekDVR will seek a play client before the cached GOP of a
+// stream with a DVR, and expect playback to resume from the keyframe
+// the DVR has buffered.
+func TestServerSeekDVR(t *testing.T) {
+	listener, err := Listen("localhost:1963/twinx/default")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := NewServer()
+	server.SetDVR(time.Minute, DefaultDVRMaximumSizeBytes)
+	go server.Serve(listener)
+	defer server.Close()
+
+	publisher := testPublish(t, "localhost:1963/twinx/dvr-seek")
+	defer publisher.Close()
+	waitFor(t, "publisher", func() bool {
+		return server.liveStream("twinx/dvr-seek") != nil
+	})
+
+	client := NewClient()
+	err = client.Dial("localhost:1963/twinx/dvr-seek")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	player := client.Client()
+	defer player.Close()
+	player.method = ClientMethodPlay
+	err = player.initialTX()
+	if err == nil {
+		_, err = player.playTX()
+	}
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamPlayStart)
+
+	for _, timestamp := range []uint32{1000, 1040, 5000, 5040} {
+		x := testVideo(FRAME_INTER, AVC_NALU)
+		if timestamp%1000 == 0 {
+			x = testVideo(FRAME_KEY, AVC_NALU)
+		}
+		x.Timestamp = timestamp
+		err = publisher.Write(x)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	err = publisher.Flush()
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	video := func() uint32 {
+		player.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		defer player.conn.SetReadDeadline(time.Time{})
+		for {
+			x, err := player.NextChunk()
+			if err != nil {
+				t.Fatalf("waiting for video: %v", err)
+			}
+			if x.TypeID == VideoMessageID {
+				return x.Timestamp
+			}
+		}
+	}
+	for video() != 5040 {
+		// Drain the live packets
+	}
+
+	// Before the cached GOP, playback resumes from the DVR
+	_, err = player.writeMsg(CommandSeek, 0, nil, 2000)
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamSeekNotify)
+	for _, expected := range []uint32{1000, 1040, 5000, 5040} {
+		if timestamp := video(); timestamp != expected {
+			t.Errorf("expected %d from the DVR, got %d", expected, timestamp)
+		}
+	}
+
+	// Before the first keyframe of the DVR, the seek is refused
+	_, err = player.writeMsg(CommandSeek, 0, nil, 500)
+	if err == nil {
+		err = player.Flush()
+	}
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	expectStatus(t, player, CommandNetStreamSeekInvalid)
+}
@@ -0,0 +1,99 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sign will return a signed stream name, that can be used in place of
+// an issued key to publish or play app/name until expires.
+//
+// Similar to the "secure link" module in Nginx, the signature is an
+// HMAC of the app, stream name and expiry using the server secret.
+//  guest?expires=1634400000&sig=5d41402abc4b2a76b9719d911017c592...
+func Sign(secret []byte, app, name string, expires time.Time) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("empty secret")
+	}
+	if app == "" || name == "" {
+		return "", fmt.Errorf("invalid stream %q, expected app/stream", streamName(app, name))
+	}
+	query := url.Values{}
+	query.Set(QueryExpires, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(QuerySignature, signature(secret, app, name, query.Get(QueryExpires)))
+	return fmt.Sprintf("%s?%s", name, query.Encode()), nil
+}
+
+// verifySignature will check a signed stream name from splitQuery.
+// The error will never contain the signature.
+func verifySignature(secret []byte, app, name string, query url.Values, now time.Time) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("signed streams are not enabled")
+	}
+	expires := query.Get(QueryExpires)
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiry for stream %s", streamName(app, name))
+	}
+	expected := signature(secret, app, name, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(QuerySignature))) {
+		return fmt.Errorf("invalid signature for stream %s", streamName(app, name))
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return fmt.Errorf("signature expired for stream %s", streamName(app, name))
+	}
+	return nil
+}
+
+// signature is the hex HMAC-SHA256 of the app, stream name and expiry.
+func signature(secret []byte, app, name, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s/%s/%s", app, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// splitQuery will split a stream name from a query string, such as
+// the name sent by a client in a publish or play command.
+//  guest?expires=1634400000&sig=5d41402a...
+func splitQuery(name string) (string, url.Values) {
+	i := strings.Index(name, "?")
+	if i < 0 {
+		return name, url.Values{}
+	}
+	query, err := url.ParseQuery(name[i+1:])
+	if err != nil {
+		return name[:i], url.Values{}
+	}
+	return name[:i], query
+}
@@ -0,0 +1,259 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kris-nova/logger"
+)
+
+// Slate is a pre-recorded loop, such as "be right back", that keeps
+// the destinations of a stream publishing while there is no publisher.
+//
+// The slate is written to the destinations in real time, and is never
+// written to play clients. When a publisher returns, the destinations
+// switch back to the stream at the next keyframe. Every switch is a
+// discontinuity, and each destination rebases the timestamps that follow
+// so that remote servers such as Twitch and YouTube never see the
+// timestamps go back.
+type Slate struct {
+	headers  []*ChunkStream
+	packets  []*ChunkStream
+	duration uint32
+}
+
+// LoadSlate will read a slate from an FLV file.
+func LoadSlate(path string) (*Slate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	packets, err := ReadFLV(f)
+	if err != nil {
+		return nil, fmt.Errorf("slate %s: %v", path, err)
+	}
+	return NewSlate(packets)
+}
+
+// NewSlate will create a slate from the messages of one loop. The loop
+// begins on the first keyframe, and the metadata and sequence headers
+// are sent before the first loop.
+func NewSlate(packets []*ChunkStream) (*Slate, error) {
+	slate := &Slate{}
+	var video bool
+	for _, x := range packets {
+		if x.TypeID == VideoMessageID {
+			video = true
+		}
+	}
+	var first, last, previous uint32
+	for _, x := range packets {
+		y := *x
+		// Every client publishes on the first message stream
+		y.StreamID = 1
+		switch {
+		case y.TypeID == DataMessageAMF0ID:
+			data, err := addSetDataFrame(y.Data)
+			if err != nil {
+				return nil, fmt.Errorf("slate metadata: %v", err)
+			}
+			y.Data = data
+			y.Length = uint32(len(data))
+			slate.headers = append(slate.headers, &y)
+		case isAVCSequenceHeader(&y), isAACSequenceHeader(&y):
+			slate.headers = append(slate.headers, &y)
+		case isMedia(&y):
+			if len(slate.packets) == 0 {
+				if video && !isKeyFrame(&y) {
+					// A loop always begins on a keyframe
+					continue
+				}
+				first = y.Timestamp
+			}
+			if y.Timestamp < first {
+				y.Timestamp = first
+			}
+			y.Timestamp -= first
+			previous, last = last, y.Timestamp
+			slate.packets = append(slate.packets, &y)
+		}
+	}
+	if len(slate.packets) == 0 {
+		return nil, fmt.Errorf("slate has no keyframe")
+	}
+
+	// The next loop begins one frame after the last
+	slate.duration = last + (last - previous)
+	if slate.duration == 0 {
+		slate.duration = 1
+	}
+	return slate, nil
+}
+
+// Duration is the length of one loop of the slate.
+func (slate *Slate) Duration() time.Duration {
+	return time.Duration(slate.duration) * time.Millisecond
+}
+
+// StartSlate will write the slate to the destinations of the stream in
+// a loop, until a publisher writes a keyframe to the stream.
+func (s *Stream) StartSlate(slate *Slate) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.slateStop != nil {
+		return
+	}
+	logger.Info(rtmpMessage(fmt.Sprintf("Slate %s", s.key), stream))
+	s.slate = slate
+	s.slateStop = make(chan struct{})
+	go s.runSlate(slate, s.slateStop)
+}
+
+// StopSlate will stop writing the slate to the destinations.
+func (s *Stream) StopSlate() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stopSlate()
+}
+
+// Slating will return true while the slate is written to the
+// destinations.
+func (s *Stream) Slating() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.slateStop != nil
+}
+
+// stopSlate must be called while holding the lock.
+func (s *Stream) stopSlate() {
+	if s.slateStop == nil {
+		return
+	}
+	close(s.slateStop)
+	s.slateStop = nil
+	s.slate = nil
+}
+
+// runSlate will write the slate in real time until stop is closed.
+func (s *Stream) runSlate(slate *Slate, stop chan struct{}) {
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var loop uint32
+	for {
+		for _, x := range slate.packets {
+			timestamp := loop + x.Timestamp
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(start.Add(time.Duration(timestamp) * time.Millisecond)))
+			select {
+			case <-stop:
+				return
+			case <-timer.C:
+			}
+
+			// Only the first packet of the slate is a discontinuity,
+			// and the loop is carried in the timestamps that follow.
+			var packets []*ChunkStream
+			y := *x
+			y.Timestamp = timestamp
+			if loop == 0 && x == slate.packets[0] {
+				packets = discontinuity(slate.headers, timestamp)
+				if len(packets) == 0 {
+					y.discontinuity = true
+				}
+			}
+			if !s.writeSlate(stop, append(packets, &y)) {
+				return
+			}
+		}
+		loop += slate.duration
+	}
+}
+
+// writeSlate will queue slate packets for every destination, and
+// return false if the slate has been stopped.
+func (s *Stream) writeSlate(stop chan struct{}, packets []*ChunkStream) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.slateStop != stop {
+		return false
+	}
+	for _, x := range packets {
+		s.enqueue(x, (*streamWriter).isDestination)
+	}
+	return true
+}
+
+// writeSlating will queue a packet from the publisher while the
+// destinations are on the slate. The destinations switch back to the
+// stream at a keyframe, and the sequence headers of the publisher are
+// queued for the destinations first.
+//
+// This must be called while holding the lock.
+func (s *Stream) writeSlating(x *ChunkStream) {
+	audioOnly := s.gop.avcSeqHeader == nil && isMedia(x)
+	if !audioOnly && (!isKeyFrame(x) || isAVCSequenceHeader(x)) {
+		s.enqueue(x, (*streamWriter).isPlay)
+		return
+	}
+	logger.Info(rtmpMessage(fmt.Sprintf("Slate %s ended, switching to live", s.key), stream))
+	s.stopSlate()
+	headers := discontinuity(s.gop.Headers(), x.Timestamp)
+	for _, h := range headers {
+		s.enqueue(h, (*streamWriter).isDestination)
+	}
+	y := x
+	if len(headers) == 0 {
+		// Only the destinations rebase on x
+		y = discontinuity([]*ChunkStream{x}, x.Timestamp)[0]
+	}
+	s.enqueue(y, (*streamWriter).isDestination)
+	s.enqueue(x, (*streamWriter).isPlay)
+}
+
+// discontinuity will return copies of headers at the timestamp, with
+// the first marked as a discontinuity.
+func discontinuity(headers []*ChunkStream, timestamp uint32) []*ChunkStream {
+	var packets []*ChunkStream
+	for _, h := range headers {
+		y := *h
+		y.Timestamp = timestamp
+		packets = append(packets, &y)
+	}
+	if len(packets) > 0 {
+		packets[0].discontinuity = true
+	}
+	return packets
+}
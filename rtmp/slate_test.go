@@ -0,0 +1,180 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewSlate(t *testing.T) {
+	metaData, err := EncodeAMF(AMF0, "onMetaData", map[string]interface{}{"width": 1280.0})
+	if err != nil {
+		t.Fatalf("unable to encode metadata: %v", err)
+	}
+	meta := &ChunkStream{TypeID: DataMessageAMF0ID, Length: uint32(len(metaData)), Data: metaData}
+	key := testVideo(FRAME_KEY, AVC_NALU)
+	key.Timestamp = 1000
+	audio := testAudio(AAC_RAW)
+	audio.Timestamp = 1010
+	inter := testVideo(FRAME_INTER, AVC_NALU)
+	inter.Timestamp = 1033
+
+	slate, err := NewSlate([]*ChunkStream{
+		meta,
+		testVideo(FRAME_INTER, AVC_NALU), // Before the first keyframe, never looped
+		testVideo(FRAME_KEY, AVC_SEQHDR),
+		key, audio, inter,
+	})
+	if err != nil {
+		t.Fatalf("new slate: %v", err)
+	}
+	if len(slate.headers) != 2 || len(slate.packets) != 3 {
+		t.Fatalf("expected 2 headers and 3 packets, got %d and %d", len(slate.headers), len(slate.packets))
+	}
+	vs, err := DecodeAMF(slate.headers[0].Data, AMF0)
+	if err != nil || len(vs) != 3 || vs[0] != SetDataFrame {
+		t.Errorf("expected metadata with @setDataFrame, got %v %v", vs, err)
+	}
+	for i, expected := range []uint32{0, 10, 33} {
+		if slate.packets[i].Timestamp != expected {
+			t.Errorf("expected packet %d at %d, got %d", i, expected, slate.packets[i].Timestamp)
+		}
+	}
+	if slate.Duration() != time.Millisecond*56 {
+		t.Errorf("expected a 56ms loop, got %v", slate.Duration())
+	}
+
+	if _, err := NewSlate([]*ChunkStream{testVideo(FRAME_INTER, AVC_NALU)}); err == nil {
+		t.Fatalf("expected an error for a slate without a keyframe")
+	}
+}
+
+// TestStreamSlate will write a slate to a destination of a stream, and
+// expect the destination to switch back to the stream at a keyframe with
+// monotonic timestamps.
+func TestStreamSlate(t *testing.T) {
+	addr, err := NewURLAddr("rtmp://localhost:1935/twinx/slate")
+	if err != nil {
+		t.Fatalf("invalid addr: %v", err)
+	}
+	c, peer := net.Pipe()
+	defer peer.Close()
+	conn := newTestConn(c)
+	conn.URLAddr = *addr
+
+	stream := NewStream("slate")
+	stream.SetChunkSize(DefaultRTMPChunkSizeBytes)
+	if err := stream.AddConn(conn); err != nil {
+		t.Fatalf("add conn: %v", err)
+	}
+	defer stream.RemoveConn(conn)
+
+	// Slate packets are marked in the last byte
+	slateKey := testVideo(FRAME_KEY, AVC_NALU)
+	slateKey.Data[4] = 1
+	slateInter := testVideo(FRAME_INTER, AVC_NALU)
+	slateInter.Data[4] = 1
+	slateInter.Timestamp = 10
+	slateLast := testVideo(FRAME_INTER, AVC_NALU)
+	slateLast.Data[4] = 1
+	slateLast.Timestamp = 40
+	slate, err := NewSlate([]*ChunkStream{testVideo(FRAME_KEY, AVC_SEQHDR), slateKey, slateInter, slateLast})
+	if err != nil {
+		t.Fatalf("new slate: %v", err)
+	}
+
+	reader := newTestConn(peer)
+	var last uint32
+	read := func() *ChunkStream {
+		for {
+			x := &ChunkStream{}
+			if err := reader.Read(x); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if x.TypeID != VideoMessageID {
+				continue
+			}
+			if x.Timestamp < last {
+				t.Fatalf("timestamp went back from %d to %d", last, x.Timestamp)
+			}
+			last = x.Timestamp
+			return x
+		}
+	}
+
+	for _, x := range []*ChunkStream{testVideo(FRAME_KEY, AVC_SEQHDR), testVideo(FRAME_KEY, AVC_NALU)} {
+		x.Timestamp = 5000
+		stream.Write(x)
+	}
+	read()
+	read()
+
+	// The slate keeps its own timing across loops, which
+	// are 70ms long
+	stream.StartSlate(slate)
+	var slated []uint32
+	for len(slated) < 6 {
+		if x := read(); !isAVCSequenceHeader(x) {
+			if x.Data[4] != 1 {
+				t.Fatalf("expected the slate")
+			}
+			slated = append(slated, x.Timestamp)
+		}
+	}
+	for i, step := range []uint32{10, 30, 30, 10, 30} {
+		if slated[i+1]-slated[i] != step {
+			t.Errorf("expected slate packet %d %dms after the last, got %v", i+1, step, slated)
+		}
+	}
+
+	// A new publisher begins at 0, and the destination
+	// switches back at the keyframe
+	inter := testVideo(FRAME_INTER, AVC_NALU)
+	stream.Write(inter)
+	if !stream.Slating() {
+		t.Fatalf("expected the slate until the next keyframe")
+	}
+	stream.Write(testVideo(FRAME_KEY, AVC_NALU))
+	if stream.Slating() {
+		t.Fatalf("expected the slate to stop at the keyframe")
+	}
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for the stream")
+		default:
+		}
+		if x := read(); isKeyFrame(x) && !isAVCSequenceHeader(x) && x.Data[4] == 0 {
+			if x.Timestamp <= 5000 {
+				t.Fatalf("expected the stream to be rebased after the slate, got %d", x.Timestamp)
+			}
+			break
+		}
+	}
+}
@@ -27,8 +27,11 @@
 package rtmp
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/kris-nova/logger"
 )
@@ -37,146 +40,562 @@ type Stream struct {
 	URLAddr
 	key       string
 	chunkSize uint32
-	conns     map[string]*Conn
-	mtx       sync.Mutex
-	metaData  *ChunkStream
-	dropped   int
+
+	// writers is indexed on each destination conn, and the message
+	// stream of each play client NetStream.
+	// Every destination has its own writer go routine and queue, so
+	// that a slow destination will never block the stream.
+	writers map[writerKey]*streamWriter
+	mtx     sync.Mutex
+	gop     *GOPCache
+	dvr     *DVR
+	dropped int
+
+	// slate is written to the destinations while slateStop is open,
+	// until the publisher writes a keyframe.
+	slate     *Slate
+	slateStop chan struct{}
+
+	// inputs are the publishers of the stream, sorted by priority, and
+	// only the active input is written. The stream switches to next at
+	// the next keyframe of next. forced is the input chosen with UseInput.
+	inputs []*streamInput
+	active *streamInput
+	next   *streamInput
+	forced string
 }
 
-var mx = map[string]*Stream{}
+// writerKey is a destination of a Stream. A proxy destination is
+// on message stream 0, and every NetStream of a play client is a
+// destination of its own, even on the same conn.
+type writerKey struct {
+	conn     *Conn
+	streamID uint32
+}
+
+var (
+	mx    = map[string]*Stream{}
+	mxMtx sync.Mutex
+)
 
 // Multiplex onto key
 //
 // All bytes written to this key (the base key)
 // will be multiplexed onto any configured proxy clients.
+//
+// The server uses the app and stream name as the key, such
+// as "twinx/camera".
 func Multiplex(key string) *Stream {
+	mxMtx.Lock()
+	defer mxMtx.Unlock()
 	s, ok := mx[key]
 	if ok {
 		return s
 	}
-	mx[key] = NewStream(key)
+	mx[key] = newStream(key)
 	return mx[key]
 }
 
 func NewStream(key string) *Stream {
-	s := &Stream{
-		key:   key,
-		conns: make(map[string]*Conn),
-	}
+	s := newStream(key)
 	// Hacky cache
+	mxMtx.Lock()
 	mx[key] = s
+	mxMtx.Unlock()
 	return s
 }
 
+func newStream(key string) *Stream {
+	return &Stream{
+		key:     key,
+		writers: make(map[writerKey]*streamWriter),
+		gop:     NewGOPCache(DefaultGOPCacheMaximumSizeBytes),
+	}
+}
+
 func (s *Stream) SetChunkSize(chunkSize uint32) {
 	logger.Debug(rtmpMessage(fmt.Sprintf("SetChunkSize: %d", chunkSize), ack))
 	s.chunkSize = chunkSize
 }
 
+// AddMetaData will write (and cache) the metadata for every conn
 func (s *Stream) AddMetaData(x *ChunkStream) error {
-	s.metaData = x
-	err := s.Write(s.metaData)
-	if err != nil {
-		return err
-	}
+	return s.addMetaData(nil, x)
+}
 
+// addMetaData will write the metadata of an input, like AddMetaData.
+// The metadata of an input that is not active is only cached.
+func (s *Stream) addMetaData(in *streamInput, x *ChunkStream) error {
+	if x == nil {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.writeInput(in, x) {
+		return nil
+	}
 	logger.Debug(rtmpMessage("Multiplex: StreamBegin", tx))
-	for _, conn := range s.conns {
-		err := conn.Write(conn.streamBegin())
+	for k, w := range s.writers {
+		begin := k.conn.streamBegin()
+		if w.streamID != 0 {
+			begin = k.conn.userControlStream(StreamBegin, w.streamID)
+		}
+		_, err := w.enqueue(begin)
 		if err != nil {
-			return err
+			s.removeWriter(k, err)
 		}
 	}
 	return nil
 }
 
 func (s *Stream) GetMetaData() *ChunkStream {
-	if s.metaData == nil {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.gop.metaData == nil {
 		panic("nil metadata for play client")
 	}
-	return s.metaData
+	return s.gop.metaData
+}
+
+// Notify will queue control messages for a single destination, behind
+// the packets already queued. The messages are never dropped.
+func (s *Stream) Notify(c *Conn, streamID uint32, packets ...*ChunkStream) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, err := s.writer(c, streamID)
+	if err != nil {
+		return err
+	}
+	w.replay(packets)
+	return nil
+}
+
+// errSeekInvalidTime is returned by Seek for an offset before the
+// earliest time the stream can be played from.
+var errSeekInvalidTime = errors.New("seek before the earliest time")
+
+// Seek will discard the packets queued for a destination, and queue
+// the messages and then the stream from offset, so that the destination
+// restarts from a keyframe.
+//
+// The offset is in the timestamps written to the destination. If the
+// stream has a DVR, the destination restarts from the last keyframe
+// buffered at or before the offset. Otherwise it restarts from the
+// cached GOP. An offset before the earliest time is not honoured, and
+// errSeekInvalidTime is returned with the earliest time.
+func (s *Stream) Seek(c *Conn, streamID, offset uint32, packets ...*ChunkStream) (uint32, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, err := s.writer(c, streamID)
+	if err != nil {
+		return 0, err
+	}
+	w.mtx.Lock()
+	cached, earliest, err := s.seekable(w, offset)
+	if err != nil {
+		w.mtx.Unlock()
+		return earliest, err
+	}
+	w.discard()
+	w.skipping = false
+	w.mtx.Unlock()
+	w.replay(append(packets, cached...))
+	return earliest, nil
+}
+
+// seekable will return the packets to play a destination from offset,
+// and the earliest time the destination can be played from.
+//
+// The packets are from the DVR, beginning on the last keyframe at or
+// before offset. If the stream has no DVR, or the DVR has not buffered
+// a keyframe, the packets are the cached GOP. The earliest time is then
+// the cached keyframe, or the last timestamp written if there is no
+// cached GOP. An offset before the earliest time returns
+// errSeekInvalidTime.
+//
+// This must be called while holding the lock, and the lock of w.
+func (s *Stream) seekable(w *streamWriter, offset uint32) ([]*ChunkStream, uint32, error) {
+	if s.dvr != nil {
+		packets, earliest, ok := s.dvr.seek(offset, w.peekTimestamp)
+		if ok && offset < earliest {
+			return nil, earliest, errSeekInvalidTime
+		}
+		if ok {
+			return packets, earliest, nil
+		}
+	}
+	earliest := w.last
+	if len(s.gop.gop) > 0 {
+		earliest = w.peekTimestamp(s.gop.gop[0])
+	}
+	if offset < earliest {
+		return nil, earliest, errSeekInvalidTime
+	}
+	return s.gop.Packets(), earliest, nil
+}
+
+// Pause will hold delivery to a destination, and discard the packets
+// already queued. When unpaused the messages are queued, and video
+// resumes at the next keyframe.
+func (s *Stream) Pause(c *Conn, streamID uint32, paused bool, packets ...*ChunkStream) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, err := s.writer(c, streamID)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	if paused {
+		w.discard()
+	} else if w.paused {
+		w.skipping = true
+	}
+	w.paused = paused
+	w.mtx.Unlock()
+	w.replay(packets)
+	return nil
+}
+
+// Receive will set if a destination receives audio and video. When
+// video is received again, it resumes at the next keyframe.
+func (s *Stream) Receive(c *Conn, streamID uint32, audio, video bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, err := s.writer(c, streamID)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if video && w.noVideo {
+		w.skipping = true
+	}
+	w.noAudio = !audio
+	w.noVideo = !video
+	return nil
+}
+
+// Receiving returns if a destination receives audio and video.
+func (s *Stream) Receiving(c *Conn, streamID uint32) (audio, video bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, err := s.writer(c, streamID)
+	if err != nil {
+		return false, false, err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return !w.noAudio, !w.noVideo, nil
+}
+
+// writer will return the writer of a destination, or of a play
+// client on streamID.
+//
+// This must be called while holding the lock.
+func (s *Stream) writer(c *Conn, streamID uint32) (*streamWriter, error) {
+	w, ok := s.writers[writerKey{c, streamID}]
+	if !ok {
+		return nil, fmt.Errorf("conn is not a destination of stream %s", s.key)
+	}
+	return w, nil
+}
+
+// ResetGOP will drop the cached GOP, such as when the publisher has
+// stopped. The metadata and sequence headers are kept.
+func (s *Stream) ResetGOP() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.gop.reset()
+}
+
+// SetDVR will buffer the last retention of the stream, up to
+// maxSizeBytes, so that it can be saved with Clip. If the DVR is
+// already enabled with the same settings the buffer is kept. A
+// retention of 0 will disable the DVR and drop the buffer.
+func (s *Stream) SetDVR(retention time.Duration, maxSizeBytes int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.dvr != nil {
+		if s.dvr.retention == retention && s.dvr.maxSizeBytes == maxSizeBytes {
+			return
+		}
+		s.dvr.reset()
+		s.dvr = nil
+	}
+	if retention > 0 {
+		s.dvr = NewDVR(retention, maxSizeBytes)
+	}
+}
+
+// Clip will write the last duration of the stream to w as an FLV file,
+// beginning on a keyframe. A duration of 0 will write everything the
+// DVR has buffered.
+func (s *Stream) Clip(w io.Writer, last time.Duration) error {
+	s.mtx.Lock()
+	if s.dvr == nil {
+		s.mtx.Unlock()
+		return fmt.Errorf("dvr is not enabled for stream %s", s.key)
+	}
+	packets, err := s.dvr.Clip(last)
+	s.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The stream is not blocked while the clip is written
+	defer func() {
+		for _, x := range packets {
+			x.release()
+		}
+	}()
+	return WriteFLV(w, packets)
+}
+
+// SetDelay will change the broadcast delay of a destination. If the
+// destination has been added, the packets it is sent are never changed,
+// and it is written slower or faster than real time until it reaches
+// the new delay.
+func (s *Stream) SetDelay(c *Conn, delay time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c.delay = delay
+	if w, ok := s.writers[writerKey{conn: c}]; ok {
+		w.setDelay(delay)
+	}
 }
 
+// RemoveConn will remove a destination from the stream.
 func (s *Stream) RemoveConn(c *Conn) {
-	// Setting to nil is safe, we check for nil and bypass
-	// later in the Write()
-	s.conns[c.SafeURL()] = nil
+	s.RemovePlayConn(c, 0)
 }
 
+// RemovePlayConn will remove a play client on streamID from the
+// stream. The other NetStreams of the conn are unaffected.
+func (s *Stream) RemovePlayConn(c *Conn, streamID uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := writerKey{c, streamID}
+	w, ok := s.writers[k]
+	if !ok {
+		return
+	}
+	w.close()
+	delete(s.writers, k)
+}
+
+// AddConn will add a new destination to the stream. The destination
+// is sent the cached metadata, sequence headers, and the last GOP
+// before any live packets.
 func (s *Stream) AddConn(c *Conn) error {
+	return s.addConn(c, 0, false, -1)
+}
+
+// AddPlayConn will add a play client to the stream, like AddConn.
+// Packets are written to the message stream the client plays on.
+func (s *Stream) AddPlayConn(c *Conn, streamID uint32) error {
+	return s.addConn(c, streamID, false, -1)
+}
+
+// ResumeConn will add a destination that is reconnecting to the
+// stream. The destination is sent the cached metadata and sequence
+// headers, and video will resume at the next keyframe.
+func (s *Stream) ResumeConn(c *Conn) error {
+	return s.addConn(c, 0, true, -1)
+}
+
+// ResumePlayConn will add a play client that has switched from another
+// stream, like ResumeConn.
+func (s *Stream) ResumePlayConn(c *Conn, streamID uint32) error {
+	return s.addConn(c, streamID, true, -1)
+}
+
+// ResumePlayConnAt will add a play client that has switched from
+// another stream, and play it from offset like Seek. If the stream
+// cannot be played from offset, it resumes like ResumePlayConn.
+func (s *Stream) ResumePlayConnAt(c *Conn, streamID, offset uint32) error {
+	return s.addConn(c, streamID, true, int64(offset))
+}
+
+// addConn will add a destination. A destination that resumes is sent
+// the headers, unless it has an offset it can be played from. An
+// offset below 0 is no offset.
+func (s *Stream) addConn(c *Conn, streamID uint32, resume bool, offset int64) error {
 	if c.Key() == "" {
 		return fmt.Errorf("empty conn key, unable to multiplex")
 	}
 	if c.SafeKey() == "" {
 		return fmt.Errorf("unable to find safe key to hash metrics")
 	}
-	p := P(c.SafeURL())
+	M().Lock()
+	p := P(c.ID())
+	p.ProxyAddrTX = c.SafeURL()
 	p.ProxyKeyHash = c.SafeKey()
-	s.conns[c.SafeURL()] = c
-
-	// All new conns need metadata right away
+	M().Unlock()
 
 	// write the chunk size of the client to the server
 	if s.chunkSize == 0 {
 		return fmt.Errorf("invalid chunk size: %d", s.chunkSize)
 	}
+
+	// Hold the lock until the new conn has been queued the cache,
+	// so that live packets cannot be written before the cache.
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k := writerKey{c, streamID}
+	if existing, ok := s.writers[k]; ok {
+		existing.close()
+	}
+	w := newStreamWriter(c, c.writeQueueSize, c.overflowPolicy)
+	w.streamID = streamID
+	w.onError = func(w *streamWriter, err error) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if s.writers[k] == w {
+			s.removeWriter(k, err)
+		}
+	}
+	if c.delay > 0 {
+		w.delay = newDelayLine(c.delay, w.release)
+		go w.delay.run()
+	}
+
 	logger.Debug(rtmpMessage(fmt.Sprintf("SetChunkSize: %d", s.chunkSize), tx))
-	err := s.Write(c.newChunkStreamSetChunkSize(s.chunkSize))
-	if err != nil {
-		return err
+	packets := []*ChunkStream{c.newChunkStreamSetChunkSize(s.chunkSize)}
+
+	// All new conns need metadata, sequence headers, and
+	// a keyframe right away
+	var cached []*ChunkStream
+	switch {
+	case s.slate != nil && w.isDestination():
+		// The destination begins on the next keyframe of the slate
+		cached = s.slate.headers
+		w.skipping = true
+	case resume:
+		cached = s.gop.Headers()
+		w.skipping = true
+		if offset < 0 {
+			break
+		}
+		w.mtx.Lock()
+		from, _, err := s.seekable(w, uint32(offset))
+		w.mtx.Unlock()
+		if err == nil {
+			cached = from
+			w.skipping = false
+		}
+	default:
+		cached = s.gop.Packets()
 	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("GOP cache replay: %d packets", len(cached)), tx))
+	w.replay(append(packets, cached...))
+	s.writers[k] = w
+	go w.run()
 	return nil
 }
 
+// removeWriter will stop and remove a destination from the stream.
+// A destination is closed, while a play client is only sent a
+// NetStream.Play.Failed status, as the other NetStreams of the conn
+// are unaffected.
+//
+// This must be called while holding the lock.
+func (s *Stream) removeWriter(k writerKey, err error) {
+	w, ok := s.writers[k]
+	if !ok {
+		return
+	}
+	logger.Critical("dropping stream destination %s: %v", k.conn.SafeURL(), err)
+	w.close()
+	delete(s.writers, k)
+	if w.isDestination() {
+		k.conn.Close()
+		return
+	}
+	status, err := k.conn.playFailed(k.streamID, err.Error())
+	if err != nil {
+		return
+	}
+	// The play client is slow, so the status is not written
+	// while holding the lock.
+	go func() {
+		if k.conn.Write(status) == nil {
+			k.conn.Flush()
+		}
+	}()
+}
+
 // [ Write ]
 //
 // The almighty Write() method.
 //
-// This method is effectively a single threaded
-// Write() method.
+// Write will queue the packet for every destination
+// and return immediately.
 //
-// If this blocks. All corresponding *Conn objects
-// will also block.
+// Each destination is written to from its own go routine.
+// If a destination is unable to keep up, its OverflowPolicy
+// is applied and all other destinations are unaffected.
 func (s *Stream) Write(x *ChunkStream) error {
-	if x == nil {
-		fmt.Errorf("nil packet in multiplex writter")
-	}
+	return s.publish(nil, x)
+}
 
+// publish will write a packet from an input of the stream. The packet
+// is only written if the input is active, and a nil input is always
+// written.
+func (s *Stream) publish(in *streamInput, x *ChunkStream) error {
 	if x == nil {
 		return nil
 	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
+	s.writeInput(in, x)
+	return nil
+}
 
-	packetWrite := false
+// write will cache and queue a packet for the writers.
+//
+// This must be called while holding the lock.
+func (s *Stream) write(x *ChunkStream) {
+	// Cache before writing, so conns added later
+	// can start on a keyframe.
+	s.gop.Cache(x)
+	if s.dvr != nil {
+		s.dvr.Cache(x)
+	}
+
+	if s.slateStop != nil {
+		s.writeSlating(x)
+		return
+	}
 
-	for _, c := range s.conns {
-		if c == nil {
+	if len(s.writers) == 0 {
+		s.dropped++
+		return
+	}
+	s.enqueue(x, nil)
+}
+
+// enqueue will queue the packet for every writer, or only the writers
+// that match. A writer that returns an error is removed.
+//
+// This must be called while holding the lock.
+func (s *Stream) enqueue(x *ChunkStream, match func(w *streamWriter) bool) {
+	for k, w := range s.writers {
+		if match != nil && !match(w) {
 			continue
 		}
-		M().Lock()
-		p := P(c.SafeURL())
-		p.ProxyTotalBytesTX = p.ProxyTotalBytesTX + int(x.Length)
-		p.ProxyTotalPacketsTX++
-		M().Unlock()
-		err := c.Write(x)
+		dropped, err := w.enqueue(x)
 		if err != nil {
-			s.conns[c.SafeURL()] = nil
-			return err
+			s.removeWriter(k, err)
+			continue
 		}
-
-		// If we are dropping packets
-		// it is going to be here.
-
-		//err = c.Flush()
-		//if err != nil {
-		//	return err
-		//}
-		packetWrite = true
-	}
-	if !packetWrite {
-		s.dropped++
+		M().Lock()
+		p := P(k.conn.ID())
+		if dropped > 0 {
+			p.ProxyTotalPacketsDropped += dropped
+		} else {
+			p.ProxyTotalBytesTX = p.ProxyTotalBytesTX + int(x.Length)
+			p.ProxyTotalPacketsTX++
+		}
+		M().Unlock()
 	}
-
-	return nil
 }
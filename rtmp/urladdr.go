@@ -40,13 +40,12 @@ package rtmp
 
 import (
 	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
-	"math/rand"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // URLAddr is a flexible RTMP address member that resembles url.URL.
@@ -58,13 +57,18 @@ type URLAddr struct {
 	// into a valid *Addr
 	raw string
 
-	// scheme should always be DefaultScheme "rtmp://"
+	// scheme is either DefaultScheme "rtmp://" or
+	// DefaultSchemeTLS "rtmps://"
 	scheme string
 
 	// host is the host:port combination for the server
 	// host should be valid with net.Listen() and net.Dial()
 	host string
 
+	// hostname is the host without the port. This is the
+	// name we send (SNI) and verify during a TLS handshake.
+	hostname string
+
 	// app is the first parameter to the RTMP URL
 	// such as rtmp://host:port/app/key
 	app string
@@ -72,6 +76,14 @@ type URLAddr struct {
 	// key is the 2nd and final parameter to the RTMP URL
 	// such as rtmp://host:port/app/key
 	key string
+
+	// query is kept from the stream key, and is sent
+	// with the key such as rtmp://host:port/app/key?query
+	query url.Values
+
+	// rawQuery is the query as given, which is sent unchanged
+	// so that the order and encoding of a signed name are kept.
+	rawQuery string
 }
 
 func NewURLAddr(raw string) (*URLAddr, error) {
@@ -79,18 +91,28 @@ func NewURLAddr(raw string) (*URLAddr, error) {
 
 	raw = strings.Replace(raw, DefaultLo, DefaultLocalHost, 1)
 
-	if !strings.HasPrefix(raw, fmt.Sprintf("%s://", DefaultScheme)) {
+	if !strings.HasPrefix(raw, fmt.Sprintf("%s://", DefaultScheme)) &&
+		!strings.HasPrefix(raw, fmt.Sprintf("%s://", DefaultSchemeTLS)) {
 		raw = fmt.Sprintf("%s://%s", DefaultScheme, raw)
 	}
 	url, err := url.Parse(raw)
 	if err != nil {
 		return nil, fmt.Errorf("unable to url.Parse raw rtmp string: %s", err)
 	}
-	if len(url.Scheme) == 4 {
+	if url.Scheme == DefaultScheme || url.Scheme == DefaultSchemeTLS {
 		scheme = url.Scheme
 	}
+	defaultPort := DefaultLocalPort
+	if scheme == DefaultSchemeTLS {
+		defaultPort = DefaultTLSPort
+	}
 
 	path := strings.Replace(raw, fmt.Sprintf("%s://", scheme), "", 1)
+	path, query := splitQuery(path)
+	rawQuery := ""
+	if i := strings.Index(raw, "?"); i >= 0 {
+		rawQuery = raw[i+1:]
+	}
 
 	if strings.Contains(path, "/") {
 		splt := strings.Split(path, "/")
@@ -118,7 +140,7 @@ func NewURLAddr(raw string) (*URLAddr, error) {
 				splt[0] = DefaultLocalHost
 			}
 			if len(splt[1]) == 0 {
-				splt[0] = DefaultLocalPort
+				splt[1] = defaultPort
 			}
 			host = fmt.Sprintf("%s:%s", splt[0], splt[1])
 		}
@@ -128,28 +150,35 @@ func NewURLAddr(raw string) (*URLAddr, error) {
 	}
 	if host == "" {
 		// Check for host/port
-		host = fmt.Sprintf("%s:%s", DefaultLocalHost, DefaultLocalPort)
+		host = fmt.Sprintf("%s:%s", DefaultLocalHost, defaultPort)
 	}
 	if app == "" {
 		app = DefaultRTMPApp
 	}
 	if key == "" {
-		key = generateKey()
+		key, err = generateKey()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	a := &URLAddr{
-		raw:    raw,
-		scheme: scheme,
-		host:   host,
-		app:    app,
-		key:    key,
+		raw:      raw,
+		scheme:   scheme,
+		host:     host,
+		app:      app,
+		key:      key,
+		query:    query,
+		rawQuery: rawQuery,
 	}
 
 	// Grab the port
 	rawHost, port, err := net.SplitHostPort(a.host)
 	if err != nil {
 		if strings.Contains(err.Error(), "missing port in address") {
-			port = DefaultLocalPort
+			rawHost = a.host
+			port = defaultPort
+			a.host = net.JoinHostPort(rawHost, port)
 		} else {
 			return nil, fmt.Errorf("split host port: %v", err)
 		}
@@ -158,6 +187,7 @@ func NewURLAddr(raw string) (*URLAddr, error) {
 	if err != nil {
 		return nil, fmt.Errorf("convert port: %v", err)
 	}
+	a.hostname = rawHost
 	if rawHost == DefaultLocalHost {
 		ip := net.ParseIP(DefaultLo)
 		a.Addr = &net.TCPAddr{
@@ -168,9 +198,9 @@ func NewURLAddr(raw string) (*URLAddr, error) {
 		a.URL = *url
 		return a, nil
 	}
-	ips, err := net.LookupIP(a.host)
+	ips, err := net.LookupIP(a.hostname)
 	if err != nil {
-		return nil, fmt.Errorf("dns lookup: %s", a.host)
+		return nil, fmt.Errorf("dns lookup: %s", a.hostname)
 	}
 	if len(ips) == 0 {
 		return nil, fmt.Errorf("dns lookup failure: no records: %s", a.SafeURL())
@@ -201,6 +231,8 @@ func NewURLAddr(raw string) (*URLAddr, error) {
 //   :
 // We should see
 //   localhost:1935
+// A host without a port will use the default port for the scheme,
+// 1935 for rtmp:// and 443 for rtmps://
 func (a *URLAddr) Host() string {
 	return a.host
 }
@@ -213,31 +245,68 @@ func (a *URLAddr) SafeURL() string {
 
 // StreamURL is a resolvable stream URL that can be played, published, or proxied.
 //  rtmp://localhost:1935/app/key
+//  rtmp://localhost:1935/app/key?expires=1634400000&sig=5d41402a...
 func (a *URLAddr) StreamURL() string {
-	return fmt.Sprintf("%s://%s/%s/%s", a.scheme, a.host, a.app, a.key)
+	return fmt.Sprintf("%s://%s/%s/%s", a.scheme, a.host, a.app, a.StreamName())
 }
 
 // generateKey will generate a random stream key
-func generateKey() string {
-	rand.Seed(time.Now().UnixNano())
-	b := make([]byte, DefaultGenerateKeyLength)
-	for i := range b {
-		b[i] = StreamKeyRandomBytePool[rand.Intn(len(StreamKeyRandomBytePool))]
+func generateKey() (string, error) {
+	key, err := randomString(DefaultGenerateKeyLength)
+	if err != nil {
+		return "", fmt.Errorf("generate key: %v", err)
 	}
-	return fmt.Sprintf("%s%s", DefaultGenerateKeyPrefix, string(b))
+	return fmt.Sprintf("%s%s", DefaultGenerateKeyPrefix, key), nil
 }
 
-// Scheme should always return DefaultScheme "rtmp://"
+// Scheme will return either DefaultScheme "rtmp://" or DefaultSchemeTLS "rtmps://"
 func (a *URLAddr) Scheme() string {
 	return a.scheme
 }
 
+// TLS will return true if this address should be served or dialed over TLS.
+//  rtmps://host:port/app/key
+func (a *URLAddr) TLS() bool {
+	return a.scheme == DefaultSchemeTLS
+}
+
+// Hostname will return the host without the port.
+// This is the server name used for SNI and certificate verification.
+func (a *URLAddr) Hostname() string {
+	return a.hostname
+}
+
+// TLSConfig is the default client TLS configuration for this address.
+// The server certificate is verified against the hostname of the URL.
+func (a *URLAddr) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName: a.hostname,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
 // Key should return the stream key for this instance of *rtmp.Addr
 // All instances will generate a key if one is not provided.
 func (a *URLAddr) Key() string {
 	return a.key
 }
 
+// Query will return the query string of the stream key, such as
+// the expiry and signature of a signed stream name.
+func (a *URLAddr) Query() url.Values {
+	return a.query
+}
+
+// StreamName is the stream key and query string, which is the name
+// a client will send in a publish or play command.
+//  key?expires=1634400000&sig=5d41402a...
+func (a *URLAddr) StreamName() string {
+	if a.rawQuery == "" {
+		return a.key
+	}
+	return fmt.Sprintf("%s?%s", a.key, a.rawQuery)
+}
+
 // App will return the first parameter of the path.
 // Such as rtmp://host:port/app/key
 func (a *URLAddr) App() string {
@@ -253,12 +322,39 @@ func (a *URLAddr) String() string {
 }
 
 func (a *URLAddr) NewNetConn() (net.Conn, error) {
+	return a.NewNetConnTLS(nil)
+}
+
+// NewNetConnTLS will dial the address, and perform a TLS handshake
+// for rtmps:// addresses. If config is nil, TLSConfig() is used.
+func (a *URLAddr) NewNetConnTLS(config *tls.Config) (net.Conn, error) {
 	// Note: This is the string we will try to dial()
-	return net.Dial(DefaultProtocol, a.String())
+	if !a.TLS() {
+		return net.Dial(DefaultProtocol, a.String())
+	}
+	if config == nil {
+		config = a.TLSConfig()
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = a.hostname
+	}
+	dialer := &net.Dialer{
+		Timeout: TimeoutDurationSeconds * 10,
+	}
+	tlsConn, err := tls.DialWithDialer(dialer, DefaultProtocol, a.String(), config)
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake %s: %v", a.hostname, err)
+	}
+	return tlsConn, nil
 }
 
 func (a *URLAddr) NewConn() (*Conn, error) {
-	netConn, err := a.NewNetConn()
+	return a.NewConnTLS(nil)
+}
+
+func (a *URLAddr) NewConnTLS(config *tls.Config) (*Conn, error) {
+	netConn, err := a.NewNetConnTLS(config)
 	if err != nil {
 		return nil, err
 	}
@@ -266,6 +362,13 @@ func (a *URLAddr) NewConn() (*Conn, error) {
 	return conn, nil
 }
 
+// ID is a short, stable identifier for the full stream URL.
+// The ID can be displayed, and does not expose the stream key.
+func (a *URLAddr) ID() string {
+	x := sha256.Sum256([]byte(a.StreamURL()))
+	return fmt.Sprintf("%x", x)[:8]
+}
+
 // SafeKey is a sha256 of the stream key
 func (a *URLAddr) SafeKey() string {
 	x := sha256.Sum256([]byte(a.key))
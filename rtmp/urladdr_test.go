@@ -86,6 +86,34 @@ func TestAddrs(t *testing.T) {
 			scheme: "rtmp",
 			app:    "beeps",
 		},
+		"rtmps://localhost": &URLAddr{
+			host:   "localhost:443",
+			scheme: "rtmps",
+			app:    "twinx",
+		},
+		"rtmps://localhost:1443/beeps/boops": &URLAddr{
+			host:   "localhost:1443",
+			scheme: "rtmps",
+			app:    "beeps",
+			key:    "boops",
+		},
+		"rtmps://localhost/beeps/boops": &URLAddr{
+			host:   "localhost:443",
+			scheme: "rtmps",
+			app:    "beeps",
+			key:    "boops",
+		},
+		"rtmp://localhost/beeps": &URLAddr{
+			host:   "localhost:1935",
+			scheme: "rtmp",
+			app:    "beeps",
+		},
+		"rtmp://localhost:1935/twinx/guest?expires=1634400000&sig=abcd": &URLAddr{
+			host:   "localhost:1935",
+			scheme: "rtmp",
+			app:    "twinx",
+			key:    "guest",
+		},
 	}
 	for input, expected := range happyCases {
 		actual, err := NewURLAddr(input)
@@ -119,6 +147,30 @@ func TestAddrs(t *testing.T) {
 
 }
 
+func TestAddrQuery(t *testing.T) {
+	raw := "rtmp://localhost:1935/twinx/guest?expires=1634400000&sig=abcd"
+	a, err := NewURLAddr(raw)
+	if err != nil {
+		t.Fatalf("url: %v", err)
+	}
+	if a.Query().Get(QuerySignature) != "abcd" {
+		t.Errorf("expected query to be kept, got %v", a.Query())
+	}
+	if a.StreamURL() != raw {
+		t.Errorf("expected stream URL %s, got %s", raw, a.StreamURL())
+	}
+
+	// The query is sent as given, and never re-encoded
+	raw = "rtmp://localhost:1935/twinx/guest?sig=ab%2Bcd&expires=1634400000"
+	a, err = NewURLAddr(raw)
+	if err != nil {
+		t.Fatalf("url: %v", err)
+	}
+	if a.StreamURL() != raw {
+		t.Errorf("expected stream URL %s, got %s", raw, a.StreamURL())
+	}
+}
+
 func assertAddrs(a, b *URLAddr) bool {
 	if a == nil || b == nil {
 		return false
@@ -0,0 +1,204 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/kris-nova/logger"
+)
+
+// UserControlEvent is a parsed User Control message.
+//
+// 7.1.7. User Control Message Events
+//
+// The message data is a 2 byte event type, followed by the event
+// data. The stream events carry the 4 byte message stream ID,
+// SetBufferLength also carries the 4 byte buffer length in
+// milliseconds, and the ping events carry a 4 byte timestamp.
+type UserControlEvent struct {
+	Type uint32
+
+	// StreamID is set for the stream events, and SetBufferLength.
+	StreamID uint32
+
+	// BufferLength is the buffer length in milliseconds,
+	// and is only set for SetBufferLength.
+	BufferLength uint32
+
+	// Timestamp is only set for PingRequest and PingResponse.
+	Timestamp uint32
+}
+
+// parseUserControl will parse the event of a User Control message.
+func parseUserControl(x *ChunkStream) (*UserControlEvent, error) {
+	if len(x.Data) < 2 {
+		return nil, fmt.Errorf("user control message: length %d", len(x.Data))
+	}
+	event := &UserControlEvent{
+		Type: uint32(binary.BigEndian.Uint16(x.Data)),
+	}
+	data := x.Data[2:]
+	size := 4
+	switch event.Type {
+	case SetBufferLen:
+		size = 8
+	case StreamBegin, StreamEOF, StreamDry, StreamIsRecorded, UserMessagePingRequest, UserMessagePingResponse:
+	default:
+		// Some servers send events that are not in the
+		// specification, such as BufferEmpty (31).
+		return event, nil
+	}
+	if len(data) < size {
+		return nil, fmt.Errorf("user control message: %s event length %d", userControlString(event.Type), len(data))
+	}
+	switch event.Type {
+	case StreamBegin, StreamEOF, StreamDry, StreamIsRecorded:
+		event.StreamID = binary.BigEndian.Uint32(data)
+	case SetBufferLen:
+		event.StreamID = binary.BigEndian.Uint32(data)
+		event.BufferLength = binary.BigEndian.Uint32(data[4:])
+	case UserMessagePingRequest, UserMessagePingResponse:
+		event.Timestamp = binary.BigEndian.Uint32(data)
+	}
+	return event, nil
+}
+
+func userControlString(eventType uint32) string {
+	switch eventType {
+	case StreamBegin:
+		return "StreamBegin"
+	case StreamEOF:
+		return "StreamEOF"
+	case StreamDry:
+		return "StreamDry"
+	case SetBufferLen:
+		return "SetBufferLength"
+	case StreamIsRecorded:
+		return "StreamIsRecorded"
+	case UserMessagePingRequest:
+		return "PingRequest"
+	case UserMessagePingResponse:
+		return "PingResponse"
+	}
+	return fmt.Sprintf("UserControlEvent(%d)", eventType)
+}
+
+// handleUserControl will handle the events of a User Control message
+// that are the same for clients and servers.
+//
+// A PingRequest is answered with a PingResponse, the round trip time
+// is recorded for a PingResponse, and the buffer length is recorded
+// for SetBufferLength.
+func (conn *Conn) handleUserControl(x *ChunkStream) (*UserControlEvent, error) {
+	event, err := parseUserControl(x)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug(rtmpMessage(fmt.Sprintf("UserControl.%s", userControlString(event.Type)), rx))
+	switch event.Type {
+	case UserMessagePingRequest:
+		logger.Debug(rtmpMessage("UserControl.PingResponse", tx))
+		return event, conn.Write(conn.userControlPing(UserMessagePingResponse, event.Timestamp))
+	case UserMessagePingResponse:
+		rtt := time.Duration(pingTimestamp()-event.Timestamp) * time.Millisecond
+		atomic.StoreInt64(&conn.rtt, int64(rtt))
+	case SetBufferLen:
+		atomic.StoreUint32(&conn.bufferLength, event.BufferLength)
+	}
+	return event, nil
+}
+
+// RTT is the round trip time of the last PingRequest sent
+// to the peer, or 0 if a PingResponse has not been received.
+func (conn *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&conn.rtt))
+}
+
+// BufferLength is the buffer length in milliseconds the peer
+// last sent with SetBufferLength.
+func (conn *Conn) BufferLength() uint32 {
+	return atomic.LoadUint32(&conn.bufferLength)
+}
+
+// ping will send a PingRequest to the peer every interval, until
+// the returned stop function is called, or a write fails.
+//
+// An interval of 0 will never ping the peer.
+func (conn *Conn) ping(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			logger.Debug(rtmpMessage("UserControl.PingRequest", tx))
+			err := conn.Write(conn.userControlPing(UserMessagePingRequest, pingTimestamp()))
+			if err == nil {
+				err = conn.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func (conn *Conn) userControlPing(eventType, timestamp uint32) *ChunkStream {
+	x := conn.userControlMsg(eventType, 4)
+	x.StreamID = 0
+	binary.BigEndian.PutUint32(x.Data[2:], timestamp)
+	return &x
+}
+
+// userControlStream will return a stream event, such as StreamEOF,
+// for a message stream.
+func (conn *Conn) userControlStream(eventType, streamID uint32) *ChunkStream {
+	x := conn.userControlMsg(eventType, 4)
+	x.StreamID = 0
+	binary.BigEndian.PutUint32(x.Data[2:], streamID)
+	return &x
+}
+
+// pingTimestamp is the wall clock in milliseconds, which will wrap.
+// The round trip time is the difference of two timestamps, and
+// is correct across the wrap.
+func pingTimestamp() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
+}
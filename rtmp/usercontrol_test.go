@@ -0,0 +1,158 @@
+// Copyright © 2021 Kris Nóva <kris@nivenly.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ────────────────────────────────────────────────────────────────────────────
+//
+//  ████████╗██╗    ██╗██╗███╗   ██╗██╗  ██╗
+//  ╚══██╔══╝██║    ██║██║████╗  ██║╚██╗██╔╝
+//     ██║   ██║ █╗ ██║██║██╔██╗ ██║ ╚███╔╝
+//     ██║   ██║███╗██║██║██║╚██╗██║ ██╔██╗
+//     ██║   ╚███╔███╔╝██║██║ ╚████║██╔╝ ██╗
+//     ╚═╝    ╚══╝╚══╝ ╚═╝╚═╝  ╚═══╝╚═╝  ╚═╝
+//
+// ────────────────────────────────────────────────────────────────────────────
+
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseUserControl(t *testing.T) {
+	conn := &Conn{}
+	tests := []struct {
+		x        *ChunkStream
+		expected UserControlEvent
+	}{
+		{conn.streamBegin(), UserControlEvent{Type: StreamBegin, StreamID: 1}},
+		{conn.userControlPing(UserMessagePingRequest, 1234), UserControlEvent{Type: UserMessagePingRequest, Timestamp: 1234}},
+		{conn.userControlPing(UserMessagePingResponse, 5678), UserControlEvent{Type: UserMessagePingResponse, Timestamp: 5678}},
+		{
+			&ChunkStream{TypeID: UserControlMessageID, Data: []byte{0, 3, 0, 0, 0, 1, 0, 0, 0x0b, 0xb8}},
+			UserControlEvent{Type: SetBufferLen, StreamID: 1, BufferLength: 3000},
+		},
+		{
+			&ChunkStream{TypeID: UserControlMessageID, Data: []byte{0, 1, 0, 0, 0, 2}},
+			UserControlEvent{Type: StreamEOF, StreamID: 2},
+		},
+		{
+			&ChunkStream{TypeID: UserControlMessageID, Data: []byte{0, 2, 0, 0, 0, 3}},
+			UserControlEvent{Type: StreamDry, StreamID: 3},
+		},
+		{
+			&ChunkStream{TypeID: UserControlMessageID, Data: []byte{0, 4, 0, 0, 0, 4}},
+			UserControlEvent{Type: StreamIsRecorded, StreamID: 4},
+		},
+		// Unknown events are ignored
+		{
+			&ChunkStream{TypeID: UserControlMessageID, Data: []byte{0, 31, 0, 0, 0, 1}},
+			UserControlEvent{Type: 31},
+		},
+	}
+	for _, test := range tests {
+		event, err := parseUserControl(test.x)
+		if err != nil {
+			t.Fatalf("parse %v: %v", test.x.Data, err)
+		}
+		if *event != test.expected {
+			t.Errorf("expected %+v, got %+v", test.expected, *event)
+		}
+	}
+
+	for _, data := range [][]byte{
+		{0},
+		{0, 0, 0, 0, 1},
+		{0, 3, 0, 0, 0, 1},
+	} {
+		if _, err := parseUserControl(&ChunkStream{TypeID: UserControlMessageID, Data: data}); err == nil {
+			t.Errorf("expected error parsing %v", data)
+		}
+	}
+}
+
+func TestConnPingRequest(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	server := newTestConn(s)
+	client := newTestConn(c)
+
+	go func() {
+		var x ChunkStream
+		if err := client.Read(&x); err != nil {
+			return
+		}
+		client.handleUserControl(&x)
+		client.Flush()
+	}()
+	stop := server.ping(time.Millisecond * 10)
+	defer stop()
+
+	var x ChunkStream
+	if err := server.Read(&x); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	event, err := server.handleUserControl(&x)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if event.Type != UserMessagePingResponse {
+		t.Fatalf("expected PingResponse, got %s", userControlString(event.Type))
+	}
+}
+
+func TestConnPingRTT(t *testing.T) {
+	conn := &Conn{}
+	if conn.RTT() != 0 {
+		t.Fatalf("expected no RTT before a PingResponse")
+	}
+	_, err := conn.handleUserControl(conn.userControlPing(UserMessagePingResponse, pingTimestamp()-50))
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if rtt := conn.RTT(); rtt < time.Millisecond*50 || rtt > time.Second {
+		t.Errorf("expected RTT of about 50ms, got %s", rtt)
+	}
+}
+
+func TestClientConnStreamEvents(t *testing.T) {
+	addr, err := NewURLAddr("rtmp://localhost:1935/twinx/events")
+	if err != nil {
+		t.Fatalf("invalid addr: %v", err)
+	}
+	cc := NewClientConn()
+	cc.conn = &Conn{}
+	cc.urladdr = addr
+	for _, event := range []struct {
+		data      []byte
+		streaming bool
+	}{
+		{[]byte{0, 0, 0, 0, 0, 1}, true},
+		{[]byte{0, 4, 0, 0, 0, 1}, true},
+		{[]byte{0, 1, 0, 0, 0, 1}, false},
+	} {
+		err := cc.Route(&ChunkStream{TypeID: UserControlMessageID, Length: uint32(len(event.data)), Data: event.data})
+		if err != nil {
+			t.Fatalf("route: %v", err)
+		}
+		if cc.streaming != event.streaming {
+			t.Errorf("expected streaming %t after %v", event.streaming, event.data)
+		}
+	}
+	if !cc.recorded {
+		t.Errorf("expected StreamIsRecorded to be recorded")
+	}
+}